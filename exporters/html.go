@@ -0,0 +1,56 @@
+package exporters
+
+import (
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var statsPage = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>PodMeter: {{.Stats.Hostname}}</title>
+{{- if .Refresh}}
+<meta http-equiv="refresh" content="{{.Refresh}}">
+{{- end}}
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: right; font-variant-numeric: tabular-nums; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f4f4f4; font-weight: 600; }
+p { color: #666; }
+</style>
+</head>
+<body>
+<h1>PodMeter: {{.Stats.Hostname}}</h1>
+<p>{{.Generated}}{{with .Stats.Build.Version}} &middot; {{.}}{{end}} &middot; <a href="?format=json">JSON</a></p>
+{{- range .Tables}}
+<h2>{{.Title}}</h2>
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{- range .Rows}}
+<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+// HTML writes stats as a page of tables, the same sections as Text, for a
+// quick look in a browser through kubectl port-forward. A positive refresh
+// reloads the page every that many seconds.
+func HTML(w io.Writer, stats meter.Stats, refresh int) error {
+	return statsPage.Execute(w, map[string]any{
+		"Stats":     stats,
+		"Tables":    tables(stats),
+		"Generated": time.Now().UTC().Format(time.RFC3339),
+		"Refresh":   max(refresh, 0),
+	})
+}
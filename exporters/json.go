@@ -0,0 +1,15 @@
+// Package exporters renders meter.Stats snapshots in the formats PodMeter
+// serves them in.
+package exporters
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// JSON writes stats as a single JSON document, the /stats format.
+func JSON(w io.Writer, stats meter.Stats) error {
+	return json.NewEncoder(w).Encode(stats)
+}
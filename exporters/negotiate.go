@@ -0,0 +1,79 @@
+package exporters
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Formats /stats can be served in, chosen by NegotiateFormat.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+	FormatHTML = "html"
+)
+
+// Content types of the human-readable formats.
+const (
+	TextContentType = "text/plain; charset=utf-8"
+	HTMLContentType = "text/html; charset=utf-8"
+)
+
+// formatTypes maps the media types /stats offers to their format.
+var formatTypes = map[string]string{
+	"application/json": FormatJSON,
+	"text/plain":       FormatText,
+	"text/html":        FormatHTML,
+}
+
+// NegotiateFormat picks the format of /stats from an Accept header: the
+// offered media type with the highest q-value, earliest first on ties. JSON
+// is the default, including for `*/*` and an empty or unparsable header.
+func NegotiateFormat(accept string) string {
+	best, bestQ := FormatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := formatTypes[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// Serve writes stats in the format r asks for: ?format= (json, text or
+// html), else its Accept header. The HTML page reloads every ?refresh=
+// seconds, if given.
+func Serve(w http.ResponseWriter, r *http.Request, stats meter.Stats) error {
+	w.Header().Add("Vary", "Accept")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = NegotiateFormat(r.Header.Get("Accept"))
+	}
+	switch format {
+	case FormatText:
+		w.Header().Set("Content-Type", TextContentType)
+		return Text(w, stats)
+	case FormatHTML:
+		refresh, _ := strconv.Atoi(r.URL.Query().Get("refresh"))
+		w.Header().Set("Content-Type", HTMLContentType)
+		return HTML(w, stats, refresh)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return JSON(w, stats)
+}
@@ -0,0 +1,557 @@
+package exporters
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// FlagPrometheus is the feature flag handlers serving Prometheus output check.
+const FlagPrometheus = "exporter.prometheus"
+
+func init() {
+	meter.DefineFlag(FlagPrometheus, "Serve stats in the Prometheus exposition format", true)
+}
+
+// PrometheusContentType is the Content-Type of the text exposition format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// labelEscaper escapes label values per the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promBuilder accumulates metric families in exposition order.
+type promBuilder struct {
+	sb     strings.Builder
+	static []string // name/value pairs added to every sample
+}
+
+// family writes the HELP and TYPE lines that introduce a metric.
+func (p *promBuilder) family(name, typ, help string) {
+	fmt.Fprintf(&p.sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample line. labels alternates names and values; static
+// labels are appended unless the sample already sets the same name.
+func (p *promBuilder) sample(name string, value float64, labels ...string) {
+	for i := 0; i+1 < len(p.static); i += 2 {
+		if !hasLabel(labels, p.static[i]) {
+			labels = append(labels, p.static[i], p.static[i+1])
+		}
+	}
+
+	p.sb.WriteString(name)
+	if len(labels) > 0 {
+		p.sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.sb.WriteByte(',')
+			}
+			fmt.Fprintf(&p.sb, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		p.sb.WriteByte('}')
+	}
+	fmt.Fprintf(&p.sb, " %g\n", value)
+}
+
+// hasLabel reports whether the name/value list sets name.
+func hasLabel(labels []string, name string) bool {
+	for i := 0; i < len(labels); i += 2 {
+		if labels[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// promLabelName turns an OpenTelemetry attribute key into a label name, as
+// the OpenTelemetry Prometheus exporters do: `k8s.pod.name` is `k8s_pod_name`.
+func promLabelName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// single writes a metric family with one unlabelled sample.
+func (p *promBuilder) single(name, typ, help string, value float64) {
+	p.family(name, typ, help)
+	p.sample(name, value)
+}
+
+// quantiles writes the p50, p95 and p99 samples of a latency family, with
+// labels ahead of the quantile.
+func (p *promBuilder) quantiles(name string, p50, p95, p99 float64, labels ...string) {
+	p.sample(name, p50, append(labels[:len(labels):len(labels)], "quantile", "0.5")...)
+	p.sample(name, p95, append(labels[:len(labels):len(labels)], "quantile", "0.95")...)
+	p.sample(name, p99, append(labels[:len(labels):len(labels)], "quantile", "0.99")...)
+}
+
+// gauge01 is 1 for true and 0 for false, for boolean state as a gauge.
+func gauge01(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Prometheus writes stats in the Prometheus text exposition format: the
+// request, latency, hop, connection, protocol and runtime figures of every
+// section, counters as counters and the rest as gauges. The static labels in
+// stats.Labels, and the pod's zone as `zone` when known, are attached to
+// every sample.
+func Prometheus(w io.Writer, stats meter.Stats) error {
+	var p promBuilder
+	for _, name := range sortedKeys(stats.Labels) {
+		p.static = append(p.static, name, stats.Labels[name])
+	}
+	if zone := stats.Topology.Zone; zone != "" && !hasLabel(p.static, "zone") {
+		p.static = append(p.static, "zone", zone)
+	}
+
+	p.family("podmeter_build_info", "gauge", "Build metadata of the running binary; always 1.")
+	p.sample("podmeter_build_info", 1,
+		"version", stats.Build.Version,
+		"revision", stats.Build.Revision,
+		"modified", strconv.FormatBool(stats.Build.Modified),
+		"go_version", stats.Build.GoVersion)
+
+	if stats.IstioVersion != "" || stats.EnvoyVersion != "" {
+		p.family("podmeter_sidecar_info", "gauge", "Versions of the pod's Istio sidecar; always 1.")
+		p.sample("podmeter_sidecar_info", 1,
+			"istio_version", stats.IstioVersion,
+			"envoy_version", stats.EnvoyVersion)
+	}
+	if e := stats.Envoy; e != nil {
+		p.family("podmeter_envoy_upstream_hosts", "gauge", "Upstream hosts known to the sidecar, by health.")
+		p.sample("podmeter_envoy_upstream_hosts", float64(e.HealthyHosts), "health", "healthy")
+		p.sample("podmeter_envoy_upstream_hosts", float64(e.DegradedHosts), "health", "degraded")
+		p.sample("podmeter_envoy_upstream_hosts", float64(e.UnhealthyHosts), "health", "unhealthy")
+		p.single("podmeter_envoy_outlier_ejected_hosts", "gauge", "Upstream hosts ejected by outlier detection.", float64(e.OutlierEjectedHosts))
+		p.single("podmeter_envoy_circuit_breakers_open", "gauge", "Circuit breakers currently tripped across the sidecar's clusters.", float64(len(e.CircuitBreakersOpen)))
+	}
+
+	if len(stats.Resource) > 0 {
+		var labels []string
+		for _, key := range sortedKeys(stats.Resource) {
+			labels = append(labels, promLabelName(key), stats.Resource[key])
+		}
+		p.family("target_info", "gauge", "OpenTelemetry resource attributes of the pod; always 1.")
+		p.sample("target_info", 1, labels...)
+	}
+
+	p.single("podmeter_requests_total", "counter", "Requests served.", float64(stats.Requests))
+	p.single("podmeter_errors_total", "counter", "Requests that failed: 5xx, panics, timeouts and injected faults.", float64(stats.Errors))
+	p.single("podmeter_response_bytes_total", "counter", "Response body bytes written by the workload endpoint.", float64(stats.Response.BytesSentTotal))
+	p.single("podmeter_requests_via_proxy_total", "counter", "Requests that carried proxy or mesh hop headers.", float64(stats.RequestsViaProxy))
+
+	p.family("podmeter_latency_ms", "gauge", "Request latency percentiles over the recent sample window.")
+	for _, q := range []struct {
+		quantile string
+		value    float64
+	}{
+		{"0.5", stats.P50Latency},
+		{"0.95", stats.P95Latency},
+		{"0.99", stats.P99Latency},
+		{"0.999", stats.P999Latency},
+	} {
+		p.sample("podmeter_latency_ms", q.value, "quantile", q.quantile)
+	}
+	p.single("podmeter_latency_avg_ms", "gauge", "Average request latency over the recent sample window.", stats.AvgLatency)
+	p.single("podmeter_latency_min_ms", "gauge", "Shortest request latency over the recent sample window.", stats.MinLatency)
+	p.single("podmeter_latency_max_ms", "gauge", "Longest request latency over the recent sample window.", stats.MaxLatency)
+	p.single("podmeter_success_rate_percent", "gauge", "Requests that did not fail, in percent.", stats.SuccessRate)
+	p.family("podmeter_request_rate", "gauge", "Requests per second, by window.")
+	p.sample("podmeter_request_rate", stats.RequestRate.Last10s, "window", "10s")
+	p.sample("podmeter_request_rate", stats.RequestRate.Last1m, "window", "1m")
+	p.sample("podmeter_request_rate", stats.RequestRate.Lifetime, "window", "lifetime")
+	p.single("podmeter_avg_proxy_hops", "gauge", "Average proxy and mesh hops over the recent sample window.", stats.AvgProxyHops)
+	p.family("podmeter_scrape_hops", "gauge", "Proxy and mesh hops the scrape request itself came through.")
+	p.sample("podmeter_scrape_hops", float64(stats.ProxyHopCount), "kind", "proxy")
+	p.sample("podmeter_scrape_hops", float64(stats.ServiceMeshHops), "kind", "mesh")
+	p.sample("podmeter_scrape_hops", float64(stats.CrossClusterHops), "kind", "cross_cluster")
+	p.family("podmeter_service_mesh_info", "gauge", "Service mesh mode the pod was detected in; always 1.")
+	p.sample("podmeter_service_mesh_info", 1, "mode", stats.ServiceMeshMode, "ambient_enrolled", strconv.FormatBool(stats.AmbientEnrolled))
+	p.single("podmeter_waypoint_requests_total", "counter", "Requests that came through an ambient waypoint proxy.", float64(stats.WaypointTraversed))
+	p.single("podmeter_ztunnel_only_requests_total", "counter", "Requests that came through ztunnel alone.", float64(stats.ZtunnelOnly))
+	p.single("podmeter_cross_cluster_requests_total", "counter", "Workload requests that crossed clusters.", float64(stats.RequestsCrossCluster))
+	p.single("podmeter_chaos_active", "gauge", "Whether a chaos experiment is running.", gauge01(stats.ChaosActive))
+	p.single("podmeter_chaos_injected_requests_total", "counter", "Requests a chaos experiment was applied to.", float64(stats.ChaosInjected))
+	p.single("podmeter_header_faults_injected_total", "counter", "Faults injected through the X-PodMeter-Fault header.", float64(stats.HeaderFaults))
+	p.single("podmeter_header_fault_aborts_total", "counter", "Header faults answered with an error status.", float64(stats.HeaderAborts))
+	p.single("podmeter_panics_total", "counter", "Handler panics recovered and answered with a 500.", float64(stats.PanicsTotal))
+	p.single("podmeter_status_emulated_total", "counter", "Responses served by /status/{code}.", float64(stats.StatusEmulated))
+	p.single("podmeter_draining", "gauge", "Whether the pod is draining ahead of shutdown.", gauge01(stats.Draining))
+
+	if len(stats.StatusCodes) > 0 {
+		p.family("podmeter_responses_total", "counter", "Responses by HTTP status code.")
+		for _, code := range sortedKeys(stats.StatusCodes) {
+			p.sample("podmeter_responses_total", float64(stats.StatusCodes[code]), "code", code)
+		}
+	}
+	if u := stats.Upstream; u != nil {
+		p.single("podmeter_upstream_requests_total", "counter", "Requests the upstream answered, in reverse-proxy mode.", float64(u.Requests))
+		p.single("podmeter_upstream_unreachable_total", "counter", "Requests answered 502 because the upstream could not be reached.", float64(u.Unreachable))
+		p.single("podmeter_upstream_retries_total", "counter", "Requests a mesh proxy was retrying.", float64(u.Retries))
+		p.family("podmeter_upstream_latency_ms", "gauge", "Upstream latency percentiles, until its response headers.")
+		p.sample("podmeter_upstream_latency_ms", u.P50Latency, "quantile", "0.5")
+		p.sample("podmeter_upstream_latency_ms", u.P95Latency, "quantile", "0.95")
+		p.sample("podmeter_upstream_latency_ms", u.P99Latency, "quantile", "0.99")
+		p.family("podmeter_upstream_overhead_ms", "gauge", "Total latency minus upstream latency, percentiles.")
+		p.sample("podmeter_upstream_overhead_ms", u.P50Overhead, "quantile", "0.5")
+		p.sample("podmeter_upstream_overhead_ms", u.P95Overhead, "quantile", "0.95")
+		p.sample("podmeter_upstream_overhead_ms", u.P99Overhead, "quantile", "0.99")
+	}
+	if t := stats.Tracing; t != nil {
+		p.family("podmeter_trace_spans_total", "counter", "OpenTelemetry spans sampled, by what became of them.")
+		p.sample("podmeter_trace_spans_total", float64(t.Sampled), "outcome", "sampled")
+		p.sample("podmeter_trace_spans_total", float64(t.Exported), "outcome", "exported")
+		p.sample("podmeter_trace_spans_total", float64(t.Dropped), "outcome", "dropped")
+		p.sample("podmeter_trace_spans_total", float64(t.Failed), "outcome", "failed")
+		p.single("podmeter_trace_sample_ratio", "gauge", "Share of new traces sampled.", t.SampleRatio)
+	}
+	if checks := stats.Probes.Synthetic; len(checks) > 0 {
+		p.family("podmeter_synthetic_success", "gauge", "Whether the last run of a synthetic check passed every assertion.")
+		for _, c := range checks {
+			success := 0.0
+			if c.Success {
+				success = 1
+			}
+			p.sample("podmeter_synthetic_success", success, "check", c.Name)
+		}
+		p.family("podmeter_synthetic_duration_ms", "gauge", "Duration of the last run of a synthetic check.")
+		for _, c := range checks {
+			p.sample("podmeter_synthetic_duration_ms", c.LastLatency, "check", c.Name)
+		}
+		p.family("podmeter_synthetic_runs_total", "counter", "Runs of a synthetic check.")
+		for _, c := range checks {
+			p.sample("podmeter_synthetic_runs_total", float64(c.Runs), "check", c.Name)
+		}
+		p.family("podmeter_synthetic_failures_total", "counter", "Runs of a synthetic check that failed an assertion or got no response.")
+		for _, c := range checks {
+			p.sample("podmeter_synthetic_failures_total", float64(c.Failures), "check", c.Name)
+		}
+	}
+	if pr := stats.Probes.ICMP; len(pr) > 0 {
+		p.family("podmeter_icmp_sent_total", "counter", "ICMP echo requests sent, by target.")
+		for _, t := range pr {
+			p.sample("podmeter_icmp_sent_total", float64(t.Sent), "target", t.Target)
+		}
+		p.family("podmeter_icmp_received_total", "counter", "ICMP echo replies received, by target.")
+		for _, t := range pr {
+			p.sample("podmeter_icmp_received_total", float64(t.Received), "target", t.Target)
+		}
+		p.family("podmeter_icmp_rtt_ms", "gauge", "ICMP round-trip time percentiles, by target.")
+		for _, t := range pr {
+			p.quantiles("podmeter_icmp_rtt_ms", t.P50RTT, t.P95RTT, t.P99RTT, "target", t.Target)
+		}
+	}
+	if pr := stats.Probes.MTLS; len(pr) > 0 {
+		p.family("podmeter_mtls_strict_verified", "gauge", "Whether the last probe of a port saw plaintext refused.")
+		for _, t := range pr {
+			p.sample("podmeter_mtls_strict_verified", gauge01(t.StrictVerified), "target", t.Target)
+		}
+		p.family("podmeter_mtls_plaintext_accepted_total", "counter", "Plaintext probes a port accepted.")
+		for _, t := range pr {
+			p.sample("podmeter_mtls_plaintext_accepted_total", float64(t.PlaintextAccepted), "target", t.Target)
+		}
+	}
+	if oi := stats.Probes.OutboundInterception; oi != nil {
+		p.family("podmeter_outbound_mesh_intercepted", "gauge", "Whether the last probe to a target was captured by this pod's sidecar on the way out.")
+		for _, t := range oi.Probes {
+			p.sample("podmeter_outbound_mesh_intercepted", gauge01(t.Result == "intercepted"), "kind", t.Kind, "target", t.Target)
+		}
+		p.family("podmeter_outbound_interception_probes_total", "counter", "Outbound interception probes, by outcome.")
+		for _, t := range oi.Probes {
+			p.sample("podmeter_outbound_interception_probes_total", float64(t.Intercepted), "kind", t.Kind, "target", t.Target, "outcome", "intercepted")
+			p.sample("podmeter_outbound_interception_probes_total", float64(t.NotIntercepted), "kind", t.Kind, "target", t.Target, "outcome", "not_intercepted")
+			p.sample("podmeter_outbound_interception_probes_total", float64(t.Inconclusive), "kind", t.Kind, "target", t.Target, "outcome", "inconclusive")
+		}
+	}
+	if len(stats.ErrorClasses) > 0 {
+		p.family("podmeter_request_errors_total", "counter", "Requests that did not succeed, by error class; client errors and disconnects do not count as failed.")
+		for _, class := range sortedKeys(stats.ErrorClasses) {
+			p.sample("podmeter_request_errors_total", float64(stats.ErrorClasses[class]), "class", class)
+		}
+	}
+	f := stats.IPFamilies
+	p.family("podmeter_ip_family_requests_total", "counter", "Workload requests by the IP family of the connection they arrived on.")
+	p.sample("podmeter_ip_family_requests_total", float64(f.RequestsIPv4), "family", "ipv4")
+	p.sample("podmeter_ip_family_requests_total", float64(f.RequestsIPv6), "family", "ipv6")
+	p.family("podmeter_client_ip_family_requests_total", "counter", "Workload requests by the IP family of the client the forwarding headers report.")
+	p.sample("podmeter_client_ip_family_requests_total", float64(f.ClientRequestsIPv4), "family", "ipv4")
+	p.sample("podmeter_client_ip_family_requests_total", float64(f.ClientRequestsIPv6), "family", "ipv6")
+	if len(stats.Interfaces) > 0 {
+		p.family("podmeter_interface_requests_total", "counter", "Workload requests by the network interface they arrived on.")
+		for _, ifc := range stats.Interfaces {
+			p.sample("podmeter_interface_requests_total", float64(ifc.Requests), "interface", ifc.Name, "network", ifc.Network)
+		}
+	}
+	if len(stats.Protocols) > 0 {
+		p.family("podmeter_protocol_requests_total", "counter", "Requests by HTTP protocol version.")
+		for _, proto := range sortedKeys(stats.Protocols) {
+			p.sample("podmeter_protocol_requests_total", float64(stats.Protocols[proto]), "protocol", proto)
+		}
+	}
+
+	g := stats.GRPC
+	p.single("podmeter_grpc_requests_total", "counter", "gRPC calls served.", float64(g.Requests))
+	p.single("podmeter_grpc_errors_total", "counter", "gRPC calls that failed.", float64(g.Errors))
+	p.single("podmeter_grpc_streams_total", "counter", "gRPC streams opened.", float64(g.StreamsTotal))
+	p.single("podmeter_grpc_active_streams", "gauge", "gRPC streams open.", float64(g.ActiveStreams))
+	p.single("podmeter_grpc_stream_messages_total", "counter", "Messages received on gRPC streams.", float64(g.StreamMessages))
+	p.family("podmeter_grpc_latency_ms", "gauge", "gRPC latency percentiles over the recent sample window.")
+	p.quantiles("podmeter_grpc_latency_ms", g.P50Latency, g.P95Latency, g.P99Latency)
+
+	ws := stats.WebSocket
+	p.single("podmeter_websocket_connections_total", "counter", "WebSocket connections upgraded.", float64(ws.ConnectionsTotal))
+	p.single("podmeter_websocket_active_connections", "gauge", "WebSocket connections open.", float64(ws.ActiveConnections))
+	p.single("podmeter_websocket_upgrade_failures_total", "counter", "WebSocket upgrades that failed.", float64(ws.UpgradeFailures))
+	p.family("podmeter_websocket_messages_total", "counter", "WebSocket messages, by direction.")
+	p.sample("podmeter_websocket_messages_total", float64(ws.MessagesReceived), "direction", "received")
+	p.sample("podmeter_websocket_messages_total", float64(ws.MessagesSent), "direction", "sent")
+	p.family("podmeter_websocket_rtt_ms", "gauge", "WebSocket ping round-trip percentiles.")
+	p.quantiles("podmeter_websocket_rtt_ms", ws.P50RTT, ws.P95RTT, ws.P99RTT)
+
+	if u := stats.UDP; u.Enabled {
+		p.single("podmeter_udp_datagrams_received_total", "counter", "Datagrams received by the UDP echo listener.", float64(u.DatagramsReceived))
+		p.single("podmeter_udp_datagrams_echoed_total", "counter", "Datagrams echoed by the UDP echo listener.", float64(u.DatagramsEchoed))
+		p.single("podmeter_udp_lost_total", "counter", "Probe datagrams lost on the way in.", float64(u.Lost))
+		p.single("podmeter_udp_jitter_ms", "gauge", "Interarrival jitter of probe datagrams.", u.JitterMs)
+	}
+	if t := stats.TCP; t.Enabled {
+		p.single("podmeter_tcp_connections_total", "counter", "Connections to the TCP echo listener.", float64(t.ConnectionsTotal))
+		p.single("podmeter_tcp_active_connections", "gauge", "Connections to the TCP echo listener open.", float64(t.ActiveConnections))
+		p.family("podmeter_tcp_bytes_total", "counter", "Bytes through the TCP echo listener, by direction.")
+		p.sample("podmeter_tcp_bytes_total", float64(t.BytesReceived), "direction", "received")
+		p.sample("podmeter_tcp_bytes_total", float64(t.BytesSent), "direction", "sent")
+	}
+
+	c := stats.Connections
+	p.single("podmeter_connections_opened_total", "counter", "HTTP connections accepted.", float64(c.OpenedTotal))
+	p.single("podmeter_connections_open", "gauge", "HTTP connections open.", float64(c.Open))
+	p.single("podmeter_connections_idle", "gauge", "HTTP connections open and idle between requests.", float64(c.Idle))
+	p.family("podmeter_connection_requests_total", "counter", "HTTP requests by whether their connection was new or reused.")
+	p.sample("podmeter_connection_requests_total", float64(c.NewRequests), "connection", "new")
+	p.sample("podmeter_connection_requests_total", float64(c.ReusedRequests), "connection", "reused")
+	p.family("podmeter_connection_lifetime_ms", "gauge", "Lifetime percentiles of closed HTTP connections.")
+	p.sample("podmeter_connection_lifetime_ms", c.P50Lifetime, "quantile", "0.5")
+	p.sample("podmeter_connection_lifetime_ms", c.P99Lifetime, "quantile", "0.99")
+	p.family("podmeter_connections_closed_idle_total", "counter", "HTTP connections closed while idle, by who closed them.")
+	p.sample("podmeter_connections_closed_idle_total", float64(c.Reaped), "by", "idle_timeout")
+	p.sample("podmeter_connections_closed_idle_total", float64(c.ClosedIdle), "by", "client")
+	p.family("podmeter_connection_idle_before_reuse_ms", "gauge", "Percentiles of how long HTTP connections sat idle before their next request.")
+	p.sample("podmeter_connection_idle_before_reuse_ms", c.P50IdleBeforeReuse, "quantile", "0.5")
+	p.sample("podmeter_connection_idle_before_reuse_ms", c.P99IdleBeforeReuse, "quantile", "0.99")
+	if len(c.Clients) > 0 {
+		clients := sortedKeys(c.Clients)
+		p.family("podmeter_client_connections_opened_total", "counter", "HTTP connections opened, by client address.")
+		for _, client := range clients {
+			p.sample("podmeter_client_connections_opened_total", float64(c.Clients[client].Opened), "client", client)
+		}
+		p.family("podmeter_client_connections_reaped_total", "counter", "HTTP connections closed after the idle timeout, by client address.")
+		for _, client := range clients {
+			p.sample("podmeter_client_connections_reaped_total", float64(c.Clients[client].Reaped), "client", client)
+		}
+	}
+
+	if t := stats.TLS; t.Enabled {
+		p.single("podmeter_tls_handshakes_total", "counter", "TLS handshakes completed on the HTTPS listener.", float64(t.Handshakes))
+		p.single("podmeter_tls_resumed_total", "counter", "TLS handshakes that resumed a session.", float64(t.Resumed))
+		p.family("podmeter_tls_handshake_ms", "gauge", "TLS handshake duration percentiles.")
+		p.quantiles("podmeter_tls_handshake_ms", t.P50Handshake, t.P95Handshake, t.P99Handshake)
+	}
+
+	b := stats.RequestBody
+	p.single("podmeter_request_body_requests_total", "counter", "Workload requests with a body.", float64(b.Requests))
+	p.single("podmeter_request_body_bytes_total", "counter", "Request body bytes received by the workload endpoint.", float64(b.BytesTotal))
+	p.single("podmeter_request_body_rejected_total", "counter", "Requests refused with 413 for a body over the limit.", float64(b.Rejected))
+
+	ph := stats.Phases
+	p.family("podmeter_phase_ms", "gauge", "Workload request phase percentiles, by phase.")
+	for _, phase := range []struct {
+		name string
+		s    meter.PhaseSummary
+	}{{"first_byte", ph.FirstByte}, {"headers", ph.Headers}, {"body_read", ph.BodyRead}, {"work", ph.Work}, {"write", ph.Write}} {
+		p.quantiles("podmeter_phase_ms", phase.s.P50, phase.s.P95, phase.s.P99, "phase", phase.name)
+	}
+
+	if len(stats.RouteLimits) > 0 {
+		p.family("podmeter_route_limit_in_flight", "gauge", "Requests in flight under a route limit.")
+		for _, l := range stats.RouteLimits {
+			p.sample("podmeter_route_limit_in_flight", float64(l.InFlight), "prefix", l.Prefix)
+		}
+		p.family("podmeter_route_limit_allowed_total", "counter", "Requests a route limit let through.")
+		for _, l := range stats.RouteLimits {
+			p.sample("podmeter_route_limit_allowed_total", float64(l.Allowed), "prefix", l.Prefix)
+		}
+		p.family("podmeter_route_limit_rejected_total", "counter", "Requests a route limit rejected, by reason.")
+		for _, l := range stats.RouteLimits {
+			p.sample("podmeter_route_limit_rejected_total", float64(l.RejectedRate), "prefix", l.Prefix, "reason", "rate")
+			p.sample("podmeter_route_limit_rejected_total", float64(l.RejectedConcurrency), "prefix", l.Prefix, "reason", "concurrency")
+		}
+	}
+
+	t := stats.Topology
+	p.family("podmeter_zone_requests_total", "counter", "Workload requests by whether the client was in the pod's zone.")
+	p.sample("podmeter_zone_requests_total", float64(t.SameZoneRequests), "path", "same_zone")
+	p.sample("podmeter_zone_requests_total", float64(t.CrossZoneRequests), "path", "cross_zone")
+	p.sample("podmeter_zone_requests_total", float64(t.UnknownZoneRequests), "path", "unknown")
+	if len(t.ClientZones) > 0 {
+		zones := sortedKeys(t.ClientZones)
+		p.family("podmeter_client_zone_requests_total", "counter", "Workload requests by the zone of the client.")
+		for _, zone := range zones {
+			p.sample("podmeter_client_zone_requests_total", float64(t.ClientZones[zone].Requests), "client_zone", zone)
+		}
+		p.family("podmeter_client_zone_latency_ms", "gauge", "Workload latency percentiles by the zone of the client.")
+		for _, zone := range zones {
+			zs := t.ClientZones[zone]
+			p.quantiles("podmeter_client_zone_latency_ms", zs.P50Latency, zs.P95Latency, zs.P99Latency, "client_zone", zone)
+		}
+	}
+
+	if len(stats.Routes) > 0 {
+		routes := sortedKeys(stats.Routes)
+		p.family("podmeter_route_requests_total", "counter", "Requests served per route.")
+		for _, route := range routes {
+			p.sample("podmeter_route_requests_total", float64(stats.Routes[route].Requests), "route", route)
+		}
+		p.family("podmeter_route_errors_total", "counter", "Requests that failed (5xx) per route.")
+		for _, route := range routes {
+			p.sample("podmeter_route_errors_total", float64(stats.Routes[route].Errors), "route", route)
+		}
+		p.family("podmeter_route_latency_ms", "gauge", "Request latency percentiles per route over the recent sample window.")
+		for _, route := range routes {
+			rs := stats.Routes[route]
+			p.sample("podmeter_route_latency_ms", rs.P50Latency, "route", route, "quantile", "0.5")
+			p.sample("podmeter_route_latency_ms", rs.P95Latency, "route", route, "quantile", "0.95")
+			p.sample("podmeter_route_latency_ms", rs.P99Latency, "route", route, "quantile", "0.99")
+		}
+	}
+	if len(stats.Listeners) > 0 {
+		names := sortedKeys(stats.Listeners)
+		p.family("podmeter_listener_requests_total", "counter", "Workload requests served per listener.")
+		for _, name := range names {
+			l := stats.Listeners[name]
+			p.sample("podmeter_listener_requests_total", float64(l.Requests), "listener", name, "protocol", l.Protocol)
+		}
+		p.family("podmeter_listener_errors_total", "counter", "Workload requests that failed per listener.")
+		for _, name := range names {
+			l := stats.Listeners[name]
+			p.sample("podmeter_listener_errors_total", float64(l.Errors), "listener", name, "protocol", l.Protocol)
+		}
+		p.family("podmeter_listener_latency_ms", "gauge", "Workload latency percentiles per listener over the recent sample window.")
+		for _, name := range names {
+			l := stats.Listeners[name]
+			p.sample("podmeter_listener_latency_ms", l.P50Latency, "listener", name, "protocol", l.Protocol, "quantile", "0.5")
+			p.sample("podmeter_listener_latency_ms", l.P95Latency, "listener", name, "protocol", l.Protocol, "quantile", "0.95")
+			p.sample("podmeter_listener_latency_ms", l.P99Latency, "listener", name, "protocol", l.Protocol, "quantile", "0.99")
+		}
+	}
+	for _, vh := range []struct {
+		name, label, what string
+		hosts             map[string]meter.HostStats
+	}{{"host", "host", "Host header", stats.Hosts}, {"sni", "server_name", "TLS server name", stats.SNI}} {
+		if len(vh.hosts) == 0 {
+			continue
+		}
+		names := sortedKeys(vh.hosts)
+		p.family("podmeter_"+vh.name+"_requests_total", "counter", "Workload requests by "+vh.what+".")
+		for _, name := range names {
+			p.sample("podmeter_"+vh.name+"_requests_total", float64(vh.hosts[name].Requests), vh.label, name)
+		}
+		p.family("podmeter_"+vh.name+"_errors_total", "counter", "Workload requests that failed by "+vh.what+".")
+		for _, name := range names {
+			p.sample("podmeter_"+vh.name+"_errors_total", float64(vh.hosts[name].Errors), vh.label, name)
+		}
+		p.family("podmeter_"+vh.name+"_latency_ms", "gauge", "Workload latency percentiles by "+vh.what+" over the recent sample window.")
+		for _, name := range names {
+			hs := vh.hosts[name]
+			p.sample("podmeter_"+vh.name+"_latency_ms", hs.P50Latency, vh.label, name, "quantile", "0.5")
+			p.sample("podmeter_"+vh.name+"_latency_ms", hs.P95Latency, vh.label, name, "quantile", "0.95")
+			p.sample("podmeter_"+vh.name+"_latency_ms", hs.P99Latency, vh.label, name, "quantile", "0.99")
+		}
+	}
+
+	// Derived metrics get one gauge each, with the expression as help text
+	for _, d := range meter.DerivedMetrics() {
+		if v, ok := stats.Derived[d.Name]; ok {
+			p.single("podmeter_derived_"+d.Name, "gauge", "Derived: "+d.Expr, v)
+		}
+	}
+
+	p.single("podmeter_memory_heap_mb", "gauge", "Go heap in use, in MB.", stats.MemoryHeapMB)
+	p.single("podmeter_memory_sys_mb", "gauge", "Memory obtained from the OS by the Go runtime, in MB.", stats.MemorySysMB)
+	p.single("podmeter_memory_alloc_mb_total", "counter", "Heap memory allocated since the process started, in MB.", stats.MemoryTotalMB)
+	p.single("podmeter_gc_cycles_total", "counter", "Completed GC cycles.", float64(stats.GC.NumGC))
+	p.single("podmeter_gc_pause_ms_total", "counter", "Time spent in GC pauses since the process started.", stats.GC.TotalPauseMs)
+	p.family("podmeter_gc_pause_ms", "gauge", "Recent GC pause percentiles.")
+	p.sample("podmeter_gc_pause_ms", stats.GC.P50PauseMs, "quantile", "0.5")
+	p.sample("podmeter_gc_pause_ms", stats.GC.P99PauseMs, "quantile", "0.99")
+	p.single("podmeter_gc_cpu_percent", "gauge", "Estimated share of CPU spent in GC since the process started.", stats.GC.CPUPercent)
+	p.single("podmeter_heap_live_mb", "gauge", "Heap marked live by the last GC, in MB.", stats.GC.HeapLiveMB)
+	p.single("podmeter_next_gc_mb", "gauge", "Heap size that triggers the next GC, in MB.", stats.GC.NextGCMB)
+	if c := stats.CPUQuota; c.GOMAXPROCS > 0 {
+		p.single("podmeter_gomaxprocs", "gauge", "Effective GOMAXPROCS.", float64(c.GOMAXPROCS))
+	}
+	if c := stats.CPUQuota; c.QuotaCores > 0 {
+		p.single("podmeter_cpu_quota_cores", "gauge", "CPU limit of the container's cgroup, in cores.", c.QuotaCores)
+		p.single("podmeter_gomaxprocs_per_quota_core", "gauge", "GOMAXPROCS over the CPU quota; above 1 risks CFS throttling.", c.ProcsPerQuotaCore)
+	}
+	if m := stats.MemoryLimit; m.GoMemLimitMB > 0 {
+		p.single("podmeter_gomemlimit_mb", "gauge", "Go runtime soft memory limit (GOMEMLIMIT), in MB.", m.GoMemLimitMB)
+	}
+	if m := stats.MemoryLimit; m.ContainerLimitMB > 0 {
+		p.single("podmeter_container_memory_limit_mb", "gauge", "Memory limit of the container's cgroup, in MB.", m.ContainerLimitMB)
+	}
+	if c := stats.Container; c.CgroupVersion > 0 {
+		p.single("podmeter_container_memory_working_set_mb", "gauge", "Container memory usage minus inactive page cache, in MB.", c.MemoryWorkingSetMB)
+		p.single("podmeter_container_cpu_usage_seconds_total", "counter", "CPU time used by the container.", c.CPUUsageSeconds)
+		p.single("podmeter_container_cpu_throttled_seconds_total", "counter", "Time the container spent throttled by its CPU quota.", c.CPUThrottledSeconds)
+	}
+	if g := stats.GPU; g.Count > 0 {
+		p.family("podmeter_gpu_utilization_percent", "gauge", "GPU utilization, by device.")
+		for _, d := range g.Devices {
+			p.sample("podmeter_gpu_utilization_percent", d.UtilizationPercent, "gpu", strconv.Itoa(d.Index), "model", d.Model)
+		}
+		p.family("podmeter_gpu_memory_used_mb", "gauge", "GPU memory in use, by device, in MB.")
+		for _, d := range g.Devices {
+			p.sample("podmeter_gpu_memory_used_mb", d.MemoryUsedMB, "gpu", strconv.Itoa(d.Index), "model", d.Model)
+		}
+	}
+	if t := stats.Node.Thermal; len(t.Sensors) > 0 {
+		p.family("podmeter_temperature_celsius", "gauge", "Node temperature, by sensor.")
+		for _, s := range t.Sensors {
+			p.sample("podmeter_temperature_celsius", s.TempC, "chip", s.Chip, "sensor", s.Label)
+		}
+		p.family("podmeter_cpu_thermal_throttle_events_total", "counter", "Times a CPU core or package was clocked down for heat since boot.")
+		p.sample("podmeter_cpu_thermal_throttle_events_total", float64(t.CoreThrottleEvents), "scope", "core")
+		p.sample("podmeter_cpu_thermal_throttle_events_total", float64(t.PackageThrottleEvents), "scope", "package")
+	}
+	p.single("podmeter_cpu_steal_percent", "gauge", "Node CPU time stolen by the hypervisor over the last sample interval, in percent.", stats.CPUStealPercent)
+	p.single("podmeter_noisy_neighbor_suspected", "gauge", "Whether CPU steal has stayed above its threshold.", gauge01(stats.NoisyNeighborSuspected))
+	p.single("podmeter_node_memory_total_mb", "gauge", "Memory of the node, in MB.", stats.TotalMemoryMB)
+	p.single("podmeter_node_memory_available_mb", "gauge", "Memory available on the node, in MB.", stats.AvailableMemoryMB)
+	p.single("podmeter_disk_usage_percent", "gauge", "Usage of the root filesystem, in percent.", stats.DiskUsagePercent)
+	p.single("podmeter_goroutines", "gauge", "Goroutines currently running.", float64(stats.Goroutines))
+	p.single("podmeter_goroutine_leak_suspected", "gauge", "Whether goroutines have grown steadily.", gauge01(stats.GoroutineLeakSuspected))
+	p.single("podmeter_uptime_seconds", "gauge", "Seconds since the process started.", float64(stats.UptimeSeconds))
+
+	_, err := io.WriteString(w, p.sb.String())
+	return err
+}
+
+// sortedKeys returns the keys of m in sorted order for stable output.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
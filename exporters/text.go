@@ -0,0 +1,149 @@
+package exporters
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Text writes stats as an aligned, human-readable summary in the style of
+// kubectl top, for reading in a terminal: one table per section, latencies
+// in milliseconds.
+func Text(w io.Writer, stats meter.Stats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	for i, t := range tables(stats) {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintln(tw, strings.Join(t.Header, "\t"))
+		for _, row := range t.Rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		// Columns align within a table only
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// table is one section of the human-readable formats.
+type table struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+// tables lays stats out as the sections of the text and HTML formats.
+func tables(stats meter.Stats) []table {
+	var out []table
+	add := func(title string, header ...string) *table {
+		out = append(out, table{Title: title, Header: header})
+		return &out[len(out)-1]
+	}
+	row := func(t *table, cells ...any) {
+		r := make([]string, len(cells))
+		for i, c := range cells {
+			r[i] = fmt.Sprint(c)
+		}
+		t.Rows = append(t.Rows, r)
+	}
+
+	t := add("Requests", "HOST", "UPTIME", "REQUESTS", "ERRORS", "RPS", "SUCCESS")
+	row(t, stats.Hostname, (time.Duration(stats.UptimeSeconds) * time.Second).String(), stats.Requests, stats.Errors,
+		ff(stats.RequestsPerSecond), ff(stats.SuccessRate)+"%")
+
+	t = add("Latency (ms)", "LATENCY(ms)", "REQUESTS", "AVG", "P50", "P95", "P99", "P99.9", "MIN", "MAX")
+	row(t, "http", stats.Requests, ff(stats.AvgLatency), ff(stats.P50Latency), ff(stats.P95Latency), ff(stats.P99Latency),
+		ff(stats.P999Latency), ff(stats.MinLatency), ff(stats.MaxLatency))
+	if g := stats.GRPC; g.Requests > 0 {
+		row(t, "grpc", g.Requests, ff(g.AvgLatency), ff(g.P50Latency), ff(g.P95Latency), ff(g.P99Latency),
+			ff(g.P999Latency), ff(g.MinLatency), ff(g.MaxLatency))
+	}
+
+	if len(stats.Routes) > 0 {
+		names := make([]string, 0, len(stats.Routes))
+		for name := range stats.Routes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t = add("Routes", "ROUTE", "REQUESTS", "ERRORS", "AVG(ms)", "P50(ms)", "P95(ms)", "P99(ms)", "MAX(ms)")
+		for _, name := range names {
+			rs := stats.Routes[name]
+			row(t, name, rs.Requests, rs.Errors, ff(rs.AvgLatency), ff(rs.P50Latency), ff(rs.P95Latency), ff(rs.P99Latency), ff(rs.MaxLatency))
+		}
+	}
+
+	if len(stats.StatusCodes) > 0 {
+		codes := make([]string, 0, len(stats.StatusCodes))
+		for code := range stats.StatusCodes {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		t = add("Status codes", "STATUS", "RESPONSES")
+		for _, code := range codes {
+			row(t, code, stats.StatusCodes[code])
+		}
+	}
+
+	t = add("Hops and mesh", "MESH", "SIDECAR", "WAYPOINT", "PROXY_HOPS", "MESH_HOPS", "VIA_PROXY", "ISTIO", "ENVOY")
+	row(t, orNone(stats.ServiceMeshMode), yesNo(stats.IstioSidecar), yesNo(stats.WaypointProxyDetected), stats.ProxyHopCount,
+		stats.ServiceMeshHops, stats.RequestsViaProxy, orNone(stats.IstioVersion), orNone(stats.EnvoyVersion))
+
+	t = add("Resources", "CPU(cores)", "CPU_QUOTA", "GOMAXPROCS", "HEAP(MB)", "SYS(MB)", "GOMEMLIMIT(MB)", "MEM_LIMIT(MB)", "GOROUTINES", "GC", "GC_PAUSE(ms)")
+	row(t, stats.NumCPU, orNone(ffPositive(stats.CPUQuota.QuotaCores)), stats.CPUQuota.GOMAXPROCS, ff(stats.MemoryHeapMB), ff(stats.MemorySysMB), orNone(ffPositive(stats.MemoryLimit.GoMemLimitMB)),
+		orNone(ffPositive(stats.MemoryLimit.ContainerLimitMB)), stats.Goroutines, stats.NumGC, ff(stats.GCPauseMs))
+
+	if c := stats.Container; c.CgroupVersion > 0 {
+		t = add("Container", "WORKING_SET(MB)", "MEM_LIMIT(MB)", "MEM_USED", "CPU(cores)", "CPU_QUOTA", "THROTTLED", "THROTTLED(s)")
+		row(t, ff(c.MemoryWorkingSetMB), orNone(ffPositive(c.MemoryLimitMB)), orNone(percentPositive(c.MemoryLimitPercent, c.MemoryLimitMB)),
+			ff(c.CPUUsageCores), orNone(ffPositive(c.CPUQuotaCores)), ff(c.CPUThrottledPercent)+"%", ff(c.CPUThrottledSeconds))
+	}
+
+	n := stats.Node
+	t = add("Node", "OS/ARCH", "KERNEL", "MEMORY(MB)", "AVAILABLE(MB)", "DISK(GB)", "DISK_USED", "CPU_STEAL")
+	row(t, n.OS+"/"+n.Architecture, n.KernelVersion, ff(n.TotalMemoryMB), ff(n.AvailableMemoryMB),
+		ff(n.TotalDiskGB), ff(n.DiskUsagePercent)+"%", ff(n.CPUStealPercent)+"%")
+	return out
+}
+
+// ff formats a float without trailing zeros.
+func ff(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// ffPositive is ff, or "" for zero and below, which mean "no limit".
+func ffPositive(v float64) string {
+	if v <= 0 {
+		return ""
+	}
+	return ff(v)
+}
+
+// percentPositive formats v as a percentage when limit is set, else "".
+func percentPositive(v, limit float64) string {
+	if limit <= 0 {
+		return ""
+	}
+	return ff(v) + "%"
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,3 @@
+module github.com/nyan-lin-tun/PodMeter
+
+go 1.25
@@ -0,0 +1,335 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// ParquetContentType is the media type of WriteParquet's output.
+const ParquetContentType = "application/vnd.apache.parquet"
+
+// Parquet physical types, repetitions, encodings and page types used below
+// (see parquet.thrift).
+const (
+	parquetBoolean   = 0
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetOptional = 1
+	parquetUTF8     = 0 // ConvertedType
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+)
+
+// parquetColumn is one column of the export with its values in row order;
+// nil marks a NULL.
+type parquetColumn struct {
+	name   string
+	typ    int32
+	values []any
+}
+
+// WriteParquet writes the retained rows of a table as a Parquet file: one row
+// group, one uncompressed PLAIN data page per column. Every column is
+// optional. Its type is taken from its first non-null value: DOUBLE for
+// numbers, BOOLEAN for booleans, BYTE_ARRAY (UTF8) for strings.
+func (s *Store) WriteParquet(w io.Writer, table string) error {
+	rows, err := s.TableRows(table)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	var cols []parquetColumn
+	for _, it := range starItems(rows) {
+		col := parquetColumn{name: it.name, typ: parquetDouble}
+		typed := false
+		for _, row := range rows {
+			v := value(row, it.column, now)
+			if !typed && v != nil {
+				switch v.(type) {
+				case bool:
+					col.typ = parquetBoolean
+				case string:
+					col.typ = parquetByteArray
+				}
+				typed = true
+			}
+			col.values = append(col.values, v)
+		}
+		cols = append(cols, col)
+	}
+	return writeParquet(w, table, cols, len(rows))
+}
+
+func writeParquet(w io.Writer, table string, cols []parquetColumn, numRows int) error {
+	var buf bytes.Buffer
+	buf.WriteString("PAR1")
+
+	var chunks [][]byte
+	var totalSize int64
+	for _, col := range cols {
+		offset := int64(buf.Len())
+		page := encodeDataPage(col)
+
+		var hdr thriftWriter
+		hdr.i32(1, parquetDataPage)
+		hdr.i32(2, int32(len(page)))
+		hdr.i32(3, int32(len(page)))
+		hdr.structBegin(5)
+		hdr.i32(1, int32(len(col.values)))
+		hdr.i32(2, parquetPlain)
+		hdr.i32(3, parquetRLE)
+		hdr.i32(4, parquetRLE)
+		hdr.structEnd()
+		hdr.stop()
+
+		buf.Write(hdr.buf)
+		buf.Write(page)
+		size := int64(len(hdr.buf) + len(page))
+		totalSize += size
+
+		var cc thriftWriter
+		cc.i64(2, offset)
+		cc.structBegin(3)
+		cc.i32(1, col.typ)
+		cc.i32List(2, parquetPlain, parquetRLE)
+		cc.stringList(3, col.name)
+		cc.i32(4, 0) // UNCOMPRESSED
+		cc.i64(5, int64(len(col.values)))
+		cc.i64(6, size)
+		cc.i64(7, size)
+		cc.i64(9, offset)
+		cc.structEnd()
+		cc.stop()
+		chunks = append(chunks, cc.buf)
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(cols)+1)
+	// Root of the schema tree, then one leaf per column
+	meta.field(0, thriftStruct)
+	meta.str(4, table)
+	meta.i32(5, int32(len(cols)))
+	meta.stop()
+	for _, col := range cols {
+		meta.field(0, thriftStruct)
+		meta.i32(1, col.typ)
+		meta.i32(3, parquetOptional)
+		meta.str(4, col.name)
+		if col.typ == parquetByteArray {
+			meta.i32(6, parquetUTF8)
+		}
+		meta.stop()
+	}
+	meta.listEnd()
+	meta.i64(3, int64(numRows))
+	if numRows == 0 {
+		meta.listBegin(4, thriftStruct, 0)
+		meta.listEnd()
+	} else {
+		meta.listBegin(4, thriftStruct, 1)
+		meta.field(0, thriftStruct)
+		meta.listBegin(1, thriftStruct, len(chunks))
+		for _, cc := range chunks {
+			meta.raw(cc)
+		}
+		meta.listEnd()
+		meta.i64(2, totalSize)
+		meta.i64(3, int64(numRows))
+		meta.stop()
+		meta.listEnd()
+	}
+	meta.str(6, "podmeter")
+	meta.stop()
+
+	buf.Write(meta.buf)
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta.buf))))
+	buf.WriteString("PAR1")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// encodeDataPage encodes a v1 data page body: definition levels (1 bit,
+// RLE/bit-packed hybrid with a length prefix), then the non-null values in
+// PLAIN encoding.
+func encodeDataPage(col parquetColumn) []byte {
+	defined := make([]bool, len(col.values))
+	var present []any
+	for i, v := range col.values {
+		if v = coerce(v, col.typ); v != nil {
+			defined[i] = true
+			present = append(present, v)
+		}
+	}
+
+	levels := binary.AppendUvarint(nil, uint64((len(defined)+7)/8)<<1|1)
+	levels = append(levels, packBits(defined)...)
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	page = append(page, levels...)
+
+	switch col.typ {
+	case parquetBoolean:
+		bits := make([]bool, len(present))
+		for i, v := range present {
+			bits[i] = v.(bool)
+		}
+		page = append(page, packBits(bits)...)
+	case parquetByteArray:
+		for _, v := range present {
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(v.(string))))
+			page = append(page, v.(string)...)
+		}
+	default:
+		for _, v := range present {
+			page = binary.LittleEndian.AppendUint64(page, math.Float64bits(v.(float64)))
+		}
+	}
+	return page
+}
+
+// coerce converts v to the column's type, or nil if it has no such form.
+func coerce(v any, typ int32) any {
+	switch typ {
+	case parquetBoolean:
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	case parquetByteArray:
+		if s, ok := v.(string); ok {
+			return s
+		}
+	default:
+		if n, ok := number(v); ok {
+			return n
+		}
+	}
+	return nil
+}
+
+// packBits packs bools LSB first, padding the last byte with zeros.
+func packBits(bits []bool) []byte {
+	out := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			out[i/8] |= 1 << (i % 8)
+		}
+	}
+	return out
+}
+
+// Thrift compact protocol type codes.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol, which Parquet
+// uses for its page headers and footer. Field ids must be written in
+// increasing order within a struct.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // Last field id per open struct
+}
+
+// field writes a field header. Id 0 writes nothing: list elements carry no
+// header, but a struct element still opens a nesting level.
+func (t *thriftWriter) field(id int16, typ byte) {
+	if id == 0 {
+		if typ == thriftStruct {
+			t.last = append(t.last, 0)
+		}
+		return
+	}
+	prev := int16(0)
+	if n := len(t.last); n > 0 {
+		prev = t.last[n-1]
+		t.last[n-1] = id
+	} else {
+		t.last = append(t.last, id)
+	}
+	if delta := id - prev; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	if typ == thriftStruct {
+		t.last = append(t.last, 0)
+	}
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+}
+
+func (t *thriftWriter) structEnd() {
+	t.stop()
+}
+
+// stop ends the innermost open struct.
+func (t *thriftWriter) stop() {
+	t.buf = append(t.buf, 0)
+	if n := len(t.last); n > 0 {
+		t.last = t.last[:n-1]
+	}
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elem)
+	} else {
+		t.buf = append(t.buf, 0xf0|elem)
+		t.buf = binary.AppendUvarint(t.buf, uint64(size))
+	}
+}
+
+// listEnd exists for symmetry; compact lists carry their size up front.
+func (t *thriftWriter) listEnd() {}
+
+func (t *thriftWriter) i32List(id int16, vals ...int32) {
+	t.listBegin(id, thriftI32, len(vals))
+	for _, v := range vals {
+		t.buf = binary.AppendVarint(t.buf, int64(v))
+	}
+}
+
+func (t *thriftWriter) stringList(id int16, vals ...string) {
+	t.listBegin(id, thriftBinary, len(vals))
+	for _, v := range vals {
+		t.buf = binary.AppendUvarint(t.buf, uint64(len(v)))
+		t.buf = append(t.buf, v...)
+	}
+}
+
+// raw appends an already encoded list element.
+func (t *thriftWriter) raw(b []byte) {
+	t.buf = append(t.buf, b...)
+}
@@ -0,0 +1,585 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Table is the table of raw snapshots. Downsampled resolutions are tables
+// named after it, e.g. snapshots_1m.
+const Table = "snapshots"
+
+// AgeColumn is a virtual column: seconds between the snapshot and the query.
+const AgeColumn = "age_seconds"
+
+// Result is the outcome of a query.
+type Result struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// Query runs a read-only SQL query over the retained snapshots. The dialect
+// is a small subset of SQLite's:
+//
+//	SELECT * | col [AS name], ... | agg(col) [AS name], ...
+//	FROM snapshots | snapshots_RESOLUTION
+//	[WHERE col op value [AND|OR ...]]
+//	[ORDER BY col [ASC|DESC]]
+//	[LIMIT n]
+//
+// op is one of = != <> < <= > >=, values are numbers or 'strings', and
+// conditions may be grouped with parentheses. Comparing a number column with
+// a string, or a string column with a number, is an error. Aggregates are count, sum, avg,
+// min and max; a query that uses one must use only aggregates. Columns are
+// the dotted /stats JSON names plus ts (Unix seconds) and age_seconds, and
+// in downsampled tables samples.
+func (s *Store) Query(sql string) (*Result, error) {
+	q, err := parseQuery(sql)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.TableRows(q.table)
+	if err != nil {
+		return nil, err
+	}
+	return q.run(rows, time.Now())
+}
+
+type selectItem struct {
+	agg    string // "" for a plain column
+	column string // "*" for count(*)
+	name   string
+}
+
+type predicate func(row Row, now time.Time) (bool, error)
+
+type query struct {
+	star    bool
+	items   []selectItem
+	where   predicate
+	orderBy string
+	desc    bool
+	limit   int // -1 for no limit
+	table   string
+}
+
+// value returns a row's value for column, resolving the virtual columns.
+func value(row Row, column string, now time.Time) any {
+	if column == AgeColumn {
+		if ts, ok := row[TimeColumn].(float64); ok {
+			return float64(now.UnixMilli())/1000 - ts
+		}
+		return nil
+	}
+	return row[column]
+}
+
+func (q *query) run(rows []Row, now time.Time) (*Result, error) {
+	var matched []Row
+	for _, row := range rows {
+		ok := q.where == nil
+		if !ok {
+			var err error
+			if ok, err = q.where(row, now); err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+
+	if len(q.items) > 0 && q.items[0].agg != "" {
+		res := &Result{Rows: [][]any{make([]any, len(q.items))}}
+		for i, it := range q.items {
+			res.Columns = append(res.Columns, it.name)
+			res.Rows[0][i] = aggregate(it, matched, now)
+		}
+		return res, nil
+	}
+
+	if q.orderBy != "" {
+		sort.SliceStable(matched, func(i, j int) bool {
+			a, b := value(matched[i], q.orderBy, now), value(matched[j], q.orderBy, now)
+			if q.desc {
+				return compare(b, a) < 0
+			}
+			return compare(a, b) < 0
+		})
+	}
+	if q.limit >= 0 && len(matched) > q.limit {
+		matched = matched[:q.limit]
+	}
+
+	items := q.items
+	if q.star {
+		items = starItems(matched)
+	}
+	res := &Result{Rows: make([][]any, 0, len(matched))}
+	for _, it := range items {
+		res.Columns = append(res.Columns, it.name)
+	}
+	for _, row := range matched {
+		out := make([]any, len(items))
+		for i, it := range items {
+			out[i] = value(row, it.column, now)
+		}
+		res.Rows = append(res.Rows, out)
+	}
+	return res, nil
+}
+
+// starItems lists every column present in rows, ts first.
+func starItems(rows []Row) []selectItem {
+	seen := map[string]bool{TimeColumn: true}
+	var names []string
+	for _, row := range rows {
+		for name := range row {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	items := []selectItem{{column: TimeColumn, name: TimeColumn}}
+	for _, name := range names {
+		items = append(items, selectItem{column: name, name: name})
+	}
+	return items
+}
+
+func aggregate(it selectItem, rows []Row, now time.Time) any {
+	if it.agg == "count" {
+		n := 0
+		for _, row := range rows {
+			if it.column == "*" || value(row, it.column, now) != nil {
+				n++
+			}
+		}
+		return float64(n)
+	}
+
+	var acc float64
+	n := 0
+	for _, row := range rows {
+		v, ok := number(value(row, it.column, now))
+		if !ok {
+			continue
+		}
+		switch {
+		case n == 0:
+			acc = v
+		case it.agg == "min" && v < acc, it.agg == "max" && v > acc:
+			acc = v
+		case it.agg == "sum", it.agg == "avg":
+			acc += v
+		}
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if it.agg == "avg" {
+		return acc / float64(n)
+	}
+	return acc
+}
+
+// number converts a numeric or boolean value; booleans read as 1 or 0.
+func number(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// compare orders values: NULLs first, then numbers, then strings.
+func compare(a, b any) int {
+	rank := func(v any) int {
+		if v == nil {
+			return 0
+		}
+		if _, ok := number(v); ok {
+			return 1
+		}
+		return 2
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	if x, ok := number(a); ok {
+		y, _ := number(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	if a == nil {
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// token kinds produced by lex.
+const (
+	tokIdent = iota
+	tokNumber
+	tokString
+	tokSymbol
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			// SQL strings double a quote to escape it
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, fmt.Errorf("unterminated string at offset %d", i)
+				}
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						sb.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(src[j])
+				j++
+			}
+			toks = append(toks, token{tokString, sb.String()})
+			i = j + 1
+		case c == '"':
+			j := strings.IndexByte(src[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated identifier at offset %d", i)
+			}
+			toks = append(toks, token{tokIdent, src[i+1 : i+1+j]})
+			i += j + 2
+		case c >= '0' && c <= '9' || c == '.' || c == '-' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i + 1
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E') {
+				j++
+			}
+			toks = append(toks, token{tokNumber, src[i:j]})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] >= 'a' && src[j] <= 'z' ||
+				src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, token{tokIdent, src[i:j]})
+			i = j
+		default:
+			sym := symbolAt(src[i:])
+			if sym == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			toks = append(toks, token{tokSymbol, sym})
+			i += len(sym)
+		}
+	}
+	return toks, nil
+}
+
+// symbolAt returns the operator or punctuation src starts with, if any.
+func symbolAt(src string) string {
+	for _, sym := range []string{"<=", ">=", "!=", "<>", "=", "<", ">", "(", ")", ",", "*", ";"} {
+		if strings.HasPrefix(src, sym) {
+			return sym
+		}
+	}
+	return ""
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{kind: -1}
+}
+
+// keyword consumes the next token if it is the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// symbol consumes the next token if it is the symbol sym.
+func (p *parser) symbol(sym string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return "", fmt.Errorf("expected column name, got %q", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+var (
+	aggregates  = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+	comparisons = map[string]bool{"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+)
+
+func parseQuery(sql string) (*query, error) {
+	toks, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	q := &query{limit: -1}
+
+	if !p.keyword("select") {
+		return nil, fmt.Errorf("only SELECT queries are supported")
+	}
+	if p.symbol("*") {
+		q.star = true
+	} else {
+		for {
+			it, err := p.selectItem()
+			if err != nil {
+				return nil, err
+			}
+			q.items = append(q.items, it)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		for _, it := range q.items[1:] {
+			if (it.agg == "") != (q.items[0].agg == "") {
+				return nil, fmt.Errorf("cannot mix aggregates and plain columns (GROUP BY is not supported)")
+			}
+		}
+	}
+
+	if !p.keyword("from") {
+		return nil, fmt.Errorf("expected FROM %s", Table)
+	}
+	if q.table, err = p.ident(); err != nil {
+		return nil, fmt.Errorf("expected a table name after FROM")
+	}
+
+	if p.keyword("where") {
+		if q.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("order") {
+		if !p.keyword("by") {
+			return nil, fmt.Errorf("expected BY after ORDER")
+		}
+		if q.orderBy, err = p.ident(); err != nil {
+			return nil, err
+		}
+		if p.keyword("desc") {
+			q.desc = true
+		} else {
+			p.keyword("asc")
+		}
+	}
+	if p.keyword("limit") {
+		t := p.peek()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n < 0 {
+			return nil, fmt.Errorf("LIMIT wants a non-negative integer")
+		}
+		p.pos++
+		q.limit = n
+	}
+	p.symbol(";")
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	return q, nil
+}
+
+func (p *parser) selectItem() (selectItem, error) {
+	name, err := p.ident()
+	if err != nil {
+		return selectItem{}, err
+	}
+	it := selectItem{column: name, name: name}
+	if p.symbol("(") {
+		fn := strings.ToLower(name)
+		if !aggregates[fn] {
+			return selectItem{}, fmt.Errorf("unknown function %q (use count, sum, avg, min or max)", name)
+		}
+		col := "*"
+		if !p.symbol("*") {
+			if col, err = p.ident(); err != nil {
+				return selectItem{}, err
+			}
+		} else if fn != "count" {
+			return selectItem{}, fmt.Errorf("%s(*) is not supported", fn)
+		}
+		if !p.symbol(")") {
+			return selectItem{}, fmt.Errorf("missing ')' after %s(%s", fn, col)
+		}
+		it = selectItem{agg: fn, column: col, name: fn + "(" + col + ")"}
+	}
+	if p.keyword("as") {
+		if it.name, err = p.ident(); err != nil {
+			return selectItem{}, err
+		}
+	}
+	return it, nil
+}
+
+func (p *parser) or() (predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row Row, now time.Time) (bool, error) {
+			if ok, err := l(row, now); ok || err != nil {
+				return ok, err
+			}
+			return right(row, now)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (predicate, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row Row, now time.Time) (bool, error) {
+			if ok, err := l(row, now); !ok || err != nil {
+				return false, err
+			}
+			return right(row, now)
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) comparison() (predicate, error) {
+	if p.symbol("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return inner, nil
+	}
+
+	col, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	if op.kind != tokSymbol || !comparisons[op.text] {
+		return nil, fmt.Errorf("expected comparison after %s", col)
+	}
+	p.pos++
+
+	var lit any
+	t := p.peek()
+	litText := t.text
+	switch {
+	case t.kind == tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		lit = n
+	case t.kind == tokString:
+		lit = t.text
+		litText = "'" + t.text + "'"
+	case t.kind == tokIdent && strings.EqualFold(t.text, "true"):
+		lit = 1.0
+	case t.kind == tokIdent && strings.EqualFold(t.text, "false"):
+		lit = 0.0
+	default:
+		return nil, fmt.Errorf("expected a number or 'string' after %s %s", col, op.text)
+	}
+	p.pos++
+
+	_, litNumber := number(lit)
+	return func(row Row, now time.Time) (bool, error) {
+		v := value(row, col, now)
+		if v == nil {
+			return false, nil // NULL compares false, as in SQL
+		}
+		if _, isNumber := number(v); isNumber != litNumber {
+			// compare would rank them by type, and quietly match all or nothing
+			kind := "a string"
+			if isNumber {
+				kind = "a number"
+			}
+			return false, fmt.Errorf("cannot compare %s, %s, with %s", col, kind, litText)
+		}
+		c := compare(v, lit)
+		switch op.text {
+		case "=":
+			return c == 0, nil
+		case "!=", "<>":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	}, nil
+}
@@ -0,0 +1,411 @@
+// Package history keeps per-interval stats snapshots on long-lived pods and
+// answers ad-hoc SQL queries over them, without external infrastructure.
+// Snapshots are persisted through a storage.Store.
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+	"github.com/nyan-lin-tun/PodMeter/storage"
+)
+
+// TimeColumn is the snapshot time in Unix seconds (millisecond precision),
+// present in every row.
+const TimeColumn = "ts"
+
+// Row is one snapshot flattened to columns: nested JSON objects become
+// dotted names (`grpc.p99_latency_ms`, `connections.open`), while maps
+// such as status_codes are one column of JSON text. Values are float64,
+// string or bool.
+type Row map[string]any
+
+// bucket is the storage bucket raw snapshots are kept in, keyed by
+// zero-padded Unix milliseconds so they scan in time order. Downsampled
+// resolutions are kept in buckets of their own, e.g. history.1m.
+const bucket = "history"
+
+// SamplesColumn is present in downsampled rows only: the number of raw
+// snapshots the row summarizes.
+const SamplesColumn = "samples"
+
+// Resolution is a downsampled copy of the history: one row per Every,
+// kept for Retention (0 keeps rows forever).
+type Resolution struct {
+	Every     time.Duration
+	Retention time.Duration
+}
+
+// series is one table of rows: the raw snapshots, or one resolution of them.
+type series struct {
+	table     string
+	bucket    string
+	every     time.Duration // 0 for the raw snapshots
+	retention time.Duration
+	rows      []Row
+	keys      []string // Storage key of each row
+	// open is the start of the interval whose rows are still being
+	// collected from the finer series, or zero before the first one
+	open time.Time
+}
+
+// Store is a table of snapshots cached in memory and persisted through a
+// storage.Store, with optional downsampled tables of it. It is safe for
+// concurrent use.
+type Store struct {
+	mu     sync.RWMutex
+	series []*series // The raw snapshots, then each resolution, finest first
+	db     storage.Store
+}
+
+// Open returns a Store keeping snapshots in db for retention (0 keeps them
+// forever), starting with the snapshots db already holds. Each resolution
+// is rolled up from the next finer one, and so must be a whole multiple of
+// it; its table is named after the interval, e.g. snapshots_1m.
+func Open(db storage.Store, retention time.Duration, resolutions ...Resolution) (*Store, error) {
+	s := &Store{db: db}
+	s.series = append(s.series, &series{table: Table, bucket: bucket, retention: retention})
+	var prev time.Duration
+	for _, res := range resolutions {
+		if res.Every <= 0 || (prev > 0 && res.Every%prev != 0) || res.Every <= prev {
+			return nil, fmt.Errorf("resolution %s must be a longer whole multiple of %s", res.Every, prev)
+		}
+		prev = res.Every
+		name := resolutionName(res.Every)
+		s.series = append(s.series, &series{
+			table:     Table + "_" + name,
+			bucket:    bucket + "." + name,
+			every:     res.Every,
+			retention: res.Retention,
+		})
+	}
+
+	for _, ser := range s.series {
+		err := db.Scan(ser.bucket, "", func(key string, value []byte) bool {
+			var row Row
+			if json.Unmarshal(value, &row) == nil {
+				ser.rows = append(ser.rows, row)
+				ser.keys = append(ser.keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Carry on after the last interval rolled up before a restart
+		if n := len(ser.rows); n > 0 && ser.every > 0 {
+			ser.open = rowTime(ser.rows[n-1]).Add(ser.every)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ser := range s.series {
+		if err := s.expire(ser, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// resolutionName names a resolution compactly: 1m, 10m, 1h, 1m30s.
+func resolutionName(d time.Duration) string {
+	name := d.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// Record adds a snapshot taken at t, and rolls up every resolution whose
+// interval closed with it.
+func (s *Store) Record(t time.Time, stats meter.Stats) error {
+	row, err := flattenStats(stats)
+	if err != nil {
+		return err
+	}
+	row[TimeColumn] = float64(t.UnixMilli()) / 1000
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.add(s.series[0], t, row); err != nil {
+		return err
+	}
+	for i, ser := range s.series {
+		if i > 0 {
+			if err := s.rollup(ser, s.series[i-1], t); err != nil {
+				return err
+			}
+		}
+		if err := s.expire(ser, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add persists row, taken at t, and appends it to ser. The caller holds
+// s.mu.
+func (s *Store) add(ser *series, t time.Time, row Row) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%020d", t.UnixMilli())
+	if err := s.db.Put(ser.bucket, key, data); err != nil {
+		return err
+	}
+	ser.rows = append(ser.rows, row)
+	ser.keys = append(ser.keys, key)
+	return nil
+}
+
+// rollup adds a row to ser for every interval of it that closed by now,
+// summarizing the rows of the finer series src in that interval. The caller
+// holds s.mu.
+func (s *Store) rollup(ser, src *series, now time.Time) error {
+	current := now.Truncate(ser.every)
+	if ser.open.IsZero() {
+		// The interval in progress at startup is incomplete; start with
+		// the next
+		ser.open = current.Add(ser.every)
+		return nil
+	}
+	if !current.After(ser.open) {
+		return nil
+	}
+
+	first := len(src.rows)
+	for first > 0 && !rowTime(src.rows[first-1]).Before(ser.open) {
+		first--
+	}
+	var group []Row
+	var start time.Time
+	for _, row := range src.rows[first:] {
+		t := rowTime(row)
+		if !t.Before(current) {
+			break
+		}
+		if at := t.Truncate(ser.every); !at.Equal(start) {
+			if len(group) > 0 {
+				if err := s.add(ser, start, summarize(group, start)); err != nil {
+					return err
+				}
+			}
+			group, start = nil, at
+		}
+		group = append(group, row)
+	}
+	if len(group) > 0 {
+		if err := s.add(ser, start, summarize(group, start)); err != nil {
+			return err
+		}
+	}
+	ser.open = current
+	return nil
+}
+
+// summarize rolls rows up into one row starting at start. Numbers are
+// averaged, weighted by the raw snapshots behind each row; strings and
+// booleans take their last value.
+func summarize(rows []Row, start time.Time) Row {
+	out := make(Row)
+	sums := make(map[string]float64)
+	weights := make(map[string]float64)
+	var samples float64
+	for _, row := range rows {
+		w := 1.0
+		if n, ok := row[SamplesColumn].(float64); ok {
+			w = n
+		}
+		samples += w
+		for col, v := range row {
+			if f, ok := v.(float64); ok {
+				sums[col] += f * w
+				weights[col] += w
+			} else {
+				out[col] = v
+			}
+		}
+	}
+	for col, sum := range sums {
+		out[col] = meter.Round(sum / weights[col])
+	}
+	out[TimeColumn] = float64(start.UnixMilli()) / 1000
+	out[SamplesColumn] = samples
+	return out
+}
+
+// rowTime returns the time a row was taken, or its interval starts.
+func rowTime(row Row) time.Time {
+	ts, _ := row[TimeColumn].(float64)
+	return time.UnixMilli(int64(math.Round(ts * 1000)))
+}
+
+// table returns the series queried as name.
+func (s *Store) table(name string) (*series, error) {
+	for _, ser := range s.series {
+		if strings.EqualFold(ser.table, name) {
+			return ser, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown table %s (tables: %s)", name, strings.Join(s.Tables(), ", "))
+}
+
+// Tables returns the names of the raw table and each resolution's, finest
+// first.
+func (s *Store) Tables() []string {
+	out := make([]string, len(s.series))
+	for i, ser := range s.series {
+		out[i] = ser.table
+	}
+	return out
+}
+
+// Rows returns a copy of the retained raw rows, oldest first.
+func (s *Store) Rows() []Row {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Row(nil), s.series[0].rows...)
+}
+
+// TableRows returns a copy of the retained rows of a table, oldest first.
+func (s *Store) TableRows(table string) ([]Row, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ser, err := s.table(table)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Row(nil), ser.rows...), nil
+}
+
+// At returns the last raw row recorded at or before t, if one is retained.
+func (s *Store) At(t time.Time) (Row, bool) {
+	ts := float64(t.UnixMilli()) / 1000
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rows := s.series[0].rows
+	i := sort.Search(len(rows), func(i int) bool {
+		rowTS, _ := rows[i][TimeColumn].(float64)
+		return rowTS > ts
+	})
+	if i == 0 {
+		return nil, false
+	}
+	return rows[i-1], true
+}
+
+// Len returns the number of retained raw rows.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.series[0].rows)
+}
+
+// expire drops rows of ser older than its retention. The caller holds s.mu.
+func (s *Store) expire(ser *series, now time.Time) error {
+	if ser.retention <= 0 {
+		return nil
+	}
+	cutoff := float64(now.Add(-ser.retention).UnixMilli()) / 1000
+	n := 0
+	for n < len(ser.rows) {
+		if ts, _ := ser.rows[n][TimeColumn].(float64); ts >= cutoff {
+			break
+		}
+		if err := s.db.Delete(ser.bucket, ser.keys[n]); err != nil {
+			return err
+		}
+		n++
+	}
+	ser.rows = ser.rows[n:]
+	ser.keys = ser.keys[n:]
+	return nil
+}
+
+// flattenStats turns stats into a Row using the JSON field names /stats
+// shows.
+func flattenStats(stats meter.Stats) (Row, error) {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	row := make(Row)
+	flatten("", fields, row)
+	return row, nil
+}
+
+// mapColumns are the dotted names of the maps in Stats. Their keys are open
+// ended (client addresses, hosts, status codes), so a column per key would
+// make the column set unbounded and the names ambiguous, as keys may hold
+// dots themselves.
+var mapColumns = sync.OnceValue(func() map[string]bool {
+	out := make(map[string]bool)
+	collectMaps("", reflect.TypeOf(meter.Stats{}), out)
+	return out
+})
+
+func collectMaps(prefix string, t reflect.Type, out map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if !sf.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Map:
+			out[name] = true
+		case ft.Kind() == reflect.Struct && ft != reflect.TypeOf(time.Time{}):
+			collectMaps(name, ft, out)
+		}
+	}
+}
+
+func flatten(prefix string, fields map[string]any, out Row) {
+	for name, v := range fields {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			if mapColumns()[name] {
+				data, _ := json.Marshal(v)
+				out[name] = string(data)
+				continue
+			}
+			flatten(name, v, out)
+		case float64, string, bool:
+			out[name] = v
+		case nil:
+		default:
+			// Lists have no column form either
+			data, _ := json.Marshal(v)
+			out[name] = string(data)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package hops
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths a request can take into an ambient-mode pod, as returned by
+// MeshPath.
+const (
+	PathWaypoint = "waypoint" // Through an L7 waypoint proxy, then ztunnel
+	PathZtunnel  = "ztunnel"  // ztunnel only: mTLS at L4, no L7 policy
+	PathSidecar  = "sidecar"  // Through this pod's Envoy sidecar
+	PathNone     = "none"     // No mesh component seen
+)
+
+// ztunnelInboundPort is the HBONE port ztunnel listens on inside the network
+// namespace of every pod enrolled in ambient mode.
+const ztunnelInboundPort = 15008
+
+var (
+	// Cached detection of ambient enrollment, refreshed like SidecarPresent
+	ambientMu      sync.RWMutex
+	ambientCached  bool
+	ambientChecked time.Time
+)
+
+// AmbientEnrolled reports whether the pod is enrolled in Istio ambient mode:
+// it has no sidecar, yet something listens on the HBONE port in its network
+// namespace, which is ztunnel's in-pod redirection. Result is cached for 30
+// seconds.
+func AmbientEnrolled() bool {
+	ambientMu.RLock()
+	recent := time.Since(ambientChecked) < 30*time.Second
+	cached := ambientCached
+	ambientMu.RUnlock()
+
+	if recent {
+		return cached
+	}
+
+	enrolled := !SidecarPresent() &&
+		(listening("/proc/net/tcp", ztunnelInboundPort) || listening("/proc/net/tcp6", ztunnelInboundPort))
+
+	ambientMu.Lock()
+	ambientCached = enrolled
+	ambientChecked = time.Now()
+	ambientMu.Unlock()
+	return enrolled
+}
+
+// listening reports whether the /proc/net/tcp-style table at file has a
+// socket in LISTEN state on port.
+func listening(file string, port int) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		// sl local_address rem_address st ..., addresses as HEXIP:HEXPORT
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+		_, hexPort, _ := strings.Cut(fields[1], ":")
+		if p, err := strconv.ParseUint(hexPort, 16, 16); err == nil && int(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// hasL7Headers reports whether r carries headers only an Envoy acting at L7
+// adds: a sidecar, a gateway or a waypoint. ztunnel works on TCP streams and
+// adds none.
+func hasL7Headers(r *http.Request) bool {
+	return r.Header.Get("X-Request-Id") != "" ||
+		r.Header.Get("X-Envoy-Decorator-Operation") != "" ||
+		r.Header.Get("X-Envoy-Attempt-Count") != "" ||
+		r.Header.Get("X-B3-TraceId") != ""
+}
+
+// MeshPath classifies how r reached the pod. In ambient mode, L7 headers on a
+// request mean a waypoint handled it, since ztunnel cannot add them; without
+// them only ztunnel did. Outside ambient mode, L7 headers without a sidecar
+// are still taken as a waypoint, as MeshMode does.
+func MeshPath(r *http.Request, sidecarPresent, ambient bool) string {
+	switch {
+	case sidecarPresent:
+		return PathSidecar
+	case hasL7Headers(r):
+		return PathWaypoint
+	case ambient:
+		return PathZtunnel
+	}
+	return PathNone
+}
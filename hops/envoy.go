@@ -0,0 +1,97 @@
+package hops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envoyAdminAddr is where an Istio sidecar serves the Envoy admin interface.
+const envoyAdminAddr = "127.0.0.1:15000"
+
+// envoyAdminClient queries the sidecar admin interface. It is on localhost,
+// so anything slower than this means the sidecar is not answering.
+var envoyAdminClient = &http.Client{Timeout: time.Second}
+
+var (
+	// Cached sidecar versions, refreshed like SidecarPresent
+	proxyVersionMu      sync.Mutex
+	proxyIstioVersion   string
+	proxyEnvoyVersion   string
+	proxyVersionChecked time.Time
+)
+
+// envoyAdminGet fetches path from the sidecar admin interface. The cluster
+// dump of a large mesh runs to tens of MB, hence the generous limit.
+func envoyAdminGet(path string) ([]byte, error) {
+	resp, err := envoyAdminClient.Get("http://" + envoyAdminAddr + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("envoy admin %s: %s", path, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
+
+// EnvoyAdminJSON decodes the JSON the sidecar admin interface serves at path
+// into v. It fails when there is no sidecar.
+func EnvoyAdminJSON(path string, v any) error {
+	body, err := envoyAdminGet(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ProxyVersions returns the Istio and Envoy versions of the pod's sidecar, as
+// reported by the admin /server_info endpoint, or empty strings when there is
+// no sidecar or it cannot be queried. Results are cached for 30 seconds, so a
+// sidecar restarted with a new version is picked up without per-request cost.
+func ProxyVersions() (istio, envoy string) {
+	proxyVersionMu.Lock()
+	defer proxyVersionMu.Unlock()
+	if time.Since(proxyVersionChecked) < 30*time.Second {
+		return proxyIstioVersion, proxyEnvoyVersion
+	}
+	proxyVersionChecked = time.Now()
+	proxyIstioVersion, proxyEnvoyVersion = "", ""
+	if !SidecarPresent() {
+		return "", ""
+	}
+
+	var info struct {
+		Version string `json:"version"` // e.g. <sha>/1.30.2-dev/Clean/RELEASE/BoringSSL
+		Node    struct {
+			Metadata struct {
+				IstioVersion string `json:"ISTIO_VERSION"`
+			} `json:"metadata"`
+		} `json:"node"`
+	}
+	if err := EnvoyAdminJSON("/server_info", &info); err != nil {
+		return "", ""
+	}
+	proxyIstioVersion = info.Node.Metadata.IstioVersion
+	proxyEnvoyVersion = info.Version
+	if parts := strings.Split(info.Version, "/"); len(parts) >= 2 {
+		proxyEnvoyVersion = parts[1]
+	}
+	return proxyIstioVersion, proxyEnvoyVersion
+}
+
+// ExpectedTimeout returns how long the downstream Envoy waits for the
+// response before giving up, from the x-envoy-expected-rq-timeout-ms header
+// it adds to requests, or 0 when the header is absent.
+func ExpectedTimeout(r *http.Request) time.Duration {
+	ms, err := strconv.ParseInt(r.Header.Get("X-Envoy-Expected-Rq-Timeout-Ms"), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,131 @@
+// Package hops detects proxies and service-mesh components a request passed
+// through, from the headers they leave behind and from the pod itself.
+package hops
+
+import (
+	"net/http"
+	"strings"
+)
+
+// debugHeaders are the headers that feed hop counting, echoed back in
+// /stats so operators can see why a count came out the way it did.
+var debugHeaders = []string{"X-Forwarded-For", "Via", "X-Envoy-External-Address",
+	"X-Envoy-Decorator-Operation", "X-B3-TraceId", "X-B3-SpanId", "X-Request-Id", "X-Real-IP",
+	"X-Forwarded-Client-Cert", "Baggage", "L5d-Client-Id"}
+
+// Info is the hop and mesh view of a single request.
+type Info struct {
+	ProxyHops     int    // Traditional proxy hops (nginx, X-Forwarded-For, Via)
+	MeshHops      int    // Service mesh hops (Istio/Envoy headers)
+	MeshMode      string // none, ambient-l4, ambient-l7 or sidecar
+	MeshPath      string // waypoint, ztunnel, sidecar or none; see MeshPath
+	Waypoint      bool   // Ambient L7 waypoint proxy detected
+	IstioDetected bool   // Istio headers seen or sidecar present in the pod
+}
+
+// Total returns proxy + service mesh hops.
+func (i Info) Total() int {
+	return i.ProxyHops + i.MeshHops
+}
+
+// Detect gathers every hop and mesh signal for r in one call.
+func Detect(r *http.Request) Info {
+	sidecar := SidecarPresent()
+	mode, waypoint := MeshMode(r, sidecar)
+	path := MeshPath(r, sidecar, AmbientEnrolled())
+
+	// Detect Istio presence. We combine two signals:
+	// 1) Request headers that Envoy/Istio often injects when traffic traverses the proxy
+	// 2) A pod-level probe of Envoy admin port on 127.0.0.1:15000 which indicates sidecar is present
+	return Info{
+		ProxyHops:     ProxyHops(r),
+		MeshHops:      ServiceMeshHops(r),
+		MeshMode:      mode,
+		MeshPath:      path,
+		Waypoint:      waypoint,
+		IstioDetected: HasIstioHeaders(r) || sidecar,
+	}
+}
+
+// ProxyHops counts traditional proxy hops (nginx, load balancers, etc.)
+func ProxyHops(r *http.Request) int {
+	hops := 0
+
+	// Check X-Forwarded-For header (counts IPs in chain)
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// Count commas + 1 for number of IPs
+		hops += strings.Count(xff, ",") + 1
+	}
+
+	// Check Via header (standard proxy header)
+	if via := r.Header.Get("Via"); via != "" {
+		hops += strings.Count(via, ",") + 1
+	}
+
+	return hops
+}
+
+// ServiceMeshHops counts service mesh hops (Istio/Envoy/ztunnel)
+func ServiceMeshHops(r *http.Request) int {
+	hops := 0
+
+	// X-Request-Id is added by Envoy (both sidecar and ambient mode)
+	if r.Header.Get("X-Request-Id") != "" {
+		hops++
+	}
+
+	// Check Envoy-specific headers (Istio uses Envoy)
+	if r.Header.Get("X-Envoy-External-Address") != "" {
+		hops++
+	}
+	if r.Header.Get("X-Envoy-Decorator-Operation") != "" {
+		hops++
+	}
+
+	// Check for Istio-specific headers
+	if r.Header.Get("X-B3-TraceId") != "" {
+		// Istio uses B3 propagation for distributed tracing
+		hops++
+	}
+	if r.Header.Get("X-B3-SpanId") != "" {
+		hops++
+	}
+
+	return hops
+}
+
+// TotalHops returns total proxy + service mesh hops
+func TotalHops(r *http.Request) int {
+	return ProxyHops(r) + ServiceMeshHops(r)
+}
+
+// MeshMode determines the service mesh configuration based on headers and sidecar presence
+// Returns the mode (sidecar, ambient-l7, ambient-l4 or none) and whether waypoint proxy is detected
+func MeshMode(r *http.Request, sidecarPresent bool) (mode string, waypointDetected bool) {
+	// Determine mode based on sidecar presence and L7 headers
+	if sidecarPresent {
+		// Envoy sidecar is running in the pod (port 15000)
+		return "sidecar", false
+	} else if hasL7Headers(r) {
+		// No sidecar but L7 headers present = waypoint proxy (ambient L7 mode)
+		return "ambient-l7", true
+	} else if AmbientEnrolled() {
+		// ztunnel only: it operates at L4 and doesn't add HTTP headers, but
+		// its listener in the pod's network namespace gives it away
+		return "ambient-l4", false
+	}
+
+	// No sidecar, no L7 headers and no ztunnel
+	return "none", false
+}
+
+// DebugHeaders returns the hop-related headers present on r.
+func DebugHeaders(r *http.Request) map[string]string {
+	out := make(map[string]string)
+	for _, hdr := range debugHeaders {
+		if val := r.Header.Get(hdr); val != "" {
+			out[hdr] = val
+		}
+	}
+	return out
+}
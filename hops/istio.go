@@ -0,0 +1,67 @@
+package hops
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// Cached detection of Istio sidecar presence in the pod's network namespace
+	istioDetectMu      sync.RWMutex
+	istioPresentCached bool
+	istioLastChecked   time.Time
+)
+
+// HasIstioHeaders checks common Istio/Envoy headers on the incoming request.
+// Note: These only appear if the request actually traversed the proxy.
+func HasIstioHeaders(r *http.Request) bool {
+	h := r.Header
+	if h.Get("X-B3-TraceId") != "" { // B3 tracing header used by Istio when tracing is enabled
+		return true
+	}
+	if h.Get("X-Envoy-Decorator-Operation") != "" { // Envoy route/operation decoration
+		return true
+	}
+	if h.Get("X-Request-Id") != "" { // Frequently added by Envoy
+		return true
+	}
+	if h.Get("X-Envoy-Attempt-Count") != "" || h.Get("X-Envoy-Internal") != "" {
+		return true
+	}
+	return false
+}
+
+// SidecarPresent detects whether an Envoy sidecar is present in the pod.
+// It probes Envoy's admin port (127.0.0.1:15000). Result is cached and refreshed
+// at most every 30 seconds to avoid per-request overhead.
+func SidecarPresent() bool {
+	istioDetectMu.RLock()
+	recent := time.Since(istioLastChecked) < 30*time.Second
+	cached := istioPresentCached
+	istioDetectMu.RUnlock()
+
+	if recent {
+		return cached
+	}
+
+	present := probeEnvoyAdmin()
+
+	istioDetectMu.Lock()
+	istioPresentCached = present
+	istioLastChecked = time.Now()
+	istioDetectMu.Unlock()
+	return present
+}
+
+// probeEnvoyAdmin attempts a quick TCP connect to Envoy's admin port.
+// If the connection succeeds, we assume the Istio sidecar is running.
+func probeEnvoyAdmin() bool {
+	conn, err := net.DialTimeout("tcp", envoyAdminAddr, 50*time.Millisecond)
+	if err == nil {
+		_ = conn.Close()
+		return true
+	}
+	return false
+}
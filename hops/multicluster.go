@@ -0,0 +1,95 @@
+package hops
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CrossClusterHops counts the legs r took between clusters of a multi-cluster
+// mesh, from what east-west gateways and remote proxies leave behind:
+//
+//   - an X-Forwarded-Client-Cert element whose client (URI) and receiving
+//     proxy (By) identities belong to different trust domains, or whose
+//     client is an Istio east-west gateway terminating mTLS
+//   - a W3C baggage k8s.cluster.name other than localCluster, as set by
+//     proxies that propagate their cluster
+//   - an l5d-client-id naming the Linkerd multicluster gateway
+//
+// East-west gateways in Istio's default AUTO_PASSTHROUGH mode forward mTLS
+// untouched and leave no trace, so a zero count is not proof that a request
+// stayed in one cluster. localCluster may be empty to skip the baggage check.
+func CrossClusterHops(r *http.Request, localCluster string) int {
+	hops := 0
+	for _, xfcc := range r.Header.Values("X-Forwarded-Client-Cert") {
+		for _, element := range strings.Split(xfcc, ",") {
+			by, uri := xfccIdentities(element)
+			switch {
+			case strings.Contains(uri, "/sa/istio-eastwestgateway"):
+				hops++
+			case by != "" && uri != "" && trustDomain(by) != trustDomain(uri):
+				hops++
+			}
+		}
+	}
+
+	if localCluster != "" {
+		if cluster := baggageValue(r, "k8s.cluster.name"); cluster != "" && cluster != localCluster {
+			hops++
+		}
+	}
+
+	if strings.HasPrefix(r.Header.Get("L5d-Client-Id"), "linkerd-gateway.") {
+		hops++
+	}
+	return hops
+}
+
+// xfccIdentities returns the By and URI SPIFFE IDs of one XFCC element, e.g.
+// `By=spiffe://a/ns/x/sa/y;Hash=...;URI=spiffe://b/ns/z/sa/w`.
+func xfccIdentities(element string) (by, uri string) {
+	for _, kv := range strings.Split(element, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "by":
+			by = value
+		case "uri":
+			uri = value
+		}
+	}
+	return by, uri
+}
+
+// trustDomain returns the trust domain of a SPIFFE ID.
+func trustDomain(spiffeID string) string {
+	rest := strings.TrimPrefix(spiffeID, "spiffe://")
+	domain, _, _ := strings.Cut(rest, "/")
+	return domain
+}
+
+// baggageValue returns the value of key in r's W3C baggage headers.
+func baggageValue(r *http.Request, key string) string {
+	for _, baggage := range r.Header.Values("Baggage") {
+		for _, member := range strings.Split(baggage, ",") {
+			member, _, _ = strings.Cut(member, ";") // Drop properties
+			k, v, ok := strings.Cut(member, "=")
+			if ok && strings.TrimSpace(k) == key {
+				return strings.TrimSpace(v)
+			}
+		}
+	}
+	return ""
+}
+
+// ClientIdentity returns the SPIFFE ID of the client that sent r over mTLS,
+// from the X-Forwarded-Client-Cert element added by the nearest proxy, or ""
+// when there is none.
+func ClientIdentity(r *http.Request) string {
+	values := r.Header.Values("X-Forwarded-Client-Cert")
+	if len(values) == 0 {
+		return ""
+	}
+	elements := strings.Split(values[len(values)-1], ",")
+	_, uri := xfccIdentities(elements[len(elements)-1])
+	return uri
+}
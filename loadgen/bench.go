@@ -0,0 +1,269 @@
+package loadgen
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// BenchReport is the result of `podmeter bench`: the client's view of a
+// load run next to the target PodMeter's.
+type BenchReport struct {
+	Plan    Plan        `json:"plan"`
+	Started time.Time   `json:"started"`
+	Client  meter.Stats `json:"client"`
+	Dropped int64       `json:"dropped_requests"`
+	// Server is missing, and ServerError says why, when the target's
+	// /stats could not be read, e.g. because it is not PodMeter
+	Server      *BenchServer `json:"server,omitempty"`
+	ServerError string       `json:"server_error,omitempty"`
+}
+
+// BenchServer is the target's side of a bench run. Requests are those it
+// recorded during the run, from /stats/delta, and latencies its samples from
+// the run in /stats/samples, or its delta histogram when it kept none;
+// Before and After are its /stats around the run.
+type BenchServer struct {
+	StatsURL          string  `json:"stats_url"`
+	LatencySource     string  `json:"latency_source"` // samples or histogram
+	Samples           int     `json:"samples,omitempty"`
+	Requests          int64   `json:"requests"`
+	Errors            int64   `json:"errors"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	AvgLatency        float64 `json:"avg_latency_ms"`
+	P50Latency        float64 `json:"p50_latency_ms"`
+	P95Latency        float64 `json:"p95_latency_ms"`
+	P99Latency        float64 `json:"p99_latency_ms"`
+	MaxLatency        float64 `json:"max_latency_ms"`
+	// Client latency minus server latency: the network, proxies and mesh
+	// between the two
+	AvgOverhead float64     `json:"avg_overhead_ms"`
+	P50Overhead float64     `json:"p50_overhead_ms"`
+	P95Overhead float64     `json:"p95_overhead_ms"`
+	P99Overhead float64     `json:"p99_overhead_ms"`
+	Before      meter.Stats `json:"before"`
+	After       meter.Stats `json:"after"`
+}
+
+// BenchCommand implements `podmeter bench`: it reads the target PodMeter's
+// /stats, runs a load plan against it, reads /stats again, and prints a
+// report comparing both sides as Markdown or JSON.
+func BenchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	plan := planFlags(fs)
+	statsURL := fs.String("stats", "", "the target's /stats URL (default: /stats on the target's host)")
+	format := fs.String("format", "markdown", "report format: markdown or json")
+	fs.Parse(args)
+
+	if err := plan.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "podmeter bench: %v\n", err)
+		fs.Usage()
+		return 2
+	}
+	if *format != "markdown" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "podmeter bench: --format must be markdown or json, not %q\n", *format)
+		return 2
+	}
+	if *statsURL == "" {
+		u, err := url.Parse(plan.Target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "podmeter bench: %v\n", err)
+			return 2
+		}
+		*statsURL = (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: "/stats"}).String()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	// The target's delta window for this run opens before the load starts
+	// and is collected after it, so it holds exactly the run's requests
+	deltaURL := strings.TrimSuffix(*statsURL, "/stats") + "/stats/delta?consumer=" + fmt.Sprintf("bench-%d", os.Getpid())
+	report := BenchReport{Plan: *plan}
+	var before meter.Stats
+	err := getJSON(ctx, client, *statsURL, &before)
+	if err == nil {
+		err = getJSON(ctx, client, deltaURL, &struct{}{})
+	}
+	if err != nil {
+		log.Printf("Warning: reading the target's stats failed, reporting the client side only: %v", err)
+		report.ServerError = err.Error()
+	}
+
+	log.Printf("Benchmarking %s with %s load at %.0f rps for %s (concurrency %d)",
+		plan.Target, plan.Pattern, plan.RPS, plan.Duration, plan.Concurrency)
+	report.Started = time.Now().UTC()
+	res := Run(ctx, *plan)
+	report.Client = res.Stats()
+	report.Dropped = res.Dropped
+
+	if report.ServerError == "" {
+		// Collect even after an interrupt, so the partial run is reported
+		ctx := context.WithoutCancel(ctx)
+		var delta struct {
+			HTTP meter.Delta `json:"http"`
+		}
+		var after meter.Stats
+		err := getJSON(ctx, client, deltaURL, &delta)
+		if err == nil {
+			err = getJSON(ctx, client, *statsURL, &after)
+		}
+		if err != nil {
+			report.ServerError = err.Error()
+		} else {
+			samples, err := fetchSamples(ctx, client, *statsURL+"/samples", delta.HTTP.Start, delta.HTTP.End)
+			if err != nil {
+				log.Printf("Warning: reading the target's samples failed, estimating its percentiles: %v", err)
+			}
+			report.Server = benchServer(*statsURL, report.Client, delta.HTTP, samples, before, after)
+		}
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		writeBenchMarkdown(os.Stdout, &report)
+	}
+	return 0
+}
+
+// getJSON GETs url and decodes its JSON body into v.
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchSamples pages through the target's latency samples taken between
+// start and end.
+func fetchSamples(ctx context.Context, client *http.Client, samplesURL string, start, end time.Time) ([]float64, error) {
+	var out []float64
+	for offset := 0; ; {
+		var page struct {
+			NextOffset *int `json:"next_offset"`
+			Samples    []struct {
+				Timestamp time.Time `json:"timestamp"`
+				Latency   float64   `json:"latency_ms"`
+			} `json:"samples"`
+		}
+		q := url.Values{"since": {start.Format(time.RFC3339Nano)}, "limit": {"10000"}, "offset": {fmt.Sprint(offset)}}
+		if err := getJSON(ctx, client, samplesURL+"?"+q.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, s := range page.Samples {
+			if !s.Timestamp.After(end) {
+				out = append(out, s.Latency)
+			}
+		}
+		if page.NextOffset == nil {
+			return out, nil
+		}
+		offset = *page.NextOffset
+	}
+}
+
+// benchServer summarizes the target's side of a run and compares its
+// latencies with the client's. Percentiles come from samples, or are
+// estimated from the delta's histogram when there are none.
+func benchServer(statsURL string, client meter.Stats, delta meter.Delta, samples []float64, before, after meter.Stats) *BenchServer {
+	s := &BenchServer{
+		StatsURL: statsURL,
+		Requests: delta.Requests,
+		Errors:   delta.Errors,
+		Before:   before,
+		After:    after,
+	}
+	if elapsed := delta.End.Sub(delta.Start).Seconds(); elapsed > 0 {
+		s.RequestsPerSecond = meter.Round(float64(delta.Requests) / elapsed)
+	}
+	if len(samples) > 0 {
+		lat := meter.Summarize(samples)
+		s.LatencySource, s.Samples = "samples", len(samples)
+		s.AvgLatency, s.P50Latency, s.P95Latency, s.P99Latency, s.MaxLatency = lat.Avg, lat.P50, lat.P95, lat.P99, lat.Max
+	} else if delta.Count > 0 {
+		s.LatencySource = "histogram"
+		s.AvgLatency = meter.Round(delta.SumMs / float64(delta.Count))
+		s.P50Latency = delta.Quantile(0.50)
+		s.P95Latency = delta.Quantile(0.95)
+		s.P99Latency = delta.Quantile(0.99)
+		s.MaxLatency = meter.Round(delta.MaxMs)
+	}
+	if s.LatencySource != "" {
+		s.AvgOverhead = meter.Round(client.AvgLatency - s.AvgLatency)
+		s.P50Overhead = meter.Round(client.P50Latency - s.P50Latency)
+		s.P95Overhead = meter.Round(client.P95Latency - s.P95Latency)
+		s.P99Overhead = meter.Round(client.P99Latency - s.P99Latency)
+	}
+	return s
+}
+
+// writeBenchMarkdown renders a report as a Markdown document, for pasting
+// into a pull request or an issue.
+func writeBenchMarkdown(w io.Writer, r *BenchReport) {
+	p := r.Plan
+	fmt.Fprintf(w, "# PodMeter benchmark: %s\n\n", p.Target)
+	fmt.Fprintf(w, "%s load at %g rps for %s, concurrency %d, started %s.",
+		p.Pattern, p.RPS, p.Duration, p.Concurrency, r.Started.Format(time.RFC3339))
+	if r.Dropped > 0 {
+		fmt.Fprintf(w, " %d requests were dropped because every worker was busy.", r.Dropped)
+	}
+	fmt.Fprint(w, "\n\n## Latency\n\n")
+	fmt.Fprintln(w, "| | Requests | Errors | RPS | Avg (ms) | p50 (ms) | p95 (ms) | p99 (ms) | Max (ms) |")
+	fmt.Fprintln(w, "|---|---:|---:|---:|---:|---:|---:|---:|---:|")
+	c := r.Client
+	fmt.Fprintf(w, "| Client | %d | %d | %g | %g | %g | %g | %g | %g |\n",
+		c.Requests, c.Errors, c.RequestsPerSecond, c.AvgLatency, c.P50Latency, c.P95Latency, c.P99Latency, c.MaxLatency)
+	if r.Server == nil {
+		fmt.Fprintf(w, "\nThe target's side is missing: %s\n", r.ServerError)
+		return
+	}
+	s := r.Server
+	fmt.Fprintf(w, "| Server | %d | %d | %g | %g | %g | %g | %g | %g |\n",
+		s.Requests, s.Errors, s.RequestsPerSecond, s.AvgLatency, s.P50Latency, s.P95Latency, s.P99Latency, s.MaxLatency)
+	fmt.Fprintf(w, "| Overhead | | | | %g | %g | %g | %g | |\n", s.AvgOverhead, s.P50Overhead, s.P95Overhead, s.P99Overhead)
+	fmt.Fprint(w, "\nThe overhead is the client's latency minus the server's: the network, proxies and mesh in between.")
+	if s.LatencySource == "histogram" {
+		fmt.Fprint(w, " The target kept no samples, so its percentiles are estimated from its latency histogram.")
+	}
+	fmt.Fprintln(w)
+
+	b, a := s.Before, s.After
+	fmt.Fprint(w, "\n## Target\n\n")
+	fmt.Fprintln(w, "| | Before | After | Change |")
+	fmt.Fprintln(w, "|---|---:|---:|---:|")
+	row := func(name string, before, after float64) {
+		fmt.Fprintf(w, "| %s | %g | %g | %+g |\n", name, before, after, meter.Round(after-before))
+	}
+	row("Memory, sys (MB)", b.MemorySysMB, a.MemorySysMB)
+	row("Memory, heap (MB)", b.MemoryHeapMB, a.MemoryHeapMB)
+	row("Goroutines", float64(b.Goroutines), float64(a.Goroutines))
+	row("GC cycles", float64(b.NumGC), float64(a.NumGC))
+	row("Avg proxy hops", b.AvgProxyHops, a.AvgProxyHops)
+	fmt.Fprintf(w, "\nHost %s, service mesh mode %s, PodMeter %s.\n", a.Hostname, a.ServiceMeshMode, a.Resource["service.version"])
+}
@@ -0,0 +1,188 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// maxStartSkew bounds how far in the future a coordinator may schedule a
+// peer's run, so a bad clock or typo cannot park a handler for hours.
+const maxStartSkew = 5 * time.Minute
+
+// PeerRequest is what a coordinator sends to each peer's /admin/load.
+type PeerRequest struct {
+	Plan    Plan      `json:"plan"`
+	StartAt time.Time `json:"start_at"` // Wall-clock time all peers begin together
+}
+
+// PeerResult is one peer's outcome as seen by the coordinator.
+type PeerResult struct {
+	Peer   string       `json:"peer"`
+	Stats  *meter.Stats `json:"stats,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Result *Result      `json:"-"`
+}
+
+// Report is the aggregated output of a distributed run.
+type Report struct {
+	Combined meter.Stats  `json:"combined"`
+	Dropped  int64        `json:"dropped_requests"`
+	Peers    []PeerResult `json:"peers"`
+}
+
+// peerLoadRunning ensures a peer executes at most one plan at a time.
+var peerLoadRunning atomic.Bool
+
+// PeerHandler serves POST /admin/load: it waits until the requested start
+// time, runs the plan, and returns the raw Result so the coordinator can
+// merge latency samples rather than averaging percentiles.
+func PeerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PeerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Plan.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait := time.Until(req.StartAt)
+	if wait > maxStartSkew {
+		http.Error(w, "start_at is too far in the future", http.StatusBadRequest)
+		return
+	}
+
+	if !peerLoadRunning.CompareAndSwap(false, true) {
+		http.Error(w, "a load run is already in progress", http.StatusConflict)
+		return
+	}
+	defer peerLoadRunning.Store(false)
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	log.Printf("Running coordinated %s load at %.0f rps against %s for %s",
+		req.Plan.Pattern, req.Plan.RPS, req.Plan.Target, req.Plan.Duration)
+	res := Run(r.Context(), req.Plan)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Coordinate splits plan across peers, starts them simultaneously and
+// merges their raw results into a single combined view. token is the peers'
+// admin token. Without peers nothing runs, and the report is empty.
+func Coordinate(ctx context.Context, plan Plan, peers []string, startDelay time.Duration, token string) *Report {
+	n := len(peers)
+	if n == 0 {
+		return &Report{Combined: (&Result{}).Stats(), Peers: []PeerResult{}}
+	}
+	share := plan
+	share.RPS = plan.RPS / float64(n)
+	share.Concurrency = plan.Concurrency / n
+	if share.Concurrency < 1 {
+		share.Concurrency = 1
+	}
+
+	body, _ := json.Marshal(PeerRequest{
+		Plan:    share,
+		StartAt: time.Now().Add(startDelay),
+	})
+
+	// The peer holds the request open for the whole run
+	client := &http.Client{Timeout: startDelay + plan.Duration + plan.Timeout + 30*time.Second}
+
+	results := make([]PeerResult, n)
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			results[i] = runOnPeer(ctx, client, peer, token, body)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	// Merge raw samples so combined percentiles are true cluster-wide values
+	merged := &Result{}
+	for i := range results {
+		res := results[i].Result
+		if res == nil {
+			continue
+		}
+		merged.Requests += res.Requests
+		merged.Errors += res.Errors
+		merged.Dropped += res.Dropped
+		merged.Latencies = append(merged.Latencies, res.Latencies...)
+		if res.Elapsed > merged.Elapsed {
+			merged.Elapsed = res.Elapsed
+		}
+		stats := res.Stats()
+		results[i].Stats = &stats
+	}
+
+	return &Report{
+		Combined: merged.Stats(),
+		Dropped:  merged.Dropped,
+		Peers:    results,
+	}
+}
+
+// runOnPeer posts the plan to a single peer and decodes its raw result.
+func runOnPeer(ctx context.Context, client *http.Client, peer, token string, body []byte) PeerResult {
+	out := PeerResult{Peer: peer}
+	url := strings.TrimSuffix(peer, "/") + "/admin/load"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		out.Error = fmt.Sprintf("peer returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		return out
+	}
+
+	var res Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		out.Error = fmt.Sprintf("invalid peer response: %v", err)
+		return out
+	}
+	out.Result = &res
+	return out
+}
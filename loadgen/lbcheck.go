@@ -0,0 +1,348 @@
+package loadgen
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Workload responses name the PodMeter instance that answered in these
+// headers, so a client behind a Service can tell its backends apart. Node
+// and zone are left out when unknown.
+const (
+	PodHeader  = "X-PodMeter-Pod"
+	NodeHeader = "X-PodMeter-Node"
+	ZoneHeader = "X-PodMeter-Zone"
+)
+
+// SetIdentityHeaders adds this instance's identity headers to h. The pod,
+// node and zone are the k8s.pod.name, k8s.node.name and
+// cloud.availability_zone resource attributes.
+func SetIdentityHeaders(h http.Header) {
+	res := meter.Resource()
+	for header, attr := range map[string]string{
+		PodHeader:  "k8s.pod.name",
+		NodeHeader: "k8s.node.name",
+		ZoneHeader: "cloud.availability_zone",
+	} {
+		if v := res[attr]; v != "" {
+			h.Set(header, v)
+		}
+	}
+}
+
+// LBBackend is one backend pod that answered `podmeter lb-check`.
+type LBBackend struct {
+	Pod        string  `json:"pod"`
+	Node       string  `json:"node,omitempty"`
+	Zone       string  `json:"zone,omitempty"`
+	Responses  int64   `json:"responses"`
+	Percent    float64 `json:"percent"`
+	AvgLatency float64 `json:"avg_latency_ms"`
+	P95Latency float64 `json:"p95_latency_ms"`
+}
+
+// LBCheckReport is the client-side result of `podmeter lb-check`.
+type LBCheckReport struct {
+	Target    string `json:"target"`
+	KeepAlive bool   `json:"keep_alive"`
+	Requests  int64  `json:"requests"`
+	Errors    int64  `json:"errors"`
+	// Unidentified responses came without identity headers, from something
+	// other than PodMeter
+	Unidentified int64            `json:"unidentified"`
+	Statuses     map[int]int64    `json:"statuses"`
+	Backends     []LBBackend      `json:"backends"`
+	Nodes        map[string]int64 `json:"nodes,omitempty"`
+	Zones        map[string]int64 `json:"zones,omitempty"`
+	// MaxDeviationPercent is how far the busiest or idlest backend is from
+	// an even share, relative to that share
+	MaxDeviationPercent float64 `json:"max_deviation_percent"`
+	// Switches counts consecutive requests answered by different pods;
+	// with session affinity it is 0 and Sticky is set
+	Switches int64 `json:"switches"`
+	Sticky   bool  `json:"sticky"`
+	// The client's own node and zone, and the share of responses from
+	// backends in them, where both sides are known
+	ClientNode      string   `json:"client_node,omitempty"`
+	ClientZone      string   `json:"client_zone,omitempty"`
+	SameNodePercent *float64 `json:"same_node_percent,omitempty"`
+	SameZonePercent *float64 `json:"same_zone_percent,omitempty"`
+	Expect          string   `json:"expect,omitempty"`
+	ExpectationMet  *bool    `json:"expectation_met,omitempty"`
+}
+
+// lbResult is the outcome of one lb-check request.
+type lbResult struct {
+	pod, node, zone string
+	status          int
+	latencyMs       float64
+	err             bool
+}
+
+// headerFlags collects repeated --header flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string     { return strings.Join(*h, ", ") }
+func (h *headerFlags) Set(v string) error { *h = append(*h, v); return nil }
+
+// LBCheckCommand implements `podmeter lb-check`: it calls a Service
+// repeatedly, tallies which backend pods answered from their identity
+// headers, and reports the distribution as JSON. It exits with 1 when an
+// --expect check fails.
+func LBCheckCommand(args []string) int {
+	fs := flag.NewFlagSet("lb-check", flag.ExitOnError)
+	target := fs.String("target", "", "URL of a Service backed by PodMeter (required)")
+	requests := fs.Int("requests", 100, "how many requests to send")
+	concurrency := fs.Int("concurrency", 1, "maximum in-flight requests")
+	rate := fs.Float64("rate", 0, "requests per second; 0 sends as fast as --concurrency allows")
+	keepAlive := fs.Bool("keep-alive", false, "reuse connections; by default every request opens a new one, as kube-proxy balances connections, not requests")
+	cookies := fs.Bool("cookies", false, "keep cookies between requests, for cookie-based affinity")
+	timeout := fs.Duration("timeout", 5*time.Second, "per-request timeout")
+	expect := fs.String("expect", "", "check the distribution: even, sticky, node or zone")
+	tolerance := fs.Float64("tolerance", 20, "with --expect even, the largest deviation from an even share allowed, in percent")
+	var headers headerFlags
+	fs.Var(&headers, "header", "`Name: value` header to send with every request, e.g. for consistent hashing; repeatable")
+	fs.Parse(args)
+
+	if *target == "" || *requests <= 0 || *concurrency <= 0 || *rate < 0 {
+		fmt.Fprintln(os.Stderr, "podmeter lb-check: --target and a positive --requests and --concurrency are required")
+		fs.Usage()
+		return 2
+	}
+	switch *expect {
+	case "", "even", "sticky", "node", "zone":
+	default:
+		fmt.Fprintf(os.Stderr, "podmeter lb-check: --expect must be even, sticky, node or zone, not %q\n", *expect)
+		return 2
+	}
+	header := make(http.Header)
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Fprintf(os.Stderr, "podmeter lb-check: --header %q: want Name: value\n", h)
+			return 2
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	req, err := http.NewRequest(http.MethodGet, *target, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "podmeter lb-check: %v\n", err)
+		return 2
+	}
+	req.Header = header
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{DisableKeepAlives: !*keepAlive, MaxIdleConnsPerHost: *concurrency},
+	}
+	if *cookies {
+		client.Jar, _ = cookiejar.New(nil)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Results are kept in request order, so that Switches follows the
+	// sequence the requests were issued in
+	results := make([]*lbResult, *requests)
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		var tick <-chan time.Time
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := range *requests {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+			if tick != nil && i < *requests-1 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	log.Printf("Checking load balancing of %s with %d requests", *target, *requests)
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = lbRequest(ctx, client, req)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := lbReport(results, *target, *keepAlive)
+	if *expect != "" {
+		met := report.meets(*expect, *tolerance)
+		report.Expect, report.ExpectationMet = *expect, &met
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if report.ExpectationMet != nil && !*report.ExpectationMet {
+		return 1
+	}
+	return 0
+}
+
+// lbRequest sends one request and reads who answered it.
+func lbRequest(ctx context.Context, client *http.Client, req *http.Request) *lbResult {
+	start := time.Now()
+	resp, err := client.Do(req.Clone(ctx))
+	if err != nil {
+		return &lbResult{err: true, latencyMs: meter.Ms(time.Since(start))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return &lbResult{
+		pod:       resp.Header.Get(PodHeader),
+		node:      resp.Header.Get(NodeHeader),
+		zone:      resp.Header.Get(ZoneHeader),
+		status:    resp.StatusCode,
+		latencyMs: meter.Ms(time.Since(start)),
+	}
+}
+
+// lbReport tallies the results by backend. Requests left unsent by an
+// interrupt are nil and not counted.
+func lbReport(results []*lbResult, target string, keepAlive bool) LBCheckReport {
+	report := LBCheckReport{
+		Target:     target,
+		KeepAlive:  keepAlive,
+		Statuses:   make(map[int]int64),
+		Backends:   []LBBackend{},
+		ClientNode: meter.Resource()["k8s.node.name"],
+		ClientZone: meter.Resource()["cloud.availability_zone"],
+	}
+	latencies := make(map[string][]float64)
+	backends := make(map[string]*LBBackend)
+	var identified, sameNode, knownNode, sameZone, knownZone int64
+	lastPod := ""
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		report.Requests++
+		if r.err {
+			report.Errors++
+			continue
+		}
+		report.Statuses[r.status]++
+		if r.pod == "" {
+			report.Unidentified++
+			continue
+		}
+		identified++
+
+		b, ok := backends[r.pod]
+		if !ok {
+			b = &LBBackend{Pod: r.pod, Node: r.node, Zone: r.zone}
+			backends[r.pod] = b
+		}
+		b.Responses++
+		latencies[r.pod] = append(latencies[r.pod], r.latencyMs)
+		if lastPod != "" && lastPod != r.pod {
+			report.Switches++
+		}
+		lastPod = r.pod
+
+		if r.node != "" {
+			if report.Nodes == nil {
+				report.Nodes = make(map[string]int64)
+			}
+			report.Nodes[r.node]++
+			if report.ClientNode != "" {
+				knownNode++
+				if r.node == report.ClientNode {
+					sameNode++
+				}
+			}
+		}
+		if r.zone != "" {
+			if report.Zones == nil {
+				report.Zones = make(map[string]int64)
+			}
+			report.Zones[r.zone]++
+			if report.ClientZone != "" {
+				knownZone++
+				if r.zone == report.ClientZone {
+					sameZone++
+				}
+			}
+		}
+	}
+
+	if identified > 0 {
+		fair := float64(identified) / float64(len(backends))
+		for pod, b := range backends {
+			b.Percent = meter.Round(float64(b.Responses) / float64(identified) * 100)
+			lat := meter.Summarize(latencies[pod])
+			b.AvgLatency, b.P95Latency = lat.Avg, lat.P95
+			dev := math.Abs(float64(b.Responses)-fair) / fair * 100
+			report.MaxDeviationPercent = max(report.MaxDeviationPercent, meter.Round(dev))
+			report.Backends = append(report.Backends, *b)
+		}
+		slices.SortFunc(report.Backends, func(a, b LBBackend) int {
+			return cmp.Or(cmp.Compare(b.Responses, a.Responses), strings.Compare(a.Pod, b.Pod))
+		})
+		report.Sticky = len(backends) == 1
+	}
+	if knownNode > 0 {
+		p := meter.Round(float64(sameNode) / float64(knownNode) * 100)
+		report.SameNodePercent = &p
+	}
+	if knownZone > 0 {
+		p := meter.Round(float64(sameZone) / float64(knownZone) * 100)
+		report.SameZonePercent = &p
+	}
+	return report
+}
+
+// meets checks the distribution against an --expect mode: even within
+// tolerance percent, sticky to one pod, or kept on the client's node or
+// zone. Any errors or unidentified responses fail the check.
+func (r *LBCheckReport) meets(expect string, tolerance float64) bool {
+	if r.Errors > 0 || r.Unidentified > 0 || len(r.Backends) == 0 {
+		return false
+	}
+	switch expect {
+	case "even":
+		return r.MaxDeviationPercent <= tolerance
+	case "sticky":
+		return r.Sticky
+	case "node":
+		return r.SameNodePercent != nil && *r.SameNodePercent == 100
+	case "zone":
+		return r.SameZonePercent != nil && *r.SameZonePercent == 100
+	}
+	return false
+}
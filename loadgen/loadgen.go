@@ -0,0 +1,317 @@
+// Package loadgen is PodMeter's client side: open-loop HTTP load generation,
+// coordination of multi-pod runs through peers' /admin/load, benchmark
+// reports, the UDP loss/jitter probe, and the load-balancing distribution
+// check.
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+	"github.com/nyan-lin-tun/PodMeter/sysinfo"
+)
+
+// Plan describes a client-side load test against a single target.
+type Plan struct {
+	Target      string        `json:"target"`
+	RPS         float64       `json:"rps"`
+	Duration    time.Duration `json:"duration"`
+	Concurrency int           `json:"concurrency"`
+	Pattern     string        `json:"pattern"` // constant, ramp, or step
+	Timeout     time.Duration `json:"timeout"`
+	BodySize    int           `json:"body_size,omitempty"` // Bytes POSTed with each request; 0 sends GETs
+}
+
+// Result is the raw client-side outcome of running a Plan.
+type Result struct {
+	Requests  int64         `json:"requests"`
+	Errors    int64         `json:"errors"`
+	Dropped   int64         `json:"dropped"` // Scheduled requests skipped because all workers were busy
+	Latencies []float64     `json:"latencies_ms"`
+	Elapsed   time.Duration `json:"elapsed"`
+}
+
+// Validate checks the plan for values that would make the run meaningless.
+func (p *Plan) Validate() error {
+	if p.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if p.RPS <= 0 {
+		return fmt.Errorf("rps must be positive")
+	}
+	if p.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if p.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	if p.BodySize < 0 {
+		return fmt.Errorf("body size must not be negative")
+	}
+	switch p.Pattern {
+	case "constant", "ramp", "step":
+	default:
+		return fmt.Errorf("unknown pattern %q (use constant, ramp, or step)", p.Pattern)
+	}
+	return nil
+}
+
+// rateAt returns the target request rate at the given offset into the run.
+//   - constant: the full rate for the whole run
+//   - ramp: linear increase from 0 to the full rate
+//   - step: four equal steps at 25%, 50%, 75% and 100% of the rate
+func (p *Plan) rateAt(elapsed time.Duration) float64 {
+	progress := float64(elapsed) / float64(p.Duration)
+	rate := p.RPS
+
+	switch p.Pattern {
+	case "ramp":
+		rate = p.RPS * progress
+	case "step":
+		step := int(progress*4) + 1
+		if step > 4 {
+			step = 4
+		}
+		rate = p.RPS * float64(step) / 4
+	}
+
+	// Never stall the scheduler completely at the start of a ramp
+	if rate < 1 {
+		rate = 1
+	}
+	return rate
+}
+
+// Run drives plan.Target at the planned rate with a bounded worker
+// pool and collects client-side latency and error counts.
+func Run(ctx context.Context, plan Plan) *Result {
+	client := &http.Client{
+		Timeout: plan.Timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        plan.Concurrency,
+			MaxIdleConnsPerHost: plan.Concurrency,
+		},
+	}
+
+	var (
+		reqCount atomic.Int64
+		errCount atomic.Int64
+		dropped  int64
+		latMu    sync.Mutex
+		lats     []float64
+		wg       sync.WaitGroup
+	)
+
+	// Every request sends the same payload, so body size is the only variable
+	var payload []byte
+	if plan.BodySize > 0 {
+		payload = bytes.Repeat([]byte("x"), plan.BodySize)
+	}
+
+	jobs := make(chan struct{}, plan.Concurrency)
+	for i := 0; i < plan.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				start := time.Now()
+				req, err := newLoadRequest(plan.Target, payload)
+				var resp *http.Response
+				if err == nil {
+					resp, err = client.Do(req)
+				}
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				lat := meter.Ms(time.Since(start))
+
+				reqCount.Add(1)
+				if err != nil || resp.StatusCode >= 400 {
+					errCount.Add(1)
+				}
+				latMu.Lock()
+				lats = append(lats, lat)
+				latMu.Unlock()
+			}
+		}()
+	}
+
+	// Open-loop scheduler: requests are issued on a clock regardless of how
+	// fast the target answers, so slow responses show up as latency rather
+	// than silently lowering the offered load.
+	start := time.Now()
+	next := start
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+schedule:
+	for {
+		elapsed := time.Since(start)
+		if elapsed >= plan.Duration {
+			break
+		}
+
+		select {
+		case jobs <- struct{}{}:
+		default:
+			dropped++
+		}
+
+		next = next.Add(time.Duration(float64(time.Second) / plan.rateAt(elapsed)))
+		timer.Reset(time.Until(next))
+		select {
+		case <-ctx.Done():
+			break schedule
+		case <-timer.C:
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return &Result{
+		Requests:  reqCount.Load(),
+		Errors:    errCount.Load(),
+		Dropped:   dropped,
+		Latencies: lats,
+		Elapsed:   time.Since(start),
+	}
+}
+
+// userAgent identifies load generator traffic in the target's User-Agent
+// counts.
+var userAgent = "podmeter-load/" + meter.Build().Version
+
+// newLoadRequest returns a GET for target, or a POST when there is a
+// payload.
+func newLoadRequest(target string, payload []byte) (*http.Request, error) {
+	method, body := http.MethodGet, io.Reader(nil)
+	if payload != nil {
+		method, body = http.MethodPost, bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	req.Header.Set("User-Agent", userAgent)
+	// Name this pod, so the target can tell which zone its load came from
+	SetIdentityHeaders(req.Header)
+	return req, nil
+}
+
+// Stats renders the client-side result in the same Stats format the server
+// reports, so both sides of a test can be compared field by field.
+func (res *Result) Stats() meter.Stats {
+	hostname, kernelVersion := sysinfo.Host()
+	elapsed := res.Elapsed.Seconds()
+
+	stats := meter.Stats{
+		Requests:      res.Requests,
+		Errors:        res.Errors,
+		SuccessRate:   100.0,
+		UptimeSeconds: int64(elapsed),
+		Hostname:      hostname,
+		KernelVersion: kernelVersion,
+		Labels:        meter.Labels(),
+	}
+	stats.SetRuntime()
+	if elapsed > 0 {
+		stats.RequestsPerSecond = meter.Round(float64(res.Requests) / elapsed)
+	}
+	if res.Requests > 0 {
+		stats.SuccessRate = meter.Round(float64(res.Requests-res.Errors) / float64(res.Requests) * 100)
+	}
+	if len(res.Latencies) > 0 {
+		stats.SetLatency(meter.Summarize(res.Latencies))
+	}
+	return stats
+}
+
+// planFlags registers the flags describing a Plan on fs, shared by the load
+// and bench commands.
+func planFlags(fs *flag.FlagSet) *Plan {
+	plan := &Plan{}
+	fs.StringVar(&plan.Target, "target", "", "URL to send requests to (required)")
+	fs.Float64Var(&plan.RPS, "rps", 100, "target requests per second")
+	fs.DurationVar(&plan.Duration, "duration", 30*time.Second, "how long to generate load")
+	fs.IntVar(&plan.Concurrency, "concurrency", 10, "maximum in-flight requests")
+	fs.StringVar(&plan.Pattern, "pattern", "constant", "load pattern: constant, ramp, or step")
+	fs.DurationVar(&plan.Timeout, "timeout", 10*time.Second, "per-request timeout")
+	fs.IntVar(&plan.BodySize, "body-size", 0, "bytes to POST with each request (0 sends GETs)")
+	return plan
+}
+
+// LoadCommand implements `podmeter load`. It prints the client-side Stats
+// as JSON on stdout and returns the process exit code.
+func LoadCommand(args []string) int {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	plan := planFlags(fs)
+	peers := fs.String("peers", "", "comma-separated PodMeter peer URLs to coordinate (load is split across them)")
+	startDelay := fs.Duration("start-delay", 2*time.Second, "lead time given to peers so they start simultaneously")
+	token := fs.String("token", os.Getenv("PODMETER_ADMIN_TOKEN"), "peers' admin token (default $PODMETER_ADMIN_TOKEN)")
+	fs.Parse(args)
+
+	if err := plan.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "podmeter load: %v\n", err)
+		fs.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	if *peers != "" {
+		var peerList []string
+		for _, p := range strings.Split(*peers, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				peerList = append(peerList, p)
+			}
+		}
+		if len(peerList) == 0 {
+			fmt.Fprintf(os.Stderr, "podmeter load: -peers names no peers\n")
+			fs.Usage()
+			return 2
+		}
+		log.Printf("Coordinating %s load at %.0f rps against %s for %s across %d peers",
+			plan.Pattern, plan.RPS, plan.Target, plan.Duration, len(peerList))
+		report := Coordinate(ctx, *plan, peerList, *startDelay, *token)
+		enc.Encode(report)
+		for _, p := range report.Peers {
+			if p.Error != "" {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	log.Printf("Generating %s load at %.0f rps against %s for %s (concurrency %d)",
+		plan.Pattern, plan.RPS, plan.Target, plan.Duration, plan.Concurrency)
+	res := Run(ctx, *plan)
+	if res.Dropped > 0 {
+		log.Printf("Warning: %d scheduled requests were dropped because all workers were busy; raise --concurrency", res.Dropped)
+	}
+
+	enc.Encode(res.Stats())
+	return 0
+}
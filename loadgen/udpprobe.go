@@ -0,0 +1,171 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// UDP probe datagrams start with UDPMagic, followed by a big-endian uint64
+// sequence number and int64 send time (UnixNano). Anything else is echoed
+// verbatim by the listener, so tools like `nc -u` still work.
+var UDPMagic = []byte("PMU1")
+
+// UDPHeaderSize is the minimum size of a probe datagram.
+const UDPHeaderSize = 4 + 8 + 8
+
+// ParseUDPProbe extracts the sequence number and send time from a probe
+// datagram, reporting false for anything that is not one.
+func ParseUDPProbe(b []byte) (seq uint64, sentNanos int64, ok bool) {
+	if len(b) < UDPHeaderSize || !bytes.Equal(b[:4], UDPMagic) {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(b[4:12]), int64(binary.BigEndian.Uint64(b[12:20])), true
+}
+
+// UDPProbeReport is the client-side result of `podmeter udp-probe`.
+type UDPProbeReport struct {
+	Target      string  `json:"target"`
+	Sent        int64   `json:"sent"`
+	Received    int64   `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	JitterMs    float64 `json:"jitter_ms"`
+	AvgRTT      float64 `json:"avg_rtt_ms"`
+	P50RTT      float64 `json:"p50_rtt_ms"`
+	P95RTT      float64 `json:"p95_rtt_ms"`
+	P99RTT      float64 `json:"p99_rtt_ms"`
+	MaxRTT      float64 `json:"max_rtt_ms"`
+}
+
+// UDPProbeCommand implements `podmeter udp-probe`: it sends sequenced,
+// timestamped datagrams to a PodMeter UDP listener and reports round-trip
+// loss, jitter and RTT percentiles as JSON.
+func UDPProbeCommand(args []string) int {
+	fs := flag.NewFlagSet("udp-probe", flag.ExitOnError)
+	target := fs.String("target", "", "host:port of a PodMeter UDP listener (required)")
+	rate := fs.Float64("rate", 50, "datagrams per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to probe")
+	size := fs.Int("size", 64, "datagram size in bytes (minimum 20)")
+	wait := fs.Duration("wait", time.Second, "how long to wait for late replies after the last send")
+	fs.Parse(args)
+
+	if *target == "" || *rate <= 0 || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "podmeter udp-probe: --target, a positive --rate and --duration are required")
+		fs.Usage()
+		return 2
+	}
+	*size = max(*size, UDPHeaderSize)
+
+	conn, err := net.Dial("udp", *target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "podmeter udp-probe: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var (
+		mu          sync.Mutex
+		seen        = make(map[uint64]bool)
+		rtts        []float64
+		lastTransit float64
+		jitter      float64
+		sent        int64
+	)
+
+	// Receiver: match echoes back to their sequence numbers
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			seq, sentAt, ok := ParseUDPProbe(buf[:n])
+			if !ok {
+				continue
+			}
+			rtt := float64(time.Now().UnixNano()-sentAt) / 1e6
+
+			mu.Lock()
+			if !seen[seq] {
+				seen[seq] = true
+				if len(rtts) > 0 {
+					jitter += (math.Abs(rtt-lastTransit) - jitter) / 16
+				}
+				lastTransit = rtt
+				rtts = append(rtts, rtt)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	log.Printf("Probing %s with %d-byte datagrams at %.0f/s for %s", *target, *size, *rate, *duration)
+	payload := make([]byte, *size)
+	copy(payload, UDPMagic)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	deadline := time.After(*duration)
+
+send:
+	for seq := uint64(0); ; seq++ {
+		binary.BigEndian.PutUint64(payload[4:12], seq)
+		binary.BigEndian.PutUint64(payload[12:20], uint64(time.Now().UnixNano()))
+		if _, err := conn.Write(payload); err == nil {
+			sent++
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			break send
+		case <-ctx.Done():
+			break send
+		}
+	}
+	ticker.Stop()
+
+	time.Sleep(*wait)
+	conn.SetReadDeadline(time.Now())
+	<-recvDone
+
+	mu.Lock()
+	defer mu.Unlock()
+	report := UDPProbeReport{
+		Target:   *target,
+		Sent:     sent,
+		Received: int64(len(rtts)),
+		JitterMs: meter.Round(jitter),
+	}
+	if sent > 0 {
+		report.LossPercent = meter.Round(float64(sent-report.Received) / float64(sent) * 100)
+	}
+	if len(rtts) > 0 {
+		lat := meter.Summarize(rtts)
+		report.AvgRTT = lat.Avg
+		report.P50RTT = lat.P50
+		report.P95RTT = lat.P95
+		report.P99RTT = lat.P99
+		report.MaxRTT = lat.Max
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	return 0
+}
@@ -1,595 +1,487 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"log"
-	"math"
-	"net/http"
-    "net"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
-	"os/exec"
-	"runtime"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
-	"syscall"
 	"time"
-)
-
-type Stats struct {
-	// Request metrics
-	Requests          int64   `json:"requests"`
-	Errors            int64   `json:"errors"`
-	RequestsPerSecond float64 `json:"requests_per_second"`
-	SuccessRate       float64 `json:"success_rate_percent"`
-
-	// Latency metrics
-	AvgLatency  float64 `json:"avg_latency_ms"`
-	P50Latency  float64 `json:"p50_latency_ms"`
-	P95Latency  float64 `json:"p95_latency_ms"`
-	P99Latency  float64 `json:"p99_latency_ms"`
-	P999Latency float64 `json:"p999_latency_ms"`
-	MinLatency  float64 `json:"min_latency_ms"`
-	MaxLatency  float64 `json:"max_latency_ms"`
-
-	// Resource usage
-	MemoryHeapMB    float64 `json:"memory_heap_mb"`
-	MemorySysMB     float64 `json:"memory_sys_mb"`
-	MemoryTotalMB   float64 `json:"memory_total_alloc_mb"`
-	Goroutines      int     `json:"goroutines"`
-	GCPauseMs       float64 `json:"gc_pause_ms"`
-	NumGC           uint32  `json:"num_gc"`
-
-	// Service health
-	UptimeSeconds int64 `json:"uptime_seconds"`
-
-	// Network/Proxy metrics
-	CurrentHopCount      int                `json:"current_hop_count"`     // Deprecated: use proxy_hop_count + service_mesh_hops
-	ProxyHopCount        int                `json:"proxy_hop_count"`       // Traditional proxy hops (nginx, X-Forwarded-For, Via)
-	ServiceMeshHops      int                `json:"service_mesh_hops"`     // Service mesh hops (Istio/Envoy headers)
-	TotalHopCount        int                `json:"total_hop_count"`       // proxy_hop_count + service_mesh_hops
-	AvgProxyHops         float64            `json:"avg_proxy_hops"`
-	ProxyDetected        bool               `json:"proxy_detected"`
-	IstioSidecar         bool               `json:"istio_sidecar_detected"`
-	WaypointProxyDetected bool              `json:"waypoint_proxy_detected"` // Ambient L7 waypoint proxy detected
-	ServiceMeshMode      string             `json:"service_mesh_mode"`      // none, ambient-l4, ambient-l7, sidecar
-	RequestsViaProxy     int64              `json:"requests_via_proxy"`
-	DebugHeaders         map[string]string  `json:"debug_headers,omitempty"`
-
-	// System information
-	Hostname         string  `json:"hostname"`
-	OS               string  `json:"os"`
-	Architecture     string  `json:"architecture"`
-	NumCPU           int     `json:"num_cpu"`
-	KernelVersion    string  `json:"kernel_version"`
-	TotalMemoryMB    float64 `json:"total_memory_mb"`
-	AvailableMemoryMB float64 `json:"available_memory_mb"`
-	TotalDiskGB      float64 `json:"total_disk_gb"`
-	AvailableDiskGB  float64 `json:"available_disk_gb"`
-	DiskUsagePercent float64 `json:"disk_usage_percent"`
-}
 
-var (
-	mu               sync.RWMutex
-	latencies        []float64
-	proxyHops        []int
-	requests         atomic.Int64
-	errors           atomic.Int64
-	requestsViaProxy atomic.Int64
-	startTime        time.Time
-
-    // Cached detection of Istio sidecar presence in the pod's network namespace
-    istioDetectMu      sync.RWMutex
-    istioPresentCached bool
-    istioLastChecked   time.Time
+	"github.com/nyan-lin-tun/PodMeter/loadgen"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+	"github.com/nyan-lin-tun/PodMeter/server"
+	"github.com/nyan-lin-tun/PodMeter/storage"
 )
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-
-	// Detect total proxy + service mesh hops from headers
-	hops := countTotalHops(r)
-
-	// Simulate some work
-	time.Sleep(20 * time.Millisecond)
-
-	lat := float64(time.Since(start).Milliseconds())
+// envOrDefault returns the value of the environment variable key, or def if it
+// is unset. An explicitly empty value is returned as-is so it can disable a feature.
+func envOrDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
 
-	requests.Add(1)
-	if hops > 0 {
-		requestsViaProxy.Add(1)
+// setLabelsFromEnv collects static labels from PODMETER_LABELS
+// ("team=payments,environment=prod") and from individual
+// PODMETER_LABEL_<NAME>=value variables, which take precedence.
+func setLabelsFromEnv() error {
+	labels, err := meter.ParseLabels(os.Getenv("PODMETER_LABELS"))
+	if err != nil {
+		return err
+	}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if name, ok := strings.CutPrefix(key, "PODMETER_LABEL_"); ok && name != "" {
+			labels[strings.ToLower(name)] = value
+		}
 	}
+	return meter.SetLabels(labels)
+}
 
-	mu.Lock()
-	latencies = append(latencies, lat)
-	proxyHops = append(proxyHops, hops)
-	if len(latencies) > 1000 {
-		latencies = latencies[1:]
-		proxyHops = proxyHops[1:]
+func main() {
+	// Static labels apply to the server and the client subcommands alike
+	if err := setLabelsFromEnv(); err != nil {
+		log.Fatalf("Invalid labels: %v", err)
+	}
+	if prefix := meter.LabelString(); prefix != "" {
+		log.SetPrefix(prefix + " ")
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
 	}
-	mu.Unlock()
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK\n"))
-}
+	// Keep the heap under the container's memory limit rather than be OOM
+	// killed: GOMEMLIMIT defaults to a share of it unless set explicitly
+	percent, err := strconv.Atoi(envOrDefault("PODMETER_MEMORY_LIMIT_PERCENT", "90"))
+	if err != nil || percent < 0 || percent > 100 {
+		log.Fatalf("Invalid PODMETER_MEMORY_LIMIT_PERCENT: want 0 to 100, got %q", os.Getenv("PODMETER_MEMORY_LIMIT_PERCENT"))
+	}
+	if ml := meter.TuneMemoryLimit(percent); ml.Source == "auto" {
+		log.Printf("Memory limit: GOMEMLIMIT set to %.0f MB, %d%% of the container's %.0f MB", ml.GoMemLimitMB, percent, ml.ContainerLimitMB)
+	}
 
-// countProxyHops counts traditional proxy hops (nginx, load balancers, etc.)
-func countProxyHops(r *http.Request) int {
-	hops := 0
-
-	// Check X-Forwarded-For header (counts IPs in chain)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Count commas + 1 for number of IPs
-		count := 1
-		for _, c := range xff {
-			if c == ',' {
-				count++
-			}
+	// Match GOMAXPROCS to the CPU quota so the process is not throttled
+	// for running more threads than it pays for
+	cpuTuning, err := strconv.ParseBool(envOrDefault("PODMETER_CPU_QUOTA_TUNING", "true"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_CPU_QUOTA_TUNING: %v", err)
+	}
+	if cpuTuning {
+		if cq := meter.TuneMaxProcs(); cq.Source == "auto" {
+			log.Printf("CPU quota: GOMAXPROCS set to %d for a quota of %g cores", cq.GOMAXPROCS, cq.QuotaCores)
 		}
-		hops += count
 	}
 
-	// Check Via header (standard proxy header)
-	if via := r.Header.Get("Via"); via != "" {
-		count := 1
-		for _, c := range via {
-			if c == ',' {
-				count++
-			}
+	// Subcommands run PodMeter as a client instead of a server. They name
+	// their zone to the target, from the resource or PODMETER_ZONE
+	if len(os.Args) > 1 {
+		meter.SetTopology("", os.Getenv("PODMETER_ZONE"), os.Getenv("PODMETER_REGION"))
+		switch os.Args[1] {
+		case "load":
+			os.Exit(loadgen.LoadCommand(os.Args[2:]))
+		case "udp-probe":
+			os.Exit(loadgen.UDPProbeCommand(os.Args[2:]))
+		case "bench":
+			os.Exit(loadgen.BenchCommand(os.Args[2:]))
+		case "lb-check":
+			os.Exit(loadgen.LBCheckCommand(os.Args[2:]))
 		}
-		hops += count
 	}
 
-	return hops
-}
-
-// countServiceMeshHops counts service mesh hops (Istio/Envoy/ztunnel)
-func countServiceMeshHops(r *http.Request) int {
-	hops := 0
-
-	// X-Request-Id is added by Envoy (both sidecar and ambient mode)
-	if r.Header.Get("X-Request-Id") != "" {
-		hops++
+	cfg := server.Config{
+		HTTPAddr: ":8080",
+		// Optional gRPC listener; set PODMETER_GRPC_ADDR="" to disable
+		GRPCAddr: envOrDefault("PODMETER_GRPC_ADDR", ":9090"),
+		// Optional UDP and raw TCP echo listeners, disabled unless set
+		UDPAddr: os.Getenv("PODMETER_UDP_ADDR"),
+		TCPAddr: os.Getenv("PODMETER_TCP_ADDR"),
+		// Optional HTTPS listener; without a certificate a self-signed one
+		// is generated
+		TLSAddr:     os.Getenv("PODMETER_TLS_ADDR"),
+		TLSCertFile: os.Getenv("PODMETER_TLS_CERT"),
+		TLSKeyFile:  os.Getenv("PODMETER_TLS_KEY"),
 	}
-
-	// Check Envoy-specific headers (Istio uses Envoy)
-	if r.Header.Get("X-Envoy-External-Address") != "" {
-		hops++
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		log.Fatalf("Invalid TLS configuration: set both PODMETER_TLS_CERT and PODMETER_TLS_KEY, or neither")
 	}
-	if r.Header.Get("X-Envoy-Decorator-Operation") != "" {
-		hops++
+	if v := os.Getenv("PODMETER_TLS_MIN_VERSION"); v != "" {
+		minVersion, err := server.ParseTLSVersion(v)
+		if err != nil {
+			log.Fatalf("Invalid PODMETER_TLS_MIN_VERSION: %v", err)
+		}
+		cfg.TLSMinVersion = minVersion
 	}
 
-	// Check for Istio-specific headers
-	if r.Header.Get("X-B3-TraceId") != "" {
-		// Istio uses B3 propagation for distributed tracing
-		hops++
-	}
-	if r.Header.Get("X-B3-SpanId") != "" {
-		hops++
+	// Optional checkpoint file (e.g. on an emptyDir or PVC) so restarts
+	// don't zero long-running measurements
+	if path := os.Getenv("PODMETER_CHECKPOINT_PATH"); path != "" {
+		interval, err := time.ParseDuration(envOrDefault("PODMETER_CHECKPOINT_INTERVAL", "30s"))
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid PODMETER_CHECKPOINT_INTERVAL: %v", err)
+		}
+		cfg.CheckpointPath = path
+		cfg.CheckpointInterval = interval
 	}
 
-	return hops
-}
+	// Diagnostic dumps (/debug/goroutines, /debug/heap, /debug/bundle) need
+	// this bearer token and are disabled without it
+	cfg.DebugToken = os.Getenv("PODMETER_DEBUG_TOKEN")
+
+	// The /admin API needs its own bearer token, and is disabled without it.
+	// Calls are optionally appended to an audit log file.
+	cfg.AdminToken = os.Getenv("PODMETER_ADMIN_TOKEN")
+	cfg.AuditLog = os.Getenv("PODMETER_AUDIT_LOG")
+
+	// The admin, debug and stats endpoints can each be restricted to, or
+	// refused to, client networks
+	for name, list := range map[string]*[]netip.Prefix{
+		"PODMETER_ADMIN_ALLOW": &cfg.AdminAllow,
+		"PODMETER_ADMIN_DENY":  &cfg.AdminDeny,
+		"PODMETER_DEBUG_ALLOW": &cfg.DebugAllow,
+		"PODMETER_DEBUG_DENY":  &cfg.DebugDeny,
+		"PODMETER_STATS_ALLOW": &cfg.StatsAllow,
+		"PODMETER_STATS_DENY":  &cfg.StatsDeny,
+	} {
+		nets, err := server.ParseAllowlist(os.Getenv(name))
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+		*list = nets
+	}
 
-// countTotalHops returns total proxy + service mesh hops (deprecated, use split counters)
-func countTotalHops(r *http.Request) int {
-	return countProxyHops(r) + countServiceMeshHops(r)
-}
+	// Graceful drain on SIGTERM and /admin/drain: how long readiness fails
+	// before the listeners close, and how long in-flight requests then get
+	drainDelay, err := time.ParseDuration(envOrDefault("PODMETER_DRAIN_DELAY", "5s"))
+	if err != nil || drainDelay < 0 {
+		log.Fatalf("Invalid PODMETER_DRAIN_DELAY: %v", err)
+	}
+	drainTimeout, err := time.ParseDuration(envOrDefault("PODMETER_DRAIN_TIMEOUT", "20s"))
+	if err != nil || drainTimeout <= 0 {
+		log.Fatalf("Invalid PODMETER_DRAIN_TIMEOUT: %v", err)
+	}
+	cfg.DrainDelay = drainDelay
+	cfg.DrainTimeout = drainTimeout
 
-// detectServiceMeshMode determines the service mesh configuration based on headers and sidecar presence
-// Returns the mode (sidecar, ambient-l7, ambient-l4, or none) and whether waypoint proxy is detected
-func detectServiceMeshMode(r *http.Request, sidecarPresent bool) (mode string, waypointDetected bool) {
-	// Check for L7 service mesh headers (Envoy/Istio)
-	hasL7Headers := false
-	if r.Header.Get("X-Request-Id") != "" {
-		hasL7Headers = true
+	// Optional simulated initialization behind /startupz
+	startupDelay, err := time.ParseDuration(envOrDefault("PODMETER_STARTUP_DELAY", "0s"))
+	if err != nil || startupDelay < 0 {
+		log.Fatalf("Invalid PODMETER_STARTUP_DELAY: %v", err)
+	}
+	startupJitter, err := time.ParseDuration(envOrDefault("PODMETER_STARTUP_JITTER", "0s"))
+	if err != nil || startupJitter < 0 {
+		log.Fatalf("Invalid PODMETER_STARTUP_JITTER: %v", err)
 	}
-	if r.Header.Get("X-Envoy-Decorator-Operation") != "" {
-		hasL7Headers = true
+	startupFail, err := strconv.ParseBool(envOrDefault("PODMETER_STARTUP_FAIL", "false"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_STARTUP_FAIL: %v", err)
 	}
-	if r.Header.Get("X-B3-TraceId") != "" {
-		hasL7Headers = true
+	cfg.StartupDelay = startupDelay
+	cfg.StartupJitter = startupJitter
+	cfg.StartupFail = startupFail
+
+	// Largest request body the workload accepts (default 10 MiB); larger
+	// ones get 413
+	if v := os.Getenv("PODMETER_MAX_REQUEST_BODY"); v != "" {
+		maxBody, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxBody <= 0 {
+			log.Fatalf("Invalid PODMETER_MAX_REQUEST_BODY %q: want a positive number of bytes", v)
+		}
+		cfg.MaxRequestBody = maxBody
 	}
 
-	// Determine mode based on sidecar presence and L7 headers
-	if sidecarPresent {
-		// Envoy sidecar is running in the pod (port 15000)
-		return "sidecar", false
-	} else if hasL7Headers {
-		// No sidecar but L7 headers present = waypoint proxy (ambient L7 mode)
-		return "ambient-l7", true
+	// Keep-alive on the HTTP listeners: how long an idle connection is kept
+	// (0, the default, until the client closes it), or off altogether
+	idleTimeout, err := time.ParseDuration(envOrDefault("PODMETER_IDLE_TIMEOUT", "0s"))
+	if err != nil || idleTimeout < 0 {
+		log.Fatalf("Invalid PODMETER_IDLE_TIMEOUT: %v", err)
 	}
+	keepAlive, err := strconv.ParseBool(envOrDefault("PODMETER_KEEP_ALIVE", "true"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_KEEP_ALIVE: %v", err)
+	}
+	cfg.IdleTimeout = idleTimeout
+	cfg.DisableKeepAlive = !keepAlive
 
-	// No sidecar and no L7 headers
-	// Note: ambient-l4 (ztunnel only) cannot be reliably detected from headers
-	// because ztunnel operates at L4 and doesn't add HTTP headers
-	return "none", false
-}
-
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	// Copy data under read lock to minimize critical section
-	mu.RLock()
-	latenciesCopy := make([]float64, len(latencies))
-	proxyHopsCopy := make([]int, len(proxyHops))
-	copy(latenciesCopy, latencies)
-	copy(proxyHopsCopy, proxyHops)
-	mu.RUnlock()
-
-	// Get current request counts
-	totalRequests := requests.Load()
-	totalErrors := errors.Load()
-	totalViaProxy := requestsViaProxy.Load()
-
-	// Calculate uptime
-	uptime := time.Since(startTime).Seconds()
-
-	// Get runtime memory stats
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-
-	// Detect proxy and service mesh hops from current request headers
-	proxyHops := countProxyHops(r)
-	meshHops := countServiceMeshHops(r)
-	totalHops := proxyHops + meshHops
-	currentHops := totalHops // For backwards compatibility
-	proxyDetected := totalHops > 0
-
-	// Collect debug headers to understand hop counting
-	debugHeaders := make(map[string]string)
-	headersToCheck := []string{"X-Forwarded-For", "Via", "X-Envoy-External-Address",
-		"X-Envoy-Decorator-Operation", "X-B3-TraceId", "X-B3-SpanId", "X-Request-Id", "X-Real-IP"}
-	for _, hdr := range headersToCheck {
-		if val := r.Header.Get(hdr); val != "" {
-			debugHeaders[hdr] = val
-		}
-	}
-
-	// Detect Istio sidecar presence. We combine two signals:
-	// 1) Request headers that Envoy/Istio often injects when traffic traverses the proxy
-	// 2) A pod-level probe of Envoy admin port on 127.0.0.1:15000 which indicates sidecar is present
-	istioHeaderSignal := hasIstioHeaders(r)
-	istioDetected := istioHeaderSignal || istioSidecarPresent()
-
-	// Detect service mesh mode (none, ambient-l4, ambient-l7, sidecar)
-	meshMode, waypointDetected := detectServiceMeshMode(r, istioSidecarPresent())
-
-	// Calculate average proxy hops
-	avgHops := 0.0
-	if len(proxyHopsCopy) > 0 {
-		totalHops := 0
-		for _, h := range proxyHopsCopy {
-			totalHops += h
-		}
-		avgHops = round(float64(totalHops) / float64(len(proxyHopsCopy)))
-	}
-
-	// Get system information
-	hostname, kernelVersion := getSystemInfo()
-	totalMemMB := getTotalMemoryMB()
-	availMemMB := getAvailableMemoryMB()
-	totalDiskGB, availDiskGB, diskUsagePercent := getDiskStats()
-
-	if len(latenciesCopy) == 0 {
-		stats := Stats{
-			Requests:          totalRequests,
-			Errors:            totalErrors,
-			RequestsPerSecond: round(float64(totalRequests) / uptime),
-			SuccessRate:       100.0,
-			MemoryHeapMB:      round(float64(memStats.Alloc) / 1024 / 1024),
-			MemorySysMB:       round(float64(memStats.Sys) / 1024 / 1024),
-			MemoryTotalMB:     round(float64(memStats.TotalAlloc) / 1024 / 1024),
-			Goroutines:        runtime.NumGoroutine(),
-			GCPauseMs:         round(float64(memStats.PauseNs[(memStats.NumGC+255)%256]) / 1e6),
-			NumGC:             memStats.NumGC,
-			UptimeSeconds:     int64(uptime),
-			CurrentHopCount:       currentHops,
-			ProxyHopCount:         proxyHops,
-			ServiceMeshHops:       meshHops,
-			TotalHopCount:         totalHops,
-			AvgProxyHops:          avgHops,
-			ProxyDetected:         proxyDetected,
-			IstioSidecar:          istioDetected,
-			WaypointProxyDetected: waypointDetected,
-			ServiceMeshMode:       meshMode,
-			RequestsViaProxy:      totalViaProxy,
-			DebugHeaders:          debugHeaders,
-			Hostname:              hostname,
-			OS:                runtime.GOOS,
-			Architecture:      runtime.GOARCH,
-			NumCPU:            runtime.NumCPU(),
-			KernelVersion:     kernelVersion,
-			TotalMemoryMB:     totalMemMB,
-			AvailableMemoryMB: availMemMB,
-			TotalDiskGB:       totalDiskGB,
-			AvailableDiskGB:   availDiskGB,
-			DiskUsagePercent:  diskUsagePercent,
-		}
-		if totalRequests > 0 {
-			stats.SuccessRate = round(float64(totalRequests-totalErrors) / float64(totalRequests) * 100)
-		}
-		json.NewEncoder(w).Encode(stats)
-		return
-	}
-
-	// Calculate latency statistics
-	sum := 0.0
-	minLat := latenciesCopy[0]
-	maxLat := latenciesCopy[0]
-
-	for _, l := range latenciesCopy {
-		sum += l
-		if l < minLat {
-			minLat = l
-		}
-		if l > maxLat {
-			maxLat = l
-		}
-	}
-
-	// Calculate percentiles
-	p50 := percentile(latenciesCopy, 0.50)
-	p95 := percentile(latenciesCopy, 0.95)
-	p99 := percentile(latenciesCopy, 0.99)
-	p999 := percentile(latenciesCopy, 0.999)
-
-	// Calculate success rate
-	successRate := 100.0
-	if totalRequests > 0 {
-		successRate = float64(totalRequests-totalErrors) / float64(totalRequests) * 100
-	}
-
-	stats := Stats{
-		// Request metrics
-		Requests:          totalRequests,
-		Errors:            totalErrors,
-		RequestsPerSecond: round(float64(totalRequests) / uptime),
-		SuccessRate:       round(successRate),
-
-		// Latency metrics
-		AvgLatency:  round(sum / float64(len(latenciesCopy))),
-		P50Latency:  round(p50),
-		P95Latency:  round(p95),
-		P99Latency:  round(p99),
-		P999Latency: round(p999),
-		MinLatency:  round(minLat),
-		MaxLatency:  round(maxLat),
-
-		// Resource usage
-		MemoryHeapMB:  round(float64(memStats.Alloc) / 1024 / 1024),
-		MemorySysMB:   round(float64(memStats.Sys) / 1024 / 1024),
-		MemoryTotalMB: round(float64(memStats.TotalAlloc) / 1024 / 1024),
-		Goroutines:    runtime.NumGoroutine(),
-		GCPauseMs:     round(float64(memStats.PauseNs[(memStats.NumGC+255)%256]) / 1e6),
-		NumGC:         memStats.NumGC,
-
-		// Service health
-		UptimeSeconds: int64(uptime),
-
-		// Network/Proxy metrics
-		CurrentHopCount:       currentHops,
-		ProxyHopCount:         proxyHops,
-		ServiceMeshHops:       meshHops,
-		TotalHopCount:         totalHops,
-		AvgProxyHops:          avgHops,
-		ProxyDetected:         proxyDetected,
-		IstioSidecar:          istioDetected,
-		WaypointProxyDetected: waypointDetected,
-		ServiceMeshMode:       meshMode,
-		RequestsViaProxy:      totalViaProxy,
-		DebugHeaders:          debugHeaders,
-
-		// System information
-		Hostname:          hostname,
-		OS:                runtime.GOOS,
-		Architecture:      runtime.GOARCH,
-		NumCPU:            runtime.NumCPU(),
-		KernelVersion:     kernelVersion,
-		TotalMemoryMB:     totalMemMB,
-		AvailableMemoryMB: availMemMB,
-		TotalDiskGB:       totalDiskGB,
-		AvailableDiskGB:   availDiskGB,
-		DiskUsagePercent:  diskUsagePercent,
-	}
-
-	json.NewEncoder(w).Encode(stats)
-}
+	// Server log level: debug, info (default), warn or error
+	if v := os.Getenv("PODMETER_LOG_LEVEL"); v != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			log.Fatalf("Invalid PODMETER_LOG_LEVEL: %v", err)
+		}
+	}
 
-func percentile(data []float64, p float64) float64 {
-	copyData := append([]float64{}, data...)
-	sort.Float64s(copyData)
+	// Goroutine leak detection; PODMETER_LEAK_CHECK_INTERVAL=0 disables it
+	leakInterval, err := time.ParseDuration(envOrDefault("PODMETER_LEAK_CHECK_INTERVAL", "10s"))
+	if err != nil || leakInterval < 0 {
+		log.Fatalf("Invalid PODMETER_LEAK_CHECK_INTERVAL: %v", err)
+	}
+	cfg.LeakCheckInterval = leakInterval
 
-	idx := int(math.Ceil(p*float64(len(copyData)))) - 1
-	return copyData[idx]
-}
+	// Capture of the slowest workload requests; PODMETER_SLOW_REQUESTS=0 disables it
+	cfg.SlowRequests, err = strconv.Atoi(envOrDefault("PODMETER_SLOW_REQUESTS", "20"))
+	if err != nil || cfg.SlowRequests < 0 {
+		log.Fatalf("Invalid PODMETER_SLOW_REQUESTS: want a non-negative integer, got %q", os.Getenv("PODMETER_SLOW_REQUESTS"))
+	}
+	cfg.SlowRequestsMaxAge, err = time.ParseDuration(envOrDefault("PODMETER_SLOW_REQUESTS_MAX_AGE", "15m"))
+	if err != nil || cfg.SlowRequestsMaxAge < 0 {
+		log.Fatalf("Invalid PODMETER_SLOW_REQUESTS_MAX_AGE: %v", err)
+	}
 
-func round(val float64) float64 {
-	return math.Round(val*100) / 100
-}
+	// CPU steal sampling; PODMETER_STEAL_CHECK_INTERVAL=0 disables it
+	cfg.StealCheckInterval, err = time.ParseDuration(envOrDefault("PODMETER_STEAL_CHECK_INTERVAL", "5s"))
+	if err != nil || cfg.StealCheckInterval < 0 {
+		log.Fatalf("Invalid PODMETER_STEAL_CHECK_INTERVAL: %v", err)
+	}
+	cfg.StealThreshold, err = strconv.ParseFloat(envOrDefault("PODMETER_STEAL_THRESHOLD_PERCENT", "10"), 64)
+	if err != nil || cfg.StealThreshold <= 0 || cfg.StealThreshold > 100 {
+		log.Fatalf("Invalid PODMETER_STEAL_THRESHOLD_PERCENT: want a percentage above 0, got %q", os.Getenv("PODMETER_STEAL_THRESHOLD_PERCENT"))
+	}
 
-// hasIstioHeaders checks common Istio/Envoy headers on the incoming request.
-// Note: These only appear if the request actually traversed the proxy.
-func hasIstioHeaders(r *http.Request) bool {
-    h := r.Header
-    if h.Get("X-B3-TraceId") != "" { // B3 tracing header used by Istio when tracing is enabled
-        return true
-    }
-    if h.Get("X-Envoy-Decorator-Operation") != "" { // Envoy route/operation decoration
-        return true
-    }
-    if h.Get("X-Request-Id") != "" { // Frequently added by Envoy
-        return true
-    }
-    if h.Get("X-Envoy-Attempt-Count") != "" || h.Get("X-Envoy-Internal") != "" {
-        return true
-    }
-    return false
-}
+	// Where stateful features persist: memory (default) or the embedded kv log
+	cfg.StorageBackend = envOrDefault("PODMETER_STORAGE", storage.BackendMemory)
+	cfg.StoragePath = os.Getenv("PODMETER_STORAGE_PATH")
 
-// istioSidecarPresent detects whether an Envoy sidecar is present in the pod.
-// It probes Envoy's admin port (127.0.0.1:15000). Result is cached and refreshed
-// at most every 30 seconds to avoid per-request overhead.
-func istioSidecarPresent() bool {
-    istioDetectMu.RLock()
-    recent := time.Since(istioLastChecked) < 30*time.Second
-    cached := istioPresentCached
-    istioDetectMu.RUnlock()
-
-    if recent {
-        return cached
-    }
-
-    present := probeEnvoyAdmin()
-
-    istioDetectMu.Lock()
-    istioPresentCached = present
-    istioLastChecked = time.Now()
-    istioDetectMu.Unlock()
-    return present
-}
+	// Optional snapshot history with SQL access on /admin/history/query
+	if v := os.Getenv("PODMETER_HISTORY_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid PODMETER_HISTORY_INTERVAL: %v", err)
+		}
+		retention, err := time.ParseDuration(envOrDefault("PODMETER_HISTORY_RETENTION", "24h"))
+		if err != nil || retention < 0 {
+			log.Fatalf("Invalid PODMETER_HISTORY_RETENTION: %v", err)
+		}
+		resolutions, err := server.ParseHistoryResolutions(os.Getenv("PODMETER_HISTORY_DOWNSAMPLE"))
+		if err != nil {
+			log.Fatalf("Invalid PODMETER_HISTORY_DOWNSAMPLE: %v", err)
+		}
+		cfg.HistoryInterval = interval
+		cfg.HistoryRetention = retention
+		cfg.HistoryResolutions = resolutions
+	}
 
-// probeEnvoyAdmin attempts a quick TCP connect to Envoy's admin port.
-// If the connection succeeds, we assume the Istio sidecar is running.
-func probeEnvoyAdmin() bool {
-    conn, err := net.DialTimeout("tcp", "127.0.0.1:15000", 50*time.Millisecond)
-    if err == nil {
-        _ = conn.Close()
-        return true
-    }
-    return false
-}
+	// Optional ICMP probes to a comma-separated list of hosts
+	for _, t := range strings.Split(os.Getenv("PODMETER_PING_TARGETS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.PingTargets = append(cfg.PingTargets, t)
+		}
+	}
+	if len(cfg.PingTargets) > 0 {
+		interval, err := time.ParseDuration(envOrDefault("PODMETER_PING_INTERVAL", "5s"))
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid PODMETER_PING_INTERVAL: %v", err)
+		}
+		cfg.PingInterval = interval
+	}
 
-// getSystemInfo collects system information
-func getSystemInfo() (hostname, kernelVersion string) {
-	// Get hostname
-	hostname, _ = os.Hostname()
-	if hostname == "" {
-		hostname = "unknown"
+	// Optional plaintext probes verifying that service ports enforce mTLS
+	for _, t := range strings.Split(os.Getenv("PODMETER_MTLS_PROBE_TARGETS"), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			log.Fatalf("Invalid PODMETER_MTLS_PROBE_TARGETS: %v", err)
+		}
+		cfg.MTLSProbeTargets = append(cfg.MTLSProbeTargets, t)
+	}
+	if len(cfg.MTLSProbeTargets) > 0 {
+		interval, err := time.ParseDuration(envOrDefault("PODMETER_MTLS_PROBE_INTERVAL", "30s"))
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid PODMETER_MTLS_PROBE_INTERVAL: %v", err)
+		}
+		cfg.MTLSProbeInterval = interval
 	}
 
-	// Get kernel version from uname -a
-	if cmd := exec.Command("uname", "-a"); cmd != nil {
-		if output, err := cmd.Output(); err == nil {
-			kernelVersion = strings.TrimSpace(string(output))
+	// Optional probes checking that requests leaving the pod, to a service
+	// and to a raw pod IP, are captured by its sidecar
+	for _, kind := range []string{server.InterceptionEcho, server.InterceptionPodIP} {
+		env := "PODMETER_INTERCEPTION_" + strings.ToUpper(kind)
+		if v := os.Getenv(env); v != "" {
+			t, err := server.ParseInterceptionTarget(kind, v)
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", env, err)
+			}
+			cfg.InterceptionTargets = append(cfg.InterceptionTargets, t)
 		}
 	}
+	if len(cfg.InterceptionTargets) > 0 {
+		interval, err := time.ParseDuration(envOrDefault("PODMETER_INTERCEPTION_INTERVAL", "60s"))
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid PODMETER_INTERCEPTION_INTERVAL: %v", err)
+		}
+		cfg.InterceptionInterval = interval
+	}
 
-	if kernelVersion == "" {
-		kernelVersion = "unknown"
+	// Optional scheduled synthetic transactions, from a JSON file
+	if path := os.Getenv("PODMETER_SYNTHETICS"); path != "" {
+		checks, err := server.LoadSyntheticChecks(path)
+		if err != nil {
+			log.Fatalf("Invalid PODMETER_SYNTHETICS: %v", err)
+		}
+		cfg.Synthetics = checks
 	}
 
-	return
-}
+	// The pod's annotations, from a downward API volume, for Multus network status
+	cfg.AnnotationsFile = envOrDefault("PODMETER_ANNOTATIONS_FILE", "/etc/podinfo/annotations")
 
-// getTotalMemoryMB reads total system memory from /proc/meminfo (Linux)
-func getTotalMemoryMB() float64 {
-	file, err := os.Open("/proc/meminfo")
+	// Where the pod runs: its zone and region, set directly, from the
+	// pod's labels in a downward API volume, or from its node's labels
+	cfg.Zone = os.Getenv("PODMETER_ZONE")
+	cfg.Region = os.Getenv("PODMETER_REGION")
+	cfg.LabelsFile = envOrDefault("PODMETER_LABELS_FILE", "/etc/podinfo/labels")
+	cfg.TopologyAPI, err = strconv.ParseBool(envOrDefault("PODMETER_TOPOLOGY_API", "false"))
 	if err != nil {
-		return 0
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "MemTotal:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				kb, err := strconv.ParseFloat(fields[1], 64)
-				if err == nil {
-					return round(kb / 1024) // Convert KB to MB
-				}
-			}
-		}
+		log.Fatalf("Invalid PODMETER_TOPOLOGY_API: %v", err)
 	}
-	return 0
-}
 
-// getAvailableMemoryMB reads available system memory from /proc/meminfo (Linux)
-func getAvailableMemoryMB() float64 {
-	file, err := os.Open("/proc/meminfo")
-	if err != nil {
-		return 0
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "MemAvailable:") {
-			fields := strings.Fields(line)
-			if len(fields) >= 2 {
-				kb, err := strconv.ParseFloat(fields[1], 64)
-				if err == nil {
-					return round(kb / 1024) // Convert KB to MB
-				}
+	// OpenTelemetry spans for workload and /stats requests, exported over
+	// OTLP/HTTP to the collector the standard OTEL_* variables name
+	cfg.Tracing.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); cfg.Tracing.Endpoint == "" && v != "" {
+		cfg.Tracing.Endpoint = strings.TrimSuffix(v, "/") + "/v1/traces"
+	}
+	if cfg.Tracing.Endpoint != "" {
+		for _, name := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+			if v := os.Getenv(name); v != "" && v != "http/protobuf" {
+				log.Fatalf("Invalid %s: only http/protobuf is supported, got %q", name, v)
 			}
 		}
+		if _, err := url.Parse(cfg.Tracing.Endpoint); err != nil {
+			log.Fatalf("Invalid OTLP traces endpoint: %v", err)
+		}
+		headers := envOrDefault("OTEL_EXPORTER_OTLP_TRACES_HEADERS", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		cfg.Tracing.Headers, err = server.ParseOTLPHeaders(headers)
+		if err != nil {
+			log.Fatalf("Invalid OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+		}
+	}
+	cfg.Tracing.SampleRatio, err = strconv.ParseFloat(envOrDefault("PODMETER_TRACE_SAMPLE_RATIO", "1"), 64)
+	if err != nil || cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		log.Fatalf("Invalid PODMETER_TRACE_SAMPLE_RATIO: want a ratio from 0 to 1, got %q", os.Getenv("PODMETER_TRACE_SAMPLE_RATIO"))
 	}
-	return 0
-}
 
-// getDiskStats gets filesystem statistics for the root partition
-func getDiskStats() (totalGB, availableGB, usagePercent float64) {
-	var stat syscall.Statfs_t
-	err := syscall.Statfs("/", &stat)
+	// Optional extra workload listeners: name=[protocol://]addr,...
+	cfg.Listeners, err = server.ParseListeners(os.Getenv("PODMETER_LISTENERS"))
 	if err != nil {
-		return 0, 0, 0
+		log.Fatalf("Invalid PODMETER_LISTENERS: %v", err)
 	}
 
-	// Calculate total and available space
-	totalBytes := stat.Blocks * uint64(stat.Bsize)
-	availBytes := stat.Bavail * uint64(stat.Bsize)
-
-	totalGB = round(float64(totalBytes) / 1024 / 1024 / 1024)
-	availableGB = round(float64(availBytes) / 1024 / 1024 / 1024)
-
-	if totalGB > 0 {
-		usagePercent = round((float64(totalBytes-availBytes) / float64(totalBytes)) * 100)
+	// Optional matrix for the reachability tester, run via /admin/reachability
+	reach, err := server.ParseReachabilityTargets(os.Getenv("PODMETER_REACHABILITY_TARGETS"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_REACHABILITY_TARGETS: %v", err)
 	}
+	cfg.ReachabilityTargets = reach
 
-	return
-}
+	// Optional per-route limits: /prefix=rps[:max_in_flight],...
+	cfg.RouteLimits, err = server.ParseRouteLimits(os.Getenv("PODMETER_ROUTE_LIMITS"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_ROUTE_LIMITS: %v", err)
+	}
 
-func debugHeadersHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	// Block and mutex profiling, off unless set; /admin/profile/rates
+	// changes them at runtime
+	for name, dst := range map[string]*int{
+		"PODMETER_BLOCK_PROFILE_RATE":     &cfg.ContentionRates.BlockRate,
+		"PODMETER_MUTEX_PROFILE_FRACTION": &cfg.ContentionRates.MutexFraction,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Fatalf("Invalid %s: want a non-negative integer, got %q", name, v)
+			}
+			*dst = n
+		}
+	}
 
-	headers := make(map[string][]string)
-	for name, values := range r.Header {
-		headers[name] = values
+	// Optional full request logs: one in N workload requests, plus those
+	// carrying a header
+	cfg.RequestLog.Every, err = server.ParseRequestLogSampling(os.Getenv("PODMETER_REQUEST_LOG_SAMPLING"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_REQUEST_LOG_SAMPLING: %v", err)
+	}
+	cfg.RequestLog.Header, cfg.RequestLog.Value, err = server.ParseRequestLogMatch(os.Getenv("PODMETER_REQUEST_LOG_MATCH"))
+	if err != nil {
+		log.Fatalf("Invalid PODMETER_REQUEST_LOG_MATCH: %v", err)
 	}
 
-	proxyHops := countProxyHops(r)
-	meshHops := countServiceMeshHops(r)
-	totalHops := proxyHops + meshHops
+	// Optional reverse-proxy mode: the workload is the application at this URL
+	if v := os.Getenv("PODMETER_UPSTREAM"); v != "" {
+		target, err := url.Parse(v)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			log.Fatalf("Invalid PODMETER_UPSTREAM %q: want an http:// or https:// URL", v)
+		}
+		cfg.Upstream = target
+	}
 
-	response := map[string]interface{}{
-		"headers":          headers,
-		"proxy_hop_count":  proxyHops,
-		"mesh_hop_count":   meshHops,
-		"total_hop_count":  totalHops,
-		"hop_count":        totalHops, // Deprecated: use split counters
-		"remote_addr":      r.RemoteAddr,
+	// Optional file-backed collectors: name=/path/to/metrics.json,...
+	for _, spec := range strings.Split(os.Getenv("PODMETER_COLLECT_FILES"), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(spec, "=")
+		if !ok {
+			log.Fatalf("Invalid PODMETER_COLLECT_FILES entry %q (want name=path)", spec)
+		}
+		if err := meter.RegisterCollector(meter.FileCollector(name, path)); err != nil {
+			log.Fatalf("PODMETER_COLLECT_FILES: %v", err)
+		}
+	}
+	if v := os.Getenv("PODMETER_COLLECTOR_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("Invalid PODMETER_COLLECTOR_TIMEOUT: %v", err)
+		}
+		meter.SetCollectorTimeout(timeout)
 	}
 
-	json.NewEncoder(w).Encode(response)
-}
+	// Sample window retention: by count and optionally by age
+	ret := meter.Retention{Size: meter.DefaultWindow}
+	if v := os.Getenv("PODMETER_WINDOW_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			log.Fatalf("Invalid PODMETER_WINDOW_SIZE %q: want a positive integer", v)
+		}
+		ret.Size = size
+	}
+	if v := os.Getenv("PODMETER_WINDOW_MAX_AGE"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil || maxAge < 0 {
+			log.Fatalf("Invalid PODMETER_WINDOW_MAX_AGE: %v", err)
+		}
+		ret.MaxAge = maxAge
+	}
+	meter.SetRetention(ret)
 
-func main() {
-	// Initialize start time for uptime tracking
-	startTime = time.Now()
+	// Optional go_runtime section with the full runtime/metrics catalogue
+	if v := os.Getenv("PODMETER_GO_RUNTIME_METRICS"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid PODMETER_GO_RUNTIME_METRICS: %v", err)
+		}
+		meter.SetGoRuntimeMetrics(enabled)
+	}
 
-	// Pre-allocate slices with capacity
-	latencies = make([]float64, 0, 1000)
-	proxyHops = make([]int, 0, 1000)
+	// Latency sampling for high-RPS deployments: all, 1/N or reservoir
+	if v := os.Getenv("PODMETER_LATENCY_SAMPLING"); v != "" {
+		policy, err := meter.ParseSampling(v)
+		if err != nil {
+			log.Fatalf("Invalid PODMETER_LATENCY_SAMPLING: %v", err)
+		}
+		meter.SetSampling(policy)
+	}
 
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/stats", statsHandler)
-	http.HandleFunc("/debug/headers", debugHeadersHandler)
+	// Optional derived metrics: "name = expression; ..."
+	if spec := os.Getenv("PODMETER_DERIVED_METRICS"); spec != "" {
+		defs, err := meter.ParseDerivedMetrics(spec)
+		if err != nil {
+			log.Fatalf("Invalid PODMETER_DERIVED_METRICS: %v", err)
+		}
+		meter.SetDerivedMetrics(defs)
+	}
 
-	log.Println("App running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := server.Run(cfg); err != nil {
+		log.Fatal(err)
+	}
 }
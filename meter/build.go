@@ -0,0 +1,70 @@
+package meter
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// Build metadata stamped at link time, for builds without VCS information
+// (such as the Docker image, whose context excludes .git):
+//
+//	go build -ldflags "-X github.com/nyan-lin-tun/PodMeter/meter.version=v1.4.0
+//	  -X github.com/nyan-lin-tun/PodMeter/meter.revision=$(git rev-parse HEAD)
+//	  -X github.com/nyan-lin-tun/PodMeter/meter.modified=false
+//	  -X github.com/nyan-lin-tun/PodMeter/meter.buildTime=$(date -u +%FT%TZ)"
+//
+// Set values take precedence over what debug.ReadBuildInfo reports.
+var (
+	version   string
+	revision  string
+	modified  string
+	buildTime string
+)
+
+// BuildInfo identifies the running binary, reported under the `build`
+// section so version skew across a fleet is visible.
+type BuildInfo struct {
+	Module    string `json:"module,omitempty" proto:"1"`
+	Version   string `json:"version" proto:"2"`
+	GoVersion string `json:"go_version" proto:"3"`
+	Revision  string `json:"vcs_revision,omitempty" proto:"4"`
+	Modified  bool   `json:"vcs_modified" proto:"5"`
+	VCSTime   string `json:"vcs_time,omitempty" proto:"6"`
+	BuildTime string `json:"build_time,omitempty" proto:"7"`
+}
+
+// Build returns the build metadata of the running binary. It describes the
+// main module, so a program embedding PodMeter reports its own version.
+var Build = sync.OnceValue(func() BuildInfo {
+	b := BuildInfo{Version: "unknown", GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		b.Module = bi.Main.Path
+		if bi.Main.Version != "" {
+			b.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				b.Revision = s.Value
+			case "vcs.modified":
+				b.Modified = s.Value == "true"
+			case "vcs.time":
+				b.VCSTime = s.Value
+			}
+		}
+	}
+
+	if version != "" {
+		b.Version = version
+	}
+	if revision != "" {
+		b.Revision = revision
+	}
+	if m, err := strconv.ParseBool(modified); err == nil {
+		b.Modified = m
+	}
+	b.BuildTime = buildTime
+	return b
+})
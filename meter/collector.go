@@ -0,0 +1,179 @@
+package meter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCollectorTimeout bounds a single Collect call unless changed with
+// SetCollectorTimeout.
+const DefaultCollectorTimeout = 2 * time.Second
+
+// Collector is a pluggable source of extra metrics. Each registered collector
+// is reported under `collectors.<Name>` in the stats snapshot; a failing
+// collector is reported under `collector_errors.<Name>` instead.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) (map[string]any, error)
+}
+
+// collectorFunc adapts a plain function to the Collector interface.
+type collectorFunc struct {
+	name string
+	fn   func(ctx context.Context) (map[string]any, error)
+}
+
+func (c collectorFunc) Name() string { return c.name }
+
+func (c collectorFunc) Collect(ctx context.Context) (map[string]any, error) {
+	return c.fn(ctx)
+}
+
+// NewCollector returns a Collector that calls fn, for app-specific gauges
+// that do not need a type of their own.
+func NewCollector(name string, fn func(ctx context.Context) (map[string]any, error)) Collector {
+	return collectorFunc{name: name, fn: fn}
+}
+
+// FileCollector returns a Collector that reads a JSON object from path on
+// every collection, so sidecars and scripts can publish gauges by writing a file.
+func FileCollector(name, path string) Collector {
+	return NewCollector(name, func(ctx context.Context) (map[string]any, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var out map[string]any
+		if err := json.Unmarshal(data, &out); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return out, nil
+	})
+}
+
+var (
+	collectorsMu     sync.RWMutex
+	collectors       []Collector
+	collectorTimeout = DefaultCollectorTimeout
+)
+
+// RegisterCollector adds c to the set run for every stats snapshot. Names must
+// be non-empty and unique. The collector can be switched off at runtime with
+// its CollectorFlag.
+func RegisterCollector(c Collector) error {
+	name := c.Name()
+	if name == "" {
+		return fmt.Errorf("collector name must not be empty")
+	}
+
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	for _, existing := range collectors {
+		if existing.Name() == name {
+			return fmt.Errorf("collector %q is already registered", name)
+		}
+	}
+	collectors = append(collectors, c)
+	DefineFlag(CollectorFlag(name), "Run the "+name+" collector", true)
+	return nil
+}
+
+// UnregisterCollector removes the collector with the given name, if any.
+func UnregisterCollector(name string) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	for i, c := range collectors {
+		if c.Name() == name {
+			collectors = append(collectors[:i:i], collectors[i+1:]...)
+			removeFlag(CollectorFlag(name))
+			return
+		}
+	}
+}
+
+// SetCollectorTimeout changes how long each collector may take per snapshot.
+func SetCollectorTimeout(d time.Duration) {
+	collectorsMu.Lock()
+	collectorTimeout = d
+	collectorsMu.Unlock()
+}
+
+// collectResult is one collector's outcome.
+type collectResult struct {
+	values map[string]any
+	err    error
+}
+
+// RunCollectors runs every enabled collector concurrently, each bounded by
+// the collector timeout, and returns their values and errors keyed by name.
+// A collector that overruns its timeout is reported as failed and left to
+// finish in the background; a panicking collector is reported as failed.
+func RunCollectors(ctx context.Context) (values map[string]map[string]any, errs map[string]string) {
+	collectorsMu.RLock()
+	var active []Collector
+	for _, c := range collectors {
+		if FlagEnabled(CollectorFlag(c.Name())) {
+			active = append(active, c)
+		}
+	}
+	timeout := collectorTimeout
+	collectorsMu.RUnlock()
+
+	if len(active) == 0 {
+		return nil, nil
+	}
+
+	results := make([]collectResult, len(active))
+	var wg sync.WaitGroup
+	for i, c := range active {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCollector(ctx, c, timeout)
+		}()
+	}
+	wg.Wait()
+
+	for i, c := range active {
+		if err := results[i].err; err != nil {
+			if errs == nil {
+				errs = make(map[string]string)
+			}
+			errs[c.Name()] = err.Error()
+			continue
+		}
+		if values == nil {
+			values = make(map[string]map[string]any)
+		}
+		values[c.Name()] = results[i].values
+	}
+	return values, errs
+}
+
+// runCollector calls c.Collect with a deadline and stops waiting once it passes.
+func runCollector(ctx context.Context, c Collector, timeout time.Duration) collectResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan collectResult, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- collectResult{err: fmt.Errorf("collector panicked: %v", p)}
+			}
+		}()
+		values, err := c.Collect(ctx)
+		done <- collectResult{values: values, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res
+	case <-ctx.Done():
+		return collectResult{err: fmt.Errorf("timed out after %s", timeout)}
+	}
+}
@@ -0,0 +1,160 @@
+package meter
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DeltaBounds are the upper bounds, in ms, of the buckets of delta
+// histograms. A final bucket counts everything above the last bound.
+var DeltaBounds = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const (
+	// maxDeltaConsumers bounds how many consumers can hold delta windows
+	maxDeltaConsumers = 16
+	// deltaConsumerTTL forgets consumers that stop collecting
+	deltaConsumerTTL = 10 * time.Minute
+)
+
+// ErrTooManyConsumers is returned by Collect when maxDeltaConsumers
+// consumers already hold delta windows.
+var ErrTooManyConsumers = errors.New("too many delta consumers")
+
+// Delta is what a Meter recorded between two collections by one consumer,
+// in the layout of an OTLP explicit-bucket histogram with delta temporality.
+type Delta struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Requests     int64     `json:"requests"`
+	Errors       int64     `json:"errors"`
+	Count        int64     `json:"count"` // Requests with a latency sample
+	SumMs        float64   `json:"sum_ms"`
+	MinMs        float64   `json:"min_ms"`
+	MaxMs        float64   `json:"max_ms"`
+	BoundsMs     []float64 `json:"bounds_ms"`
+	BucketCounts []int64   `json:"bucket_counts"` // len(BoundsMs)+1, not cumulative
+}
+
+// deltas holds one open window per consumer. Each consumer's window is
+// rotated only when that consumer collects, so several exporters reading
+// the same Meter each see every request exactly once.
+type deltas struct {
+	mu        sync.Mutex
+	consumers map[string]*deltaWindow
+}
+
+type deltaWindow struct {
+	Delta
+	lastCollect time.Time
+}
+
+func newDeltaWindow(now time.Time) *deltaWindow {
+	return &deltaWindow{
+		Delta: Delta{
+			Start:        now,
+			BoundsMs:     DeltaBounds,
+			BucketCounts: make([]int64, len(DeltaBounds)+1),
+		},
+		lastCollect: now,
+	}
+}
+
+// add records one request in every open window; latencyMs is ignored
+// unless sampled.
+func (d *deltas) add(ok bool, latencyMs float64, sampled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.consumers) == 0 {
+		return
+	}
+	bucket := 0
+	if sampled {
+		bucket, _ = slices.BinarySearch(DeltaBounds, latencyMs)
+	}
+	for _, w := range d.consumers {
+		w.Requests++
+		if !ok {
+			w.Errors++
+		}
+		if !sampled {
+			continue
+		}
+		if w.Count == 0 || latencyMs < w.MinMs {
+			w.MinMs = latencyMs
+		}
+		if latencyMs > w.MaxMs {
+			w.MaxMs = latencyMs
+		}
+		w.Count++
+		w.SumMs += latencyMs
+		w.BucketCounts[bucket]++
+	}
+}
+
+// collect closes consumer's window and opens the next one. A consumer's
+// first collection only opens its window, so it returns an empty Delta
+// starting now.
+func (d *deltas) collect(consumer string) (Delta, error) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.consumers == nil {
+		d.consumers = make(map[string]*deltaWindow)
+	}
+	for name, w := range d.consumers {
+		if now.Sub(w.lastCollect) > deltaConsumerTTL {
+			delete(d.consumers, name)
+		}
+	}
+
+	w, ok := d.consumers[consumer]
+	if !ok {
+		if len(d.consumers) >= maxDeltaConsumers {
+			return Delta{}, ErrTooManyConsumers
+		}
+		w = newDeltaWindow(now)
+	}
+	d.consumers[consumer] = newDeltaWindow(now)
+
+	out := w.Delta
+	out.End = now
+	out.SumMs = roundMicros(out.SumMs)
+	return out, nil
+}
+
+// CollectDelta returns what m recorded since consumer last collected, and
+// starts consumer's next window. Consumers are independent: one collecting
+// does not affect what another sees. A consumer that stops collecting is
+// forgotten after 10 minutes.
+func (m *Meter) CollectDelta(consumer string) (Delta, error) {
+	return m.deltas.collect(consumer)
+}
+
+// Quantile estimates the q-th quantile (0 to 1) of the latencies in d, in
+// ms, interpolating linearly within the bucket it falls in. The open ends of
+// the first and last buckets are taken from MinMs and MaxMs. It returns 0
+// for an empty histogram.
+func (d Delta) Quantile(q float64) float64 {
+	if d.Count == 0 || len(d.BucketCounts) != len(d.BoundsMs)+1 {
+		return 0
+	}
+	rank := q * float64(d.Count)
+	var seen int64
+	for i, n := range d.BucketCounts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower, upper := d.MinMs, d.MaxMs
+		if i > 0 {
+			lower = max(lower, d.BoundsMs[i-1])
+		}
+		if i < len(d.BoundsMs) {
+			upper = min(upper, d.BoundsMs[i])
+		}
+		return Round(lower + (upper-lower)*(rank-float64(seen))/float64(n))
+	}
+	return Round(d.MaxMs)
+}
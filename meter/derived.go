@@ -0,0 +1,397 @@
+package meter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DerivedMetric is a named expression computed from other stats fields, e.g.
+// `headroom = available_memory_mb / total_memory_mb * 100`.
+//
+// Expressions support numbers, + - * / %, parentheses, unary minus, the
+// functions min, max and abs, and field references by their JSON name.
+// Nested fields use dots (`grpc.p99_latency_ms`, `collectors.app.depth`);
+// booleans read as 1 or 0.
+type DerivedMetric struct {
+	Name string
+	Expr string
+	eval evalFunc
+}
+
+// evalFunc evaluates a parsed expression against the flattened stats.
+type evalFunc func(fields map[string]any) (float64, error)
+
+var (
+	derivedMu sync.RWMutex
+	derived   []DerivedMetric
+)
+
+// ParseDerivedMetrics parses definitions of the form `name = expr`, separated
+// by semicolons or newlines.
+func ParseDerivedMetrics(spec string) ([]DerivedMetric, error) {
+	var out []DerivedMetric
+	seen := make(map[string]bool)
+	for _, def := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+		name, expr, ok := strings.Cut(def, "=")
+		if !ok {
+			return nil, fmt.Errorf("derived metric %q: want name = expression", strings.TrimSpace(def))
+		}
+		m, err := NewDerivedMetric(strings.TrimSpace(name), strings.TrimSpace(expr))
+		if err != nil {
+			return nil, err
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("derived metric %q is defined twice", m.Name)
+		}
+		seen[m.Name] = true
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// NewDerivedMetric parses a single expression. Names must be valid metric
+// names (letters, digits and underscores, not starting with a digit).
+func NewDerivedMetric(name, expr string) (DerivedMetric, error) {
+	if !validMetricName(name) {
+		return DerivedMetric{}, fmt.Errorf("derived metric name %q must match [a-zA-Z_][a-zA-Z0-9_]*", name)
+	}
+	p := &exprParser{src: expr}
+	eval, err := p.parse()
+	if err != nil {
+		return DerivedMetric{}, fmt.Errorf("derived metric %q: %w", name, err)
+	}
+	return DerivedMetric{Name: name, Expr: expr, eval: eval}, nil
+}
+
+// SetDerivedMetrics replaces the set of derived metrics computed for every
+// stats snapshot.
+func SetDerivedMetrics(defs []DerivedMetric) {
+	derivedMu.Lock()
+	derived = append([]DerivedMetric(nil), defs...)
+	derivedMu.Unlock()
+}
+
+// DerivedMetrics returns the configured derived metrics.
+func DerivedMetrics() []DerivedMetric {
+	derivedMu.RLock()
+	defer derivedMu.RUnlock()
+	return append([]DerivedMetric(nil), derived...)
+}
+
+// SetDerived evaluates the configured derived metrics against s and stores
+// the results in s.Derived, or the reason in s.DerivedErrors. It should run
+// last, once every other field is filled in.
+func (s *Stats) SetDerived() {
+	defs := DerivedMetrics()
+	if len(defs) == 0 {
+		return
+	}
+
+	// Go through JSON so expressions use exactly the names /stats shows
+	s.Derived, s.DerivedErrors = nil, nil
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+
+	for _, d := range defs {
+		v, err := d.eval(fields)
+		if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			err = fmt.Errorf("result is not a finite number")
+		}
+		if err != nil {
+			if s.DerivedErrors == nil {
+				s.DerivedErrors = make(map[string]string)
+			}
+			s.DerivedErrors[d.Name] = err.Error()
+			continue
+		}
+		if s.Derived == nil {
+			s.Derived = make(map[string]float64)
+		}
+		s.Derived[d.Name] = Round(v)
+		// Later definitions may refer to earlier ones as derived.<name>
+		if dm, ok := fields["derived"].(map[string]any); ok {
+			dm[d.Name] = v
+		} else {
+			fields["derived"] = map[string]any{d.Name: v}
+		}
+	}
+}
+
+func validMetricName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c == '.' || !isIdentByte(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField resolves a dotted JSON path to a number.
+func lookupField(fields map[string]any, path string) (float64, error) {
+	var cur any = fields
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("unknown field %q", path)
+		}
+		if cur, ok = m[part]; !ok {
+			return 0, fmt.Errorf("unknown field %q", path)
+		}
+	}
+	switch v := cur.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("field %q is not numeric", path)
+	}
+}
+
+// exprParser is a recursive-descent parser producing closures:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | primary
+//	primary = number | field | func "(" expr { "," expr } ")" | "(" expr ")"
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) parse() (evalFunc, error) {
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// accept consumes c if it is the next non-space character.
+func (p *exprParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expr() (evalFunc, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('+'):
+			op = '+'
+		case p.accept('-'):
+			op = '-'
+		default:
+			return left, nil
+		}
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+}
+
+func (p *exprParser) term() (evalFunc, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('*'):
+			op = '*'
+		case p.accept('/'):
+			op = '/'
+		case p.accept('%'):
+			op = '%'
+		default:
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+}
+
+func (p *exprParser) unary() (evalFunc, error) {
+	if p.accept('-') {
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f map[string]any) (float64, error) {
+			v, err := inner(f)
+			return -v, err
+		}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (evalFunc, error) {
+	if p.accept('(') {
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("missing ')' at offset %d", p.pos)
+		}
+		return inner, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && isIdentByte(p.src[p.pos]) {
+		p.pos++
+	}
+	tok := p.src[start:p.pos]
+	if tok == "" {
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos], p.pos)
+	}
+
+	if tok[0] >= '0' && tok[0] <= '9' || tok[0] == '.' {
+		n, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		return func(map[string]any) (float64, error) { return n, nil }, nil
+	}
+
+	if p.accept('(') {
+		return p.call(tok)
+	}
+	return func(f map[string]any) (float64, error) { return lookupField(f, tok) }, nil
+}
+
+// call parses the argument list of a function call after its '('.
+func (p *exprParser) call(name string) (evalFunc, error) {
+	var args []evalFunc
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(')') {
+			break
+		}
+		if !p.accept(',') {
+			return nil, fmt.Errorf("expected ',' or ')' in call to %s", name)
+		}
+	}
+
+	var fn func(vals []float64) float64
+	switch name {
+	case "min":
+		fn = func(vals []float64) float64 { return foldFloat(vals, math.Min) }
+	case "max":
+		fn = func(vals []float64) float64 { return foldFloat(vals, math.Max) }
+	case "abs":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("abs takes exactly one argument")
+		}
+		fn = func(vals []float64) float64 { return math.Abs(vals[0]) }
+	default:
+		return nil, fmt.Errorf("unknown function %q (use min, max or abs)", name)
+	}
+
+	return func(f map[string]any) (float64, error) {
+		vals := make([]float64, len(args))
+		for i, a := range args {
+			v, err := a(f)
+			if err != nil {
+				return 0, err
+			}
+			vals[i] = v
+		}
+		return fn(vals), nil
+	}, nil
+}
+
+func binaryOp(op byte, left, right evalFunc) evalFunc {
+	return func(f map[string]any) (float64, error) {
+		a, err := left(f)
+		if err != nil {
+			return 0, err
+		}
+		b, err := right(f)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '+':
+			return a + b, nil
+		case '-':
+			return a - b, nil
+		case '*':
+			return a * b, nil
+		case '/':
+			if b == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return a / b, nil
+		default:
+			if b == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return math.Mod(a, b), nil
+		}
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// foldFloat reduces a non-empty list with fn.
+func foldFloat(vals []float64, fn func(a, b float64) float64) float64 {
+	acc := vals[0]
+	for _, v := range vals[1:] {
+		acc = fn(acc, v)
+	}
+	return acc
+}
@@ -0,0 +1,164 @@
+package meter
+
+import (
+	"errors"
+	"math"
+)
+
+// DigestAccuracy is the relative accuracy of the digests PodMeter serves: a
+// quantile read from one is within 1% of the true value.
+const DigestAccuracy = 0.01
+
+// digestMinValue is the smallest latency, in ms, a digest tells apart from
+// zero; anything at or below it counts in ZeroCount.
+const digestMinValue = 1e-3
+
+// ErrDigestMismatch is returned by MergeDigests for digests of different
+// accuracies, whose buckets do not line up, or of an accuracy outside (0, 1).
+var ErrDigestMismatch = errors.New("digests have different or invalid relative accuracies")
+
+// Digest is a mergeable latency distribution in the layout of a DDSketch:
+// bucket i counts values in (gamma^(i-1), gamma^i] ms, where gamma is
+// (1+a)/(1-a) for relative accuracy a. Counts holds buckets Offset onwards.
+// Digests of the same accuracy from any number of pods merge exactly, by
+// adding their buckets, so quantiles of the merged digest are true
+// cluster-wide quantiles rather than averages of per-pod ones.
+type Digest struct {
+	RelativeAccuracy float64 `json:"relative_accuracy"`
+	Count            int64   `json:"count"`
+	SumMs            float64 `json:"sum_ms"`
+	MinMs            float64 `json:"min_ms"`
+	MaxMs            float64 `json:"max_ms"`
+	ZeroCount        int64   `json:"zero_count"`
+	Offset           int     `json:"offset"`
+	Counts           []int64 `json:"counts"`
+}
+
+// NewDigest returns an empty digest with DigestAccuracy.
+func NewDigest() *Digest {
+	return &Digest{RelativeAccuracy: DigestAccuracy, Counts: []int64{}}
+}
+
+// DigestOf returns a digest of latencies, in ms.
+func DigestOf(latencies []float64) *Digest {
+	d := NewDigest()
+	for _, v := range latencies {
+		d.Add(v)
+	}
+	return d
+}
+
+func (d *Digest) gamma() float64 {
+	return (1 + d.RelativeAccuracy) / (1 - d.RelativeAccuracy)
+}
+
+// Add records one latency, in ms.
+func (d *Digest) Add(ms float64) {
+	if d.Count == 0 || ms < d.MinMs {
+		d.MinMs = ms
+	}
+	if d.Count == 0 || ms > d.MaxMs {
+		d.MaxMs = ms
+	}
+	d.Count++
+	d.SumMs += ms
+	if ms <= digestMinValue {
+		d.ZeroCount++
+		return
+	}
+	d.addBucket(int(math.Ceil(math.Log(ms)/math.Log(d.gamma()))), 1)
+}
+
+// addBucket adds n to bucket i, growing Counts to reach it.
+func (d *Digest) addBucket(i int, n int64) {
+	if len(d.Counts) == 0 {
+		d.Offset = i
+	}
+	if i < d.Offset {
+		d.Counts = append(make([]int64, d.Offset-i), d.Counts...)
+		d.Offset = i
+	}
+	if j := i - d.Offset; j >= len(d.Counts) {
+		d.Counts = append(d.Counts, make([]int64, j-len(d.Counts)+1)...)
+	}
+	d.Counts[i-d.Offset] += n
+}
+
+// Quantile returns the q-th quantile (0 to 1) of the digest, in ms, or 0 if
+// it is empty.
+func (d *Digest) Quantile(q float64) float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return d.MinMs
+	}
+	if q >= 1 {
+		return d.MaxMs
+	}
+	// The same rank Percentile picks from raw samples
+	rank := int64(math.Ceil(q*float64(d.Count))) - 1
+	if rank < d.ZeroCount {
+		return 0
+	}
+	seen := d.ZeroCount
+	gamma := d.gamma()
+	for j, n := range d.Counts {
+		seen += n
+		if seen > rank {
+			// The bucket's midpoint, in relative terms, is within the
+			// accuracy of every value in it
+			v := 2 * math.Pow(gamma, float64(d.Offset+j)) / (1 + gamma)
+			return Round(min(max(v, d.MinMs), d.MaxMs))
+		}
+	}
+	return d.MaxMs
+}
+
+// Summary summarizes the digest like Summarize does raw samples.
+func (d *Digest) Summary() Summary {
+	if d.Count == 0 {
+		return Summary{}
+	}
+	return Summary{
+		Avg:  Round(d.SumMs / float64(d.Count)),
+		P50:  d.Quantile(0.50),
+		P95:  d.Quantile(0.95),
+		P99:  d.Quantile(0.99),
+		P999: d.Quantile(0.999),
+		Min:  Round(d.MinMs),
+		Max:  Round(d.MaxMs),
+	}
+}
+
+// MergeDigests adds digests together, e.g. those of every pod behind a
+// Service read from /stats/digest. They must share one relative accuracy.
+func MergeDigests(digests ...*Digest) (*Digest, error) {
+	out := NewDigest()
+	for i, d := range digests {
+		if i == 0 {
+			out.RelativeAccuracy = d.RelativeAccuracy
+		}
+		if d.RelativeAccuracy != out.RelativeAccuracy || d.RelativeAccuracy <= 0 || d.RelativeAccuracy >= 1 {
+			return nil, ErrDigestMismatch
+		}
+		if d.Count == 0 {
+			continue
+		}
+		if out.Count == 0 || d.MinMs < out.MinMs {
+			out.MinMs = d.MinMs
+		}
+		if out.Count == 0 || d.MaxMs > out.MaxMs {
+			out.MaxMs = d.MaxMs
+		}
+		out.Count += d.Count
+		out.SumMs += d.SumMs
+		out.ZeroCount += d.ZeroCount
+		for j, n := range d.Counts {
+			if n > 0 {
+				out.addBucket(d.Offset+j, n)
+			}
+		}
+	}
+	return out, nil
+}
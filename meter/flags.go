@@ -0,0 +1,102 @@
+package meter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Flags owned by this package. Each registered collector also gets a flag,
+// CollectorFlag(name).
+const (
+	FlagGoRuntime = "go_runtime" // go_runtime section in snapshots
+)
+
+// Flag is the state of one feature flag.
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+}
+
+// flag is a defined flag; enabled is read on hot paths without flagsMu.
+type flag struct {
+	description string
+	def         bool
+	enabled     atomic.Bool
+}
+
+var (
+	flagsMu sync.RWMutex
+	flags   = make(map[string]*flag)
+)
+
+func init() {
+	DefineFlag(FlagGoRuntime, "Add the full runtime/metrics catalogue to snapshots", false)
+}
+
+// DefineFlag makes a feature flag that optional subsystems check at runtime,
+// so they can be switched on and off without a restart. Defining a flag that
+// already exists keeps its current state.
+func DefineFlag(name, description string, enabled bool) {
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	if _, ok := flags[name]; ok {
+		return
+	}
+	f := &flag{description: description, def: enabled}
+	f.enabled.Store(enabled)
+	flags[name] = f
+}
+
+// FlagEnabled reports whether the named flag is on. Flags that were never
+// defined read as off.
+func FlagEnabled(name string) bool {
+	flagsMu.RLock()
+	f := flags[name]
+	flagsMu.RUnlock()
+	return f != nil && f.enabled.Load()
+}
+
+// SetFlag turns a defined flag on or off.
+func SetFlag(name string, enabled bool) error {
+	flagsMu.RLock()
+	f := flags[name]
+	flagsMu.RUnlock()
+	if f == nil {
+		return fmt.Errorf("unknown flag %q", name)
+	}
+	f.enabled.Store(enabled)
+	return nil
+}
+
+// Flags returns every defined flag, sorted by name.
+func Flags() []Flag {
+	flagsMu.RLock()
+	defer flagsMu.RUnlock()
+	out := make([]Flag, 0, len(flags))
+	for name, f := range flags {
+		out = append(out, Flag{
+			Name:        name,
+			Description: f.description,
+			Enabled:     f.enabled.Load(),
+			Default:     f.def,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// removeFlag drops a flag whose subsystem is gone.
+func removeFlag(name string) {
+	flagsMu.Lock()
+	delete(flags, name)
+	flagsMu.Unlock()
+}
+
+// CollectorFlag returns the name of the flag controlling a collector.
+func CollectorFlag(collector string) string {
+	return "collector." + collector
+}
@@ -0,0 +1,96 @@
+package meter
+
+import (
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// gcPauseBuckets are the upper bounds, in ms, of the GC pause histogram.
+var gcPauseBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 50, 100}
+
+// GCStats details garbage collector impact, reported under the `gc` section.
+// Pause figures cover the most recent pauses the runtime keeps (up to 256).
+type GCStats struct {
+	NumGC          uint32          `json:"num_gc" proto:"1"`
+	NumForcedGC    uint32          `json:"num_forced_gc" proto:"2"`
+	LastPauseMs    float64         `json:"last_pause_ms" proto:"3"`
+	P50PauseMs     float64         `json:"p50_pause_ms" proto:"4"`
+	P99PauseMs     float64         `json:"p99_pause_ms" proto:"5"`
+	MaxPauseMs     float64         `json:"max_pause_ms" proto:"6"`
+	TotalPauseMs   float64         `json:"total_pause_ms" proto:"7"` // Since process start
+	PauseHistogram []GCPauseBucket `json:"pause_histogram" proto:"8"`
+	CPUPercent     float64         `json:"cpu_percent" proto:"9"`            // Estimated share of CPU spent in GC since process start
+	AllocRateMBps  float64         `json:"alloc_rate_mb_per_sec" proto:"10"` // Since the previous snapshot
+	HeapLiveMB     float64         `json:"heap_live_mb" proto:"11"`
+	NextGCMB       float64         `json:"next_gc_mb" proto:"12"` // Heap size that triggers the next cycle
+	LastGCAgoSec   float64         `json:"last_gc_seconds_ago" proto:"13"`
+}
+
+// GCPauseBucket counts recent GC pauses up to LeMs (inclusive); the last
+// bucket has LeMs -1 and holds everything longer.
+type GCPauseBucket struct {
+	LeMs  float64 `json:"le_ms" proto:"1"`
+	Count int     `json:"count" proto:"2"`
+}
+
+var (
+	allocMu    sync.Mutex
+	allocPrev  uint64
+	allocPrevT = time.Now()
+)
+
+// newGCStats derives GCStats from a runtime/metrics read and the recent
+// pause history.
+func newGCStats(rt runtimeValues, gc *debug.GCStats) GCStats {
+	g := GCStats{
+		NumGC:        uint32(gc.NumGC),
+		NumForcedGC:  uint32(rt[rtForcedGC]),
+		TotalPauseMs: Round(float64(gc.PauseTotal) / 1e6),
+		HeapLiveMB:   Round(rt[rtHeapObjects] / 1024 / 1024),
+		NextGCMB:     Round(rt[rtHeapGoal] / 1024 / 1024),
+	}
+	if total := rt[rtCPUTotal]; total > 0 {
+		g.CPUPercent = Round(rt[rtCPUGC] / total * 100)
+	}
+	if !gc.LastGC.IsZero() {
+		g.LastGCAgoSec = Round(time.Since(gc.LastGC).Seconds())
+	}
+
+	// gc.Pause holds the most recent pauses, newest first
+	pauses := make([]float64, len(gc.Pause))
+	for i, p := range gc.Pause {
+		pauses[i] = float64(p) / 1e6
+	}
+	g.PauseHistogram = pauseHistogram(pauses)
+	if n := len(pauses); n > 0 {
+		g.LastPauseMs = Round(pauses[0])
+		sort.Float64s(pauses)
+		g.P50PauseMs = Round(Percentile(pauses, 0.50))
+		g.P99PauseMs = Round(Percentile(pauses, 0.99))
+		g.MaxPauseMs = Round(pauses[n-1])
+	}
+
+	allocs := uint64(rt[rtHeapAllocs])
+	allocMu.Lock()
+	now := time.Now()
+	if elapsed := now.Sub(allocPrevT).Seconds(); elapsed > 0 && allocs >= allocPrev {
+		g.AllocRateMBps = Round(float64(allocs-allocPrev) / 1024 / 1024 / elapsed)
+	}
+	allocPrev, allocPrevT = allocs, now
+	allocMu.Unlock()
+	return g
+}
+
+func pauseHistogram(pauses []float64) []GCPauseBucket {
+	hist := make([]GCPauseBucket, len(gcPauseBuckets)+1)
+	for i, le := range gcPauseBuckets {
+		hist[i].LeMs = le
+	}
+	hist[len(gcPauseBuckets)].LeMs = -1
+	for _, p := range pauses {
+		hist[sort.SearchFloat64s(gcPauseBuckets, p)].Count++
+	}
+	return hist
+}
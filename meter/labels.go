@@ -0,0 +1,78 @@
+package meter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	labelsMu sync.RWMutex
+	labels   map[string]string
+)
+
+// ParseLabels parses a comma-separated `name=value` list such as
+// `team=payments,environment=prod`.
+func ParseLabels(spec string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q: want name=value", pair)
+		}
+		out[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return out, nil
+}
+
+// SetLabels replaces the static labels attached to every stats snapshot and
+// exported metric. Names must be valid metric label names.
+func SetLabels(l map[string]string) error {
+	cp := make(map[string]string, len(l))
+	for name, value := range l {
+		if !validMetricName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("label name %q must match [a-zA-Z_][a-zA-Z0-9_]* and not start with __", name)
+		}
+		cp[name] = value
+	}
+
+	labelsMu.Lock()
+	labels = cp
+	labelsMu.Unlock()
+	return nil
+}
+
+// Labels returns a copy of the static labels, or nil if none are set.
+func Labels() map[string]string {
+	labelsMu.RLock()
+	defer labelsMu.RUnlock()
+	if len(labels) == 0 {
+		return nil
+	}
+	cp := make(map[string]string, len(labels))
+	for name, value := range labels {
+		cp[name] = value
+	}
+	return cp
+}
+
+// LabelString renders the static labels as sorted `name=value` pairs
+// separated by spaces, for log prefixes. It is empty when no labels are set.
+func LabelString() string {
+	l := Labels()
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + l[name]
+	}
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,129 @@
+package meter
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nyan-lin-tun/PodMeter/sysinfo"
+)
+
+// MemoryLimitStats relates the Go runtime's soft memory limit to the
+// container's memory limit, reported under the `memory_limit` section.
+type MemoryLimitStats struct {
+	ContainerLimitMB float64 `json:"container_limit_mb" proto:"1"` // 0 without a cgroup limit
+	GoMemLimitMB     float64 `json:"gomemlimit_mb" proto:"2"`      // Effective soft limit; 0 when unlimited
+	Source           string  `json:"source" proto:"3"`             // auto, GOMEMLIMIT, application or none
+	Percent          int     `json:"percent,omitempty" proto:"4"`  // Share of the container limit, when auto
+}
+
+var (
+	memLimitMu      sync.Mutex
+	memLimitSource  string // Set by TuneMemoryLimit
+	memLimitPercent int
+)
+
+// TuneMemoryLimit sets the Go runtime's soft memory limit (GOMEMLIMIT) to
+// percent of the container's memory limit, so the garbage collector works
+// harder as the heap nears the limit instead of the container being OOM
+// killed. It leaves the limit alone when the GOMEMLIMIT environment variable
+// is set, when there is no container limit, or when percent is not in
+// 1..100, and returns the resulting state.
+func TuneMemoryLimit(percent int) MemoryLimitStats {
+	memLimitMu.Lock()
+	defer memLimitMu.Unlock()
+
+	container := sysinfo.MemoryLimitBytes()
+	if os.Getenv("GOMEMLIMIT") == "" && container > 0 && percent > 0 && percent <= 100 {
+		debug.SetMemoryLimit(container / 100 * int64(percent))
+		memLimitSource, memLimitPercent = "auto", percent
+	}
+	return memoryLimitStats(container)
+}
+
+// memoryLimitStats reports the effective limit, which the application may
+// also have set itself through debug.SetMemoryLimit. The caller holds
+// memLimitMu.
+func memoryLimitStats(container int64) MemoryLimitStats {
+	s := MemoryLimitStats{
+		ContainerLimitMB: Round(float64(container) / 1024 / 1024),
+		Source:           memLimitSource,
+		Percent:          memLimitPercent,
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		s.GoMemLimitMB = Round(float64(limit) / 1024 / 1024)
+	}
+	switch {
+	case s.Source != "":
+	case os.Getenv("GOMEMLIMIT") != "":
+		s.Source = "GOMEMLIMIT"
+	case s.GoMemLimitMB > 0:
+		s.Source = "application"
+	default:
+		s.Source = "none"
+	}
+	return s
+}
+
+// MemoryLimit returns the current soft memory limit and the container's
+// memory limit.
+func MemoryLimit() MemoryLimitStats {
+	memLimitMu.Lock()
+	defer memLimitMu.Unlock()
+	return memoryLimitStats(sysinfo.MemoryLimitBytes())
+}
+
+// CPUQuotaStats relates GOMAXPROCS to the container's CPU limit, reported
+// under the `cpu_quota` section. More Ps than quota lets the process burn its
+// CFS quota early in each period and sit throttled for the rest of it, which
+// shows up as tail latency.
+type CPUQuotaStats struct {
+	QuotaCores float64 `json:"quota_cores" proto:"1"` // 0 without a cgroup CPU limit
+	GOMAXPROCS int     `json:"gomaxprocs" proto:"2"`
+	NumCPU     int     `json:"num_cpu" proto:"3"`
+	Source     string  `json:"source" proto:"4"` // auto, GOMAXPROCS or runtime
+	// GOMAXPROCS over the quota: above 1 the process can run more threads
+	// than the quota pays for; 0 without a limit
+	ProcsPerQuotaCore float64 `json:"gomaxprocs_per_quota_core" proto:"5"`
+}
+
+var maxProcsSource atomic.Value // string, set by TuneMaxProcs
+
+// TuneMaxProcs sets GOMAXPROCS to the container's CPU limit rounded down,
+// and at least 1, as go.uber.org/automaxprocs does. It leaves GOMAXPROCS
+// alone when the GOMAXPROCS environment variable is set or there is no
+// limit, and returns the resulting state.
+//
+// Since Go 1.25 the runtime's own default also follows the limit, but
+// rounds it up with a minimum of 2, so a 1.5-core pod runs 2 Ps and can be
+// throttled; rounding down trades that for idle headroom. Setting GOMAXPROCS
+// here also stops the runtime from updating it if the limit changes.
+func TuneMaxProcs() CPUQuotaStats {
+	if quota := sysinfo.CPUQuota(); os.Getenv("GOMAXPROCS") == "" && quota > 0 {
+		runtime.GOMAXPROCS(min(max(int(quota), 1), runtime.NumCPU()))
+		maxProcsSource.Store("auto")
+	}
+	return CPUQuota()
+}
+
+// CPUQuota returns the current GOMAXPROCS and the container's CPU limit.
+func CPUQuota() CPUQuotaStats {
+	s := CPUQuotaStats{
+		QuotaCores: Round(sysinfo.CPUQuota()),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCPU:     runtime.NumCPU(),
+		Source:     "runtime",
+	}
+	if src, _ := maxProcsSource.Load().(string); src != "" {
+		s.Source = src
+	} else if os.Getenv("GOMAXPROCS") != "" {
+		s.Source = "GOMAXPROCS"
+	}
+	if s.QuotaCores > 0 {
+		s.ProcsPerQuotaCore = Round(float64(s.GOMAXPROCS) / s.QuotaCores)
+	}
+	return s
+}
@@ -0,0 +1,563 @@
+// Package meter is PodMeter's stats engine: bounded windows of recent
+// samples, request counters, and the percentile aggregation behind /stats.
+//
+// A Meter can be embedded in any service to get the same latency and hop
+// accounting PodMeter reports for its own traffic:
+//
+//	m := meter.New(0) // follows SetRetention, DefaultWindow samples by default
+//	m.Record(latencyMs, hops.TotalHops(r), true)
+//	summary := meter.Summarize(m.Snapshot().Latencies)
+package meter
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWindow is how many recent samples PodMeter keeps per window unless
+// SetRetention says otherwise.
+const DefaultWindow = 1000
+
+// Meter counts requests and keeps a sliding window of their latency and hop
+// counts. It is safe for concurrent use.
+type Meter struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	viaProxy atomic.Int64
+	rate     *Rate // Recent requests per second
+	deltas   deltas
+
+	mu        sync.RWMutex
+	size      int   // 0 follows the configured Retention
+	seen      int64 // Requests offered to the window, for sampling
+	latencies []float64
+	hops      []int
+	times     []time.Time // When each sample was recorded
+	reqPaths  []string    // URL path of each sample, "" when recorded without one
+	reqCodes  []int       // Status code of each sample, 0 when recorded without one
+	dropped   time.Time   // Newest sample evicted from the window
+	statuses  map[int]int64
+	protocols map[string]int64
+	paths     map[string]int64
+	classes   map[string]int64 // Requests by error class
+}
+
+// Snapshot is a point-in-time copy of a Meter's counters and windows.
+type Snapshot struct {
+	Requests  int64
+	Errors    int64
+	ViaProxy  int64
+	Latencies []float64 // ms, oldest first (unordered under reservoir sampling)
+	Hops      []int     // parallel to Latencies
+	Statuses  map[int]int64
+	Protocols map[string]int64
+	MeshPaths map[string]int64
+	Classes   map[string]int64 // Requests by error class
+	Window    WindowStats
+
+	// Requests per second over the last 10 seconds and the last minute
+	PerSecond10s float64
+	PerSecond1m  float64
+}
+
+// New returns a Meter that keeps the most recent size samples, or follows
+// the configured Retention (count and age) when size is 0.
+func New(size int) *Meter {
+	if size < 0 {
+		size = DefaultWindow
+	}
+	return &Meter{
+		size:      size,
+		statuses:  make(map[int]int64),
+		protocols: make(map[string]int64),
+		paths:     make(map[string]int64),
+		classes:   make(map[string]int64),
+		rate:      NewRate(),
+	}
+}
+
+// Sample is one request in a Meter's window.
+type Sample struct {
+	Time      time.Time `json:"timestamp"`
+	LatencyMs float64   `json:"latency_ms"`
+	Hops      int       `json:"hops"`
+	Path      string    `json:"path,omitempty"`
+	Status    int       `json:"status,omitempty"`
+}
+
+// Record counts one request and, subject to the sampling policy, adds its
+// latency and hop count to the window.
+func (m *Meter) Record(latencyMs float64, hops int, ok bool) {
+	m.RecordRequest(latencyMs, hops, ok, "", 0)
+}
+
+// RecordRequest is Record for a request whose URL path and status code
+// should be kept with its sample, for Samples.
+func (m *Meter) RecordRequest(latencyMs float64, hops int, ok bool, path string, status int) {
+	m.count(hops, ok)
+	m.deltas.add(ok, latencyMs, true)
+	policy := CurrentSampling()
+	ret := effectiveRetention(m.size)
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seen++
+
+	switch policy.Mode {
+	case SampleEveryN:
+		if m.seen%int64(policy.N) != 0 {
+			return
+		}
+	case SampleReservoir:
+		if len(m.latencies) >= ret.Size {
+			// Keep each of the seen requests with equal probability
+			if j := rand.Int64N(m.seen); j < int64(ret.Size) {
+				if m.times[j].After(m.dropped) {
+					m.dropped = m.times[j]
+				}
+				m.latencies[j] = latencyMs
+				m.hops[j] = hops
+				m.times[j] = now
+				m.reqPaths[j] = path
+				m.reqCodes[j] = status
+			}
+			m.trim(ret.Size)
+			return
+		}
+	}
+
+	m.latencies = append(m.latencies, latencyMs)
+	m.hops = append(m.hops, hops)
+	m.times = append(m.times, now)
+	m.reqPaths = append(m.reqPaths, path)
+	m.reqCodes = append(m.reqCodes, status)
+	m.trim(ret.Size)
+}
+
+// trim evicts the oldest samples beyond size. The caller holds m.mu.
+func (m *Meter) trim(size int) {
+	if over := len(m.latencies) - size; over > 0 {
+		if t := m.times[over-1]; t.After(m.dropped) {
+			m.dropped = t
+		}
+		m.latencies = m.latencies[over:]
+		m.hops = m.hops[over:]
+		m.times = m.times[over:]
+		m.reqPaths = m.reqPaths[over:]
+		m.reqCodes = m.reqCodes[over:]
+	}
+}
+
+// Count counts one request without adding a latency sample, for long-lived
+// exchanges such as streams whose duration would skew the window.
+func (m *Meter) Count(hops int, ok bool) {
+	m.count(hops, ok)
+	m.deltas.add(ok, 0, false)
+}
+
+func (m *Meter) count(hops int, ok bool) {
+	m.requests.Add(1)
+	m.rate.Add()
+	if !ok {
+		m.errors.Add(1)
+	}
+	if hops > 0 {
+		m.viaProxy.Add(1)
+	}
+}
+
+// CountStatus counts one response with the given HTTP status code.
+func (m *Meter) CountStatus(code int) {
+	m.mu.Lock()
+	m.statuses[code]++
+	m.mu.Unlock()
+}
+
+// CountProtocol counts one request that arrived over proto, as in
+// http.Request.Proto ("HTTP/1.1", "HTTP/2.0").
+func (m *Meter) CountProtocol(proto string) {
+	m.mu.Lock()
+	m.protocols[proto]++
+	m.mu.Unlock()
+}
+
+// CountMeshPath counts one request that reached the pod along path, one of
+// the hops.Path constants.
+func (m *Meter) CountMeshPath(path string) {
+	m.mu.Lock()
+	m.paths[path]++
+	m.mu.Unlock()
+}
+
+// CountErrorClass counts one request in an error class, such as
+// ErrorTimeout; see ClassifyRequest. Empty counts nothing. Whether the
+// request failed is up to Record.
+func (m *Meter) CountErrorClass(class string) {
+	if class == "" {
+		return
+	}
+	m.mu.Lock()
+	m.classes[class]++
+	m.mu.Unlock()
+}
+
+// Snapshot copies the counters and the samples still within the retention
+// limits under a read lock.
+func (m *Meter) Snapshot() Snapshot {
+	ret := effectiveRetention(m.size)
+	now := time.Now()
+
+	m.mu.RLock()
+	s := Snapshot{
+		Statuses:  make(map[int]int64, len(m.statuses)),
+		Protocols: maps.Clone(m.protocols),
+		MeshPaths: maps.Clone(m.paths),
+		Classes:   maps.Clone(m.classes),
+		Window: WindowStats{
+			MaxSamples:    ret.Size,
+			MaxAgeSeconds: ret.MaxAge.Seconds(),
+		},
+	}
+	var oldest time.Time
+	for i, t := range m.times {
+		if ret.MaxAge > 0 && now.Sub(t) > ret.MaxAge {
+			continue
+		}
+		s.Latencies = append(s.Latencies, m.latencies[i])
+		s.Hops = append(s.Hops, m.hops[i])
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	for code, n := range m.statuses {
+		s.Statuses[code] = n
+	}
+	m.mu.RUnlock()
+
+	s.Window.Samples = len(s.Latencies)
+	if !oldest.IsZero() {
+		s.Window.SpanSeconds = Round(now.Sub(oldest).Seconds())
+	}
+	s.Requests = m.requests.Load()
+	s.Errors = m.errors.Load()
+	s.ViaProxy = m.viaProxy.Load()
+	s.PerSecond10s = m.rate.PerSecond(10 * time.Second)
+	s.PerSecond1m = m.rate.PerSecond(time.Minute)
+	return s
+}
+
+// LatenciesBetween returns the latency samples recorded in [from, to), and
+// whether they cover the whole range: no sample from it was evicted or has
+// aged out of the retention.
+func (m *Meter) LatenciesBetween(from, to time.Time) (latencies []float64, complete bool) {
+	ret := effectiveRetention(m.size)
+	now := time.Now()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i, t := range m.times {
+		if ret.MaxAge > 0 && now.Sub(t) > ret.MaxAge {
+			continue
+		}
+		if !t.Before(from) && t.Before(to) {
+			latencies = append(latencies, m.latencies[i])
+		}
+	}
+	complete = m.dropped.Before(from) && (ret.MaxAge <= 0 || now.Sub(from) <= ret.MaxAge)
+	return latencies, complete
+}
+
+// Samples returns the samples within the retention limits recorded at or
+// after since, oldest first.
+func (m *Meter) Samples(since time.Time) []Sample {
+	ret := effectiveRetention(m.size)
+	now := time.Now()
+
+	m.mu.RLock()
+	var out []Sample
+	for i, t := range m.times {
+		if (ret.MaxAge > 0 && now.Sub(t) > ret.MaxAge) || t.Before(since) {
+			continue
+		}
+		out = append(out, Sample{Time: t, LatencyMs: m.latencies[i], Hops: m.hops[i], Path: m.reqPaths[i], Status: m.reqCodes[i]})
+	}
+	m.mu.RUnlock()
+
+	// Reservoir sampling replaces samples in place, out of time order
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// State is the serializable form of a Meter's counters and window, used to
+// checkpoint a Meter and restore it after a restart.
+type State struct {
+	Requests  int64            `json:"requests"`
+	Errors    int64            `json:"errors"`
+	ViaProxy  int64            `json:"via_proxy"`
+	Seen      int64            `json:"seen"`
+	Latencies []float64        `json:"latencies"`
+	Hops      []int            `json:"hops"`
+	Times     []time.Time      `json:"times"`
+	Paths     []string         `json:"paths,omitempty"` // Parallel to Times; absent from older checkpoints
+	Codes     []int            `json:"codes,omitempty"` // Parallel to Times
+	Statuses  map[int]int64    `json:"statuses,omitempty"`
+	Protocols map[string]int64 `json:"protocols,omitempty"`
+	MeshPaths map[string]int64 `json:"mesh_paths,omitempty"`
+	Classes   map[string]int64 `json:"error_classes,omitempty"`
+}
+
+// State copies everything the Meter has recorded.
+func (m *Meter) State() State {
+	m.mu.RLock()
+	st := State{
+		Seen:      m.seen,
+		Latencies: append([]float64(nil), m.latencies...),
+		Hops:      append([]int(nil), m.hops...),
+		Times:     append([]time.Time(nil), m.times...),
+		Paths:     append([]string(nil), m.reqPaths...),
+		Codes:     append([]int(nil), m.reqCodes...),
+		Statuses:  make(map[int]int64, len(m.statuses)),
+		Protocols: maps.Clone(m.protocols),
+		MeshPaths: maps.Clone(m.paths),
+		Classes:   maps.Clone(m.classes),
+	}
+	for code, n := range m.statuses {
+		st.Statuses[code] = n
+	}
+	m.mu.RUnlock()
+
+	st.Requests = m.requests.Load()
+	st.Errors = m.errors.Load()
+	st.ViaProxy = m.viaProxy.Load()
+	return st
+}
+
+// Restore replaces the Meter's counters and window with st. Samples beyond
+// the current retention are dropped; a state whose windows are not parallel
+// is rejected. The recent request rate starts again from zero.
+func (m *Meter) Restore(st State) error {
+	if len(st.Hops) != len(st.Latencies) || len(st.Times) != len(st.Latencies) {
+		return fmt.Errorf("meter state has %d latencies, %d hops and %d times",
+			len(st.Latencies), len(st.Hops), len(st.Times))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.Store(st.Requests)
+	m.errors.Store(st.Errors)
+	m.viaProxy.Store(st.ViaProxy)
+	m.seen = st.Seen
+	m.latencies = append([]float64(nil), st.Latencies...)
+	m.hops = append([]int(nil), st.Hops...)
+	m.times = append([]time.Time(nil), st.Times...)
+	m.reqPaths = make([]string, len(st.Times))
+	m.reqCodes = make([]int, len(st.Times))
+	if len(st.Paths) == len(st.Times) {
+		copy(m.reqPaths, st.Paths)
+	}
+	if len(st.Codes) == len(st.Times) {
+		copy(m.reqCodes, st.Codes)
+	}
+	m.dropped = time.Time{}
+	if st.Seen > int64(len(st.Times)) && len(st.Times) > 0 {
+		// Older samples were dropped before the checkpoint
+		m.dropped = st.Times[0]
+	}
+	m.statuses = make(map[int]int64, len(st.Statuses))
+	for code, n := range st.Statuses {
+		m.statuses[code] = n
+	}
+	m.protocols = make(map[string]int64, len(st.Protocols))
+	maps.Copy(m.protocols, st.Protocols)
+	m.paths = make(map[string]int64, len(st.MeshPaths))
+	maps.Copy(m.paths, st.MeshPaths)
+	m.classes = make(map[string]int64, len(st.Classes))
+	maps.Copy(m.classes, st.Classes)
+	m.trim(effectiveRetention(m.size).Size)
+	m.rate.Reset()
+	return nil
+}
+
+// Reset clears the Meter's counters and window.
+func (m *Meter) Reset() {
+	m.Restore(State{})
+}
+
+// AvgHops returns the rounded mean hop count over the window.
+func (s Snapshot) AvgHops() float64 {
+	if len(s.Hops) == 0 {
+		return 0
+	}
+	total := 0
+	for _, h := range s.Hops {
+		total += h
+	}
+	return Round(float64(total) / float64(len(s.Hops)))
+}
+
+// StatusCodes returns the status code counts keyed by their decimal string,
+// the form used in the stats JSON.
+func (s Snapshot) StatusCodes() map[string]int64 {
+	if len(s.Statuses) == 0 {
+		return nil
+	}
+	out := make(map[string]int64, len(s.Statuses))
+	for code, n := range s.Statuses {
+		out[strconv.Itoa(code)] = n
+	}
+	return out
+}
+
+// ProtocolCounts returns the request counts by protocol, or nil when
+// nothing has been counted.
+func (s Snapshot) ProtocolCounts() map[string]int64 {
+	if len(s.Protocols) == 0 {
+		return nil
+	}
+	return s.Protocols
+}
+
+// RequestRate returns the recent request rates together with the average
+// over uptime seconds. Less than a second of uptime counts as one, so the
+// first requests do not report a huge rate.
+func (s Snapshot) RequestRate(uptime float64) RateStats {
+	return RateStats{
+		Last10s:  s.PerSecond10s,
+		Last1m:   s.PerSecond1m,
+		Lifetime: Round(float64(s.Requests) / max(uptime, 1)),
+	}
+}
+
+// SuccessRate returns the rounded percentage of requests that did not fail,
+// or 100 when nothing has been recorded yet.
+func (s Snapshot) SuccessRate() float64 {
+	if s.Requests == 0 {
+		return 100.0
+	}
+	return Round(float64(s.Requests-s.Errors) / float64(s.Requests) * 100)
+}
+
+// Window is a bounded sliding window of float samples. It is safe for
+// concurrent use.
+type Window struct {
+	mu      sync.RWMutex
+	size    int // 0 follows the configured Retention
+	samples []float64
+	times   []time.Time
+}
+
+// NewWindow returns a Window that keeps the most recent size samples, or
+// follows the configured Retention when size is 0.
+func NewWindow(size int) *Window {
+	if size < 0 {
+		size = DefaultWindow
+	}
+	return &Window{size: size}
+}
+
+// Add appends a sample, evicting the oldest once the window is full.
+func (w *Window) Add(v float64) {
+	ret := effectiveRetention(w.size)
+
+	w.mu.Lock()
+	w.samples = append(w.samples, v)
+	w.times = append(w.times, time.Now())
+	if over := len(w.samples) - ret.Size; over > 0 {
+		w.samples = w.samples[over:]
+		w.times = w.times[over:]
+	}
+	w.mu.Unlock()
+}
+
+// Values returns a copy of the samples within the retention limits, oldest
+// first.
+func (w *Window) Values() []float64 {
+	ret := effectiveRetention(w.size)
+	now := time.Now()
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	var out []float64
+	for i, v := range w.samples {
+		if ret.MaxAge > 0 && now.Sub(w.times[i]) > ret.MaxAge {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// Reset drops every sample.
+func (w *Window) Reset() {
+	w.mu.Lock()
+	w.samples, w.times = nil, nil
+	w.mu.Unlock()
+}
+
+// Summary is the rounded aggregate view of a window of latency samples.
+type Summary struct {
+	Avg, P50, P95, P99, P999, Min, Max float64
+}
+
+// Summarize computes average, min/max and percentiles over data.
+// The caller must ensure data is non-empty.
+func Summarize(data []float64) Summary {
+	sum := 0.0
+	minLat := data[0]
+	maxLat := data[0]
+
+	for _, l := range data {
+		sum += l
+		if l < minLat {
+			minLat = l
+		}
+		if l > maxLat {
+			maxLat = l
+		}
+	}
+
+	return Summary{
+		Avg:  roundMicros(sum / float64(len(data))),
+		P50:  roundMicros(Percentile(data, 0.50)),
+		P95:  roundMicros(Percentile(data, 0.95)),
+		P99:  roundMicros(Percentile(data, 0.99)),
+		P999: roundMicros(Percentile(data, 0.999)),
+		Min:  roundMicros(minLat),
+		Max:  roundMicros(maxLat),
+	}
+}
+
+// Percentile returns the nearest-rank p-quantile (0 < p <= 1) of data
+// without modifying it. The caller must ensure data is non-empty.
+func Percentile(data []float64, p float64) float64 {
+	copyData := append([]float64{}, data...)
+	sort.Float64s(copyData)
+
+	idx := int(math.Ceil(p*float64(len(copyData)))) - 1
+	return copyData[idx]
+}
+
+// Round rounds val to two decimal places, the precision used in reports.
+func Round(val float64) float64 {
+	return math.Round(val*100) / 100
+}
+
+// roundMicros rounds val to three decimal places, so summaries of
+// millisecond windows keep microsecond precision.
+func roundMicros(val float64) float64 {
+	return math.Round(val*1000) / 1000
+}
+
+// Ms converts d to fractional milliseconds with microsecond precision, the
+// unit of the latency windows.
+func Ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
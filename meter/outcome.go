@@ -0,0 +1,62 @@
+package meter
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Error classes of a request that did not simply succeed. A request falls in
+// one class at most, the first that applies in this order: a request that
+// panicked is a panic, not the 500 it was answered with.
+const (
+	ErrorPanic            = "panic"
+	ErrorTimeout          = "timeout"           // Outlived its deadline, so the caller gave up
+	ErrorClientDisconnect = "client_disconnect" // The client went away first
+	ErrorFaultInjected    = "fault_injected"    // Aborted or reset by chaos or a fault header
+	ErrorServer           = "server_error"      // 5xx
+	ErrorClient           = "client_error"      // 4xx
+)
+
+// errorClasses lists the classes in order of precedence.
+var errorClasses = []string{ErrorPanic, ErrorTimeout, ErrorClientDisconnect, ErrorFaultInjected, ErrorServer, ErrorClient}
+
+// ClassifyRequest returns the error class of a request that ended with
+// status after latency, or "" when it succeeded. ctxErr is the request
+// context's error when it ended, and timeout the caller's deadline, 0 when
+// unknown. Panics and injected faults are known only to the handler, which
+// counts them under their own classes instead.
+func ClassifyRequest(status int, ctxErr error, latency, timeout time.Duration) string {
+	switch {
+	case errors.Is(ctxErr, context.DeadlineExceeded), timeout > 0 && latency > timeout:
+		return ErrorTimeout
+	case errors.Is(ctxErr, context.Canceled):
+		return ErrorClientDisconnect
+	case status >= 500:
+		return ErrorServer
+	case status >= 400:
+		return ErrorClient
+	}
+	return ""
+}
+
+// Failed reports whether requests of class count as errors against the
+// success rate. Client errors and disconnects are counted, but the client
+// caused them.
+func Failed(class string) bool {
+	switch class {
+	case "", ErrorClient, ErrorClientDisconnect:
+		return false
+	}
+	return true
+}
+
+// ErrorClasses returns the request counts of every error class, including
+// those with none, so dashboards see a zero rather than a missing series.
+func (s Snapshot) ErrorClasses() map[string]int64 {
+	out := make(map[string]int64, len(errorClasses))
+	for _, class := range errorClasses {
+		out[class] = s.Classes[class]
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package meter
+
+import (
+	"sync"
+	"time"
+)
+
+// rateSeconds is the longest window a Rate can report, in seconds.
+const rateSeconds = 60
+
+// Rate counts events in one-second buckets for the last minute, so it can
+// report the current event rate rather than the average since start. Bucket
+// boundaries come from the monotonic clock, so wall clock steps do not
+// distort it. It is safe for concurrent use.
+type Rate struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts [rateSeconds + 1]int64
+	secs   [rateSeconds + 1]int64 // Which second since start each bucket holds
+}
+
+// NewRate returns an empty Rate.
+func NewRate() *Rate {
+	return &Rate{start: time.Now()}
+}
+
+// Add counts one event now.
+func (r *Rate) Add() {
+	r.mu.Lock()
+	sec := int64(time.Since(r.start) / time.Second)
+	i := sec % int64(len(r.counts))
+	if r.secs[i] != sec {
+		r.secs[i] = sec
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+	r.mu.Unlock()
+}
+
+// PerSecond returns the events per second over the last window (at most a
+// minute), including the current partial second. Early on the window is cut
+// to the time since the Rate started, and never taken as shorter than a
+// second, so the first requests do not report a huge rate.
+func (r *Rate) PerSecond(window time.Duration) float64 {
+	seconds := min(int64(window/time.Second), rateSeconds)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	r.mu.Lock()
+	elapsed := time.Since(r.start)
+	now := int64(elapsed / time.Second)
+	var n int64
+	for i, sec := range r.secs {
+		if sec > now-seconds && sec <= now && r.counts[i] > 0 {
+			n += r.counts[i]
+		}
+	}
+	r.mu.Unlock()
+
+	// The buckets cover the whole seconds before this one plus the part of
+	// this one that has passed
+	span := time.Duration(seconds-1)*time.Second + elapsed%time.Second
+	span = max(min(span, elapsed), time.Second)
+	return Round(float64(n) / span.Seconds())
+}
+
+// Reset forgets every event and restarts the clock.
+func (r *Rate) Reset() {
+	r.mu.Lock()
+	r.start = time.Now()
+	r.counts = [rateSeconds + 1]int64{}
+	r.secs = [rateSeconds + 1]int64{}
+	r.mu.Unlock()
+}
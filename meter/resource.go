@@ -0,0 +1,95 @@
+package meter
+
+import (
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nyan-lin-tun/PodMeter/sysinfo"
+)
+
+// Resource returns the OpenTelemetry resource attributes that identify this
+// process, so exported telemetry is attributed to the right pod without
+// manual configuration. They are detected once, from:
+//
+//   - service.name: OTEL_SERVICE_NAME, or the executable's name
+//   - service.version: the build version
+//   - k8s.pod.name: POD_NAME from the downward API, or the hostname
+//   - k8s.namespace.name: POD_NAMESPACE, or the service account mount
+//   - k8s.node.name: NODE_NAME
+//   - k8s.pod.uid: POD_UID
+//   - container.id: the cgroup of the process
+//   - cloud.availability_zone, cloud.region: from SetTopology
+//
+// Attributes that cannot be found are left out. OTEL_RESOURCE_ATTRIBUTES
+// (comma-separated key=value pairs, values percent-encoded) adds to and
+// overrides the detected ones, and OTEL_SERVICE_NAME overrides both, as in
+// the OpenTelemetry SDKs.
+func Resource() map[string]string {
+	if m := topologyResource.Load(); m != nil {
+		return *m
+	}
+	return detectResource()
+}
+
+// topologyResource is the resource with the attributes SetTopology added.
+var topologyResource atomic.Pointer[map[string]string]
+
+// SetTopology adds the node, availability zone and region the pod runs in
+// to the resource, where known. Attributes already set, e.g. from
+// OTEL_RESOURCE_ATTRIBUTES, are kept.
+func SetTopology(node, zone, region string) {
+	attrs := maps.Clone(detectResource())
+	for key, value := range map[string]string{
+		"k8s.node.name":           node,
+		"cloud.availability_zone": zone,
+		"cloud.region":            region,
+	} {
+		if _, ok := attrs[key]; !ok && value != "" {
+			attrs[key] = value
+		}
+	}
+	topologyResource.Store(&attrs)
+}
+
+var detectResource = sync.OnceValue(func() map[string]string {
+	attrs := map[string]string{"service.version": Build().Version}
+	set := func(key, value string) {
+		if value != "" {
+			attrs[key] = value
+		}
+	}
+
+	// Like Build, this describes the main program, so a program embedding
+	// PodMeter is reported under its own name
+	if exe, err := os.Executable(); err == nil {
+		set("service.name", filepath.Base(exe))
+	}
+
+	hostname, _ := os.Hostname()
+	set("k8s.pod.name", hostname)
+	set("k8s.pod.name", os.Getenv("POD_NAME"))
+	set("k8s.namespace.name", sysinfo.Namespace())
+	set("k8s.namespace.name", os.Getenv("POD_NAMESPACE"))
+	set("k8s.node.name", os.Getenv("NODE_NAME"))
+	set("k8s.pod.uid", os.Getenv("POD_UID"))
+	set("container.id", sysinfo.ContainerID())
+
+	for _, pair := range strings.Split(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"), ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		if v, err := url.PathUnescape(strings.TrimSpace(value)); err == nil {
+			value = v
+		}
+		set(key, value)
+	}
+	set("service.name", os.Getenv("OTEL_SERVICE_NAME"))
+	return attrs
+})
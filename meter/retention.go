@@ -0,0 +1,59 @@
+package meter
+
+import (
+	"sync"
+	"time"
+)
+
+// Retention bounds the sample windows of Meters and Windows created with size
+// 0: at most Size samples, none older than MaxAge (0 keeps samples until they
+// are evicted by count).
+type Retention struct {
+	Size   int
+	MaxAge time.Duration
+}
+
+var (
+	retentionMu sync.RWMutex
+	retention   = Retention{Size: DefaultWindow}
+)
+
+// SetRetention changes the retention of every window that follows it. Windows
+// shrink on their next sample; samples evicted earlier are not recovered when
+// the limit grows. A size <= 0 means DefaultWindow.
+func SetRetention(r Retention) {
+	if r.Size <= 0 {
+		r.Size = DefaultWindow
+	}
+	if r.MaxAge < 0 {
+		r.MaxAge = 0
+	}
+	retentionMu.Lock()
+	retention = r
+	retentionMu.Unlock()
+}
+
+// CurrentRetention returns the configured retention.
+func CurrentRetention() Retention {
+	retentionMu.RLock()
+	defer retentionMu.RUnlock()
+	return retention
+}
+
+// effectiveRetention resolves a window's fixed size, or the configured
+// retention when size is 0.
+func effectiveRetention(size int) Retention {
+	if size > 0 {
+		return Retention{Size: size}
+	}
+	return CurrentRetention()
+}
+
+// WindowStats describes the sample window behind a set of percentiles, so a
+// reader can tell whether they cover hours of traffic or a few seconds.
+type WindowStats struct {
+	Samples       int     `json:"samples" proto:"1"`         // Samples currently in the window
+	MaxSamples    int     `json:"max_samples" proto:"2"`     // Count limit
+	MaxAgeSeconds float64 `json:"max_age_seconds" proto:"3"` // Age limit, 0 if unlimited
+	SpanSeconds   float64 `json:"span_seconds" proto:"4"`    // Age of the oldest sample in the window
+}
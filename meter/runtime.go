@@ -0,0 +1,119 @@
+package meter
+
+import (
+	"math"
+	"runtime/metrics"
+	"strings"
+	"sync"
+)
+
+// Metrics SetRuntime reads for the core resource fields.
+const (
+	rtHeapObjects = "/memory/classes/heap/objects:bytes"
+	rtMemoryTotal = "/memory/classes/total:bytes"
+	rtHeapAllocs  = "/gc/heap/allocs:bytes"
+	rtHeapGoal    = "/gc/heap/goal:bytes"
+	rtForcedGC    = "/gc/cycles/forced:gc-cycles"
+	rtCPUGC       = "/cpu/classes/gc/total:cpu-seconds"
+	rtCPUTotal    = "/cpu/classes/total:cpu-seconds"
+)
+
+var (
+	// runtimeSamples is reused across reads; runtime/metrics allocates
+	// histogram buckets on first use only
+	runtimeMu      sync.Mutex
+	runtimeSamples []metrics.Sample
+	runtimeIndex   map[string]int
+)
+
+func init() {
+	for _, d := range metrics.All() {
+		if d.Kind == metrics.KindBad {
+			continue
+		}
+		runtimeSamples = append(runtimeSamples, metrics.Sample{Name: d.Name})
+	}
+	runtimeIndex = make(map[string]int, len(runtimeSamples))
+	for i, s := range runtimeSamples {
+		runtimeIndex[s.Name] = i
+	}
+}
+
+// SetGoRuntimeMetrics controls whether snapshots include the go_runtime
+// section with every metric the runtime/metrics package supports. It sets
+// the FlagGoRuntime feature flag.
+func SetGoRuntimeMetrics(enabled bool) {
+	SetFlag(FlagGoRuntime, enabled)
+}
+
+// runtimeValues is one read of the runtime/metrics catalogue, flattened to
+// numbers: scalars by name, histograms as name.count, .p50, .p90, .p99 and
+// .max.
+type runtimeValues map[string]float64
+
+// readRuntimeMetrics reads every supported metric. Unlike ReadMemStats it
+// does not stop the world.
+func readRuntimeMetrics() runtimeValues {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	metrics.Read(runtimeSamples)
+
+	out := make(runtimeValues, len(runtimeSamples))
+	for _, s := range runtimeSamples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			out[s.Name] = float64(s.Value.Uint64())
+		case metrics.KindFloat64:
+			out[s.Name] = s.Value.Float64()
+		case metrics.KindFloat64Histogram:
+			h := s.Value.Float64Histogram()
+			var total uint64
+			for _, c := range h.Counts {
+				total += c
+			}
+			out[s.Name+".count"] = float64(total)
+			out[s.Name+".p50"] = histogramQuantile(h, total, 0.50)
+			out[s.Name+".p90"] = histogramQuantile(h, total, 0.90)
+			out[s.Name+".p99"] = histogramQuantile(h, total, 0.99)
+			out[s.Name+".max"] = histogramQuantile(h, total, 1)
+		}
+	}
+	return out
+}
+
+// histogramQuantile returns the upper bound of the bucket holding the
+// q-quantile, or its lower bound for the open-ended last bucket.
+func histogramQuantile(h *metrics.Float64Histogram, total uint64, q float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank && c > 0 {
+			if hi := h.Buckets[i+1]; !math.IsInf(hi, 1) {
+				return hi
+			}
+			return h.Buckets[i]
+		}
+	}
+	return 0
+}
+
+// goRuntimeSection returns the values for the go_runtime section. Names are
+// the runtime/metrics names; "/" and ":" are kept so they can be looked up
+// in the runtime/metrics documentation.
+func (v runtimeValues) goRuntimeSection() map[string]float64 {
+	out := make(map[string]float64, len(v))
+	for name, val := range v {
+		if strings.HasPrefix(name, "/godebug/") {
+			continue // Per-setting counters, noise for most readers
+		}
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			continue
+		}
+		out[name] = val
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package meter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SamplingMode selects which requests a Meter keeps latency samples for.
+// Counters always include every request.
+type SamplingMode int
+
+const (
+	// SampleAll records every request in the window.
+	SampleAll SamplingMode = iota
+	// SampleEveryN records one in every N requests.
+	SampleEveryN
+	// SampleReservoir keeps a uniform random sample of every request seen
+	// so far (Algorithm R), so percentiles cover the meter's whole lifetime
+	// rather than only the most recent requests.
+	SampleReservoir
+)
+
+// Sampling is the latency sampling policy applied to every Meter.
+type Sampling struct {
+	Mode SamplingMode
+	N    int // For SampleEveryN
+}
+
+var (
+	samplingMu sync.RWMutex
+	sampling   Sampling
+)
+
+// ParseSampling parses a sampling policy: "all", "1/N" (one in N requests)
+// or "reservoir".
+func ParseSampling(spec string) (Sampling, error) {
+	switch spec = strings.TrimSpace(spec); spec {
+	case "", "all":
+		return Sampling{Mode: SampleAll}, nil
+	case "reservoir":
+		return Sampling{Mode: SampleReservoir}, nil
+	}
+	if rest, ok := strings.CutPrefix(spec, "1/"); ok {
+		n, err := strconv.Atoi(rest)
+		if err != nil || n <= 0 {
+			return Sampling{}, fmt.Errorf("sampling %q: N must be a positive integer", spec)
+		}
+		if n == 1 {
+			return Sampling{Mode: SampleAll}, nil
+		}
+		return Sampling{Mode: SampleEveryN, N: n}, nil
+	}
+	return Sampling{}, fmt.Errorf("sampling %q: want all, 1/N or reservoir", spec)
+}
+
+// String returns the policy in the form ParseSampling accepts.
+func (s Sampling) String() string {
+	switch s.Mode {
+	case SampleEveryN:
+		return "1/" + strconv.Itoa(s.N)
+	case SampleReservoir:
+		return "reservoir"
+	default:
+		return "all"
+	}
+}
+
+// SetSampling sets the latency sampling policy used by every Meter from now
+// on. Samples already in a window are kept.
+func SetSampling(s Sampling) {
+	if s.Mode == SampleEveryN && s.N <= 1 {
+		s = Sampling{Mode: SampleAll}
+	}
+	samplingMu.Lock()
+	sampling = s
+	samplingMu.Unlock()
+}
+
+// CurrentSampling returns the active latency sampling policy.
+func CurrentSampling() Sampling {
+	samplingMu.RLock()
+	defer samplingMu.RUnlock()
+	return sampling
+}
@@ -0,0 +1,777 @@
+package meter
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Stats is the full snapshot served by /stats. Load generators report the
+// same type so both sides of a test can be compared field by field.
+//
+// GetStats serves it over gRPC with the field numbers in the proto tags, on
+// this type and every type it contains. A new field takes the next unused
+// number, and the number of a removed field is never given to another.
+type Stats struct {
+	// Request metrics
+	Requests          int64   `json:"requests" proto:"1"`
+	Errors            int64   `json:"errors" proto:"2"` // Failed requests; see error_classes
+	RequestsPerSecond float64 `json:"requests_per_second" proto:"3"`
+	SuccessRate       float64 `json:"success_rate_percent" proto:"4"`
+
+	// Latency metrics
+	AvgLatency  float64 `json:"avg_latency_ms" proto:"5"`
+	P50Latency  float64 `json:"p50_latency_ms" proto:"6"`
+	P95Latency  float64 `json:"p95_latency_ms" proto:"7"`
+	P99Latency  float64 `json:"p99_latency_ms" proto:"8"`
+	P999Latency float64 `json:"p999_latency_ms" proto:"9"`
+	MinLatency  float64 `json:"min_latency_ms" proto:"10"`
+	MaxLatency  float64 `json:"max_latency_ms" proto:"11"`
+
+	// Resource usage
+	MemoryHeapMB  float64 `json:"memory_heap_mb" proto:"12"`
+	MemorySysMB   float64 `json:"memory_sys_mb" proto:"13"`
+	MemoryTotalMB float64 `json:"memory_total_alloc_mb" proto:"14"`
+	Goroutines    int     `json:"goroutines" proto:"15"`
+	GCPauseMs     float64 `json:"gc_pause_ms" proto:"16"`
+	NumGC         uint32  `json:"num_gc" proto:"17"`
+
+	// Service health
+	UptimeSeconds int64 `json:"uptime_seconds" proto:"18"`
+
+	// gRPC metrics (served on a separate port)
+	GRPC GRPCStats `json:"grpc" proto:"19"`
+
+	// WebSocket metrics (/ws/echo)
+	WebSocket WebSocketStats `json:"websocket" proto:"45"`
+
+	// UDP echo metrics (optional listener)
+	UDP UDPStats `json:"udp" proto:"46"`
+
+	// Raw TCP echo metrics (optional listener)
+	TCP TCPStats `json:"tcp" proto:"47"`
+
+	// Active probe results (ICMP)
+	Probes ProbeStats `json:"probes" proto:"48"`
+
+	// Network/Proxy metrics
+	CurrentHopCount       int               `json:"current_hop_count" proto:"20"` // Deprecated: use proxy_hop_count + service_mesh_hops
+	ProxyHopCount         int               `json:"proxy_hop_count" proto:"21"`   // Traditional proxy hops (nginx, X-Forwarded-For, Via)
+	ServiceMeshHops       int               `json:"service_mesh_hops" proto:"22"` // Service mesh hops (Istio/Envoy headers)
+	TotalHopCount         int               `json:"total_hop_count" proto:"23"`   // proxy_hop_count + service_mesh_hops
+	AvgProxyHops          float64           `json:"avg_proxy_hops" proto:"24"`
+	ProxyDetected         bool              `json:"proxy_detected" proto:"25"`
+	IstioSidecar          bool              `json:"istio_sidecar_detected" proto:"26"`
+	WaypointProxyDetected bool              `json:"waypoint_proxy_detected" proto:"27"` // Ambient L7 waypoint proxy detected
+	ServiceMeshMode       string            `json:"service_mesh_mode" proto:"28"`       // none, ambient-l4, ambient-l7, sidecar
+	RequestsViaProxy      int64             `json:"requests_via_proxy" proto:"29"`
+	DebugHeaders          map[string]string `json:"debug_headers,omitempty" proto:"30"`
+
+	// Chaos injection
+	ChaosActive   bool  `json:"chaos_active" proto:"31"`
+	ChaosInjected int64 `json:"chaos_injected_requests" proto:"32"`
+	HeaderFaults  int64 `json:"header_faults_injected" proto:"33"`
+	HeaderAborts  int64 `json:"header_fault_aborts" proto:"34"`
+
+	// System information. The node and container sections separate the
+	// node's figures from the container's own usage and limits
+	Hostname          string  `json:"hostname" proto:"35"`
+	OS                string  `json:"os" proto:"36"`
+	Architecture      string  `json:"architecture" proto:"37"`
+	NumCPU            int     `json:"num_cpu" proto:"38"`
+	KernelVersion     string  `json:"kernel_version" proto:"39"`
+	TotalMemoryMB     float64 `json:"total_memory_mb" proto:"40"`
+	AvailableMemoryMB float64 `json:"available_memory_mb" proto:"41"`
+	TotalDiskGB       float64 `json:"total_disk_gb" proto:"42"`
+	AvailableDiskGB   float64 `json:"available_disk_gb" proto:"43"`
+	DiskUsagePercent  float64 `json:"disk_usage_percent" proto:"44"`
+
+	// Response status codes and per-route metrics. Routes are only reported
+	// by applications instrumented with podmeter.Middleware.
+	StatusCodes map[string]int64      `json:"status_codes,omitempty" proto:"49"`
+	Routes      map[string]RouteStats `json:"routes,omitempty" proto:"50"`
+
+	// Pluggable collectors (see RegisterCollector)
+	Collectors      map[string]map[string]any `json:"collectors,omitempty" proto:"51"`
+	CollectorErrors map[string]string         `json:"collector_errors,omitempty" proto:"52"`
+
+	// Config-defined derived metrics (see SetDerivedMetrics)
+	Derived       map[string]float64 `json:"derived,omitempty" proto:"53"`
+	DerivedErrors map[string]string  `json:"derived_errors,omitempty" proto:"54"`
+
+	// Static labels (team, environment, version, region, ...) from SetLabels
+	Labels map[string]string `json:"labels,omitempty" proto:"55"`
+
+	// Latency sampling policy (all, 1/N or reservoir) behind the percentiles
+	LatencySampling string `json:"latency_sampling,omitempty" proto:"56"`
+
+	// Sample window behind the HTTP latency percentiles
+	LatencyWindow WindowStats `json:"latency_window" proto:"57"`
+
+	// Goroutine leak detection: sustained growth and where it comes from
+	GoroutineLeakSuspected bool       `json:"goroutine_leak_suspected" proto:"58"`
+	GoroutineLeakSites     []LeakSite `json:"goroutine_leak_sites,omitempty" proto:"59"`
+
+	// Garbage collector detail; gc_pause_ms above is only the last pause
+	GC GCStats `json:"gc" proto:"60"`
+
+	// Full runtime/metrics catalogue, when the go_runtime flag is on
+	GoRuntime map[string]float64 `json:"go_runtime,omitempty" proto:"61"`
+
+	// Version, VCS revision and build time of the running binary
+	Build BuildInfo `json:"build" proto:"62"`
+
+	// Set while the pod is draining: readiness is failing ahead of shutdown
+	Draining bool `json:"draining" proto:"63"`
+
+	// Sizes of request bodies received by the workload endpoint
+	RequestBody BodySizeStats `json:"request_body" proto:"64"`
+
+	// Bytes written in workload responses, and the outbound throughput
+	Response ResponseSizeStats `json:"response" proto:"65"`
+
+	// HTTP connection lifecycle: how many are open and how often they are reused
+	Connections ConnectionStats `json:"connections" proto:"66"`
+
+	// TLS handshakes on the optional HTTPS listener
+	TLS TLSStats `json:"tls" proto:"67"`
+
+	// Requests by HTTP protocol version ("HTTP/1.1", "HTTP/2.0")
+	Protocols map[string]int64 `json:"protocols,omitempty" proto:"68"`
+
+	// Busiest client families by normalized User-Agent
+	UserAgents []TopEntry `json:"user_agents,omitempty" proto:"69"`
+
+	// Busiest client addresses, with their errors
+	TopClients []TopEntry `json:"top_clients,omitempty" proto:"70"`
+
+	// Request rate over recent windows; requests_per_second is last_10s
+	RequestRate RateStats `json:"request_rate" proto:"71"`
+
+	// OpenTelemetry resource attributes identifying the pod and container
+	Resource map[string]string `json:"resource,omitempty" proto:"72"`
+
+	// Versions of the pod's sidecar, from its admin /server_info
+	IstioVersion string `json:"istio_version,omitempty" proto:"73"`
+	EnvoyVersion string `json:"envoy_version,omitempty" proto:"74"`
+
+	// Health of the sidecar's listeners, upstream clusters and circuit breakers
+	Envoy *EnvoyStats `json:"envoy,omitempty" proto:"75"`
+
+	// Ambient mode: whether ztunnel serves this pod, and how many requests
+	// came through a waypoint (L7) rather than ztunnel alone (L4)
+	AmbientEnrolled   bool  `json:"ambient_enrolled" proto:"76"`
+	WaypointTraversed int64 `json:"waypoint_traversed" proto:"77"`
+	ZtunnelOnly       int64 `json:"ztunnel_only" proto:"78"`
+
+	// Multi-cluster meshes: legs between clusters on this request, and how
+	// many workload requests crossed clusters
+	CrossClusterHops     int   `json:"cross_cluster_hops" proto:"79"`
+	RequestsCrossCluster int64 `json:"requests_cross_cluster" proto:"80"`
+
+	// Simulated initialization behind /startupz, and how long the pod took
+	// to start and become ready
+	Startup StartupStats `json:"startup" proto:"81"`
+
+	// Handler panics recovered and answered with a 500
+	PanicsTotal int64 `json:"panics_total" proto:"82"`
+
+	// Responses served by /status/{code}
+	StatusEmulated int64 `json:"status_emulated" proto:"83"`
+
+	// Per-route rate and concurrency limits, and what they rejected
+	RouteLimits []RouteLimitStats `json:"route_limits,omitempty" proto:"84"`
+
+	// Go soft memory limit (GOMEMLIMIT) against the container's memory limit
+	MemoryLimit MemoryLimitStats `json:"memory_limit" proto:"85"`
+
+	// GOMAXPROCS against the container's CPU quota
+	CPUQuota CPUQuotaStats `json:"cpu_quota" proto:"86"`
+
+	// Node CPU steal over the last sample interval, and whether it has stayed
+	// above the threshold: the hypervisor giving the CPU to other guests
+	CPUStealPercent        float64 `json:"cpu_steal_percent" proto:"87"`
+	NoisyNeighborSuspected bool    `json:"noisy_neighbor_suspected" proto:"88"`
+
+	// The node the pod runs on, and the container's cgroup usage and limits
+	Node      NodeStats      `json:"node" proto:"89"`
+	Container ContainerStats `json:"container" proto:"90"`
+
+	// GPUs allocated to the container, with usage where the driver exposes it
+	GPU GPUStats `json:"gpu" proto:"91"`
+
+	// Requests by error class (see ClassifyRequest); only the classes for
+	// which Failed is true count towards errors
+	ErrorClasses map[string]int64 `json:"error_classes" proto:"92"`
+
+	// The fronted application in reverse-proxy mode
+	Upstream *UpstreamStats `json:"upstream,omitempty" proto:"93"`
+
+	// Workload served by each listener, keyed by listener name
+	Listeners map[string]ListenerStats `json:"listeners,omitempty" proto:"94"`
+
+	// Workload by Host header, and by TLS server name for requests over TLS
+	Hosts map[string]HostStats `json:"hosts,omitempty" proto:"95"`
+	SNI   map[string]HostStats `json:"sni,omitempty" proto:"96"`
+
+	// The pod's addresses and the IP families of inbound workload traffic
+	IPFamilies IPFamilyStats `json:"ip_families" proto:"97"`
+
+	// Every network interface of the pod, secondary networks included
+	Interfaces []InterfaceStats `json:"interfaces,omitempty" proto:"98"`
+
+	// Where the time of workload requests goes, phase by phase
+	Phases PhaseStats `json:"phases" proto:"99"`
+
+	// The node, zone and region the pod runs in, and workload requests by
+	// the zone they came from
+	Topology TopologyStats `json:"topology" proto:"100"`
+
+	// The spans exported over OTLP, when tracing is enabled
+	Tracing *TracingStats `json:"tracing,omitempty" proto:"101"`
+}
+
+// UpstreamStats describe the application PodMeter fronts in reverse-proxy
+// mode: how long it took to answer, and what the proxying added on top.
+// Overheads are the total latency, which the top-level figures report, minus
+// the upstream's.
+type UpstreamStats struct {
+	URL         string `json:"url" proto:"1"`
+	Requests    int64  `json:"requests" proto:"2"`    // Answered by the upstream
+	Errors      int64  `json:"errors" proto:"3"`      // 5xx answers
+	Unreachable int64  `json:"unreachable" proto:"4"` // Answered 502 by PodMeter instead
+	// Requests a mesh proxy was retrying (x-envoy-attempt-count above 1)
+	Retries     int64   `json:"retries" proto:"5"`
+	AvgLatency  float64 `json:"avg_latency_ms" proto:"6"` // Until the upstream's response headers
+	P50Latency  float64 `json:"p50_latency_ms" proto:"7"`
+	P95Latency  float64 `json:"p95_latency_ms" proto:"8"`
+	P99Latency  float64 `json:"p99_latency_ms" proto:"9"`
+	MaxLatency  float64 `json:"max_latency_ms" proto:"10"`
+	AvgOverhead float64 `json:"avg_overhead_ms" proto:"11"`
+	P50Overhead float64 `json:"p50_overhead_ms" proto:"12"`
+	P95Overhead float64 `json:"p95_overhead_ms" proto:"13"`
+	P99Overhead float64 `json:"p99_overhead_ms" proto:"14"`
+}
+
+// RouteLimitStats is one entry of the `route_limits` section.
+type RouteLimitStats struct {
+	Prefix              string  `json:"prefix" proto:"1"`
+	RPS                 float64 `json:"rps,omitempty" proto:"2"`
+	MaxInFlight         int     `json:"max_in_flight,omitempty" proto:"3"`
+	InFlight            int64   `json:"in_flight" proto:"4"`
+	Allowed             int64   `json:"allowed" proto:"5"`
+	RejectedRate        int64   `json:"rejected_rate" proto:"6"`
+	RejectedConcurrency int64   `json:"rejected_concurrency" proto:"7"`
+
+	// How clients reacted to rejections. Retries are requests with an
+	// x-envoy-attempt-count above 1; a rejection is retried when a retry
+	// from the same client follows it, and abandoned when none comes within
+	// 30s after its Retry-After.
+	Retries                   int64   `json:"retries" proto:"8"`
+	RetriesAllowed            int64   `json:"retries_allowed" proto:"9"`
+	RetriesRejected           int64   `json:"retries_rejected" proto:"10"`
+	RetrySuccessPercent       float64 `json:"retry_success_percent" proto:"11"`
+	MaxAttempt                int64   `json:"max_attempt" proto:"12"`
+	RejectionsPending         int64   `json:"rejections_pending" proto:"13"`
+	RejectionsRetried         int64   `json:"rejections_retried" proto:"14"`
+	RejectionsAbandoned       int64   `json:"rejections_abandoned" proto:"15"`
+	RetriesEarly              int64   `json:"retries_before_retry_after" proto:"16"`
+	RetriesHonoringRetryAfter int64   `json:"retries_after_retry_after" proto:"17"`
+	AvgRetryDelay             float64 `json:"avg_retry_delay_ms" proto:"18"`
+}
+
+// StartupStats is the state of the simulated initialization, reported under
+// the `startup` section. Times are from process start.
+type StartupStats struct {
+	State            string    `json:"state" proto:"1"` // initializing, started or failed
+	RemainingSeconds float64   `json:"remaining_seconds,omitempty" proto:"2"`
+	ProcessStart     time.Time `json:"process_start" proto:"3"`
+	TimeToStarted    float64   `json:"time_to_started_ms,omitempty" proto:"4"`
+	TimeToReady      float64   `json:"time_to_ready_ms,omitempty" proto:"5"` // Until /readyz first answered 200
+	Probes           int64     `json:"startup_probes" proto:"6"`
+	ProbesFailed     int64     `json:"startup_probes_failed" proto:"7"`
+}
+
+// EnvoyStats summarizes the pod's sidecar from its admin interface, reported
+// under the `envoy` section.
+type EnvoyStats struct {
+	Listeners           int                  `json:"listeners" proto:"1"`
+	Clusters            int                  `json:"clusters" proto:"2"`
+	HealthyHosts        int                  `json:"healthy_hosts" proto:"3"`
+	DegradedHosts       int                  `json:"degraded_hosts" proto:"4"`
+	UnhealthyHosts      int                  `json:"unhealthy_hosts" proto:"5"`
+	OutlierEjectedHosts int                  `json:"outlier_ejected_hosts" proto:"6"`
+	UnhealthyClusters   []EnvoyClusterHealth `json:"unhealthy_clusters,omitempty" proto:"7"`    // Most unhealthy hosts first, up to 10
+	CircuitBreakersOpen []string             `json:"circuit_breakers_open,omitempty" proto:"8"` // "<cluster> <priority>.<breaker>", e.g. "outbound|8080||db default.rq_pending"
+	CheckedAt           time.Time            `json:"checked_at" proto:"9"`
+	LastError           string               `json:"last_error,omitempty" proto:"10"`
+}
+
+// EnvoyClusterHealth counts the hosts of one upstream cluster by health.
+type EnvoyClusterHealth struct {
+	Name      string `json:"name" proto:"1"`
+	Healthy   int    `json:"healthy" proto:"2"`
+	Degraded  int    `json:"degraded" proto:"3"`
+	Unhealthy int    `json:"unhealthy" proto:"4"`
+}
+
+// RateStats is a request rate over recent windows and over the whole
+// measurement, reported under the `request_rate` section.
+type RateStats struct {
+	Last10s  float64 `json:"last_10s" proto:"1"`
+	Last1m   float64 `json:"last_1m" proto:"2"`
+	Lifetime float64 `json:"lifetime" proto:"3"`
+}
+
+// TLSStats describes handshakes on the HTTPS listener, reported under the
+// `tls` section. Durations run from the ClientHello to the client's last
+// handshake flight.
+type TLSStats struct {
+	Enabled           bool    `json:"enabled" proto:"1"`
+	Handshakes        int64   `json:"handshakes" proto:"2"`
+	Resumed           int64   `json:"resumed" proto:"3"`
+	ResumptionPercent float64 `json:"resumption_percent" proto:"4"`
+	AvgHandshake      float64 `json:"avg_handshake_ms" proto:"5"`
+	P50Handshake      float64 `json:"p50_handshake_ms" proto:"6"`
+	P95Handshake      float64 `json:"p95_handshake_ms" proto:"7"`
+	P99Handshake      float64 `json:"p99_handshake_ms" proto:"8"`
+	MaxHandshake      float64 `json:"max_handshake_ms" proto:"9"`
+
+	// Completed handshakes by negotiated version (e.g. "TLS 1.3"), cipher
+	// suite and ALPN protocol ("none" when the client offered none)
+	Versions     map[string]int64 `json:"versions,omitempty" proto:"10"`
+	CipherSuites map[string]int64 `json:"cipher_suites,omitempty" proto:"11"`
+	ALPN         map[string]int64 `json:"alpn,omitempty" proto:"12"`
+}
+
+// ConnectionStats describes the connections to the HTTP listener, reported
+// under the `connections` section. Lifetimes and requests per connection
+// cover connections that have closed.
+type ConnectionStats struct {
+	OpenedTotal        int64   `json:"opened_total" proto:"1"`
+	Open               int     `json:"open" proto:"2"`
+	Idle               int     `json:"idle" proto:"3"`
+	NewRequests        int64   `json:"requests_on_new_connections" proto:"4"`
+	ReusedRequests     int64   `json:"requests_on_reused_connections" proto:"5"`
+	ReusePercent       float64 `json:"reuse_percent" proto:"6"`
+	AvgRequestsPerConn float64 `json:"avg_requests_per_connection" proto:"7"`
+	AvgLifetime        float64 `json:"avg_lifetime_ms" proto:"8"`
+	P50Lifetime        float64 `json:"p50_lifetime_ms" proto:"9"`
+	P99Lifetime        float64 `json:"p99_lifetime_ms" proto:"10"`
+	MaxLifetime        float64 `json:"max_lifetime_ms" proto:"11"`
+
+	// Keep-alive: the idle timeout (0 for none), connections closed once
+	// idle that long (reaped) or earlier (by the client, or at shutdown),
+	// and how long connections sat idle before they were reused
+	KeepAlive          bool    `json:"keep_alive" proto:"12"`
+	IdleTimeout        float64 `json:"idle_timeout_ms" proto:"13"`
+	Reaped             int64   `json:"reaped_idle" proto:"14"`
+	ClosedIdle         int64   `json:"closed_idle" proto:"15"`
+	AvgIdleBeforeReuse float64 `json:"avg_idle_before_reuse_ms" proto:"16"`
+	P50IdleBeforeReuse float64 `json:"p50_idle_before_reuse_ms" proto:"17"`
+	P99IdleBeforeReuse float64 `json:"p99_idle_before_reuse_ms" proto:"18"`
+	MaxIdleBeforeReuse float64 `json:"max_idle_before_reuse_ms" proto:"19"`
+
+	// Connection churn by client address, which behind a sidecar is the
+	// sidecar's
+	Clients map[string]ConnClientStats `json:"clients,omitempty" proto:"20"`
+}
+
+// ConnClientStats is the connection churn of one client address.
+type ConnClientStats struct {
+	Opened          int64   `json:"opened" proto:"1"`
+	Open            int64   `json:"open" proto:"2"`
+	Requests        int64   `json:"requests" proto:"3"`
+	RequestsPerConn float64 `json:"requests_per_connection" proto:"4"`
+	Reaped          int64   `json:"reaped_idle" proto:"5"`
+	ClosedIdle      int64   `json:"closed_idle" proto:"6"`
+}
+
+// ResponseSizeStats describes the response bodies written by the workload
+// endpoint, reported under the `response` section. Headers are not counted.
+type ResponseSizeStats struct {
+	Responses      int64   `json:"responses" proto:"1"`
+	BytesSentTotal int64   `json:"bytes_sent_total" proto:"2"`
+	BytesPerSecond float64 `json:"bytes_sent_per_second" proto:"3"` // Averaged over the uptime
+	AvgBytes       float64 `json:"avg_bytes" proto:"4"`
+	P50Bytes       float64 `json:"p50_bytes" proto:"5"`
+	P95Bytes       float64 `json:"p95_bytes" proto:"6"`
+	P99Bytes       float64 `json:"p99_bytes" proto:"7"`
+	MinBytes       float64 `json:"min_bytes" proto:"8"`
+	MaxBytes       float64 `json:"max_bytes" proto:"9"`
+}
+
+// BodySizeStats describes request body sizes, reported under the
+// `request_body` section. Requests without a body are not in the
+// distribution.
+type BodySizeStats struct {
+	MaxBytes   int64   `json:"max_bytes" proto:"1"` // Configured limit; larger bodies get 413
+	Requests   int64   `json:"requests_with_body" proto:"2"`
+	BytesTotal int64   `json:"bytes_total" proto:"3"`
+	Rejected   int64   `json:"rejected_too_large" proto:"4"`
+	AvgBytes   float64 `json:"avg_bytes" proto:"5"`
+	P50Bytes   float64 `json:"p50_bytes" proto:"6"`
+	P95Bytes   float64 `json:"p95_bytes" proto:"7"`
+	P99Bytes   float64 `json:"p99_bytes" proto:"8"`
+	MinBytes   float64 `json:"min_bytes" proto:"9"`
+	MaxSeen    float64 `json:"max_seen_bytes" proto:"10"`
+}
+
+// GRPCStats holds gRPC-specific metrics, reported under the `grpc` section.
+type GRPCStats struct {
+	Requests         int64   `json:"requests" proto:"1"`
+	Errors           int64   `json:"errors" proto:"2"`
+	StreamsTotal     int64   `json:"streams_total" proto:"3"`
+	ActiveStreams    int64   `json:"active_streams" proto:"4"`
+	StreamMessages   int64   `json:"stream_messages" proto:"5"`
+	RequestsViaProxy int64   `json:"requests_via_proxy" proto:"6"`
+	AvgProxyHops     float64 `json:"avg_proxy_hops" proto:"7"`
+	AvgLatency       float64 `json:"avg_latency_ms" proto:"8"`
+	P50Latency       float64 `json:"p50_latency_ms" proto:"9"`
+	P95Latency       float64 `json:"p95_latency_ms" proto:"10"`
+	P99Latency       float64 `json:"p99_latency_ms" proto:"11"`
+	P999Latency      float64 `json:"p999_latency_ms" proto:"12"`
+	MinLatency       float64 `json:"min_latency_ms" proto:"13"`
+	MaxLatency       float64 `json:"max_latency_ms" proto:"14"`
+}
+
+// WebSocketStats holds WebSocket metrics, reported under the `websocket` section.
+type WebSocketStats struct {
+	ConnectionsTotal  int64   `json:"connections_total" proto:"1"`
+	ActiveConnections int64   `json:"active_connections" proto:"2"`
+	UpgradeFailures   int64   `json:"upgrade_failures" proto:"3"`
+	MessagesReceived  int64   `json:"messages_received" proto:"4"`
+	MessagesSent      int64   `json:"messages_sent" proto:"5"`
+	BytesReceived     int64   `json:"bytes_received" proto:"6"`
+	BytesSent         int64   `json:"bytes_sent" proto:"7"`
+	AvgUpgradeLatency float64 `json:"avg_upgrade_latency_ms" proto:"8"`
+	P99UpgradeLatency float64 `json:"p99_upgrade_latency_ms" proto:"9"`
+	AvgRTT            float64 `json:"avg_rtt_ms" proto:"10"`
+	P50RTT            float64 `json:"p50_rtt_ms" proto:"11"`
+	P95RTT            float64 `json:"p95_rtt_ms" proto:"12"`
+	P99RTT            float64 `json:"p99_rtt_ms" proto:"13"`
+	MaxRTT            float64 `json:"max_rtt_ms" proto:"14"`
+}
+
+// UDPStats holds UDP echo metrics, reported under the `udp` section.
+type UDPStats struct {
+	Enabled           bool    `json:"enabled" proto:"1"`
+	DatagramsReceived int64   `json:"datagrams_received" proto:"2"`
+	DatagramsEchoed   int64   `json:"datagrams_echoed" proto:"3"`
+	ProbeDatagrams    int64   `json:"probe_datagrams" proto:"4"`
+	Lost              int64   `json:"lost" proto:"5"`
+	OutOfOrder        int64   `json:"out_of_order" proto:"6"`
+	LossPercent       float64 `json:"loss_percent" proto:"7"`
+	JitterMs          float64 `json:"jitter_ms" proto:"8"`
+	ActivePeers       int     `json:"active_peers" proto:"9"`
+}
+
+// TCPStats holds raw TCP echo metrics, reported under the `tcp` section.
+type TCPStats struct {
+	Enabled           bool    `json:"enabled" proto:"1"`
+	ConnectionsTotal  int64   `json:"connections_total" proto:"2"`
+	ActiveConnections int64   `json:"active_connections" proto:"3"`
+	BytesReceived     int64   `json:"bytes_received" proto:"4"`
+	BytesSent         int64   `json:"bytes_sent" proto:"5"`
+	AvgDuration       float64 `json:"avg_connection_duration_ms" proto:"6"`
+	P50Duration       float64 `json:"p50_connection_duration_ms" proto:"7"`
+	P99Duration       float64 `json:"p99_connection_duration_ms" proto:"8"`
+	MaxDuration       float64 `json:"max_connection_duration_ms" proto:"9"`
+	AvgThroughput     float64 `json:"avg_throughput_bytes_per_sec" proto:"10"`
+	MaxThroughput     float64 `json:"max_throughput_bytes_per_sec" proto:"11"`
+}
+
+// ProbeStats groups active probe results, reported under the `probes` section.
+type ProbeStats struct {
+	ICMP []PingTargetStats `json:"icmp,omitempty" proto:"1"`
+	MTLS []MTLSProbeStats  `json:"mtls,omitempty" proto:"2"`
+	// Whether this pod's own sidecar captures the requests it sends
+	OutboundInterception *OutboundInterceptionStats `json:"outbound_mesh_interception,omitempty" proto:"3"`
+	// Scheduled synthetic transactions
+	Synthetic []SyntheticStats `json:"synthetic,omitempty" proto:"4"`
+}
+
+// PingTargetStats is the ICMP echo result for one configured target.
+type PingTargetStats struct {
+	Target      string  `json:"target" proto:"1"`
+	Address     string  `json:"address,omitempty" proto:"2"`
+	Mode        string  `json:"mode" proto:"3"` // raw, unprivileged, or unavailable
+	Sent        int64   `json:"sent" proto:"4"`
+	Received    int64   `json:"received" proto:"5"`
+	LossPercent float64 `json:"loss_percent" proto:"6"`
+	AvgRTT      float64 `json:"avg_rtt_ms" proto:"7"`
+	P50RTT      float64 `json:"p50_rtt_ms" proto:"8"`
+	P95RTT      float64 `json:"p95_rtt_ms" proto:"9"`
+	P99RTT      float64 `json:"p99_rtt_ms" proto:"10"`
+	MaxRTT      float64 `json:"max_rtt_ms" proto:"11"`
+	LastError   string  `json:"last_error,omitempty" proto:"12"`
+	Family      string  `json:"family,omitempty" proto:"13"` // ipv4 or ipv6
+	Interface   string  `json:"interface,omitempty" proto:"14"`
+	// The node and zone the probe ran from
+	Node string `json:"node,omitempty" proto:"15"`
+	Zone string `json:"zone,omitempty" proto:"16"`
+}
+
+// MTLSProbeStats is the result of probing one service port with plaintext
+// HTTP, to check that the mesh enforces mTLS on it.
+type MTLSProbeStats struct {
+	Target            string    `json:"target" proto:"1"` // host:port
+	Probes            int64     `json:"probes" proto:"2"`
+	PlaintextRejected int64     `json:"plaintext_rejected" proto:"3"`
+	PlaintextAccepted int64     `json:"plaintext_accepted" proto:"4"`
+	Inconclusive      int64     `json:"inconclusive" proto:"5"`         // Unreachable, or upgraded by our own sidecar
+	Result            string    `json:"result" proto:"6"`               // Last outcome: strict, permissive, intercepted or unreachable
+	StrictVerified    bool      `json:"mtls_strict_verified" proto:"7"` // The last probe saw plaintext refused
+	LastProbe         time.Time `json:"last_probe" proto:"8"`
+	LastError         string    `json:"last_error,omitempty" proto:"9"`
+	Interface         string    `json:"interface,omitempty" proto:"10"` // The probe left through
+	// The node and zone the probe ran from
+	Node string `json:"node,omitempty" proto:"11"`
+	Zone string `json:"zone,omitempty" proto:"12"`
+}
+
+// OutboundInterceptionStats is the verdict of the outbound interception
+// probes: whether requests leaving the pod pass through its sidecar, to a
+// service name and to a raw pod IP. Inbound detection only sees traffic
+// arriving at the pod.
+type OutboundInterceptionStats struct {
+	SidecarPresent bool `json:"sidecar_present" proto:"1"`
+	// intercepted when every conclusive probe was, bypassed when none was,
+	// partial when they disagree, inconclusive without a verdict
+	Result string                   `json:"result" proto:"2"`
+	Probes []InterceptionProbeStats `json:"targets" proto:"3"`
+}
+
+// InterceptionProbeStats is the record of one outbound interception probe
+// target.
+type InterceptionProbeStats struct {
+	Kind   string `json:"kind" proto:"1"` // echo (a service) or pod_ip
+	Target string `json:"target" proto:"2"`
+
+	Probes         int64 `json:"probes" proto:"3"`
+	Intercepted    int64 `json:"intercepted" proto:"4"`
+	NotIntercepted int64 `json:"not_intercepted" proto:"5"`
+	Inconclusive   int64 `json:"inconclusive" proto:"6"` // Unreachable, or no signal either way
+	// Last outcome: intercepted, not_intercepted, inconclusive or unreachable
+	Result string `json:"result" proto:"7"`
+
+	// What the last probe saw. The target's echo gives the address the
+	// connection arrived from, and the headers added on the way
+	Status          int      `json:"status,omitempty" proto:"8"`
+	LocalAddr       string   `json:"local_addr,omitempty" proto:"9"` // Our end of the connection
+	SeenFrom        string   `json:"seen_from,omitempty" proto:"10"` // The peer the target saw
+	PortPreserved   bool     `json:"source_port_preserved" proto:"11"`
+	AddedHeaders    []string `json:"added_headers,omitempty" proto:"12"`
+	ResponseSignals []string `json:"response_signals,omitempty" proto:"13"` // Proxy headers on the response
+	Evidence        string   `json:"evidence,omitempty" proto:"14"`         // Why the result was reached
+	ConnectMs       float64  `json:"connect_ms" proto:"15"`
+	LatencyMs       float64  `json:"latency_ms" proto:"16"`
+
+	LastProbe time.Time `json:"last_probe" proto:"17"`
+	LastError string    `json:"last_error,omitempty" proto:"18"`
+	Interface string    `json:"interface,omitempty" proto:"19"` // The probe left through
+	// The node and zone the probe ran from
+	Node string `json:"node,omitempty" proto:"20"`
+	Zone string `json:"zone,omitempty" proto:"21"`
+}
+
+// SyntheticStats is the record of one scheduled synthetic transaction: a
+// request to a configured target, passed or failed by its assertions.
+type SyntheticStats struct {
+	Name                string    `json:"name" proto:"1"`
+	Target              string    `json:"target" proto:"2"`
+	Schedule            string    `json:"schedule" proto:"3"`
+	Runs                int64     `json:"runs" proto:"4"`
+	Failures            int64     `json:"failures" proto:"5"`
+	Success             bool      `json:"success" proto:"6"` // The last run passed every assertion
+	ConsecutiveFailures int64     `json:"consecutive_failures" proto:"7"`
+	LastRun             time.Time `json:"last_run" proto:"8"`
+	NextRun             time.Time `json:"next_run" proto:"9"`
+	LastStatus          int       `json:"last_status" proto:"10"` // HTTP status, or gRPC status code for grpc:// targets
+	LastLatency         float64   `json:"last_latency_ms" proto:"11"`
+	AvgLatency          float64   `json:"avg_latency_ms" proto:"12"`
+	P50Latency          float64   `json:"p50_latency_ms" proto:"13"`
+	P95Latency          float64   `json:"p95_latency_ms" proto:"14"`
+	P99Latency          float64   `json:"p99_latency_ms" proto:"15"`
+	MaxLatency          float64   `json:"max_latency_ms" proto:"16"`
+	LastError           string    `json:"last_error,omitempty" proto:"17"` // Why the last run failed
+	Interface           string    `json:"interface,omitempty" proto:"18"`  // The last run left through
+	// The node and zone the check ran from
+	Node string `json:"node,omitempty" proto:"19"`
+	Zone string `json:"zone,omitempty" proto:"20"`
+}
+
+// ListenerStats is the workload served by one listener: the HTTP
+// workload for http and https listeners, Echo calls for grpc ones.
+type ListenerStats struct {
+	Protocol         string  `json:"protocol" proto:"1"`
+	Address          string  `json:"address" proto:"2"`
+	Requests         int64   `json:"requests" proto:"3"`
+	Errors           int64   `json:"errors" proto:"4"`
+	RequestsViaProxy int64   `json:"requests_via_proxy" proto:"5"`
+	AvgLatency       float64 `json:"avg_latency_ms" proto:"6"`
+	P50Latency       float64 `json:"p50_latency_ms" proto:"7"`
+	P95Latency       float64 `json:"p95_latency_ms" proto:"8"`
+	P99Latency       float64 `json:"p99_latency_ms" proto:"9"`
+	MaxLatency       float64 `json:"max_latency_ms" proto:"10"`
+}
+
+// HostStats is the workload addressed to one virtual host, by Host header
+// or TLS server name.
+type HostStats struct {
+	Requests         int64   `json:"requests" proto:"1"`
+	Errors           int64   `json:"errors" proto:"2"`
+	RequestsViaProxy int64   `json:"requests_via_proxy" proto:"3"`
+	AvgLatency       float64 `json:"avg_latency_ms" proto:"4"`
+	P50Latency       float64 `json:"p50_latency_ms" proto:"5"`
+	P95Latency       float64 `json:"p95_latency_ms" proto:"6"`
+	P99Latency       float64 `json:"p99_latency_ms" proto:"7"`
+	MaxLatency       float64 `json:"max_latency_ms" proto:"8"`
+}
+
+// IPFamilyStats describes the pod's IPv4 and IPv6 addresses and which
+// family inbound workload requests use, for validating dual-stack clusters.
+type IPFamilyStats struct {
+	IPv4Addresses []string `json:"ipv4_addresses" proto:"1"`
+	IPv6Addresses []string `json:"ipv6_addresses" proto:"2"`
+	AddressSource string   `json:"address_source" proto:"3"` // POD_IPS, or interfaces without it
+	DualStack     bool     `json:"dual_stack" proto:"4"`     // The pod has addresses of both families
+	// By the connection the request arrived on, which behind a proxy is the
+	// proxy's
+	RequestsIPv4 int64 `json:"requests_ipv4" proto:"5"`
+	RequestsIPv6 int64 `json:"requests_ipv6" proto:"6"`
+	// By the client address the forwarding headers report
+	ClientRequestsIPv4 int64 `json:"client_requests_ipv4" proto:"7"`
+	ClientRequestsIPv6 int64 `json:"client_requests_ipv6" proto:"8"`
+}
+
+// InterfaceStats describes one network interface in the pod's network
+// namespace.
+type InterfaceStats struct {
+	Name      string   `json:"name" proto:"1"`
+	Index     int      `json:"index" proto:"2"`
+	MAC       string   `json:"mac,omitempty" proto:"3"`
+	MTU       int      `json:"mtu" proto:"4"`
+	Up        bool     `json:"up" proto:"5"`
+	Addresses []string `json:"addresses" proto:"6"` // CIDR notation
+	// The Multus network attached as this interface, from the pod's
+	// network-status annotation, and whether it is the cluster network
+	Network  string `json:"network,omitempty" proto:"7"`
+	Default  bool   `json:"default,omitempty" proto:"8"`
+	Requests int64  `json:"requests" proto:"9"` // Workload requests received on it
+}
+
+// LeakSite is a goroutine creation site whose goroutine count grew over the
+// leak detection window.
+type LeakSite struct {
+	Site   string `json:"site" proto:"1"`   // Function and file:line that started the goroutines
+	Count  int    `json:"count" proto:"2"`  // Goroutines from this site now
+	Growth int    `json:"growth" proto:"3"` // Net growth over the window
+}
+
+// RouteStats is the latency and outcome view of one instrumented route.
+type RouteStats struct {
+	Requests         int64   `json:"requests" proto:"1"`
+	Errors           int64   `json:"errors" proto:"2"`
+	RequestsViaProxy int64   `json:"requests_via_proxy" proto:"3"`
+	AvgLatency       float64 `json:"avg_latency_ms" proto:"4"`
+	P50Latency       float64 `json:"p50_latency_ms" proto:"5"`
+	P95Latency       float64 `json:"p95_latency_ms" proto:"6"`
+	P99Latency       float64 `json:"p99_latency_ms" proto:"7"`
+	MaxLatency       float64 `json:"max_latency_ms" proto:"8"`
+}
+
+// SetLatency copies a latency summary into the top-level latency fields.
+func (s *Stats) SetLatency(lat Summary) {
+	s.AvgLatency = lat.Avg
+	s.P50Latency = lat.P50
+	s.P95Latency = lat.P95
+	s.P99Latency = lat.P99
+	s.P999Latency = lat.P999
+	s.MinLatency = lat.Min
+	s.MaxLatency = lat.Max
+}
+
+// SetRuntime fills the resource usage, platform, build and OpenTelemetry
+// resource fields from the Go runtime of the current process. It reads
+// runtime/metrics rather than ReadMemStats, so taking a snapshot does not stop
+// the world.
+func (s *Stats) SetRuntime() {
+	rt := readRuntimeMetrics()
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	s.MemoryHeapMB = Round(rt[rtHeapObjects] / 1024 / 1024)
+	s.MemorySysMB = Round(rt[rtMemoryTotal] / 1024 / 1024)
+	s.MemoryTotalMB = Round(rt[rtHeapAllocs] / 1024 / 1024)
+	s.Goroutines = runtime.NumGoroutine()
+	if len(gc.Pause) > 0 {
+		s.GCPauseMs = Round(float64(gc.Pause[0]) / 1e6)
+	}
+	s.NumGC = uint32(gc.NumGC)
+	s.GC = newGCStats(rt, &gc)
+	if FlagEnabled(FlagGoRuntime) {
+		s.GoRuntime = rt.goRuntimeSection()
+	}
+	s.OS = runtime.GOOS
+	s.Architecture = runtime.GOARCH
+	s.NumCPU = runtime.NumCPU()
+	s.MemoryLimit = MemoryLimit()
+	s.CPUQuota = CPUQuota()
+	s.Build = Build()
+	s.Resource = Resource()
+}
+
+// PhaseStats breaks workload requests down into phases, reported under the
+// `phases` section, to tell time spent in the network from time spent in the
+// app. FirstByte is from accepting a connection to its first byte arriving,
+// for the first request on it; Headers from a request's first byte to the
+// handler starting; Write from the handler writing its response to the
+// connection going idle or closing. These three are measured for HTTP/1
+// only. BodyRead and Work are the handler reading the body and doing the
+// simulated work.
+type PhaseStats struct {
+	FirstByte PhaseSummary `json:"first_byte" proto:"1"`
+	Headers   PhaseSummary `json:"headers" proto:"2"`
+	BodyRead  PhaseSummary `json:"body_read" proto:"3"`
+	Work      PhaseSummary `json:"work" proto:"4"`
+	Write     PhaseSummary `json:"write" proto:"5"`
+}
+
+// PhaseSummary is the distribution of one request phase, in ms.
+type PhaseSummary struct {
+	Samples int     `json:"samples" proto:"1"`
+	Avg     float64 `json:"avg_ms" proto:"2"`
+	P50     float64 `json:"p50_ms" proto:"3"`
+	P95     float64 `json:"p95_ms" proto:"4"`
+	P99     float64 `json:"p99_ms" proto:"5"`
+	Max     float64 `json:"max_ms" proto:"6"`
+}
+
+// TopologyStats places the pod in the cluster, reported under the
+// `topology` section, and attributes workload requests to the zone of the
+// client, for telling cross-zone latency apart. Clients name their zone in
+// the X-PodMeter-Zone header, which `podmeter load` and peers send.
+type TopologyStats struct {
+	Node   string `json:"node,omitempty" proto:"1"`
+	Zone   string `json:"zone,omitempty" proto:"2"`
+	Region string `json:"region,omitempty" proto:"3"`
+	Source string `json:"source,omitempty" proto:"4"` // Where the zone came from: resource, env, labels or api
+
+	SameZoneRequests    int64                `json:"same_zone_requests" proto:"5"`
+	CrossZoneRequests   int64                `json:"cross_zone_requests" proto:"6"`
+	UnknownZoneRequests int64                `json:"unknown_zone_requests" proto:"7"` // The client's zone, or ours, is unknown
+	ClientZones         map[string]HostStats `json:"client_zones,omitempty" proto:"8"`
+}
+
+// TracingStats describe the OpenTelemetry spans PodMeter exports for the
+// requests it serves, continuing the trace of the caller.
+type TracingStats struct {
+	Endpoint    string  `json:"endpoint" proto:"1"`     // OTLP/HTTP traces URL
+	SampleRatio float64 `json:"sample_ratio" proto:"2"` // Of requests that start a trace
+	Sampled     int64   `json:"sampled" proto:"3"`      // Spans sampled for export
+	Exported    int64   `json:"exported" proto:"4"`
+	Dropped     int64   `json:"dropped" proto:"5"` // Sampled while the export queue was full
+	Failed      int64   `json:"failed" proto:"6"`  // In batches the collector did not accept
+	LastError   string  `json:"last_error,omitempty" proto:"7"`
+}
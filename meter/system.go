@@ -0,0 +1,284 @@
+package meter
+
+import (
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/sysinfo"
+)
+
+// NodeStats describe the node the pod runs on. Every pod on the node sees
+// the same figures; they say nothing about this pod's own usage.
+type NodeStats struct {
+	KernelVersion     string  `json:"kernel_version" proto:"1"`
+	OS                string  `json:"os" proto:"2"`
+	Architecture      string  `json:"architecture" proto:"3"`
+	NumCPU            int     `json:"num_cpu" proto:"4"` // CPUs this process may run on
+	TotalMemoryMB     float64 `json:"total_memory_mb" proto:"5"`
+	AvailableMemoryMB float64 `json:"available_memory_mb" proto:"6"`
+	TotalDiskGB       float64 `json:"total_disk_gb" proto:"7"` // Filesystem behind the container's root
+	AvailableDiskGB   float64 `json:"available_disk_gb" proto:"8"`
+	DiskUsagePercent  float64 `json:"disk_usage_percent" proto:"9"`
+	CPUStealPercent   float64 `json:"cpu_steal_percent" proto:"10"`
+
+	Hugepages HugepagesStats `json:"hugepages" proto:"11"`
+	NUMA      NUMAStats      `json:"numa" proto:"12"`
+	CPU       CPUInfoStats   `json:"cpu" proto:"13"`
+	Thermal   ThermalStats   `json:"thermal" proto:"14"`
+}
+
+// ThermalStats are the node's temperatures, for bare-metal and edge nodes
+// where a hot CPU clocks itself down mid-run. Both are empty on most cloud
+// VMs, which do not expose sensors.
+type ThermalStats struct {
+	MaxTempC float64 `json:"max_temp_c" proto:"1"` // Hottest sensor
+	// Some sensor is at or above the point where it starts throttling
+	AtLimit               bool               `json:"at_limit" proto:"2"`
+	CoreThrottleEvents    uint64             `json:"core_throttle_events" proto:"3"` // Since boot; Intel only
+	PackageThrottleEvents uint64             `json:"package_throttle_events" proto:"4"`
+	Sensors               []TemperatureStats `json:"sensors,omitempty" proto:"5"`
+}
+
+// TemperatureStats is one sensor, in degrees Celsius. Limits are 0 when the
+// sensor does not expose them.
+type TemperatureStats struct {
+	Source    string  `json:"source" proto:"1"` // thermal_zone or hwmon
+	Chip      string  `json:"chip" proto:"2"`
+	Label     string  `json:"label,omitempty" proto:"3"`
+	TempC     float64 `json:"temp_c" proto:"4"`
+	HighC     float64 `json:"high_c" proto:"5"`
+	CriticalC float64 `json:"critical_c" proto:"6"`
+}
+
+func thermalStats() ThermalStats {
+	t := sysinfo.ReadThermal()
+	s := ThermalStats{CoreThrottleEvents: t.CoreThrottleEvents, PackageThrottleEvents: t.PackageThrottleEvents}
+	for _, sensor := range t.Sensors {
+		s.Sensors = append(s.Sensors, TemperatureStats(sensor))
+		s.MaxTempC = max(s.MaxTempC, sensor.TempC)
+		if sensor.HighC > 0 && sensor.TempC >= sensor.HighC {
+			s.AtLimit = true
+		}
+	}
+	return s
+}
+
+// CPUInfoStats identify the node's CPU model, so "identical pods, different
+// latency" can be traced to a heterogeneous node pool.
+type CPUInfoStats struct {
+	Vendor     string   `json:"vendor,omitempty" proto:"1"`
+	Model      string   `json:"model" proto:"2"`
+	BaseMHz    float64  `json:"base_mhz" proto:"3"`    // 0 when cpufreq is not exposed, as in most VMs
+	MaxMHz     float64  `json:"max_mhz" proto:"4"`     // Including turbo
+	CurrentMHz float64  `json:"current_mhz" proto:"5"` // Average across CPUs
+	Flags      []string `json:"flags" proto:"6"`       // Notable ones only: vector, crypto and TSC features
+}
+
+// NUMAStats describe the node's NUMA topology and which NUMA nodes this
+// process may run on. A process spread over several nodes pays for remote
+// memory access that a single-node one does not.
+type NUMAStats struct {
+	NodeCount    int             `json:"node_count" proto:"1"`
+	Nodes        []NUMANodeStats `json:"nodes,omitempty" proto:"2"`
+	AllowedCPUs  string          `json:"allowed_cpus" proto:"3"`  // Kernel CPU list, e.g. 0-3,8
+	AllowedNodes []int           `json:"allowed_nodes" proto:"4"` // NUMA nodes holding those CPUs
+	SpansNodes   bool            `json:"spans_nodes" proto:"5"`
+}
+
+// NUMANodeStats is one NUMA node: its CPUs, local memory and distances.
+type NUMANodeStats struct {
+	ID            int     `json:"id" proto:"1"`
+	CPUs          string  `json:"cpus" proto:"2"`
+	CPUCount      int     `json:"cpu_count" proto:"3"`
+	MemoryTotalMB float64 `json:"memory_total_mb" proto:"4"`
+	MemoryFreeMB  float64 `json:"memory_free_mb" proto:"5"`
+	Distances     []int   `json:"distances,omitempty" proto:"6"` // To each node in order; 10 is local
+}
+
+func numaStats() NUMAStats {
+	allowed := sysinfo.AllowedCPUs()
+	s := NUMAStats{AllowedCPUs: sysinfo.FormatCPUList(allowed), AllowedNodes: []int{}}
+	for _, n := range sysinfo.NUMANodes() {
+		s.Nodes = append(s.Nodes, NUMANodeStats{
+			ID:            n.ID,
+			CPUs:          sysinfo.FormatCPUList(n.CPUs),
+			CPUCount:      len(n.CPUs),
+			MemoryTotalMB: Round(float64(n.MemTotalKB) / 1024),
+			MemoryFreeMB:  Round(float64(n.MemFreeKB) / 1024),
+			Distances:     n.Distances,
+		})
+		for _, c := range n.CPUs {
+			if slices.Contains(allowed, c) {
+				s.AllowedNodes = append(s.AllowedNodes, n.ID)
+				break
+			}
+		}
+	}
+	s.NodeCount = len(s.Nodes)
+	s.SpansNodes = len(s.AllowedNodes) > 1
+	return s
+}
+
+// HugepagesStats are the node's explicit hugepage pools and transparent
+// hugepage policy.
+type HugepagesStats struct {
+	DefaultSizeKB int                 `json:"default_size_kb" proto:"1"`
+	Pools         []HugepagePoolStats `json:"pools,omitempty" proto:"2"`
+	THPEnabled    string              `json:"transparent_enabled" proto:"3"` // always, madvise or never
+	THPDefrag     string              `json:"transparent_defrag" proto:"4"`
+	THPAnonMB     float64             `json:"transparent_anon_mb" proto:"5"` // Anonymous memory backed by transparent hugepages
+}
+
+// HugepagePoolStats is the pool of explicit hugepages of one size.
+type HugepagePoolStats struct {
+	SizeKB   int `json:"size_kb" proto:"1"`
+	Total    int `json:"total" proto:"2"`
+	Free     int `json:"free" proto:"3"`
+	Reserved int `json:"reserved" proto:"4"`
+	Surplus  int `json:"surplus" proto:"5"`
+}
+
+func hugepagesStats() HugepagesStats {
+	h := sysinfo.ReadHugepages()
+	s := HugepagesStats{
+		DefaultSizeKB: h.DefaultSizeKB,
+		THPEnabled:    h.THPEnabled,
+		THPDefrag:     h.THPDefrag,
+		THPAnonMB:     Round(float64(h.AnonymousKB) / 1024),
+	}
+	for _, p := range h.Pools {
+		s.Pools = append(s.Pools, HugepagePoolStats(p))
+	}
+	return s
+}
+
+// ContainerStats are the container's usage and limits as its cgroup
+// accounts them: what the kubelet evicts on, OOM kills act on and CFS
+// throttles against.
+type ContainerStats struct {
+	CgroupVersion       int     `json:"cgroup_version" proto:"1"`        // 0 when no cgroup was found
+	MemoryUsageMB       float64 `json:"memory_usage_mb" proto:"2"`       // Including page cache
+	MemoryWorkingSetMB  float64 `json:"memory_working_set_mb" proto:"3"` // Usage minus inactive page cache, as kubectl top reports it
+	MemoryLimitMB       float64 `json:"memory_limit_mb" proto:"4"`       // 0 without a limit
+	MemoryLimitPercent  float64 `json:"memory_limit_percent" proto:"5"`  // Working set as a share of the limit
+	CPUQuotaCores       float64 `json:"cpu_quota_cores" proto:"6"`       // 0 without a limit
+	CPUUsageSeconds     float64 `json:"cpu_usage_seconds" proto:"7"`     // Since the container started
+	CPUUsageCores       float64 `json:"cpu_usage_cores" proto:"8"`       // Since the previous snapshot
+	CPUThrottledPeriods uint64  `json:"cpu_throttled_periods" proto:"9"`
+	CPUThrottledPercent float64 `json:"cpu_throttled_percent" proto:"10"` // Of the periods with a quota in force
+	CPUThrottledSeconds float64 `json:"cpu_throttled_seconds" proto:"11"`
+}
+
+var (
+	cgroupCPUMu    sync.Mutex
+	cgroupCPUPrev  uint64
+	cgroupCPUPrevT time.Time
+)
+
+// SetSystem fills the node and container sections from /proc and the
+// container's cgroup, along with the flat system fields that predate them.
+func (s *Stats) SetSystem() {
+	hostname, kernelVersion := sysinfo.Host()
+	totalDisk, availDisk, diskUsage := sysinfo.DiskStats()
+	s.Node = NodeStats{
+		KernelVersion:     kernelVersion,
+		OS:                runtime.GOOS,
+		Architecture:      runtime.GOARCH,
+		NumCPU:            runtime.NumCPU(),
+		TotalMemoryMB:     sysinfo.TotalMemoryMB(),
+		AvailableMemoryMB: sysinfo.AvailableMemoryMB(),
+		TotalDiskGB:       totalDisk,
+		AvailableDiskGB:   availDisk,
+		DiskUsagePercent:  diskUsage,
+		Hugepages:         hugepagesStats(),
+		NUMA:              numaStats(),
+		CPU:               CPUInfoStats(sysinfo.ReadCPUInfo()),
+		Thermal:           thermalStats(),
+	}
+	s.Hostname = hostname
+	s.KernelVersion = kernelVersion
+	s.TotalMemoryMB, s.AvailableMemoryMB = s.Node.TotalMemoryMB, s.Node.AvailableMemoryMB
+	s.TotalDiskGB, s.AvailableDiskGB, s.DiskUsagePercent = totalDisk, availDisk, diskUsage
+	s.Container = containerStats()
+	s.GPU = gpuStats()
+}
+
+func containerStats() ContainerStats {
+	u := sysinfo.ContainerUsage()
+	c := ContainerStats{
+		CgroupVersion:       u.Version,
+		MemoryUsageMB:       Round(float64(u.MemoryBytes) / 1024 / 1024),
+		MemoryWorkingSetMB:  Round(float64(u.WorkingSetBytes) / 1024 / 1024),
+		MemoryLimitMB:       Round(float64(sysinfo.MemoryLimitBytes()) / 1024 / 1024),
+		CPUQuotaCores:       Round(sysinfo.CPUQuota()),
+		CPUUsageSeconds:     Round(float64(u.CPUNanos) / 1e9),
+		CPUThrottledPeriods: u.Throttled,
+		CPUThrottledSeconds: Round(float64(u.ThrottledNanos) / 1e9),
+	}
+	if c.MemoryLimitMB > 0 {
+		c.MemoryLimitPercent = Round(c.MemoryWorkingSetMB / c.MemoryLimitMB * 100)
+	}
+	if u.Periods > 0 {
+		c.CPUThrottledPercent = Round(float64(u.Throttled) / float64(u.Periods) * 100)
+	}
+
+	cgroupCPUMu.Lock()
+	defer cgroupCPUMu.Unlock()
+	now := time.Now()
+	if !cgroupCPUPrevT.IsZero() && u.CPUNanos >= cgroupCPUPrev {
+		if elapsed := now.Sub(cgroupCPUPrevT); elapsed > 0 {
+			c.CPUUsageCores = Round(float64(u.CPUNanos-cgroupCPUPrev) / float64(elapsed.Nanoseconds()))
+		}
+	}
+	cgroupCPUPrev, cgroupCPUPrevT = u.CPUNanos, now
+	return c
+}
+
+// GPUStats are the accelerators visible to this container and, where the
+// driver exposes it, their memory and utilization.
+type GPUStats struct {
+	Count         int              `json:"count" proto:"1"`
+	DriverVersion string           `json:"driver_version,omitempty" proto:"2"`
+	Devices       []GPUDeviceStats `json:"devices,omitempty" proto:"3"`
+}
+
+// GPUDeviceStats is one GPU. Usage fields are 0 when the source does not
+// report them.
+type GPUDeviceStats struct {
+	Index              int     `json:"index" proto:"1"`
+	Vendor             string  `json:"vendor" proto:"2"` // nvidia or amd
+	Model              string  `json:"model" proto:"3"`
+	UUID               string  `json:"uuid,omitempty" proto:"4"`
+	BusID              string  `json:"bus_id,omitempty" proto:"5"`
+	MemoryTotalMB      float64 `json:"memory_total_mb" proto:"6"`
+	MemoryUsedMB       float64 `json:"memory_used_mb" proto:"7"`
+	UtilizationPercent float64 `json:"utilization_percent" proto:"8"`
+	TemperatureC       float64 `json:"temperature_c" proto:"9"`
+	Source             string  `json:"source" proto:"10"` // nvidia-smi, procfs or sysfs
+}
+
+// gpuCacheTTL spaces out GPU queries, which fork nvidia-smi.
+const gpuCacheTTL = 5 * time.Second
+
+var (
+	gpuMu     sync.Mutex
+	gpuCached GPUStats
+	gpuReadAt time.Time
+)
+
+func gpuStats() GPUStats {
+	gpuMu.Lock()
+	defer gpuMu.Unlock()
+	if time.Since(gpuReadAt) < gpuCacheTTL {
+		return gpuCached
+	}
+	gpus, driver := sysinfo.GPUs()
+	s := GPUStats{Count: len(gpus), DriverVersion: driver}
+	for _, g := range gpus {
+		s.Devices = append(s.Devices, GPUDeviceStats(g))
+	}
+	gpuCached, gpuReadAt = s, time.Now()
+	return s
+}
@@ -0,0 +1,96 @@
+package meter
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// TopK counts the most frequent keys of an unbounded stream in bounded
+// memory, using the space-saving algorithm: once capacity keys are tracked,
+// a new key replaces the least frequent one and inherits its count. Counts
+// are therefore upper bounds, overstated by at most the reported Overcount,
+// and any key with a true count above total/capacity is guaranteed to be
+// tracked. It is safe for concurrent use.
+type TopK struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*topKEntry
+}
+
+type topKEntry struct {
+	count     int64
+	errors    int64
+	overcount int64
+}
+
+// TopEntry is one key of a TopK, as reported in Stats.
+type TopEntry struct {
+	Key       string `json:"key" proto:"1"`
+	Count     int64  `json:"requests" proto:"2"`
+	Errors    int64  `json:"errors" proto:"3"`              // Only since the key was last admitted
+	Overcount int64  `json:"overcount,omitempty" proto:"4"` // Count may be overstated by up to this much
+}
+
+// NewTopK returns a TopK that tracks up to capacity keys.
+func NewTopK(capacity int) *TopK {
+	return &TopK{capacity: capacity, entries: make(map[string]*topKEntry, capacity)}
+}
+
+// Add counts one occurrence of key, and one error too if failed.
+func (t *TopK) Add(key string, failed bool) {
+	var errs int64
+	if failed {
+		errs = 1
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[key]; ok {
+		e.count++
+		e.errors += errs
+		return
+	}
+	if len(t.entries) < t.capacity {
+		t.entries[key] = &topKEntry{count: 1, errors: errs}
+		return
+	}
+
+	var minKey string
+	var minEntry *topKEntry
+	for k, e := range t.entries {
+		if minEntry == nil || e.count < minEntry.count {
+			minKey, minEntry = k, e
+		}
+	}
+	delete(t.entries, minKey)
+	t.entries[key] = &topKEntry{count: minEntry.count + 1, errors: errs, overcount: minEntry.count}
+}
+
+// Top returns the n most frequent keys, most frequent first.
+func (t *TopK) Top(n int) []TopEntry {
+	t.mu.Lock()
+	out := make([]TopEntry, 0, len(t.entries))
+	for k, e := range t.entries {
+		out = append(out, TopEntry{Key: k, Count: e.count, Errors: e.errors, Overcount: e.overcount})
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b TopEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Reset forgets every key.
+func (t *TopK) Reset() {
+	t.mu.Lock()
+	clear(t.entries)
+	t.mu.Unlock()
+}
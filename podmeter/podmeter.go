@@ -0,0 +1,237 @@
+// Package podmeter adds PodMeter's metering to an existing Go HTTP service:
+// wrap the application's handler with Middleware and expose the results with
+// Mount.
+//
+//	mux := http.NewServeMux()
+//	mux.HandleFunc("GET /orders/{id}", getOrder)
+//	podmeter.Mount(mux)
+//	http.ListenAndServe(":8080", podmeter.Middleware(mux))
+package podmeter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/exporters"
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// maxRoutes bounds how many distinct routes are tracked. Requests for routes
+// beyond the limit are still counted in the totals.
+const maxRoutes = 256
+
+// unmatchedRoute groups requests that did not match a ServeMux pattern.
+const unmatchedRoute = "unmatched"
+
+var (
+	appMeter  = meter.New(0)
+	startTime = time.Now()
+
+	routesMu sync.RWMutex
+	routes   = make(map[string]*meter.Meter)
+)
+
+// statusRecorder captures the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = code >= 200 // 1xx responses are informational
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush forwards to the underlying writer so streaming handlers keep working.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack forwards to the underlying writer so WebSocket upgrades keep working.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("podmeter: underlying ResponseWriter does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	rec.wroteHeader = true
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Middleware records latency, status code and hop count for every request
+// handled by next. Responses are classified with meter.ClassifyRequest, and
+// 5xx responses and timeouts count as errors. When next is
+// (or is wrapped by) a ServeMux, requests are also broken down by the
+// matched pattern.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		hopCount := hops.TotalHops(r)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(start)
+		lat := meter.Ms(elapsed)
+		class := meter.ClassifyRequest(rec.status, r.Context().Err(), elapsed, hops.ExpectedTimeout(r))
+		ok := !meter.Failed(class)
+		appMeter.Record(lat, hopCount, ok)
+		appMeter.CountStatus(rec.status)
+		appMeter.CountErrorClass(class)
+		appMeter.CountProtocol(r.Proto)
+		appMeter.CountMeshPath(hops.MeshPath(r, hops.SidecarPresent(), hops.AmbientEnrolled()))
+		if m := routeMeter(r.Pattern); m != nil {
+			m.Record(lat, hopCount, ok)
+		}
+	})
+}
+
+// routeMeter returns the meter for a route, creating it on first use, or nil
+// once maxRoutes distinct routes are already tracked.
+func routeMeter(pattern string) *meter.Meter {
+	if pattern == "" {
+		pattern = unmatchedRoute
+	}
+
+	routesMu.RLock()
+	m, ok := routes[pattern]
+	routesMu.RUnlock()
+	if ok {
+		return m
+	}
+
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	if m, ok := routes[pattern]; ok {
+		return m
+	}
+	if len(routes) >= maxRoutes {
+		return nil
+	}
+	m = meter.New(0)
+	routes[pattern] = m
+	return m
+}
+
+// Mount registers /stats (JSON) and /metrics (Prometheus) on mux. It panics
+// if mux already has handlers for those paths.
+func Mount(mux *http.ServeMux) {
+	mux.HandleFunc("/stats", StatsHandler)
+	mux.HandleFunc("/metrics", MetricsHandler)
+}
+
+// StatsHandler serves the instrumented application's stats as JSON, or as
+// text tables or an HTML page for people; see exporters.Serve.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	exporters.Serve(w, r, Collect(r))
+}
+
+// MetricsHandler serves the instrumented application's stats in the
+// Prometheus text exposition format, or 404 while the exporter.prometheus
+// flag is off.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !meter.FlagEnabled(exporters.FlagPrometheus) {
+		http.Error(w, "disabled by feature flag "+exporters.FlagPrometheus, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", exporters.PrometheusContentType)
+	exporters.Prometheus(w, Collect(r))
+}
+
+// Collect builds a Stats snapshot of everything Middleware has recorded. The
+// request is used for hop and mesh detection of the caller.
+func Collect(r *http.Request) meter.Stats {
+	snap := appMeter.Snapshot()
+	uptime := time.Since(startTime).Seconds()
+	rate := snap.RequestRate(uptime)
+	hop := hops.Detect(r)
+
+	stats := meter.Stats{
+		Requests:              snap.Requests,
+		Errors:                snap.Errors,
+		RequestsPerSecond:     rate.Last10s,
+		SuccessRate:           snap.SuccessRate(),
+		ErrorClasses:          snap.ErrorClasses(),
+		UptimeSeconds:         int64(uptime),
+		CurrentHopCount:       hop.Total(),
+		ProxyHopCount:         hop.ProxyHops,
+		ServiceMeshHops:       hop.MeshHops,
+		TotalHopCount:         hop.Total(),
+		AvgProxyHops:          snap.AvgHops(),
+		ProxyDetected:         hop.Total() > 0,
+		IstioSidecar:          hop.IstioDetected,
+		WaypointProxyDetected: hop.Waypoint,
+		ServiceMeshMode:       hop.MeshMode,
+		RequestsViaProxy:      snap.ViaProxy,
+		StatusCodes:           snap.StatusCodes(),
+		Routes:                routeStats(),
+		Protocols:             snap.ProtocolCounts(),
+		AmbientEnrolled:       hops.AmbientEnrolled(),
+		WaypointTraversed:     snap.MeshPaths[hops.PathWaypoint],
+		ZtunnelOnly:           snap.MeshPaths[hops.PathZtunnel],
+		CrossClusterHops:      hops.CrossClusterHops(r, meter.Resource()["k8s.cluster.name"]),
+		RequestRate:           rate,
+		Labels:                meter.Labels(),
+		LatencySampling:       meter.CurrentSampling().String(),
+		LatencyWindow:         snap.Window,
+	}
+	stats.SetSystem()
+	stats.SetRuntime()
+	stats.IstioVersion, stats.EnvoyVersion = hops.ProxyVersions()
+	stats.Collectors, stats.CollectorErrors = meter.RunCollectors(r.Context())
+	if len(snap.Latencies) > 0 {
+		stats.SetLatency(meter.Summarize(snap.Latencies))
+	}
+	stats.SetDerived()
+	return stats
+}
+
+// routeStats snapshots every tracked route.
+func routeStats() map[string]meter.RouteStats {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	if len(routes) == 0 {
+		return nil
+	}
+
+	out := make(map[string]meter.RouteStats, len(routes))
+	for pattern, m := range routes {
+		snap := m.Snapshot()
+		rs := meter.RouteStats{
+			Requests:         snap.Requests,
+			Errors:           snap.Errors,
+			RequestsViaProxy: snap.ViaProxy,
+		}
+		if len(snap.Latencies) > 0 {
+			lat := meter.Summarize(snap.Latencies)
+			rs.AvgLatency = lat.Avg
+			rs.P50Latency = lat.P50
+			rs.P95Latency = lat.P95
+			rs.P99Latency = lat.P99
+			rs.MaxLatency = lat.Max
+		}
+		out[pattern] = rs
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// accessGroup is a set of sensitive endpoints with its own client networks.
+type accessGroup struct {
+	env   string         // Prefix of the PODMETER_*_ALLOW and _DENY variables
+	path  string         // Path prefix of the group's endpoints
+	allow []netip.Prefix // Empty allows any client not denied
+	deny  []netip.Prefix // Checked first
+}
+
+// accessGroups are the endpoint groups restrictClients guards, set by Run.
+var accessGroups []*accessGroup
+
+func setAccessGroups(cfg Config) {
+	accessGroups = nil
+	for _, g := range []*accessGroup{
+		{env: "PODMETER_ADMIN", path: "/admin/", allow: cfg.AdminAllow, deny: cfg.AdminDeny},
+		{env: "PODMETER_DEBUG", path: "/debug/", allow: cfg.DebugAllow, deny: cfg.DebugDeny},
+		{env: "PODMETER_STATS", path: "/stats", allow: cfg.StatsAllow, deny: cfg.StatsDeny},
+		{env: "PODMETER_STATS", path: "/metrics", allow: cfg.StatsAllow, deny: cfg.StatsDeny},
+	} {
+		if len(g.allow) > 0 || len(g.deny) > 0 {
+			accessGroups = append(accessGroups, g)
+		}
+	}
+}
+
+// groupFor returns the group guarding path, or nil. /stats matches itself and
+// the paths below it, but not e.g. /statsz.
+func groupFor(path string) *accessGroup {
+	for _, g := range accessGroups {
+		if rest, ok := strings.CutPrefix(path, g.path); ok && (strings.HasSuffix(g.path, "/") || rest == "" || rest[0] == '/') {
+			return g
+		}
+	}
+	return nil
+}
+
+// restrictClients refuses requests to a guarded endpoint group from a
+// client that is in its denylist, or outside its allowlist when it has one.
+// Like the admin token, it looks at the connecting address only.
+func restrictClients(h http.Handler) http.Handler {
+	if len(accessGroups) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g := groupFor(r.URL.Path)
+		if g == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		client := clientAddr(r)
+		switch {
+		case allowed(client, g.deny):
+			warnf("Access: refused %s %s from %s (in %s_DENY)", r.Method, r.URL.Path, client, g.env)
+		case len(g.allow) > 0 && !allowed(client, g.allow):
+			warnf("Access: refused %s %s from %s (not in %s_ALLOW)", r.Method, r.URL.Path, client, g.env)
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		if g.path == "/admin/" {
+			entry := newAuditEntry(r)
+			entry.Status = http.StatusForbidden
+			recordAudit(entry)
+		}
+	})
+}
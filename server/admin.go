@@ -0,0 +1,354 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/loadgen"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var (
+	// adminToken guards every /admin endpoint. The admin API stays disabled
+	// while it is empty.
+	adminToken string
+)
+
+// adminMux returns the admin API. NewMux serves it behind requireAdmin.
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/chaos", chaosHandler)
+	mux.HandleFunc("/admin/load", loadgen.PeerHandler)
+	mux.HandleFunc("/admin/history/query", historyQueryHandler)
+	mux.HandleFunc("GET /admin/flags", flagsHandler)
+	mux.HandleFunc("POST /admin/flags/{name}/{action}", setFlagHandler)
+	mux.HandleFunc("GET /admin/config", configHandler)
+	mux.HandleFunc("/admin/drain", drainHandler)
+	mux.HandleFunc("POST /admin/restart", restartHandler)
+	mux.HandleFunc("POST /admin/reset", resetHandler)
+	mux.HandleFunc("/admin/reachability", reachabilityHandler)
+	mux.HandleFunc("POST /admin/legs", legsHandler)
+	mux.HandleFunc("POST /admin/startup", restartupHandler)
+	mux.HandleFunc("POST /admin/reload", reloadHandler)
+	mux.HandleFunc("GET /admin/loglevel", logLevelHandler)
+	mux.HandleFunc("PUT /admin/loglevel", logLevelHandler)
+	mux.HandleFunc("POST /admin/dump", dumpHandler)
+	mux.HandleFunc("GET /admin/audit", auditHandler)
+	mux.HandleFunc("GET /admin/profile/cpu", cpuProfileHandler)
+	mux.HandleFunc("GET /admin/profile/flame", flameHandler)
+	mux.HandleFunc("GET /admin/profile/trace", executionTraceHandler)
+	mux.HandleFunc("GET /admin/profile/rates", contentionRatesHandler)
+	mux.HandleFunc("PUT /admin/profile/rates", contentionRatesHandler)
+	mux.HandleFunc("GET /admin/profile/{kind}", contentionProfileHandler)
+	return mux
+}
+
+// requireAdmin wraps the admin API: the client must present the admin token
+// as a bearer token. Client networks are checked before, by restrictClients.
+// Calls other than GET and HEAD, and refused calls, are audited with the
+// caller, outcome and the state they changed.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientAddr(r)
+		entry := newAuditEntry(r)
+		if adminToken == "" {
+			http.Error(w, "admin API is disabled (set PODMETER_ADMIN_TOKEN)", http.StatusForbidden)
+			entry.Status = http.StatusForbidden
+			recordAudit(entry)
+			return
+		}
+		if !bearerMatches(r, adminToken) {
+			warnf("Admin: unauthorized %s %s from %s", r.Method, r.URL.Path, client)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="podmeter-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			entry.Status = http.StatusUnauthorized
+			recordAudit(entry)
+			return
+		}
+
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		entry.Authenticated = true
+		entry.Before = auditState(r.URL.Path)
+		rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		entry.Status = rec.status
+		if entry.Before != nil {
+			entry.After = auditState(r.URL.Path)
+		}
+		recordAudit(entry)
+		// Audit lines are written whatever the log level
+		log.Printf("Admin: %s %s from %s -> %d", r.Method, r.URL.RequestURI(), client, rec.status)
+	})
+}
+
+// clientAddr returns the address of the peer that connected to us. Forwarded
+// headers are ignored: they are set by whoever sends the request.
+func clientAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+func allowed(addr netip.Addr, nets []netip.Prefix) bool {
+	for _, p := range nets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAllowlist parses a comma-separated list of CIDRs and single addresses
+// such as `10.0.0.0/8,192.168.1.7`, for the allow and deny lists of the
+// sensitive endpoint groups.
+func ParseAllowlist(spec string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// auditRecorder captures the status an admin handler responds with.
+type auditRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *auditRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *auditRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// resetHandler serves POST /admin/reset: it zeroes the meters, cumulative
+// counters and sample windows and restarts uptime, so a new measurement
+// starts without restarting the pod. Active-connection gauges are kept.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	for _, m := range checkpointMeters {
+		m.Reset()
+	}
+	for _, c := range checkpointCounters {
+		c.Store(0)
+	}
+	for _, win := range []*meter.Window{wsUpgradeLatencies, wsRTTs, tcpDurations, tcpThroughputs, requestBodySizes, responseSizes, connLifetimes, connRequests, tlsHandshakeTimes, upstreamOverheads, connIdleGaps, phaseFirstByte, phaseHeaders, phaseBodyRead, phaseWork, phaseWrite} {
+		win.Reset()
+	}
+	resetTLSNegotiated()
+	userAgents.Reset()
+	topClients.Reset()
+	resetSlow()
+	resetRouteLimits()
+	resetListeners()
+	hostsByHeader.reset()
+	hostsBySNI.reset()
+	resetInterfaces()
+	resetClientZones()
+	resetConnClients()
+	now := time.Now()
+	setMeasurementStart(now)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"reset_at": now})
+}
+
+// runtimeSettings are the settings /admin/reload can change without a
+// restart. The PODMETER_* variables of the same names set them at startup.
+type runtimeSettings struct {
+	Labels          map[string]string `json:"labels"`
+	LatencySampling string            `json:"latency_sampling"`
+	WindowSize      int               `json:"window_size"`
+	WindowMaxAge    string            `json:"window_max_age"`
+	DerivedMetrics  string            `json:"derived_metrics"`
+
+	RequestLogSampling string `json:"request_log_sampling"`
+	RequestLogMatch    string `json:"request_log_match"`
+}
+
+// reloadRequest is the body of POST /admin/reload. Omitted fields are left
+// unchanged.
+type reloadRequest struct {
+	Labels          map[string]string `json:"labels"`
+	LatencySampling *string           `json:"latency_sampling"`
+	WindowSize      *int              `json:"window_size"`
+	WindowMaxAge    *string           `json:"window_max_age"`
+	DerivedMetrics  *string           `json:"derived_metrics"`
+
+	RequestLogSampling *string `json:"request_log_sampling"`
+	RequestLogMatch    *string `json:"request_log_match"`
+}
+
+func currentSettings() runtimeSettings {
+	ret := meter.CurrentRetention()
+	var derived []string
+	for _, d := range meter.DerivedMetrics() {
+		derived = append(derived, d.Name+" = "+d.Expr)
+	}
+	reqLog := currentRequestLogPolicy()
+	return runtimeSettings{
+		Labels:          meter.Labels(),
+		LatencySampling: meter.CurrentSampling().String(),
+		WindowSize:      ret.Size,
+		WindowMaxAge:    ret.MaxAge.String(),
+		DerivedMetrics:  strings.Join(derived, "; "),
+
+		RequestLogSampling: reqLog.sampling(),
+		RequestLogMatch:    reqLog.match(),
+	}
+}
+
+// reloadHandler serves POST /admin/reload. Every setting in the body is
+// validated before any is applied, so a bad value changes nothing.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req reloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	var apply []func()
+	if req.LatencySampling != nil {
+		policy, err := meter.ParseSampling(*req.LatencySampling)
+		if err != nil {
+			http.Error(w, "latency_sampling: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = append(apply, func() { meter.SetSampling(policy) })
+	}
+	if req.WindowSize != nil || req.WindowMaxAge != nil {
+		ret := meter.CurrentRetention()
+		if req.WindowSize != nil {
+			if *req.WindowSize <= 0 {
+				http.Error(w, "window_size must be positive", http.StatusBadRequest)
+				return
+			}
+			ret.Size = *req.WindowSize
+		}
+		if req.WindowMaxAge != nil {
+			maxAge, err := time.ParseDuration(*req.WindowMaxAge)
+			if err != nil || maxAge < 0 {
+				http.Error(w, fmt.Sprintf("window_max_age %q: want a non-negative duration", *req.WindowMaxAge), http.StatusBadRequest)
+				return
+			}
+			ret.MaxAge = maxAge
+		}
+		apply = append(apply, func() { meter.SetRetention(ret) })
+	}
+	if req.DerivedMetrics != nil {
+		defs, err := meter.ParseDerivedMetrics(*req.DerivedMetrics)
+		if err != nil {
+			http.Error(w, "derived_metrics: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		apply = append(apply, func() { meter.SetDerivedMetrics(defs) })
+	}
+	if req.RequestLogSampling != nil || req.RequestLogMatch != nil {
+		policy := currentRequestLogPolicy()
+		if req.RequestLogSampling != nil {
+			every, err := ParseRequestLogSampling(*req.RequestLogSampling)
+			if err != nil {
+				http.Error(w, "request_log_sampling: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			policy.Every = every
+		}
+		if req.RequestLogMatch != nil {
+			header, value, err := ParseRequestLogMatch(*req.RequestLogMatch)
+			if err != nil {
+				http.Error(w, "request_log_match: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			policy.Header, policy.Value = header, value
+		}
+		apply = append(apply, func() { setRequestLogPolicy(policy) })
+	}
+
+	// SetLabels validates as it applies, so it goes last of the checks and
+	// first of the changes
+	if req.Labels != nil {
+		if err := meter.SetLabels(req.Labels); err != nil {
+			http.Error(w, "labels: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogPrefix()
+	}
+	for _, fn := range apply {
+		fn()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentSettings())
+}
+
+// setLogPrefix prefixes log lines with the static labels, as at startup.
+func setLogPrefix() {
+	if prefix := meter.LabelString(); prefix != "" {
+		log.SetPrefix(prefix + " ")
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
+	} else {
+		log.SetPrefix("")
+	}
+}
+
+// logLevelHandler serves GET and PUT /admin/loglevel. PUT takes the level as
+// `?level=` or a JSON body `{"level": "debug"}`.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		name := r.URL.Query().Get("level")
+		if name == "" {
+			var body struct {
+				Level string `json:"level"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			name = body.Level
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			http.Error(w, fmt.Sprintf("unknown level %q (want debug, info, warn or error)", name), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": levelName(logLevel.Level())})
+}
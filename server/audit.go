@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// maxAuditEntries bounds the admin calls kept for /admin/audit.
+const maxAuditEntries = 1000
+
+// AuditEntry is one admin API call, as served by /admin/audit and written to
+// the audit log file.
+type AuditEntry struct {
+	Time          time.Time       `json:"time"`
+	Method        string          `json:"method"`
+	URI           string          `json:"uri"`
+	Client        string          `json:"client"`             // Connecting address
+	Identity      string          `json:"identity,omitempty"` // Caller's SPIFFE ID, from the sidecar's XFCC
+	Authenticated bool            `json:"authenticated"`      // Presented the admin token
+	Status        int             `json:"status"`
+	Changed       bool            `json:"changed"`
+	Before        json.RawMessage `json:"before,omitempty"` // State the call changed, when it did
+	After         json.RawMessage `json:"after,omitempty"`
+}
+
+var (
+	auditMu      sync.Mutex
+	auditEntries []AuditEntry
+	auditNext    int      // Ring position of the next overwrite once full
+	auditFile    *os.File // Optional JSON-lines audit log, from PODMETER_AUDIT_LOG
+)
+
+// auditStates return the state each admin endpoint can change, keyed by
+// path prefix. Calls are audited with the state before and after.
+var auditStates = map[string]func() any{
+	"/admin/chaos": func() any { return chaosState().Config },
+	"/admin/flags": func() any {
+		out := make(map[string]bool)
+		for _, f := range meter.Flags() {
+			out[f.Name] = f.Enabled
+		}
+		return out
+	},
+	"/admin/reload":        func() any { return currentSettings() },
+	"/admin/loglevel":      func() any { return levelName(logLevel.Level()) },
+	"/admin/drain":         func() any { return map[string]bool{"draining": draining.Load()} },
+	"/admin/startup":       func() any { return startupStats().State },
+	"/admin/profile/rates": func() any { return currentContentionRates() },
+}
+
+// openAuditLog appends audit entries to path from now on.
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	auditFile = f
+	return nil
+}
+
+// auditState returns the JSON state an admin path can change, or nil.
+func auditState(path string) json.RawMessage {
+	for prefix, state := range auditStates {
+		if strings.HasPrefix(path, prefix) {
+			data, err := json.Marshal(state())
+			if err != nil {
+				return nil
+			}
+			return data
+		}
+	}
+	return nil
+}
+
+// newAuditEntry starts the entry for an admin call.
+func newAuditEntry(r *http.Request) AuditEntry {
+	return AuditEntry{
+		Time:     time.Now().UTC(),
+		Method:   r.Method,
+		URI:      r.URL.RequestURI(),
+		Client:   clientAddr(r).String(),
+		Identity: hops.ClientIdentity(r),
+	}
+}
+
+// recordAudit keeps e for /admin/audit and appends it to the audit log.
+func recordAudit(e AuditEntry) {
+	if e.Changed = e.Before != nil && !bytes.Equal(e.Before, e.After); !e.Changed {
+		e.Before, e.After = nil, nil
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if len(auditEntries) < maxAuditEntries {
+		auditEntries = append(auditEntries, e)
+	} else {
+		auditEntries[auditNext] = e
+		auditNext = (auditNext + 1) % maxAuditEntries
+	}
+	if auditFile != nil {
+		data, _ := json.Marshal(e)
+		if _, err := auditFile.Write(append(data, '\n')); err != nil {
+			errorf("Audit log write failed: %v", err)
+		}
+	}
+}
+
+// recentAudit returns up to limit entries, oldest first.
+func recentAudit(limit int) []AuditEntry {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	out := make([]AuditEntry, 0, len(auditEntries))
+	out = append(out, auditEntries[auditNext:]...)
+	out = append(out, auditEntries[:auditNext]...)
+	if limit > 0 && len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// auditHandler serves GET /admin/audit: the last admin calls, oldest first,
+// at most ?limit= of them.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recentAudit(limit))
+}
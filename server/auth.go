@@ -0,0 +1,35 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// debugToken guards the diagnostic dump endpoints. They stay disabled while
+// it is empty.
+var debugToken string
+
+// requireDebugToken wraps h so it only runs for requests presenting the debug
+// token as `Authorization: Bearer <token>`.
+func requireDebugToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if debugToken == "" {
+			http.Error(w, "debug endpoints are disabled (set PODMETER_DEBUG_TOKEN)", http.StatusForbidden)
+			return
+		}
+		if !bearerMatches(r, debugToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="podmeter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// bearerMatches reports whether r presents token as `Authorization: Bearer
+// <token>`, comparing in constant time.
+func bearerMatches(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// DefaultMaxRequestBody is the largest request body the workload accepts
+// unless Config.MaxRequestBody says otherwise.
+const DefaultMaxRequestBody = 10 << 20
+
+var (
+	// maxRequestBody is the largest request body the workload accepts
+	maxRequestBody int64 = DefaultMaxRequestBody
+
+	requestBodySizes    = meter.NewWindow(0) // bytes, one per request with a body
+	requestBodies       atomic.Int64
+	requestBodyBytes    atomic.Int64
+	requestBodyRejected atomic.Int64
+
+	responseSizes     = meter.NewWindow(0) // bytes, one per workload response
+	responsesSized    atomic.Int64
+	responseBytesSent atomic.Int64
+)
+
+// readRequestBody reads and discards the request body, recording its size.
+// The read counts towards the request's latency, as it would for a real
+// service. If the body is over maxRequestBody (413) or cannot be read (400)
+// it answers the request itself and returns that status; otherwise it
+// returns 0.
+func readRequestBody(w http.ResponseWriter, r *http.Request) int {
+	n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, maxRequestBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		requestBodyRejected.Add(1)
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return http.StatusRequestEntityTooLarge
+	}
+	if err != nil {
+		http.Error(w, "reading request body: "+err.Error(), http.StatusBadRequest)
+		return http.StatusBadRequest
+	}
+	if n > 0 {
+		requestBodies.Add(1)
+		requestBodyBytes.Add(n)
+		requestBodySizes.Add(float64(n))
+	}
+	return 0
+}
+
+// responseCounter counts the body bytes a handler writes and records the
+// status it responds with.
+type responseCounter struct {
+	http.ResponseWriter
+	written     int64
+	status      int
+	wroteHeader bool
+}
+
+func (rc *responseCounter) WriteHeader(code int) {
+	if !rc.wroteHeader {
+		rc.status = code
+		rc.wroteHeader = true
+	}
+	rc.ResponseWriter.WriteHeader(code)
+}
+
+func (rc *responseCounter) Write(p []byte) (int, error) {
+	n, err := rc.ResponseWriter.Write(p)
+	rc.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rc *responseCounter) Unwrap() http.ResponseWriter {
+	return rc.ResponseWriter
+}
+
+// recordResponseSize adds one response of n body bytes.
+func recordResponseSize(n int64) {
+	responsesSized.Add(1)
+	responseBytesSent.Add(n)
+	responseSizes.Add(float64(n))
+}
+
+// responseSizeStats snapshots the response counters and size window, with
+// the throughput averaged over uptime seconds.
+func responseSizeStats(uptime float64) meter.ResponseSizeStats {
+	stats := meter.ResponseSizeStats{
+		Responses:      responsesSized.Load(),
+		BytesSentTotal: responseBytesSent.Load(),
+	}
+	stats.BytesPerSecond = meter.Round(float64(stats.BytesSentTotal) / max(uptime, 1))
+	if sizes := responseSizes.Values(); len(sizes) > 0 {
+		s := meter.Summarize(sizes)
+		stats.AvgBytes = s.Avg
+		stats.P50Bytes = s.P50
+		stats.P95Bytes = s.P95
+		stats.P99Bytes = s.P99
+		stats.MinBytes = s.Min
+		stats.MaxBytes = s.Max
+	}
+	return stats
+}
+
+// requestBodyStats snapshots the request body counters and size window.
+func requestBodyStats() meter.BodySizeStats {
+	stats := meter.BodySizeStats{
+		MaxBytes:   maxRequestBody,
+		Requests:   requestBodies.Load(),
+		BytesTotal: requestBodyBytes.Load(),
+		Rejected:   requestBodyRejected.Load(),
+	}
+	if sizes := requestBodySizes.Values(); len(sizes) > 0 {
+		s := meter.Summarize(sizes)
+		stats.AvgBytes = s.Avg
+		stats.P50Bytes = s.P50
+		stats.P95Bytes = s.P95
+		stats.P99Bytes = s.P99
+		stats.MinBytes = s.Min
+		stats.MaxSeen = s.Max
+	}
+	return stats
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// maxLogLines bounds the recent log lines kept for support bundles.
+const maxLogLines = 1000
+
+// secretWords mark environment variables whose values are left out of
+// support bundles.
+var secretWords = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+var (
+	// runConfig is the Config Run was started with, for support bundles and
+	// /admin/config
+	runConfig Config
+
+	recentLogs = &logRing{}
+)
+
+// logRing keeps the most recent log lines. It is installed as an extra log
+// output by Run.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		l.lines = append(l.lines, line)
+	}
+	if over := len(l.lines) - maxLogLines; over > 0 {
+		l.lines = l.lines[over:]
+	}
+	return len(p), nil
+}
+
+// String returns the kept lines, oldest first.
+func (l *logRing) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "")
+}
+
+// bundleHandler serves GET /debug/bundle: a tar.gz with everything usually
+// asked for on an incident ticket, collected in one request.
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	dir := "podmeter-bundle-" + now.UTC().Format("20060102T150405Z") + "/"
+
+	add := func(name string, data []byte) {
+		tw.WriteHeader(&tar.Header{
+			Name:    dir + name,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		tw.Write(data)
+	}
+	addJSON := func(name string, v any) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			data = []byte(err.Error())
+		}
+		add(name, append(data, '\n'))
+	}
+
+	addJSON("stats.json", CollectStats(r))
+	if historyStore != nil {
+		if res, err := historyStore.Query("SELECT * FROM snapshots"); err == nil {
+			addJSON("history.json", res)
+		}
+	}
+	cfg := configView()
+	cfg["env"] = redactedEnv()
+	addJSON("config.json", cfg)
+	addJSON("topology.json", topology(r))
+
+	var prof bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&prof, 2)
+	add("goroutines.txt", prof.Bytes())
+	prof.Reset()
+	runtime.GC() // Up-to-date heap statistics, as /debug/pprof/heap?gc=1
+	pprof.Lookup("heap").WriteTo(&prof, 0)
+	add("heap.pprof", prof.Bytes())
+
+	add("logs.txt", []byte(recentLogs.String()))
+
+	if err := tw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, strings.TrimSuffix(dir, "/")))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		errorf("Support bundle write failed: %v", err)
+	}
+}
+
+// redactedEnv returns the PODMETER_* environment with secret-looking values
+// replaced.
+func redactedEnv() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, "PODMETER_") {
+			continue
+		}
+		for _, word := range secretWords {
+			if strings.Contains(key, word) {
+				value = "[redacted]"
+				break
+			}
+		}
+		env[key] = value
+	}
+	return env
+}
+
+// topology describes where the pod sits: host, mesh and proxy detection as
+// seen by the request that asked for the bundle.
+func topology(r *http.Request) map[string]any {
+	hostname, _ := os.Hostname()
+	hop := hops.Detect(r)
+	ifaces := []string{}
+	if addrs, err := netInterfaceAddrs(); err == nil {
+		ifaces = addrs
+	}
+	return map[string]any{
+		"hostname":          hostname,
+		"node":              podTopology.Node,
+		"zone":              podTopology.Zone,
+		"region":            podTopology.Region,
+		"pod_ips":           ifaces,
+		"labels":            meter.Labels(),
+		"sidecar_present":   hops.SidecarPresent(),
+		"service_mesh_mode": hop.MeshMode,
+		"waypoint_detected": hop.Waypoint,
+		"istio_detected":    hop.IstioDetected,
+		"proxy_hops":        hop.ProxyHops,
+		"mesh_hops":         hop.MeshHops,
+		"caller":            r.RemoteAddr,
+		"debug_headers":     hops.DebugHeaders(r),
+	}
+}
+
+// netInterfaceAddrs lists the non-loopback interface addresses, sorted.
+func netInterfaceAddrs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			out = append(out, ipnet.String())
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
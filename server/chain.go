@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// maxChainLength bounds how many instances one /chain request may visit
+	maxChainLength = 16
+	// chainLegTimeout bounds one leg, including every leg after it
+	chainLegTimeout = 10 * time.Second
+	// defaultChainPort is where a via entry without a port is reached
+	defaultChainPort = "8080"
+)
+
+// chainClient forwards /chain requests. Each instance waits for the rest of
+// the chain, so the timeout covers them all.
+var chainClient = &http.Client{Timeout: chainLegTimeout}
+
+// chainArrival is what an instance saw of the request that reached it.
+type chainArrival struct {
+	Pod       string `json:"pod"`
+	Node      string `json:"node,omitempty"` // k8s.node.name, when known
+	ProxyHops int    `json:"proxy_hops"`
+	MeshHops  int    `json:"mesh_hops"`
+	MeshPath  string `json:"mesh_path"`
+}
+
+// chainLeg is one request between two instances of the chain.
+type chainLeg struct {
+	From      string `json:"from"`
+	To        string `json:"to"`     // The pod that answered, as it names itself
+	Target    string `json:"target"` // The via entry it was reached at
+	FromNode  string `json:"from_node,omitempty"`
+	ToNode    string `json:"to_node,omitempty"`
+	CrossNode bool   `json:"cross_node"` // Only when both nodes are known
+	Status    int    `json:"status,omitempty"`
+	// Until the rest of the chain answered
+	RoundTripMs float64 `json:"round_trip_ms"`
+	// The round trip minus the time the rest of the chain took: the network,
+	// proxies and mesh of this leg alone
+	LegMs     float64 `json:"leg_ms"`
+	ProxyHops int     `json:"proxy_hops"` // Added on this leg, as seen on arrival
+	MeshHops  int     `json:"mesh_hops"`
+	MeshPath  string  `json:"mesh_path,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// chainResponse is the body of GET /chain: the path from the instance that
+// answered to the end of via.
+type chainResponse struct {
+	Arrival  chainArrival `json:"arrival"`  // How the request reached the first instance
+	TotalMs  float64      `json:"total_ms"` // Time the first instance took to walk the rest of the chain
+	Complete bool         `json:"complete"` // Every leg answered
+	Legs     []chainLeg   `json:"legs"`
+}
+
+// chainTarget turns a via entry (host or host:port) into the /chain URL of
+// that instance, asking it to continue through rest.
+func chainTarget(entry string, rest []string) (string, error) {
+	if strings.ContainsAny(entry, "/?#@ ") {
+		return "", fmt.Errorf("via entry %q: want host or host:port", entry)
+	}
+	host := entry
+	if _, _, err := net.SplitHostPort(entry); err != nil {
+		// A bare IPv6 address may come with or without its brackets
+		host = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]"), defaultChainPort)
+	}
+	u := &url.URL{Scheme: "http", Host: host, Path: "/chain"}
+	if len(rest) > 0 {
+		u.RawQuery = url.Values{"via": {strings.Join(rest, ",")}}.Encode()
+	}
+	return u.String(), nil
+}
+
+// chainHandler serves GET /chain?via=pod-b,pod-c: it forwards to the first
+// PodMeter in via, which forwards to the next and so on, and returns every
+// leg of the path with its latency and the hops it added. The forwarded
+// requests carry the caller's trace headers, so the chain shows up as one
+// trace.
+func chainHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	hostname, _ := os.Hostname()
+	hop := hops.Detect(r)
+	resp := chainResponse{
+		Arrival: chainArrival{
+			Pod:       hostname,
+			Node:      meter.Resource()["k8s.node.name"],
+			ProxyHops: hop.ProxyHops,
+			MeshHops:  hop.MeshHops,
+			MeshPath:  hop.MeshPath,
+		},
+		Complete: true,
+		Legs:     []chainLeg{},
+	}
+
+	var via []string
+	if v := r.URL.Query().Get("via"); v != "" {
+		for _, entry := range strings.Split(v, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				via = append(via, entry)
+			}
+		}
+	}
+	if len(via) > maxChainLength {
+		http.Error(w, fmt.Sprintf("via may name at most %d instances", maxChainLength), http.StatusBadRequest)
+		return
+	}
+
+	if len(via) > 0 {
+		target, err := chainTarget(via[0], via[1:])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leg, rest := forwardChain(r, target, via[0], resp.Arrival)
+		resp.Legs = append(append(resp.Legs, leg), rest.Legs...)
+		resp.Complete = leg.Error == "" && rest.Complete
+	}
+	resp.TotalMs = meter.Ms(time.Since(start))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// forwardChain sends the chain on to target and returns the leg to it,
+// together with the rest of the chain as the next instance reported it.
+func forwardChain(r *http.Request, target, entry string, self chainArrival) (chainLeg, chainResponse) {
+	leg := chainLeg{From: self.Pod, FromNode: self.Node, Target: entry}
+	var next chainResponse
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		leg.Error = err.Error()
+		return leg, next
+	}
+	for _, name := range []string{"Traceparent", "Tracestate", "B3", "X-B3-Traceid", "X-B3-Spanid", "X-B3-Parentspanid", "X-B3-Sampled", "X-Request-Id"} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	injectTrace(r.Context(), req.Header)
+
+	sent := time.Now()
+	res, err := chainClient.Do(req)
+	if err != nil {
+		leg.RoundTripMs = meter.Ms(time.Since(sent))
+		leg.Error = err.Error()
+		return leg, next
+	}
+	defer res.Body.Close()
+	leg.Status = res.StatusCode
+	decodeErr := json.NewDecoder(res.Body).Decode(&next)
+	leg.RoundTripMs = meter.Ms(time.Since(sent))
+	switch {
+	case res.StatusCode != http.StatusOK:
+		leg.Error = "unexpected status " + res.Status
+		return leg, chainResponse{}
+	case decodeErr != nil:
+		leg.Error = "not a PodMeter /chain response: " + decodeErr.Error()
+		return leg, chainResponse{}
+	}
+
+	leg.To, leg.ToNode = next.Arrival.Pod, next.Arrival.Node
+	leg.CrossNode = leg.FromNode != "" && leg.ToNode != "" && leg.FromNode != leg.ToNode
+	leg.ProxyHops, leg.MeshHops, leg.MeshPath = next.Arrival.ProxyHops, next.Arrival.MeshHops, next.Arrival.MeshPath
+	leg.LegMs = meter.Round(max(leg.RoundTripMs-next.TotalMs, 0))
+	return leg, next
+}
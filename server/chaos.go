@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// maxChaosDuration bounds how long a single chaos experiment may run so a
+// forgotten experiment cannot degrade the pod indefinitely.
+const maxChaosDuration = time.Hour
+
+// ChaosConfig describes a degradation experiment injected via /admin/chaos.
+type ChaosConfig struct {
+	LatencyMs       int     `json:"latency_ms"`       // Extra fixed latency added to every request
+	JitterMs        int     `json:"jitter_ms"`        // Random extra latency in [0, jitter_ms)
+	ResetPercent    float64 `json:"reset_percent"`    // Percentage of requests answered with a TCP reset
+	DribbleMs       int     `json:"dribble_ms"`       // Delay between each response byte written
+	DurationSeconds int     `json:"duration_seconds"` // How long the experiment stays active
+}
+
+// ChaosState is the JSON view of the currently active chaos experiment.
+type ChaosState struct {
+	Active    bool         `json:"active"`
+	Config    *ChaosConfig `json:"config,omitempty"`
+	StartedAt *time.Time   `json:"started_at,omitempty"`
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+	Injected  int64        `json:"injected_requests"`
+	Resets    int64        `json:"connection_resets"`
+}
+
+var (
+	chaosMu       sync.RWMutex
+	chaosActive   *ChaosConfig
+	chaosStarted  time.Time
+	chaosExpires  time.Time
+	chaosInjected atomic.Int64
+	chaosResets   atomic.Int64
+)
+
+// currentChaos returns the active chaos experiment, or nil if none is running,
+// the running one has expired or the chaos flag is off.
+func currentChaos() *ChaosConfig {
+	if !meter.FlagEnabled(flagChaos) {
+		return nil
+	}
+	chaosMu.RLock()
+	defer chaosMu.RUnlock()
+	if chaosActive == nil || time.Now().After(chaosExpires) {
+		return nil
+	}
+	return chaosActive
+}
+
+// delay returns the latency to inject for a single request.
+func (c *ChaosConfig) delay() time.Duration {
+	d := time.Duration(c.LatencyMs) * time.Millisecond
+	if c.JitterMs > 0 {
+		d += time.Duration(rand.Intn(c.JitterMs)) * time.Millisecond
+	}
+	return d
+}
+
+// shouldReset decides whether this request's connection should be reset.
+func (c *ChaosConfig) shouldReset() bool {
+	return c.ResetPercent > 0 && rand.Float64()*100 < c.ResetPercent
+}
+
+// resetConnection hijacks the connection and closes it with SO_LINGER=0 so
+// the client observes a TCP RST instead of a graceful close.
+func resetConnection(w http.ResponseWriter) bool {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return false
+	}
+	if tc, ok := conn.(*timedConn); ok {
+		conn = tc.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = conn.Close()
+	return true
+}
+
+// dribble writes body one byte at a time, flushing and pausing between bytes
+// to emulate a slow upstream.
+func dribble(w http.ResponseWriter, body []byte, interval time.Duration) {
+	rc := http.NewResponseController(w)
+	for i := range body {
+		if _, err := w.Write(body[i : i+1]); err != nil {
+			return
+		}
+		rc.Flush()
+		if i < len(body)-1 {
+			time.Sleep(interval)
+		}
+	}
+}
+
+// chaosState snapshots the current experiment for the admin API and Stats.
+func chaosState() ChaosState {
+	state := ChaosState{
+		Injected: chaosInjected.Load(),
+		Resets:   chaosResets.Load(),
+	}
+	if c := currentChaos(); c != nil {
+		chaosMu.RLock()
+		started, expires := chaosStarted, chaosExpires
+		chaosMu.RUnlock()
+		cfg := *c
+		state.Active = true
+		state.Config = &cfg
+		state.StartedAt = &started
+		state.ExpiresAt = &expires
+	}
+	return state
+}
+
+// chaosHandler serves /admin/chaos:
+//
+//	GET    - show the active experiment
+//	POST   - start a new experiment (replaces any running one)
+//	DELETE - stop the running experiment
+func chaosHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Fall through to return the current state
+
+	case http.MethodPost:
+		if !meter.FlagEnabled(flagChaos) {
+			http.Error(w, "chaos is disabled by feature flag "+flagChaos, http.StatusConflict)
+			return
+		}
+		var cfg ChaosConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if cfg.LatencyMs < 0 || cfg.JitterMs < 0 || cfg.DribbleMs < 0 ||
+			cfg.ResetPercent < 0 || cfg.ResetPercent > 100 {
+			http.Error(w, "chaos values must be non-negative and reset_percent <= 100", http.StatusBadRequest)
+			return
+		}
+		duration := time.Duration(cfg.DurationSeconds) * time.Second
+		if duration <= 0 || duration > maxChaosDuration {
+			http.Error(w, "duration_seconds must be between 1 and 3600", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		chaosMu.Lock()
+		chaosActive = &cfg
+		chaosStarted = now
+		chaosExpires = now.Add(duration)
+		chaosMu.Unlock()
+
+	case http.MethodDelete:
+		chaosMu.Lock()
+		chaosActive = nil
+		chaosMu.Unlock()
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chaosState())
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// checkpoint is the on-disk form of the counters and windows that survive a
+// restart.
+type checkpoint struct {
+	SavedAt   time.Time              `json:"saved_at"`
+	StartedAt time.Time              `json:"started_at"`
+	Meters    map[string]meter.State `json:"meters"`
+	Counters  map[string]int64       `json:"counters"`
+}
+
+// checkpointMeters and checkpointCounters name everything that is persisted.
+// Gauges such as active connections are left out: they describe the process,
+// not the measurement.
+var (
+	checkpointMeters = map[string]*meter.Meter{
+		"http":     httpMeter,
+		"grpc":     grpcMeter,
+		"upstream": upstreamMeter,
+	}
+	checkpointCounters = map[string]*atomic.Int64{
+		"chaos_injected":          &chaosInjected,
+		"chaos_resets":            &chaosResets,
+		"header_faults":           &faultsInjected,
+		"header_aborts":           &faultAborts,
+		"upstream_unreachable":    &upstreamUnreachable,
+		"upstream_retries":        &upstreamRetries,
+		"grpc_streams_total":      &grpcStreamsTotal,
+		"grpc_stream_messages":    &grpcStreamMessages,
+		"tcp_connections":         &tcpConnections,
+		"tcp_bytes_in":            &tcpBytesIn,
+		"tcp_bytes_out":           &tcpBytesOut,
+		"udp_received":            &udpReceived,
+		"udp_echoed":              &udpEchoed,
+		"udp_probes":              &udpProbes,
+		"ws_connections":          &wsConnections,
+		"ws_upgrade_failures":     &wsUpgradeFailures,
+		"ws_messages_in":          &wsMessagesIn,
+		"ws_messages_out":         &wsMessagesOut,
+		"ws_bytes_in":             &wsBytesIn,
+		"ws_bytes_out":            &wsBytesOut,
+		"request_bodies":          &requestBodies,
+		"request_body_bytes":      &requestBodyBytes,
+		"request_body_rejected":   &requestBodyRejected,
+		"responses_sized":         &responsesSized,
+		"response_bytes_sent":     &responseBytesSent,
+		"connections_opened":      &connsOpened,
+		"conn_new_requests":       &connNewRequests,
+		"conn_reused_requests":    &connReused,
+		"connections_reaped":      &connsReaped,
+		"connections_closed_idle": &connsClosedIdle,
+		"tls_handshakes":          &tlsHandshakes,
+		"tls_resumed":             &tlsResumed,
+		"requests_ipv4":           &requestsIPv4,
+		"requests_ipv6":           &requestsIPv6,
+		"client_requests_ipv4":    &clientRequestsIPv4,
+		"client_requests_ipv6":    &clientRequestsIPv6,
+		"cross_cluster_requests":  &crossClusterRequests,
+		"panics_total":            &panicsTotal,
+		"status_emulated":         &statusEmulated,
+	}
+)
+
+// restoreCheckpoint loads a checkpoint written by a previous process. A
+// missing file is not an error: it is the first start.
+func restoreCheckpoint(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := applyCheckpoint(cp); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	infof("Restored checkpoint from %s (saved %s ago)", path, time.Since(cp.SavedAt).Round(time.Second))
+	return nil
+}
+
+// applyCheckpoint replaces the meters and counters with those in cp.
+func applyCheckpoint(cp checkpoint) error {
+	for name, st := range cp.Meters {
+		if m, ok := checkpointMeters[name]; ok {
+			if err := m.Restore(st); err != nil {
+				return fmt.Errorf("meter %s: %w", name, err)
+			}
+		}
+	}
+	for name, n := range cp.Counters {
+		if c, ok := checkpointCounters[name]; ok {
+			c.Store(n)
+		}
+	}
+	// Uptime and requests_per_second continue from the original start
+	if !cp.StartedAt.IsZero() {
+		setMeasurementStart(cp.StartedAt)
+	}
+	return nil
+}
+
+// takeCheckpoint copies the current counters and windows.
+func takeCheckpoint() checkpoint {
+	cp := checkpoint{
+		SavedAt:   time.Now(),
+		StartedAt: measurementStart(),
+		Meters:    make(map[string]meter.State, len(checkpointMeters)),
+		Counters:  make(map[string]int64, len(checkpointCounters)),
+	}
+	for name, m := range checkpointMeters {
+		cp.Meters[name] = m.State()
+	}
+	for name, c := range checkpointCounters {
+		cp.Counters[name] = c.Load()
+	}
+	return cp
+}
+
+// saveCheckpoint writes the current counters and windows to path. The file is
+// synced and then replaced atomically, so a crash or node restart leaves
+// either the previous checkpoint or the whole new one.
+func saveCheckpoint(path string) error {
+	cp := takeCheckpoint()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// checkpointLoop saves a checkpoint every interval. Run saves the final one
+// after draining.
+func checkpointLoop(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := saveCheckpoint(path); err != nil {
+			errorf("Checkpoint failed: %v", err)
+			continue
+		}
+		debugf("Saved checkpoint to %s", path)
+	}
+}
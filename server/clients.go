@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// topReported is how many entries each top list in Stats shows
+	topReported = 10
+	// topTracked is how many keys each top list tracks; tracking more than
+	// are reported keeps the reported counts close to exact
+	topTracked = 100
+)
+
+var (
+	// userAgents counts workload requests by normalized User-Agent
+	userAgents = meter.NewTopK(topTracked)
+
+	// topClients counts workload requests by resolved client address
+	topClients = meter.NewTopK(topTracked)
+)
+
+// resolveClient returns the address of the client a request came from. Behind
+// a sidecar or gateway the connection comes from the proxy, so the address
+// the nearest proxy reports is used instead: X-Envoy-External-Address, then
+// the last X-Forwarded-For entry, which that proxy appended. Addresses are
+// normalized, so a port, IPv6 brackets or an IPv4-mapped form do not split
+// one client in two. These headers identify the caller for the stats;
+// unlike clientAddr, nothing here is used to grant access.
+func resolveClient(r *http.Request) string {
+	forwarded := strings.TrimSpace(r.Header.Get("X-Envoy-External-Address"))
+	if xff := r.Header.Values("X-Forwarded-For"); forwarded == "" && len(xff) > 0 {
+		last := xff[len(xff)-1]
+		if i := strings.LastIndex(last, ","); i >= 0 {
+			last = last[i+1:]
+		}
+		forwarded = strings.TrimSpace(last)
+	}
+	if forwarded != "" {
+		if addr, ok := parseForwardedAddr(forwarded); ok {
+			return addr.String()
+		}
+		return forwarded
+	}
+	if addr := clientAddr(r); addr.IsValid() {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// browsers maps a product token in a Mozilla-style User-Agent to the
+// browser it identifies, most specific first: Edge also claims Chrome and
+// Safari, and Chrome also claims Safari.
+var browsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Chrome/", "Chrome"},
+	{"Firefox/", "Firefox"},
+	{"Safari/", "Safari"},
+}
+
+// normalizeUserAgent reduces a User-Agent to its client family so versions
+// do not split the counts: "kube-probe/1.30" becomes "kube-probe",
+// "curl/8.5.0" becomes "curl" and a browser string becomes its browser.
+func normalizeUserAgent(ua string) string {
+	ua = strings.TrimSpace(ua)
+	if ua == "" {
+		return "(none)"
+	}
+	if strings.HasPrefix(ua, "Mozilla/") {
+		for _, b := range browsers {
+			if strings.Contains(ua, b.token) {
+				return b.name
+			}
+		}
+		if strings.Contains(ua, "bot") || strings.Contains(ua, "Bot") {
+			return "bot"
+		}
+		return "Mozilla"
+	}
+	product, _, _ := strings.Cut(ua, " ")
+	product, _, _ = strings.Cut(product, "/")
+	return product
+}
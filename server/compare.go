@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// compareWindow is one side of GET /stats/compare.
+type compareWindow struct {
+	Window          string             `json:"window"`
+	From            time.Time          `json:"from"`
+	To              time.Time          `json:"to"`
+	LatencySamples  int                `json:"latency_samples"`
+	LatencyComplete bool               `json:"latency_complete"` // The sample window reaches back to From
+	CountsAvailable bool               `json:"counts_available"` // Request counts are known at From and To
+	Metrics         map[string]float64 `json:"metrics"`
+}
+
+// compareResponse is the body of GET /stats/compare. Deltas are a minus b,
+// for the metrics both windows have; changes are relative to b.
+type compareResponse struct {
+	A             compareWindow      `json:"a"`
+	B             compareWindow      `json:"b"`
+	Delta         map[string]float64 `json:"delta"`
+	ChangePercent map[string]float64 `json:"change_percent"`
+}
+
+// parseWindow parses DURATION[@OFFSET]: the DURATION up to OFFSET ago, or up
+// to now.
+func parseWindow(spec string, now time.Time) (from, to time.Time, err error) {
+	length, offset, hasOffset := strings.Cut(spec, "@")
+	d, err := time.ParseDuration(length)
+	if err != nil || d <= 0 {
+		return from, to, fmt.Errorf("window %q: want a positive duration, optionally @offset", spec)
+	}
+	to = now
+	if hasOffset {
+		off, err := time.ParseDuration(offset)
+		if err != nil || off < 0 {
+			return from, to, fmt.Errorf("window %q: offset must be a non-negative duration", spec)
+		}
+		to = now.Add(-off)
+	}
+	return to.Add(-d), to, nil
+}
+
+// countersAt returns the workload's cumulative request and error counts at
+// t: zero before the measurement started, the live counters now, and the
+// last history snapshot in between.
+func countersAt(t, now time.Time) (requests, errors float64, ok bool) {
+	if !t.After(measurementStart()) {
+		return 0, 0, true
+	}
+	if !t.Before(now) {
+		snap := httpMeter.Snapshot()
+		return float64(snap.Requests), float64(snap.Errors), true
+	}
+	if historyStore == nil {
+		return 0, 0, false
+	}
+	row, found := historyStore.At(t)
+	if !found {
+		return 0, 0, false
+	}
+	requests, ok1 := row["requests"].(float64)
+	errors, ok2 := row["errors"].(float64)
+	return requests, errors, ok1 && ok2
+}
+
+// measureWindow collects the metrics of the workload in [from, to).
+func measureWindow(spec string, from, to, now time.Time) compareWindow {
+	w := compareWindow{Window: spec, From: from.UTC(), To: to.UTC(), Metrics: make(map[string]float64)}
+
+	lat, complete := httpMeter.LatenciesBetween(from, to)
+	w.LatencySamples, w.LatencyComplete = len(lat), complete
+	if len(lat) > 0 {
+		s := meter.Summarize(lat)
+		w.Metrics["avg_latency_ms"] = s.Avg
+		w.Metrics["p50_latency_ms"] = s.P50
+		w.Metrics["p95_latency_ms"] = s.P95
+		w.Metrics["p99_latency_ms"] = s.P99
+		w.Metrics["max_latency_ms"] = s.Max
+	}
+
+	startReq, startErr, ok1 := countersAt(from, now)
+	endReq, endErr, ok2 := countersAt(to, now)
+	// A reset or restart between the two makes the difference meaningless
+	if ok1 && ok2 && endReq >= startReq && endErr >= startErr {
+		w.CountsAvailable = true
+		requests, errors := endReq-startReq, endErr-startErr
+		w.Metrics["requests"] = requests
+		w.Metrics["errors"] = errors
+		w.Metrics["requests_per_second"] = meter.Round(requests / to.Sub(from).Seconds())
+		if requests > 0 {
+			w.Metrics["error_rate_percent"] = meter.Round(errors / requests * 100)
+		}
+	}
+	return w
+}
+
+// compareHandler serves GET /stats/compare?a=5m&b=1h: the workload's
+// metrics over two windows side by side, with the change from b to a. A
+// window is DURATION ending now, or DURATION@OFFSET ending OFFSET ago, e.g.
+// b=10m@1h for the ten minutes before the last hour.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	query := r.URL.Query()
+	specA, specB := query.Get("a"), query.Get("b")
+	if specA == "" || specB == "" {
+		http.Error(w, "both windows a and b are required, e.g. ?a=5m&b=1h", http.StatusBadRequest)
+		return
+	}
+	fromA, toA, err := parseWindow(specA, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fromB, toB, err := parseWindow(specB, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := compareResponse{
+		A:             measureWindow(specA, fromA, toA, now),
+		B:             measureWindow(specB, fromB, toB, now),
+		Delta:         make(map[string]float64),
+		ChangePercent: make(map[string]float64),
+	}
+	for name, a := range resp.A.Metrics {
+		b, ok := resp.B.Metrics[name]
+		if !ok {
+			continue
+		}
+		resp.Delta[name] = meter.Round(a - b)
+		if b != 0 {
+			resp.ChangePercent[name] = meter.Round((a - b) / b * 100)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
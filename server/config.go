@@ -0,0 +1,31 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// configView is the effective configuration: the Config Run was started
+// with, secrets redacted, plus the live feature flag state.
+func configView() map[string]any {
+	cfg := runConfig
+	if cfg.DebugToken != "" {
+		cfg.DebugToken = "[redacted]"
+	}
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = "[redacted]"
+	}
+	return map[string]any{
+		"config": cfg,
+		"flags":  meter.Flags(),
+		"build":  meter.Build(),
+	}
+}
+
+// configHandler serves GET /admin/config.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configView())
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// connInfo is what is known about one open HTTP connection.
+type connInfo struct {
+	opened    time.Time
+	requests  int64
+	idle      bool
+	idleSince time.Time
+	client    *connClient
+}
+
+// connClient counts the connections of one client address, for telling
+// which clients churn through connections and which pool them.
+type connClient struct {
+	opened, open, requests, reaped, closedIdle int64
+}
+
+var (
+	connsMu sync.Mutex
+	conns   = make(map[net.Conn]*connInfo)
+
+	connLifetimes   = meter.NewWindow(0) // ms, one per closed connection
+	connRequests    = meter.NewWindow(0) // requests served, one per closed connection
+	connIdleGaps    = meter.NewWindow(0) // ms a connection sat idle before its next request
+	connsOpened     atomic.Int64
+	connNewRequests atomic.Int64 // First request on its connection
+	connReused      atomic.Int64 // Later requests on a kept-alive connection
+	connsReaped     atomic.Int64 // Closed by us after idleTimeout
+	connsClosedIdle atomic.Int64 // Closed while idle, before idleTimeout: by the client, or at shutdown
+
+	// connClients tracks connections by client address, bounded to
+	// maxHosts; the caller holds connsMu
+	connClients = make(map[string]*connClient)
+
+	// idleTimeout and keepAlive are the HTTP servers' keep-alive settings,
+	// set by Run
+	idleTimeout time.Duration
+	keepAlive   = true
+)
+
+// applyKeepAlive gives an HTTP server the configured idle timeout, or turns
+// keep-alive off so that every connection serves one request.
+func applyKeepAlive(srv *http.Server) {
+	srv.IdleTimeout = idleTimeout
+	if !keepAlive {
+		srv.SetKeepAlivesEnabled(false)
+	}
+}
+
+// clientOf returns the tracked client for a connection from addr. The
+// caller holds connsMu.
+func clientOf(addr net.Addr) *connClient {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if cc, ok := connClients[host]; ok {
+		return cc
+	}
+	if len(connClients) >= maxHosts {
+		host = otherHost
+		if cc, ok := connClients[host]; ok {
+			return cc
+		}
+	}
+	cc := &connClient{}
+	connClients[host] = cc
+	return cc
+}
+
+func resetConnClients() {
+	connsMu.Lock()
+	// Open connections keep counting, under a fresh entry
+	clear(connClients)
+	for c, info := range conns {
+		info.client = clientOf(c.RemoteAddr())
+		info.client.open++
+	}
+	connsMu.Unlock()
+}
+
+// trackConnState is the HTTP server's ConnState hook. Every transition to
+// active is a request, so a connection's second and later ones show that the
+// client (often the sidecar) kept it alive and reused it. Going idle or
+// closing also ends the write phase of the request just served.
+func trackConnState(c net.Conn, state http.ConnState) {
+	now := time.Now()
+	if state == http.StateIdle || state == http.StateClosed {
+		if tc := timedConnOf(c); tc != nil {
+			tc.responded(now)
+		}
+	}
+	connsMu.Lock()
+	defer connsMu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		connsOpened.Add(1)
+		cc := clientOf(c.RemoteAddr())
+		cc.opened++
+		cc.open++
+		conns[c] = &connInfo{opened: now, client: cc}
+	case http.StateActive:
+		info, ok := conns[c]
+		if !ok {
+			return
+		}
+		if info.requests == 0 {
+			connNewRequests.Add(1)
+		} else {
+			connReused.Add(1)
+		}
+		if info.idle {
+			connIdleGaps.Add(meter.Ms(now.Sub(info.idleSince)))
+		}
+		info.requests++
+		info.client.requests++
+		info.idle = false
+	case http.StateIdle:
+		if info, ok := conns[c]; ok {
+			info.idle, info.idleSince = true, now
+		}
+	case http.StateHijacked, http.StateClosed:
+		info, ok := conns[c]
+		if !ok {
+			return
+		}
+		delete(conns, c)
+		info.client.open--
+		connLifetimes.Add(meter.Ms(now.Sub(info.opened)))
+		connRequests.Add(float64(info.requests))
+		// The server closes a connection idle for idleTimeout, once its read
+		// deadline, set after it went idle, expires
+		if state == http.StateClosed && info.idle {
+			if idleTimeout > 0 && now.Sub(info.idleSince) >= idleTimeout {
+				connsReaped.Add(1)
+				info.client.reaped++
+			} else {
+				connsClosedIdle.Add(1)
+				info.client.closedIdle++
+			}
+		}
+	}
+}
+
+// connectionStats snapshots the HTTP connection counters and windows.
+func connectionStats() meter.ConnectionStats {
+	stats := meter.ConnectionStats{
+		OpenedTotal:    connsOpened.Load(),
+		NewRequests:    connNewRequests.Load(),
+		ReusedRequests: connReused.Load(),
+	}
+	stats.KeepAlive = keepAlive
+	stats.IdleTimeout = meter.Ms(idleTimeout)
+	stats.Reaped = connsReaped.Load()
+	stats.ClosedIdle = connsClosedIdle.Load()
+	connsMu.Lock()
+	stats.Open = len(conns)
+	for _, info := range conns {
+		if info.idle {
+			stats.Idle++
+		}
+	}
+	if len(connClients) > 0 {
+		stats.Clients = make(map[string]meter.ConnClientStats, len(connClients))
+		for client, cc := range connClients {
+			cs := meter.ConnClientStats{
+				Opened:     cc.opened,
+				Open:       cc.open,
+				Requests:   cc.requests,
+				Reaped:     cc.reaped,
+				ClosedIdle: cc.closedIdle,
+			}
+			if cc.opened > 0 {
+				cs.RequestsPerConn = meter.Round(float64(cc.requests) / float64(cc.opened))
+			}
+			stats.Clients[client] = cs
+		}
+	}
+	connsMu.Unlock()
+
+	if total := stats.NewRequests + stats.ReusedRequests; total > 0 {
+		stats.ReusePercent = meter.Round(float64(stats.ReusedRequests) / float64(total) * 100)
+	}
+	if lifetimes := connLifetimes.Values(); len(lifetimes) > 0 {
+		l := meter.Summarize(lifetimes)
+		stats.AvgLifetime = l.Avg
+		stats.P50Lifetime = l.P50
+		stats.P99Lifetime = l.P99
+		stats.MaxLifetime = l.Max
+	}
+	if requests := connRequests.Values(); len(requests) > 0 {
+		stats.AvgRequestsPerConn = meter.Summarize(requests).Avg
+	}
+	if gaps := connIdleGaps.Values(); len(gaps) > 0 {
+		g := meter.Summarize(gaps)
+		stats.AvgIdleBeforeReuse = g.Avg
+		stats.P50IdleBeforeReuse = g.P50
+		stats.P99IdleBeforeReuse = g.P99
+		stats.MaxIdleBeforeReuse = g.Max
+	}
+	return stats
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule decides when a synthetic check runs next.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// everySchedule runs at a fixed interval.
+type everySchedule time.Duration
+
+func (e everySchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cronSchedule is a five-field cron expression: minute, hour, day of month,
+// month and day of week, each a set of allowed values. It is evaluated in
+// the process's local time zone, which is UTC in most containers.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both day fields are restricted a day matching either
+	// one will do
+	domAny, dowAny bool
+}
+
+// cronShortcuts are the @ forms accepted besides @every.
+var cronShortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// parseSchedule parses "@every 30s", an @ shortcut such as "@hourly", or a
+// cron expression such as "*/5 9-17 * * 1-5".
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("schedule %q: want @every and a duration of at least 1s", spec)
+		}
+		return everySchedule(interval), nil
+	}
+	if expanded, ok := cronShortcuts[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want @every DURATION or five cron fields", spec)
+	}
+	var c cronSchedule
+	var err error
+	for i, f := range []struct {
+		set      *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}} {
+		if *f.set, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", spec, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 { // 7 is Sunday too
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges (a-b), *
+// and steps (*/n, a-b/n, a/n) into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value in %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first matching minute after after, or the zero time if
+// there is none within five years (e.g. 30 February).
+func (c cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case c.month&(1<<m) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// validConsumer restricts delta consumer names to short identifiers
+var validConsumer = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// deltaResponse is the body of GET /stats/delta.
+type deltaResponse struct {
+	Consumer string            `json:"consumer"`
+	HTTP     meter.Delta       `json:"http"`
+	GRPC     meter.Delta       `json:"grpc"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// deltaHandler serves GET /stats/delta?consumer=NAME: the HTTP and gRPC
+// requests and latency histograms recorded since NAME last called, for
+// backends that want delta temporality (OTLP, StatsD). Each consumer has its
+// own windows, so exporters sharing a pod neither double-count nor leave
+// gaps. A consumer's first call starts its windows and returns them empty.
+func deltaHandler(w http.ResponseWriter, r *http.Request) {
+	consumer := r.URL.Query().Get("consumer")
+	if !validConsumer.MatchString(consumer) {
+		http.Error(w, "consumer must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+
+	httpDelta, err := httpMeter.CollectDelta(consumer)
+	if errors.Is(err, meter.ErrTooManyConsumers) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	grpcDelta, _ := grpcMeter.CollectDelta(consumer)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deltaResponse{
+		Consumer: consumer,
+		HTTP:     httpDelta,
+		GRPC:     grpcDelta,
+		Labels:   meter.Labels(),
+	})
+}
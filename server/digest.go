@@ -0,0 +1,31 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// digestResponse is the body of GET /stats/digest.
+type digestResponse struct {
+	Pod    string            `json:"pod"`
+	HTTP   *meter.Digest     `json:"http"`
+	GRPC   *meter.Digest     `json:"grpc"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// digestHandler serves GET /stats/digest: the latencies of the sample window
+// behind the /stats percentiles, as mergeable digests, so external tools can
+// add up every pod's and read cluster-wide percentiles from the sum.
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	hostname, _ := os.Hostname()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digestResponse{
+		Pod:    hostname,
+		HTTP:   meter.DigestOf(httpMeter.Snapshot().Latencies),
+		GRPC:   meter.DigestOf(grpcMeter.Snapshot().Latencies),
+		Labels: meter.Labels(),
+	})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// draining is set once a drain starts: /readyz fails and gRPC health
+	// reports NOT_SERVING so endpoints stop routing new work here
+	draining     atomic.Bool
+	drainMu      sync.Mutex
+	drainStarted time.Time
+
+	// shuttingDown is set once a shutdown has begun; the drain can no longer
+	// be cancelled
+	shuttingDown atomic.Bool
+
+	// drainDelay is how long to keep serving after readiness flips, while
+	// the endpoint removal propagates; drainTimeout bounds the wait for
+	// in-flight requests on shutdown. Both are set by Run.
+	drainDelay   time.Duration
+	drainTimeout time.Duration
+)
+
+// drainState is the JSON view of /admin/drain.
+type drainState struct {
+	Draining       bool       `json:"draining"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	DelaySeconds   float64    `json:"delay_seconds"`
+	TimeoutSeconds float64    `json:"timeout_seconds"`
+}
+
+func currentDrain() drainState {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	st := drainState{
+		Draining:       draining.Load(),
+		DelaySeconds:   drainDelay.Seconds(),
+		TimeoutSeconds: drainTimeout.Seconds(),
+	}
+	if st.Draining {
+		started := drainStarted
+		st.StartedAt = &started
+	}
+	return st
+}
+
+// startDrain flips readiness and gRPC health to not serving. It returns
+// when the drain started, which is earlier than now if one was already
+// under way.
+func startDrain(reason string) time.Time {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if draining.Load() {
+		return drainStarted
+	}
+	drainStarted = time.Now()
+	draining.Store(true)
+	setAllGRPCHealth(healthNotServing)
+	infof("Draining (%s): readiness is now failing", reason)
+	return drainStarted
+}
+
+// cancelDrain makes the pod ready again after a drain that was not
+// followed by a shutdown. It reports false once shutdown has begun.
+func cancelDrain() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if shuttingDown.Load() {
+		return false
+	}
+	if !draining.Load() {
+		return true
+	}
+	draining.Store(false)
+	drainStarted = time.Time{}
+	if started() {
+		setAllGRPCHealth(healthServing)
+	}
+	infof("Drain cancelled: readiness restored")
+	return true
+}
+
+// waitDrainDelay blocks until the drain started at started has lasted delay.
+func waitDrainDelay(started time.Time, delay time.Duration) {
+	time.Sleep(time.Until(started.Add(delay)))
+}
+
+// shutdown drains and stops servers: readiness flips, new work keeps being
+// served for delay (less any time an earlier /admin/drain already spent),
+// then the listeners close and in-flight requests get up to drainTimeout to
+// finish.
+func shutdown(reason string, delay time.Duration, servers ...*http.Server) {
+	drainMu.Lock()
+	shuttingDown.Store(true)
+	drainMu.Unlock()
+	waitDrainDelay(startDrain(reason), delay)
+	shutdownServers(servers)
+}
+
+// shutdownServers closes the servers' listeners and gives in-flight requests
+// up to drainTimeout to finish.
+func shutdownServers(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				warnf("Shutdown of %s: %v", srv.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	infof("Drained in-flight requests in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// readyHandler serves /readyz for Kubernetes readiness probes: 200 while
+// serving, 503 until simulated initialization has finished and once
+// draining.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if !started() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	markReady()
+	w.Write([]byte("ready\n"))
+}
+
+// drainHandler serves /admin/drain:
+//
+//	GET    - show the drain state
+//	POST   - start draining and return once the drain delay has passed, for
+//	         use as a preStop hook
+//	DELETE - cancel a drain and become ready again
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		waitDrainDelay(startDrain("/admin/drain"), drainDelay)
+	case http.MethodDelete:
+		if !cancelDrain() {
+			http.Error(w, "shutting down", http.StatusConflict)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentDrain())
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// dumpPrefix starts every line of a diagnostic dump, so the block can be
+// pulled out of interleaved container logs with grep.
+const dumpPrefix = "podmeter-dump"
+
+var (
+	// dumpOutput is where diagnostic dumps are written: the log's own output,
+	// without the recent-lines ring, which one dump would flush.
+	dumpOutput io.Writer = os.Stderr
+
+	dumpMu sync.Mutex
+)
+
+// writeDiagnosticDump writes stats, config, topology and every goroutine's
+// stack to the log as one block, whatever the log level. Each line reads
+// `podmeter-dump <id> <section> <content>`; the JSON sections are one line
+// each. It returns the dump's ID and size.
+func writeDiagnosticDump(reason string) (id string, size int) {
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+
+	now := time.Now().UTC()
+	id = now.Format("20060102T150405.000Z")
+	// No caller: a signal or an admin request, neither of which is traffic
+	r, _ := http.NewRequest(http.MethodGet, "/stats", nil)
+	r.RemoteAddr = reason
+
+	var buf bytes.Buffer
+	line := func(section, content string) {
+		fmt.Fprintf(&buf, "%s %s %s %s\n", dumpPrefix, id, section, content)
+	}
+	jsonLine := func(section string, v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			data = []byte(fmt.Sprintf("%q", err.Error()))
+		}
+		line(section, string(data))
+	}
+
+	line("begin", fmt.Sprintf("reason=%s at=%s", reason, now.Format(time.RFC3339Nano)))
+	jsonLine("stats", CollectStats(r))
+	cfg := configView()
+	cfg["env"] = redactedEnv()
+	jsonLine("config", cfg)
+	jsonLine("topology", topology(r))
+
+	var prof bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&prof, 2)
+	scanner := bufio.NewScanner(&prof)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line("goroutines", scanner.Text())
+	}
+	line("end", "")
+
+	if _, err := dumpOutput.Write(buf.Bytes()); err != nil {
+		errorf("Diagnostic dump failed: %v", err)
+	}
+	return id, buf.Len()
+}
+
+// dumpHandler serves POST /admin/dump: it writes the same diagnostic dump as
+// SIGQUIT to the log, and answers with the ID to grep for.
+func dumpHandler(w http.ResponseWriter, r *http.Request) {
+	id, size := writeDiagnosticDump("admin")
+	infof("Diagnostic dump %s written (%d bytes)", id, size)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":    id,
+		"bytes": size,
+		"grep":  fmt.Sprintf("%s %s ", dumpPrefix, id),
+	})
+}
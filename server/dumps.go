@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// goroutinesHandler serves GET /debug/goroutines: the stack of every
+// goroutine, in the format of an unrecovered panic.
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# %d goroutines at %s\n\n", runtime.NumGoroutine(), time.Now().UTC().Format(time.RFC3339))
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// heapHandler serves GET /debug/heap: a heap profile for `go tool pprof`.
+// ?gc=1 runs a collection first so the profile reflects live memory only;
+// ?debug=1 returns the human-readable text form instead.
+func heapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	if r.URL.Query().Get("debug") == "1" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		pprof.Lookup("heap").WriteTo(w, 1)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="heap-%s.pprof"`, time.Now().UTC().Format("20060102T150405Z")))
+	pprof.Lookup("heap").WriteTo(w, 0)
+}
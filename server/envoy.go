@@ -0,0 +1,161 @@
+package server
+
+import (
+	"cmp"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// envoyRefresh is how long a sidecar summary is reused. The cluster dump
+	// of a large mesh is expensive for Envoy to produce.
+	envoyRefresh = 10 * time.Second
+	// envoyClustersReported caps the clusters listed by name
+	envoyClustersReported = 10
+	// breakerGauges selects the circuit breaker state gauges from /stats
+	breakerGauges = `^cluster\..*\.circuit_breakers\..*_open$`
+)
+
+var (
+	envoySummaryMu sync.Mutex
+	envoySummary   *meter.EnvoyStats
+)
+
+// envoyStats summarizes the health of the pod's sidecar from its admin
+// interface, or returns nil when there is no sidecar.
+func envoyStats() *meter.EnvoyStats {
+	if !hops.SidecarPresent() {
+		return nil
+	}
+	envoySummaryMu.Lock()
+	defer envoySummaryMu.Unlock()
+	if envoySummary != nil && time.Since(envoySummary.CheckedAt) < envoyRefresh {
+		return envoySummary
+	}
+	envoySummary = summarizeEnvoy()
+	return envoySummary
+}
+
+// envoyHostStatus is the part of a host in /clusters?format=json we read.
+type envoyHostStatus struct {
+	HealthStatus struct {
+		EDSHealthStatus            string `json:"eds_health_status"`
+		FailedActiveHealthCheck    bool   `json:"failed_active_health_check"`
+		FailedOutlierCheck         bool   `json:"failed_outlier_check"`
+		FailedActiveDegradedCheck  bool   `json:"failed_active_degraded_check"`
+		ExcludedViaImmediateHCFail bool   `json:"excluded_via_immediate_hc_fail"`
+		ActiveHCTimeout            bool   `json:"active_hc_timeout"`
+	} `json:"health_status"`
+}
+
+// health classifies a host as Envoy's load balancer would: only healthy and
+// degraded hosts receive traffic.
+func (h envoyHostStatus) health() string {
+	hs := h.HealthStatus
+	switch {
+	case hs.FailedActiveHealthCheck, hs.FailedOutlierCheck, hs.ExcludedViaImmediateHCFail, hs.ActiveHCTimeout,
+		hs.EDSHealthStatus == "UNHEALTHY", hs.EDSHealthStatus == "DRAINING", hs.EDSHealthStatus == "TIMEOUT":
+		return "unhealthy"
+	case hs.FailedActiveDegradedCheck, hs.EDSHealthStatus == "DEGRADED":
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// summarizeEnvoy reads listeners, clusters and circuit breaker gauges from
+// the sidecar. Whatever could be read is reported, with the first failure
+// in LastError.
+func summarizeEnvoy() *meter.EnvoyStats {
+	s := &meter.EnvoyStats{CheckedAt: time.Now().UTC()}
+	fail := func(err error) {
+		if s.LastError == "" {
+			s.LastError = err.Error()
+		}
+	}
+
+	var listeners struct {
+		ListenerStatuses []struct {
+			Name string `json:"name"`
+		} `json:"listener_statuses"`
+	}
+	if err := hops.EnvoyAdminJSON("/listeners?format=json", &listeners); err != nil {
+		fail(err)
+	}
+	s.Listeners = len(listeners.ListenerStatuses)
+
+	var clusters struct {
+		ClusterStatuses []struct {
+			Name         string            `json:"name"`
+			HostStatuses []envoyHostStatus `json:"host_statuses"`
+		} `json:"cluster_statuses"`
+	}
+	if err := hops.EnvoyAdminJSON("/clusters?format=json", &clusters); err != nil {
+		fail(err)
+	}
+	s.Clusters = len(clusters.ClusterStatuses)
+	for _, c := range clusters.ClusterStatuses {
+		ch := meter.EnvoyClusterHealth{Name: c.Name}
+		for _, h := range c.HostStatuses {
+			switch h.health() {
+			case "unhealthy":
+				ch.Unhealthy++
+			case "degraded":
+				ch.Degraded++
+			default:
+				ch.Healthy++
+			}
+			if h.HealthStatus.FailedOutlierCheck {
+				s.OutlierEjectedHosts++
+			}
+		}
+		s.HealthyHosts += ch.Healthy
+		s.DegradedHosts += ch.Degraded
+		s.UnhealthyHosts += ch.Unhealthy
+		if ch.Unhealthy > 0 {
+			s.UnhealthyClusters = append(s.UnhealthyClusters, ch)
+		}
+	}
+	slices.SortFunc(s.UnhealthyClusters, func(a, b meter.EnvoyClusterHealth) int {
+		if c := cmp.Compare(b.Unhealthy, a.Unhealthy); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	if len(s.UnhealthyClusters) > envoyClustersReported {
+		s.UnhealthyClusters = s.UnhealthyClusters[:envoyClustersReported]
+	}
+
+	// Each cluster has cx_open, rq_open, rq_pending_open and rq_retry_open
+	// gauges per priority, set to 1 while that breaker is tripped
+	var gauges struct {
+		Stats []struct {
+			Name  string `json:"name"`
+			Value int64  `json:"value"`
+		} `json:"stats"`
+	}
+	if err := hops.EnvoyAdminJSON("/stats?format=json&usedonly&filter="+url.QueryEscape(breakerGauges), &gauges); err != nil {
+		fail(err)
+	}
+	for _, g := range gauges.Stats {
+		if g.Value == 0 {
+			continue
+		}
+		// cluster.<name>.circuit_breakers.<priority>.<breaker>_open, where
+		// the cluster name itself contains dots
+		name := strings.TrimPrefix(g.Name, "cluster.")
+		i := strings.LastIndex(name, ".circuit_breakers.")
+		if i < 0 {
+			continue
+		}
+		breaker := strings.TrimSuffix(name[i+len(".circuit_breakers."):], "_open")
+		s.CircuitBreakersOpen = append(s.CircuitBreakersOpen, name[:i]+" "+breaker)
+	}
+	slices.Sort(s.CircuitBreakersOpen)
+	return s
+}
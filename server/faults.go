@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// faultHeader is the request header used to trigger per-request faults,
+// modelled on Envoy's HTTP fault filter. Example:
+//
+//	X-PodMeter-Fault: delay=200ms;abort=503;percent=50
+const faultHeader = "X-PodMeter-Fault"
+
+// maxFaultDelay caps header-requested delays so a single request cannot tie up
+// a handler goroutine indefinitely.
+const maxFaultDelay = 60 * time.Second
+
+// headerFault is a parsed X-PodMeter-Fault directive.
+type headerFault struct {
+	Delay   time.Duration // Extra latency before responding
+	Abort   int           // HTTP status to return instead of OK (0 = no abort)
+	Percent float64       // Probability (0-100) that the fault applies
+	Panic   bool          // Panic in the handler, after any delay
+}
+
+var (
+	faultsInjected atomic.Int64
+	faultAborts    atomic.Int64
+)
+
+// parseFaultHeader parses a fault directive of semicolon-separated key=value
+// pairs. Supported keys are delay (Go duration), abort (HTTP error status),
+// panic (true or false) and percent (0-100, defaults to 100).
+func parseFaultHeader(value string) (*headerFault, error) {
+	fault := &headerFault{Percent: 100}
+
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed fault directive %q", part)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+
+		switch key {
+		case "delay":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 || d > maxFaultDelay {
+				return nil, fmt.Errorf("invalid delay %q (must be a duration up to %s)", val, maxFaultDelay)
+			}
+			fault.Delay = d
+		case "abort":
+			code, err := strconv.Atoi(val)
+			if err != nil || code < 400 || code > 599 {
+				return nil, fmt.Errorf("invalid abort status %q (must be 400-599)", val)
+			}
+			fault.Abort = code
+		case "panic":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid panic %q (must be true or false)", val)
+			}
+			fault.Panic = b
+		case "percent":
+			p, err := strconv.ParseFloat(val, 64)
+			if err != nil || p < 0 || p > 100 {
+				return nil, fmt.Errorf("invalid percent %q", val)
+			}
+			fault.Percent = p
+		default:
+			return nil, fmt.Errorf("unknown fault directive %q", key)
+		}
+	}
+
+	return fault, nil
+}
+
+// applies rolls the dice for the fault's percentage.
+func (f *headerFault) applies() bool {
+	return f.Percent >= 100 || rand.Float64()*100 < f.Percent
+}
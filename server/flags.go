@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Feature flags for the optional parts of the server. See meter.DefineFlag.
+const (
+	flagChaos         = "chaos"            // /admin/chaos experiments
+	flagChain         = "chain"            // /chain forwarding
+	flagFaultHeader   = "fault_header"     // X-PodMeter-Fault request header
+	flagLeakDetection = "leak_detection"   // Goroutine leak reporting
+	flagParquetExport = "exporter.parquet" // /stats/history.parquet
+)
+
+func init() {
+	meter.DefineFlag(flagChaos, "Apply /admin/chaos experiments to the workload", true)
+	meter.DefineFlag(flagChain, "Forward /chain requests to the PodMeter instances named in via", true)
+	meter.DefineFlag(flagFaultHeader, "Honour the X-PodMeter-Fault request header", true)
+	meter.DefineFlag(flagLeakDetection, "Report suspected goroutine leaks in snapshots", true)
+	meter.DefineFlag(flagParquetExport, "Serve the snapshot history as Parquet", true)
+}
+
+// flagsHandler serves GET /admin/flags, listing every feature flag.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meter.Flags())
+}
+
+// setFlagHandler serves POST /admin/flags/{name}/enable and
+// /admin/flags/{name}/disable.
+func setFlagHandler(w http.ResponseWriter, r *http.Request) {
+	var enabled bool
+	switch r.PathValue("action") {
+	case "enable":
+		enabled = true
+	case "disable":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	name := r.PathValue("name")
+	if err := meter.SetFlag(name, enabled); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	flagsHandler(w, r)
+}
+
+// requireFlag wraps h so it answers 404 while the named flag is off.
+func requireFlag(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !meter.FlagEnabled(name) {
+			http.Error(w, "disabled by feature flag "+name, http.StatusNotFound)
+			return
+		}
+		h(w, r)
+	}
+}
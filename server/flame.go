@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// pprof profile.proto field numbers, for the parts a flame graph needs.
+const (
+	pprofSampleType  = 1
+	pprofSample      = 2
+	pprofLocation    = 4
+	pprofFunction    = 5
+	pprofStringTable = 6
+	pprofDuration    = 10
+
+	pprofSampleLocation = 1
+	pprofSampleValue    = 2
+
+	pprofLocationID   = 1
+	pprofLocationLine = 4
+	pprofLineFunction = 1
+
+	pprofFunctionID        = 1
+	pprofFunctionName      = 2
+	pprofFunctionFile      = 4
+	pprofFunctionStartLine = 5
+
+	pprofValueTypeUnit = 2
+)
+
+// pprofFunc is a function of a decoded profile, with string table indices
+// resolved.
+type pprofFunc struct {
+	Name, File string
+	Line       int
+}
+
+// pprofStack is one sample: its value and its functions, root first.
+type pprofStack struct {
+	Funcs []uint64
+	Value int64
+}
+
+// decodedProfile is what a flame graph needs from a pprof profile: the
+// samples of its last sample type (CPU nanoseconds for a CPU profile).
+type decodedProfile struct {
+	Unit     string
+	Duration time.Duration
+	Funcs    map[uint64]pprofFunc
+	Stacks   []pprofStack
+}
+
+// decodeProfile decodes a gzipped pprof profile as written by runtime/pprof.
+func decodeProfile(data []byte) (*decodedProfile, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		strs       []string
+		units      []int64 // String index of each sample type's unit
+		samples    []pprofStack
+		locs       = make(map[uint64][]uint64) // Location -> functions, inlined callees first
+		funcs      = make(map[uint64][3]int64) // Function -> name, file, start line
+		durationNs int64
+	)
+	err = parseProto(raw, func(f protoField) error {
+		switch f.Num {
+		case pprofStringTable:
+			strs = append(strs, string(f.Bytes))
+		case pprofDuration:
+			durationNs = int64(f.Varint)
+		case pprofSampleType:
+			var unit int64
+			err := parseProto(f.Bytes, func(f protoField) error {
+				if f.Num == pprofValueTypeUnit {
+					unit = int64(f.Varint)
+				}
+				return nil
+			})
+			units = append(units, unit)
+			return err
+		case pprofSample:
+			var s pprofStack
+			var values []int64
+			err := parseProto(f.Bytes, func(f protoField) error {
+				switch f.Num {
+				case pprofSampleLocation:
+					return repeatedUints(f, func(v uint64) { s.Funcs = append(s.Funcs, v) })
+				case pprofSampleValue:
+					return repeatedUints(f, func(v uint64) { values = append(values, int64(v)) })
+				}
+				return nil
+			})
+			if len(values) > 0 {
+				s.Value = values[len(values)-1]
+			}
+			samples = append(samples, s) // Funcs holds location IDs, leaf first, until resolved
+			return err
+		case pprofLocation:
+			var id uint64
+			var fns []uint64
+			err := parseProto(f.Bytes, func(f protoField) error {
+				switch f.Num {
+				case pprofLocationID:
+					id = f.Varint
+				case pprofLocationLine:
+					return parseProto(f.Bytes, func(f protoField) error {
+						if f.Num == pprofLineFunction {
+							fns = append(fns, f.Varint)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			locs[id] = fns
+			return err
+		case pprofFunction:
+			var id uint64
+			var fn [3]int64
+			err := parseProto(f.Bytes, func(f protoField) error {
+				switch f.Num {
+				case pprofFunctionID:
+					id = f.Varint
+				case pprofFunctionName:
+					fn[0] = int64(f.Varint)
+				case pprofFunctionFile:
+					fn[1] = int64(f.Varint)
+				case pprofFunctionStartLine:
+					fn[2] = int64(f.Varint)
+				}
+				return nil
+			})
+			funcs[id] = fn
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode profile: %w", err)
+	}
+
+	str := func(i int64) string {
+		if i >= 0 && int(i) < len(strs) {
+			return strs[i]
+		}
+		return ""
+	}
+	p := &decodedProfile{Duration: time.Duration(durationNs), Funcs: make(map[uint64]pprofFunc, len(funcs))}
+	if len(units) > 0 {
+		p.Unit = str(units[len(units)-1])
+	}
+	for id, fn := range funcs {
+		p.Funcs[id] = pprofFunc{Name: str(fn[0]), File: str(fn[1]), Line: int(fn[2])}
+	}
+	for _, s := range samples {
+		var stack []uint64
+		for _, loc := range s.Funcs {
+			stack = append(stack, locs[loc]...)
+		}
+		slices.Reverse(stack)
+		p.Stacks = append(p.Stacks, pprofStack{Funcs: stack, Value: s.Value})
+	}
+	return p, nil
+}
+
+// repeatedUints calls fn for each value of a repeated integer field, which
+// runtime/pprof packs when it has more than two values.
+func repeatedUints(f protoField, fn func(uint64)) error {
+	if f.Type != wireBytes {
+		fn(f.Varint)
+		return nil
+	}
+	for b := f.Bytes; len(b) > 0; {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		fn(v)
+		b = b[n:]
+	}
+	return nil
+}
+
+// speedscopeFile is the speedscope file format
+// (https://www.speedscope.app/file-format-schema.json), one sampled profile.
+type speedscopeFile struct {
+	Schema string `json:"$schema"`
+	Shared struct {
+		Frames []speedscopeFrame `json:"frames"`
+	} `json:"shared"`
+	Profiles []speedscopeProfile `json:"profiles"`
+	Name     string              `json:"name"`
+	Exporter string              `json:"exporter"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+type speedscopeProfile struct {
+	Type       string  `json:"type"`
+	Name       string  `json:"name"`
+	Unit       string  `json:"unit"`
+	StartValue int64   `json:"startValue"`
+	EndValue   int64   `json:"endValue"`
+	Samples    [][]int `json:"samples"` // Frame indices, root first
+	Weights    []int64 `json:"weights"`
+}
+
+// speedscope converts p to a speedscope file.
+func (p *decodedProfile) speedscope(name string) speedscopeFile {
+	var f speedscopeFile
+	f.Schema = "https://www.speedscope.app/file-format-schema.json"
+	f.Name, f.Exporter = name, "podmeter"
+
+	ids := make([]uint64, 0, len(p.Funcs))
+	for id := range p.Funcs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	frame := make(map[uint64]int, len(ids))
+	for i, id := range ids {
+		fn := p.Funcs[id]
+		frame[id] = i
+		f.Shared.Frames = append(f.Shared.Frames, speedscopeFrame{Name: fn.Name, File: fn.File, Line: fn.Line})
+	}
+
+	prof := speedscopeProfile{Type: "sampled", Name: name, Unit: "none", Samples: [][]int{}, Weights: []int64{}}
+	switch p.Unit {
+	case "nanoseconds", "microseconds", "milliseconds", "seconds", "bytes":
+		prof.Unit = p.Unit
+	}
+	for _, s := range p.Stacks {
+		stack := make([]int, len(s.Funcs))
+		for i, id := range s.Funcs {
+			stack[i] = frame[id]
+		}
+		prof.Samples = append(prof.Samples, stack)
+		prof.Weights = append(prof.Weights, s.Value)
+		prof.EndValue += s.Value
+	}
+	f.Profiles = []speedscopeProfile{prof}
+	return f
+}
+
+// flameNode is a frame of the flame graph: the total value of the samples
+// whose stacks pass through it.
+type flameNode struct {
+	Name     string       `json:"n"`
+	Value    int64        `json:"v"`
+	Children []*flameNode `json:"c,omitempty"`
+}
+
+// flameTree merges p's stacks by function name under a root "all" frame,
+// with children in name order as flame graphs draw them.
+func (p *decodedProfile) flameTree() *flameNode {
+	root := &flameNode{Name: "all"}
+	for _, s := range p.Stacks {
+		node := root
+		node.Value += s.Value
+		for _, id := range s.Funcs {
+			name := p.Funcs[id].Name
+			i := slices.IndexFunc(node.Children, func(c *flameNode) bool { return c.Name == name })
+			if i < 0 {
+				node.Children = append(node.Children, &flameNode{Name: name})
+				i = len(node.Children) - 1
+			}
+			node = node.Children[i]
+			node.Value += s.Value
+		}
+	}
+	var sortChildren func(n *flameNode)
+	sortChildren = func(n *flameNode) {
+		slices.SortFunc(n.Children, func(a, b *flameNode) int { return strings.Compare(a.Name, b.Name) })
+		for _, c := range n.Children {
+			sortChildren(c)
+		}
+	}
+	sortChildren(root)
+	return root
+}
+
+var flamePage = template.Must(template.New("flame").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>PodMeter CPU flame graph: {{.Host}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+p { color: #666; }
+#flame { position: relative; width: 100%; }
+.f { position: absolute; height: 17px; overflow: hidden; white-space: nowrap; font: 12px monospace; line-height: 17px;
+     padding-left: 2px; box-sizing: border-box; border: 1px solid #fff; cursor: pointer; }
+.f:hover { border-color: #000; }
+#info { font: 12px monospace; min-height: 1.5em; }
+</style>
+</head>
+<body>
+<h1>CPU flame graph: {{.Host}}</h1>
+<p>{{.Captured}} &middot; {{.Duration}} &middot; click a frame to zoom, <a href="#" id="reset">reset</a></p>
+<div id="info"></div>
+<div id="flame"></div>
+<script>
+const root = {{.Tree}};
+const unit = {{.Unit}};
+const el = document.getElementById("flame"), info = document.getElementById("info");
+const rowHeight = 17;
+
+function depth(n) { let d = 0; for (const c of n.c || []) d = Math.max(d, depth(c)); return d + 1; }
+function amount(v) { return unit === "nanoseconds" ? (v / 1e6).toFixed(1) + " ms" : v + " " + unit; }
+function color(name) {
+  let h = 0;
+  for (let i = 0; i < name.length; i++) h = (h * 31 + name.charCodeAt(i)) >>> 0;
+  return "hsl(" + (10 + h % 40) + ", 80%, " + (55 + h % 15) + "%)";
+}
+
+function render(focus) {
+  el.innerHTML = "";
+  const rows = depth(focus);
+  el.style.height = rows * rowHeight + "px";
+  const draw = (n, x, d) => {
+    const w = n.v / focus.v;
+    if (w < 0.001) return;
+    const f = document.createElement("div");
+    f.className = "f";
+    f.style.left = x * 100 + "%";
+    f.style.width = w * 100 + "%";
+    f.style.top = (rows - d - 1) * rowHeight + "px";
+    f.style.background = color(n.n);
+    f.textContent = n.n;
+    const text = n.n + ": " + amount(n.v) + " (" + (n.v / root.v * 100).toFixed(2) + "%)";
+    f.title = text;
+    f.onmouseover = () => { info.textContent = text; };
+    f.onclick = () => render(n);
+    el.appendChild(f);
+    for (const c of n.c || []) { draw(c, x, d + 1); x += c.v / focus.v; }
+  };
+  draw(focus, 0, 0);
+}
+document.getElementById("reset").onclick = e => { e.preventDefault(); render(root); };
+render(root);
+</script>
+</body>
+</html>
+`))
+
+// flameHandler serves GET /admin/profile/flame?seconds=30: it captures a CPU
+// profile like /admin/profile/cpu and returns it as an interactive flame
+// graph page, or with ?format=speedscope as a file to open in speedscope.
+func flameHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "html" && format != "speedscope" {
+		http.Error(w, "format must be html or speedscope", http.StatusBadRequest)
+		return
+	}
+	data, ok := captureCPUProfile(w, r)
+	if !ok {
+		return
+	}
+	p, err := decodeProfile(data)
+	if err != nil {
+		errorf("Profile: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	host, _ := os.Hostname()
+	if format == "speedscope" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cpu-%s.speedscope.json"`, time.Now().UTC().Format("20060102T150405Z")))
+		json.NewEncoder(w).Encode(p.speedscope("CPU " + host))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flamePage.Execute(w, map[string]any{
+		"Host":     host,
+		"Captured": time.Now().UTC().Format(time.RFC3339),
+		"Duration": p.Duration.Round(time.Millisecond).String(),
+		"Tree":     p.flameTree(),
+		"Unit":     p.Unit,
+	})
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// gRPC status codes used by PodMeter (subset of google.rpc.Code).
+const (
+	grpcOK              = 0
+	grpcCanceled        = 1
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+)
+
+// maxGRPCMessageSize mirrors grpc-go's default receive limit.
+const maxGRPCMessageSize = 4 << 20
+
+// grpcMethod implements a single RPC. It writes response messages itself and
+// returns the status code and message to send in the trailers.
+type grpcMethod func(w http.ResponseWriter, r *http.Request) (code int, msg string)
+
+// grpcMethods routes full method names to their implementations.
+var grpcMethods = map[string]grpcMethod{
+	"/podmeter.v1.Echo/Echo":       grpcEcho,
+	"/podmeter.v1.Echo/EchoStream": grpcEchoStream,
+}
+
+var (
+	// grpcMeter records unary calls; streams are only counted
+	grpcMeter          = meter.New(0)
+	grpcStreamsTotal   atomic.Int64
+	grpcActiveStreams  atomic.Int64
+	grpcStreamMessages atomic.Int64
+)
+
+// grpcHandler dispatches gRPC calls arriving over h2c.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only (HTTP/2, application/grpc)", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	code, msg := grpcUnimplemented, "unknown method "+r.URL.Path
+	if method, ok := grpcMethods[r.URL.Path]; ok {
+		code, msg = method(w, r)
+	}
+
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(msg))
+	}
+}
+
+// readGRPCMessage reads one length-prefixed message. It returns io.EOF when
+// the client has half-closed the stream cleanly.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated message prefix")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit of %d", size, maxGRPCMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("truncated message body")
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes one length-prefixed, uncompressed message and flushes
+// it so streaming clients see it immediately.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// grpcEncodeMessage percent-encodes a status message as the gRPC spec requires.
+func grpcEncodeMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// echoReply builds an EchoResponse carrying the message back with the hop
+// counts observed on this call.
+//
+//	message EchoResponse {
+//	  string message = 1;
+//	  string hostname = 2;
+//	  int32 proxy_hop_count = 3;
+//	  int32 service_mesh_hops = 4;
+//	}
+func echoReply(req []byte, r *http.Request) ([]byte, error) {
+	var message string
+	err := parseProto(req, func(f protoField) error {
+		if f.Num == 1 && f.Type == wireBytes {
+			message = string(f.Bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	var out []byte
+	out = appendStringField(out, 1, message)
+	out = appendStringField(out, 2, hostname)
+	out = appendIntField(out, 3, int64(hops.ProxyHops(r)))
+	out = appendIntField(out, 4, int64(hops.ServiceMeshHops(r)))
+	return out, nil
+}
+
+// grpcEcho implements the unary podmeter.v1.Echo/Echo RPC with the same
+// simulated work as the HTTP handler so the two paths are comparable.
+func grpcEcho(w http.ResponseWriter, r *http.Request) (int, string) {
+	start := time.Now()
+	hopCount := hops.TotalHops(r)
+
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		recordGRPCCall(r, start, hopCount, false)
+		return grpcInvalidArgument, err.Error()
+	}
+
+	// Simulate some work
+	time.Sleep(20 * time.Millisecond)
+
+	reply, err := echoReply(req, r)
+	if err != nil {
+		recordGRPCCall(r, start, hopCount, false)
+		return grpcInvalidArgument, err.Error()
+	}
+	recordGRPCCall(r, start, hopCount, true)
+
+	if err := writeGRPCMessage(w, reply); err != nil {
+		return grpcInternal, err.Error()
+	}
+	return grpcOK, ""
+}
+
+// grpcEchoStream implements the bidirectional podmeter.v1.Echo/EchoStream
+// RPC, echoing every request message until the client half-closes.
+func grpcEchoStream(w http.ResponseWriter, r *http.Request) (int, string) {
+	grpcStreamsTotal.Add(1)
+	grpcActiveStreams.Add(1)
+	defer grpcActiveStreams.Add(-1)
+
+	// Send headers right away so clients can start streaming
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	hopCount := hops.TotalHops(r)
+	ok := true
+	defer func() { grpcMeter.Count(hopCount, ok) }()
+
+	for {
+		req, err := readGRPCMessage(r.Body)
+		if err == io.EOF {
+			return grpcOK, ""
+		}
+		if err != nil {
+			ok = false
+			if r.Context().Err() != nil {
+				return grpcCanceled, "stream canceled by client"
+			}
+			return grpcInvalidArgument, err.Error()
+		}
+
+		reply, err := echoReply(req, r)
+		if err != nil {
+			ok = false
+			return grpcInvalidArgument, err.Error()
+		}
+		grpcStreamMessages.Add(1)
+		if err := writeGRPCMessage(w, reply); err != nil {
+			ok = false
+			return grpcInternal, err.Error()
+		}
+	}
+}
+
+// recordGRPCCall records a completed unary call in the gRPC sample window
+// and for the listener it arrived on.
+func recordGRPCCall(r *http.Request, start time.Time, hopCount int, ok bool) {
+	lat := meter.Ms(time.Since(start))
+	grpcMeter.Record(lat, hopCount, ok)
+	if m := listenerMeter(r); m != nil {
+		m.Record(lat, hopCount, ok)
+	}
+}
+
+// grpcStats snapshots the gRPC counters and unary latency window.
+func grpcStats() meter.GRPCStats {
+	snap := grpcMeter.Snapshot()
+
+	stats := meter.GRPCStats{
+		Requests:         snap.Requests,
+		Errors:           snap.Errors,
+		StreamsTotal:     grpcStreamsTotal.Load(),
+		ActiveStreams:    grpcActiveStreams.Load(),
+		StreamMessages:   grpcStreamMessages.Load(),
+		RequestsViaProxy: snap.ViaProxy,
+		AvgProxyHops:     snap.AvgHops(),
+	}
+	if len(snap.Latencies) > 0 {
+		lat := meter.Summarize(snap.Latencies)
+		stats.AvgLatency = lat.Avg
+		stats.P50Latency = lat.P50
+		stats.P95Latency = lat.P95
+		stats.P99Latency = lat.P99
+		stats.P999Latency = lat.P999
+		stats.MinLatency = lat.Min
+		stats.MaxLatency = lat.Max
+	}
+	return stats
+}
+
+// newGRPCServer returns a server for gRPC over cleartext HTTP/2 (h2c with
+// prior knowledge), which is what gRPC clients and mesh sidecars speak
+// in-cluster.
+func newGRPCServer(addr string) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   http.HandlerFunc(grpcHandler),
+		Protocols: &protocols,
+	}
+}
+
+// startGRPCServer serves srv on ln until it is shut down. If serving
+// fails, the error is sent to serveErr, for Run to shut down as for any
+// other listener.
+func startGRPCServer(srv *http.Server, ln net.Listener, serveErr chan<- error) {
+	infof("gRPC server running on %s", ln.Addr())
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		serveErr <- err
+	}
+}
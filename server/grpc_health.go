@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Serving status values from grpc.health.v1.HealthCheckResponse.ServingStatus.
+const (
+	healthUnknown        = 0
+	healthServing        = 1
+	healthNotServing     = 2
+	healthServiceUnknown = 3
+)
+
+var (
+	healthMu     sync.RWMutex
+	healthStatus = map[string]int{
+		"":                      healthServing, // Overall server health
+		"podmeter.v1.Echo":      healthServing,
+		"grpc.health.v1.Health": healthServing,
+	}
+	// healthChanged is closed and replaced whenever any status changes,
+	// waking every Watch stream.
+	healthChanged = make(chan struct{})
+)
+
+func init() {
+	grpcMethods["/grpc.health.v1.Health/Check"] = grpcHealthCheck
+	grpcMethods["/grpc.health.v1.Health/Watch"] = grpcHealthWatch
+}
+
+// setAllGRPCHealth sets the serving status of the server and every service.
+func setAllGRPCHealth(status int) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for service := range healthStatus {
+		healthStatus[service] = status
+	}
+	close(healthChanged)
+	healthChanged = make(chan struct{})
+}
+
+// grpcHealthLookup returns the status for service plus a channel that is
+// closed on the next change.
+func grpcHealthLookup(service string) (status int, known bool, changed <-chan struct{}) {
+	healthMu.RLock()
+	defer healthMu.RUnlock()
+	status, known = healthStatus[service]
+	return status, known, healthChanged
+}
+
+// parseHealthCheckRequest extracts the service name from
+// `message HealthCheckRequest { string service = 1; }`.
+func parseHealthCheckRequest(msg []byte) (string, error) {
+	var service string
+	err := parseProto(msg, func(f protoField) error {
+		if f.Num == 1 && f.Type == wireBytes {
+			service = string(f.Bytes)
+		}
+		return nil
+	})
+	return service, err
+}
+
+// healthCheckResponse encodes `message HealthCheckResponse { ServingStatus status = 1; }`.
+func healthCheckResponse(status int) []byte {
+	return appendIntField(nil, 1, int64(status))
+}
+
+// grpcHealthCheck implements grpc.health.v1.Health/Check.
+func grpcHealthCheck(w http.ResponseWriter, r *http.Request) (int, string) {
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+	service, err := parseHealthCheckRequest(req)
+	if err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+
+	status, known, _ := grpcHealthLookup(service)
+	if !known {
+		return grpcNotFound, "unknown service " + service
+	}
+	if err := writeGRPCMessage(w, healthCheckResponse(status)); err != nil {
+		return grpcInternal, err.Error()
+	}
+	return grpcOK, ""
+}
+
+// grpcHealthWatch implements grpc.health.v1.Health/Watch: it sends the
+// current status immediately and again on every change until the client
+// goes away. Unknown services report SERVICE_UNKNOWN rather than failing, as
+// the protocol requires.
+func grpcHealthWatch(w http.ResponseWriter, r *http.Request) (int, string) {
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+	service, err := parseHealthCheckRequest(req)
+	if err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+
+	last := -1
+	for {
+		status, known, changed := grpcHealthLookup(service)
+		if !known {
+			status = healthServiceUnknown
+		}
+		if status != last {
+			if err := writeGRPCMessage(w, healthCheckResponse(status)); err != nil {
+				return grpcInternal, err.Error()
+			}
+			last = status
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return grpcCanceled, "watch canceled by client"
+		}
+	}
+}
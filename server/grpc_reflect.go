@@ -0,0 +1,643 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// FieldDescriptorProto.Type and .Label values used by PodMeter's descriptors.
+const (
+	protoTypeDouble  = 1
+	protoTypeInt64   = 3
+	protoTypeInt32   = 5
+	protoTypeUint64  = 4
+	protoTypeBool    = 8
+	protoTypeString  = 9
+	protoTypeMessage = 11
+	protoTypeBytes   = 12
+	protoTypeEnum    = 14
+
+	protoLabelOptional = 1
+	protoLabelRepeated = 3
+)
+
+const (
+	podmeterProtoFile = "podmeter.proto"
+	healthProtoFile   = "grpc/health/v1/health.proto"
+)
+
+func init() {
+	grpcMethods["/podmeter.v1.Echo/GetStats"] = grpcGetStats
+	grpcMethods["/podmeter.v1.Echo/EchoMetadata"] = grpcEchoMetadata
+	grpcMethods["/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"] = grpcReflectionInfo
+	grpcMethods["/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"] = grpcReflectionInfo
+}
+
+// Descriptor builders. These emit serialized google.protobuf descriptor
+// messages (descriptor.proto) so reflection clients such as grpcurl can
+// discover PodMeter's API without a shared .proto file.
+
+func fieldDescriptor(name string, number, label, typ int, typeName string) []byte {
+	var b []byte
+	b = appendStringField(b, 1, name)
+	b = appendIntField(b, 3, int64(number))
+	b = appendIntField(b, 4, int64(label))
+	b = appendIntField(b, 5, int64(typ))
+	b = appendStringField(b, 6, typeName)
+	return b
+}
+
+func messageDescriptor(name string, fields, nested, enums [][]byte, mapEntry bool) []byte {
+	var b []byte
+	b = appendStringField(b, 1, name)
+	for _, f := range fields {
+		b = appendBytesField(b, 2, f)
+	}
+	for _, n := range nested {
+		b = appendBytesField(b, 3, n)
+	}
+	for _, e := range enums {
+		b = appendBytesField(b, 4, e)
+	}
+	if mapEntry {
+		// MessageOptions { bool map_entry = 7; }
+		b = appendBytesField(b, 7, appendBoolField(nil, 7, true))
+	}
+	return b
+}
+
+func enumDescriptor(name string, values ...string) []byte {
+	b := appendStringField(nil, 1, name)
+	for i, v := range values {
+		var val []byte
+		val = appendStringField(val, 1, v)
+		// descriptor.proto is proto2, so a zero number must still be written
+		val = appendVarint(appendTag(val, 2, wireVarint), uint64(i))
+		b = appendBytesField(b, 2, val)
+	}
+	return b
+}
+
+func methodDescriptor(name, input, output string, clientStreaming, serverStreaming bool) []byte {
+	var b []byte
+	b = appendStringField(b, 1, name)
+	b = appendStringField(b, 2, input)
+	b = appendStringField(b, 3, output)
+	b = appendBoolField(b, 5, clientStreaming)
+	b = appendBoolField(b, 6, serverStreaming)
+	return b
+}
+
+func serviceDescriptor(name string, methods ...[]byte) []byte {
+	b := appendStringField(nil, 1, name)
+	for _, m := range methods {
+		b = appendBytesField(b, 2, m)
+	}
+	return b
+}
+
+func fileDescriptor(name, pkg string, messages, services [][]byte) []byte {
+	var b []byte
+	b = appendStringField(b, 1, name)
+	b = appendStringField(b, 2, pkg)
+	for _, m := range messages {
+		b = appendBytesField(b, 4, m)
+	}
+	for _, s := range services {
+		b = appendBytesField(b, 6, s)
+	}
+	b = appendStringField(b, 12, "proto3")
+	return b
+}
+
+// Go struct <-> protobuf mapping. The Stats message is derived from the Go
+// Stats struct at runtime so it always mirrors the /stats JSON document:
+// field names are the JSON names and numbers come from the proto tags, so a
+// descriptor fetched from an older build still decodes a newer one's stats.
+
+// goProtoField maps one exported struct field to a protobuf field.
+type goProtoField struct {
+	index  int
+	name   string
+	number int
+}
+
+// goProtoFields lists the fields of t with their proto tag numbers. A field
+// without a number, or one numbered twice, is a bug in t and panics.
+func goProtoFields(t reflect.Type) []goProtoField {
+	var fields []goProtoField
+	numbered := map[int]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		number, err := strconv.Atoi(sf.Tag.Get("proto"))
+		if err != nil || number < 1 || numbered[number] {
+			panic(fmt.Sprintf("%s.%s: want a proto tag with a field number of its own", t, sf.Name))
+		}
+		numbered[number] = true
+		fields = append(fields, goProtoField{index: i, name: name, number: number})
+	}
+	return fields
+}
+
+// protoCamel converts a snake_case field name to CamelCase for nested type names.
+func protoCamel(name string) string {
+	var sb strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return sb.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// scalarProtoType returns the protobuf type for a non-message Go type. Types
+// with no natural mapping are carried as JSON strings.
+func scalarProtoType(t reflect.Type) int {
+	switch t.Kind() {
+	case reflect.Bool:
+		return protoTypeBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return protoTypeInt64
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return protoTypeUint64
+	case reflect.Float32, reflect.Float64:
+		return protoTypeDouble
+	default:
+		return protoTypeString
+	}
+}
+
+// isProtoMessage reports whether t is encoded as an embedded message.
+func isProtoMessage(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// structDescriptor builds a DescriptorProto for the Go struct t. scope is the
+// fully-qualified name of the message being built, used for nested type names.
+func structDescriptor(t reflect.Type, name, scope string) []byte {
+	var fields, nested [][]byte
+	for _, f := range goProtoFields(t) {
+		ft := t.Field(f.index).Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		label := protoLabelOptional
+
+		switch {
+		case ft.Kind() == reflect.Map:
+			entry := protoCamel(f.name) + "Entry"
+			kf := fieldDescriptor("key", 1, protoLabelOptional, scalarProtoType(ft.Key()), "")
+			var vf []byte
+			if isProtoMessage(ft.Elem()) {
+				valName := ft.Elem().Name()
+				nested = append(nested, structDescriptor(ft.Elem(), valName, scope+"."+valName))
+				vf = fieldDescriptor("value", 2, protoLabelOptional, protoTypeMessage, "."+scope+"."+valName)
+			} else {
+				vf = fieldDescriptor("value", 2, protoLabelOptional, scalarProtoType(ft.Elem()), "")
+			}
+			nested = append(nested, messageDescriptor(entry, [][]byte{kf, vf}, nil, nil, true))
+			fields = append(fields, fieldDescriptor(f.name, f.number, protoLabelRepeated, protoTypeMessage, "."+scope+"."+entry))
+			continue
+
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Uint8:
+			fields = append(fields, fieldDescriptor(f.name, f.number, label, protoTypeBytes, ""))
+			continue
+
+		case ft.Kind() == reflect.Slice:
+			label = protoLabelRepeated
+			ft = ft.Elem()
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+		}
+
+		if isProtoMessage(ft) {
+			msgName := ft.Name()
+			if msgName == "" {
+				msgName = protoCamel(f.name)
+			}
+			nested = append(nested, structDescriptor(ft, msgName, scope+"."+msgName))
+			fields = append(fields, fieldDescriptor(f.name, f.number, label, protoTypeMessage, "."+scope+"."+msgName))
+			continue
+		}
+		fields = append(fields, fieldDescriptor(f.name, f.number, label, scalarProtoType(ft), ""))
+	}
+	return messageDescriptor(name, fields, dedupeDescriptors(nested), nil, false)
+}
+
+// dedupeDescriptors drops identical nested definitions, which occur when the
+// same Go struct type is used by more than one field.
+func dedupeDescriptors(in [][]byte) [][]byte {
+	seen := make(map[string]bool)
+	var out [][]byte
+	for _, d := range in {
+		if !seen[string(d)] {
+			seen[string(d)] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// appendProtoValue appends v as field number num, matching structDescriptor.
+// Zero scalars are omitted, as in proto3.
+func appendProtoValue(b []byte, num int, v reflect.Value) []byte {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return b
+		}
+		if v.Kind() == reflect.Interface {
+			// Dynamically typed values are described as JSON strings
+			data, err := json.Marshal(v.Interface())
+			if err != nil {
+				return b
+			}
+			return appendStringField(b, num, string(data))
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return appendBoolField(b, num, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendIntField(b, num, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() == 0 {
+			return b
+		}
+		return appendVarint(appendTag(b, num, wireVarint), v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return appendDoubleField(b, num, v.Float())
+	case reflect.String:
+		return appendStringField(b, num, v.String())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			if t := v.Interface().(time.Time); !t.IsZero() {
+				return appendStringField(b, num, t.Format(time.RFC3339Nano))
+			}
+			return b
+		}
+		return appendBytesField(b, num, encodeStructProto(v))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() == 0 {
+				return b
+			}
+			return appendBytesField(b, num, v.Bytes())
+		}
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if isProtoMessage(reflect.Indirect(elem).Type()) {
+				// Repeated messages are always emitted, even when empty
+				b = appendBytesField(b, num, encodeStructProto(reflect.Indirect(elem)))
+			} else {
+				b = appendRepeatedScalar(b, num, elem)
+			}
+		}
+		return b
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			var entry []byte
+			entry = appendProtoValue(entry, 1, k)
+			if val := v.MapIndex(k); val.Kind() == reflect.Map || val.Kind() == reflect.Slice {
+				// Nested containers are described as JSON strings (see scalarProtoType)
+				data, _ := json.Marshal(val.Interface())
+				entry = appendStringField(entry, 2, string(data))
+			} else {
+				entry = appendProtoValue(entry, 2, val)
+			}
+			b = appendBytesField(b, num, entry)
+		}
+		return b
+	default:
+		// Anything else is carried as its JSON representation
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return b
+		}
+		return appendStringField(b, num, string(data))
+	}
+}
+
+// appendRepeatedScalar appends one element of a repeated scalar field. Unlike
+// singular fields, zero values must be kept so element positions survive.
+func appendRepeatedScalar(b []byte, num int, v reflect.Value) []byte {
+	switch scalarProtoType(v.Type()) {
+	case protoTypeString:
+		s := v.String()
+		if v.Kind() != reflect.String {
+			data, _ := json.Marshal(v.Interface())
+			s = string(data)
+		}
+		b = appendTag(b, num, wireBytes)
+		b = appendVarint(b, uint64(len(s)))
+		return append(b, s...)
+	case protoTypeDouble:
+		b = appendTag(b, num, wireFixed64)
+		return appendDoubleBits(b, v.Float())
+	case protoTypeBool:
+		var x uint64
+		if v.Bool() {
+			x = 1
+		}
+		return appendVarint(appendTag(b, num, wireVarint), x)
+	case protoTypeUint64:
+		return appendVarint(appendTag(b, num, wireVarint), v.Uint())
+	default:
+		return appendVarint(appendTag(b, num, wireVarint), uint64(v.Int()))
+	}
+}
+
+// encodeStructProto serializes a struct according to structDescriptor.
+func encodeStructProto(v reflect.Value) []byte {
+	var b []byte
+	for _, f := range goProtoFields(v.Type()) {
+		b = appendProtoValue(b, f.number, v.Field(f.index))
+	}
+	return b
+}
+
+// File descriptors served through reflection.
+
+var (
+	podmeterDescriptorOnce sync.Once
+	podmeterDescriptor     []byte
+	healthDescriptorOnce   sync.Once
+	healthDescriptor       []byte
+)
+
+// podmeterFileDescriptor describes podmeter.proto, including the runtime
+// derived Stats message.
+func podmeterFileDescriptor() []byte {
+	podmeterDescriptorOnce.Do(func() {
+		str := func(name string, num int) []byte {
+			return fieldDescriptor(name, num, protoLabelOptional, protoTypeString, "")
+		}
+		i64 := func(name string, num int) []byte {
+			return fieldDescriptor(name, num, protoLabelOptional, protoTypeInt64, "")
+		}
+
+		messages := [][]byte{
+			messageDescriptor("EchoRequest", [][]byte{str("message", 1)}, nil, nil, false),
+			messageDescriptor("EchoResponse", [][]byte{
+				str("message", 1),
+				str("hostname", 2),
+				fieldDescriptor("proxy_hop_count", 3, protoLabelOptional, protoTypeInt32, ""),
+				fieldDescriptor("service_mesh_hops", 4, protoLabelOptional, protoTypeInt32, ""),
+			}, nil, nil, false),
+			messageDescriptor("StatsRequest", nil, nil, nil, false),
+			structDescriptor(reflect.TypeOf(meter.Stats{}), "Stats", "podmeter.v1.Stats"),
+			messageDescriptor("MetadataRequest", nil, nil, nil, false),
+			messageDescriptor("MetadataEntry", [][]byte{
+				str("key", 1),
+				fieldDescriptor("values", 2, protoLabelRepeated, protoTypeString, ""),
+			}, nil, nil, false),
+			messageDescriptor("MetadataResponse", [][]byte{
+				str("method", 1),
+				str("authority", 2),
+				str("remote_addr", 3),
+				str("protocol", 4),
+				fieldDescriptor("metadata", 5, protoLabelRepeated, protoTypeMessage, ".podmeter.v1.MetadataEntry"),
+				i64("proxy_hop_count", 6),
+				i64("service_mesh_hops", 7),
+				str("service_mesh_mode", 8),
+				str("hostname", 9),
+			}, nil, nil, false),
+		}
+
+		service := serviceDescriptor("Echo",
+			methodDescriptor("Echo", ".podmeter.v1.EchoRequest", ".podmeter.v1.EchoResponse", false, false),
+			methodDescriptor("EchoStream", ".podmeter.v1.EchoRequest", ".podmeter.v1.EchoResponse", true, true),
+			methodDescriptor("GetStats", ".podmeter.v1.StatsRequest", ".podmeter.v1.Stats", false, false),
+			methodDescriptor("EchoMetadata", ".podmeter.v1.MetadataRequest", ".podmeter.v1.MetadataResponse", false, false),
+		)
+
+		podmeterDescriptor = fileDescriptor(podmeterProtoFile, "podmeter.v1", messages, [][]byte{service})
+	})
+	return podmeterDescriptor
+}
+
+// healthFileDescriptor describes the standard grpc/health/v1/health.proto.
+func healthFileDescriptor() []byte {
+	healthDescriptorOnce.Do(func() {
+		messages := [][]byte{
+			messageDescriptor("HealthCheckRequest", [][]byte{
+				fieldDescriptor("service", 1, protoLabelOptional, protoTypeString, ""),
+			}, nil, nil, false),
+			messageDescriptor("HealthCheckResponse", [][]byte{
+				fieldDescriptor("status", 1, protoLabelOptional, protoTypeEnum, ".grpc.health.v1.HealthCheckResponse.ServingStatus"),
+			}, nil, [][]byte{
+				enumDescriptor("ServingStatus", "UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"),
+			}, false),
+		}
+		service := serviceDescriptor("Health",
+			methodDescriptor("Check", ".grpc.health.v1.HealthCheckRequest", ".grpc.health.v1.HealthCheckResponse", false, false),
+			methodDescriptor("Watch", ".grpc.health.v1.HealthCheckRequest", ".grpc.health.v1.HealthCheckResponse", false, true),
+		)
+		healthDescriptor = fileDescriptor(healthProtoFile, "grpc.health.v1", messages, [][]byte{service})
+	})
+	return healthDescriptor
+}
+
+// reflectionFiles maps file names and top-level symbols to descriptors.
+var reflectionFiles = []struct {
+	name    string
+	pkg     string
+	symbols []string
+	build   func() []byte
+}{
+	{podmeterProtoFile, "podmeter.v1", []string{
+		"Echo", "EchoRequest", "EchoResponse", "StatsRequest", "Stats",
+		"MetadataRequest", "MetadataEntry", "MetadataResponse",
+	}, podmeterFileDescriptor},
+	{healthProtoFile, "grpc.health.v1", []string{
+		"Health", "HealthCheckRequest", "HealthCheckResponse",
+	}, healthFileDescriptor},
+}
+
+// lookupReflectionFile finds a descriptor by file name or by a (possibly
+// nested) fully-qualified symbol such as podmeter.v1.Echo.GetStats.
+func lookupReflectionFile(filename, symbol string) []byte {
+	for _, f := range reflectionFiles {
+		if filename != "" && filename == f.name {
+			return f.build()
+		}
+		if symbol != "" && strings.HasPrefix(symbol, f.pkg+".") {
+			top := strings.SplitN(strings.TrimPrefix(symbol, f.pkg+"."), ".", 2)[0]
+			for _, s := range f.symbols {
+				if s == top {
+					return f.build()
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// grpcReflectionInfo implements the bidirectional ServerReflectionInfo RPC
+// for both grpc.reflection.v1 and v1alpha, which share the same wire format.
+func grpcReflectionInfo(w http.ResponseWriter, r *http.Request) (int, string) {
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	for {
+		req, err := readGRPCMessage(r.Body)
+		if err == io.EOF {
+			return grpcOK, ""
+		}
+		if err != nil {
+			return grpcInvalidArgument, err.Error()
+		}
+
+		var host, filename, symbol string
+		var listServices, extensionNumbers, containingExtension bool
+		var baseType string
+		err = parseProto(req, func(f protoField) error {
+			switch f.Num {
+			case 1:
+				host = string(f.Bytes)
+			case 3:
+				filename = string(f.Bytes)
+			case 4:
+				symbol = string(f.Bytes)
+			case 5:
+				containingExtension = true
+			case 6:
+				extensionNumbers = true
+				baseType = string(f.Bytes)
+			case 7:
+				listServices = true
+			}
+			return nil
+		})
+		if err != nil {
+			return grpcInvalidArgument, err.Error()
+		}
+
+		var resp []byte
+		resp = appendStringField(resp, 1, host)
+		resp = appendBytesField(resp, 2, req)
+
+		switch {
+		case listServices:
+			var list []byte
+			for _, name := range []string{"podmeter.v1.Echo", "grpc.health.v1.Health"} {
+				list = appendBytesField(list, 1, appendStringField(nil, 1, name))
+			}
+			resp = appendBytesField(resp, 6, list)
+
+		case filename != "" || symbol != "":
+			fd := lookupReflectionFile(filename, symbol)
+			if fd == nil {
+				resp = appendBytesField(resp, 7, reflectionError(grpcNotFound, "not found: "+filename+symbol))
+				break
+			}
+			resp = appendBytesField(resp, 4, appendBytesField(nil, 1, fd))
+
+		case extensionNumbers:
+			// PodMeter's messages declare no extensions
+			resp = appendBytesField(resp, 5, appendStringField(nil, 1, baseType))
+
+		case containingExtension:
+			resp = appendBytesField(resp, 7, reflectionError(grpcNotFound, "extensions are not supported"))
+
+		default:
+			resp = appendBytesField(resp, 7, reflectionError(grpcInvalidArgument, "empty reflection request"))
+		}
+
+		if err := writeGRPCMessage(w, resp); err != nil {
+			return grpcInternal, err.Error()
+		}
+	}
+}
+
+// reflectionError encodes an ErrorResponse { int32 error_code = 1; string error_message = 2; }.
+func reflectionError(code int, msg string) []byte {
+	var b []byte
+	b = appendIntField(b, 1, int64(code))
+	return appendStringField(b, 2, msg)
+}
+
+// grpcGetStats implements podmeter.v1.Echo/GetStats, returning the same
+// snapshot as GET /stats encoded as the reflected Stats message.
+func grpcGetStats(w http.ResponseWriter, r *http.Request) (int, string) {
+	if _, err := readGRPCMessage(r.Body); err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+	stats := CollectStats(r)
+	if err := writeGRPCMessage(w, encodeStructProto(reflect.ValueOf(stats))); err != nil {
+		return grpcInternal, err.Error()
+	}
+	return grpcOK, ""
+}
+
+// grpcEchoMetadata implements podmeter.v1.Echo/EchoMetadata, returning the
+// metadata and connection details PodMeter observed for this call.
+func grpcEchoMetadata(w http.ResponseWriter, r *http.Request) (int, string) {
+	if _, err := readGRPCMessage(r.Body); err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+
+	hostname, _ := os.Hostname()
+	meshMode, _ := hops.MeshMode(r, hops.SidecarPresent())
+
+	var out []byte
+	out = appendStringField(out, 1, r.URL.Path)
+	out = appendStringField(out, 2, r.Host)
+	out = appendStringField(out, 3, r.RemoteAddr)
+	out = appendStringField(out, 4, r.Proto)
+
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := appendStringField(nil, 1, strings.ToLower(k))
+		for _, v := range r.Header[k] {
+			entry = appendTag(entry, 2, wireBytes)
+			entry = appendVarint(entry, uint64(len(v)))
+			entry = append(entry, v...)
+		}
+		out = appendBytesField(out, 5, entry)
+	}
+
+	out = appendIntField(out, 6, int64(hops.ProxyHops(r)))
+	out = appendIntField(out, 7, int64(hops.ServiceMeshHops(r)))
+	out = appendStringField(out, 8, meshMode)
+	out = appendStringField(out, 9, hostname)
+
+	if err := writeGRPCMessage(w, out); err != nil {
+		return grpcInternal, err.Error()
+	}
+	return grpcOK, ""
+}
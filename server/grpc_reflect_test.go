@@ -0,0 +1,22 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// TestStatsProtoNumbersAreFixed checks that every field reachable from
+// Stats has a number of its own, and that fields keep the numbers the first
+// reflection-enabled build gave them.
+func TestStatsProtoNumbersAreFixed(t *testing.T) {
+	podmeterFileDescriptor() // Panics on a missing or repeated number
+
+	want := map[string]int{"requests": 1, "grpc": 19, "current_hop_count": 20, "kernel_version": 39, "websocket": 45}
+	for _, f := range goProtoFields(reflect.TypeOf(meter.Stats{})) {
+		if n, ok := want[f.name]; ok && f.number != n {
+			t.Errorf("%s is field %d, want %d", f.name, f.number, n)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/exporters"
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/loadgen"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var (
+	// httpMeter records the simulated workload served on /
+	httpMeter = meter.New(0)
+
+	// startTime is when the current measurement began: process start, the
+	// restored checkpoint's start, or the last /admin/reset
+	startMu   sync.RWMutex
+	startTime = time.Now()
+
+	// crossClusterRequests counts workload requests with cross-cluster hops
+	crossClusterRequests atomic.Int64
+)
+
+// localCluster is the cluster this pod runs in, if set as the k8s.cluster.name
+// resource attribute, for telling remote clusters apart in baggage.
+func localCluster() string {
+	return meter.Resource()["k8s.cluster.name"]
+}
+
+func measurementStart() time.Time {
+	startMu.RLock()
+	defer startMu.RUnlock()
+	return startTime
+}
+
+func setMeasurementStart(t time.Time) {
+	startMu.Lock()
+	startTime = t
+	startMu.Unlock()
+}
+
+// WorkloadHandler serves the simulated workload: ~20ms of work plus any
+// active chaos experiment or per-request fault, recorded in the HTTP meter.
+// In reverse-proxy mode the upstream application does the work instead.
+func WorkloadHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// Name this pod in the response, for `podmeter lb-check`
+	loadgen.SetIdentityHeaders(w.Header())
+
+	// Detect total proxy + service mesh hops from headers
+	hopCount := hops.TotalHops(r)
+	httpMeter.CountProtocol(r.Proto)
+	httpMeter.CountMeshPath(hops.MeshPath(r, hops.SidecarPresent(), hops.AmbientEnrolled()))
+	if hops.CrossClusterHops(r, localCluster()) > 0 {
+		crossClusterRequests.Add(1)
+	}
+
+	// Count the response's body bytes, and its outcome against the client
+	// and User-Agent. A chaos reset sends no response and counts as failed.
+	rc := &responseCounter{ResponseWriter: w, status: http.StatusOK}
+	w = rc
+	reset := false
+	outcome := "" // The error class recorded, for the per-client counts
+	logRequest := shouldLogRequest(r)
+	var timings requestTimings
+	conn := requestConn(r)
+	if conn != nil {
+		timings.HeadersMs = conn.recordArrival(start)
+	}
+	mark := start
+	lap := func() float64 {
+		now := time.Now()
+		d := meter.Ms(now.Sub(mark))
+		mark = now
+		return d
+	}
+	defer func() {
+		// A panic is answered with a 500 by recoverPanics, further up; count
+		// it as one here, then let it carry on there
+		p := recover()
+		if p != nil && p != http.ErrAbortHandler {
+			_, outcome = recordWorkload(r, start, hopCount, http.StatusInternalServerError, meter.ErrorPanic)
+			rc.status = http.StatusInternalServerError
+		}
+		if !reset {
+			recordResponseSize(rc.written)
+		}
+		failed := meter.Failed(outcome)
+		userAgents.Add(normalizeUserAgent(r.UserAgent()), failed)
+		client := resolveClient(r)
+		topClients.Add(client, failed)
+		countIPFamily(r, client)
+		countInterface(r)
+		timings.TotalMs = meter.Ms(time.Since(start))
+		if slow := isSlowCandidate(timings.TotalMs); logRequest || slow {
+			entry := newRequestLogEntry(r, start, rc.status, rc.written, reset, timings)
+			if logRequest {
+				writeRequestLog(entry)
+			}
+			if slow {
+				captureSlow(r, entry)
+			}
+		}
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	// A proxied body streams through to the upstream instead
+	if upstream == nil {
+		code := readRequestBody(w, r)
+		timings.BodyMs = lap()
+		phaseBodyRead.Add(timings.BodyMs)
+		if code != 0 {
+			_, outcome = recordWorkload(r, start, hopCount, code, "")
+			return
+		}
+	}
+
+	// Apply any active chaos experiment before doing the real work
+	chaos := currentChaos()
+	if chaos != nil {
+		chaosInjected.Add(1)
+		if chaos.shouldReset() && resetConnection(w) {
+			chaosResets.Add(1)
+			_, outcome = recordWorkload(r, start, hopCount, 0, meter.ErrorFaultInjected)
+			reset = true
+			return
+		}
+		time.Sleep(chaos.delay())
+		timings.ChaosMs = lap()
+	}
+
+	// Apply a per-request fault requested via the X-PodMeter-Fault header
+	status := http.StatusOK
+	class := ""
+	if v := r.Header.Get(faultHeader); v != "" && meter.FlagEnabled(flagFaultHeader) {
+		fault, err := parseFaultHeader(v)
+		if err != nil {
+			_, outcome = recordWorkload(r, start, hopCount, http.StatusBadRequest, "")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if fault.applies() {
+			faultsInjected.Add(1)
+			time.Sleep(fault.Delay)
+			timings.FaultMs = lap()
+			if fault.Panic {
+				panic("fault injected: " + v)
+			}
+			if fault.Abort != 0 {
+				faultAborts.Add(1)
+				status = fault.Abort
+				class = meter.ErrorFaultInjected
+			}
+		}
+	}
+
+	if upstream != nil && status == http.StatusOK {
+		status, upstreamMs := proxyUpstream(rc, r)
+		timings.UpstreamMs = upstreamMs
+		timings.WorkMs = lap()
+		phaseWork.Add(timings.WorkMs)
+		lat, class := recordWorkload(r, start, hopCount, status, "")
+		outcome = class
+		upstreamOverheads.Add(max(lat-upstreamMs, 0))
+		recordTrace(r, start, lat, status)
+		return
+	}
+
+	// Simulate some work
+	time.Sleep(20 * time.Millisecond)
+	timings.WorkMs = lap()
+	phaseWork.Add(timings.WorkMs)
+	if conn != nil {
+		conn.startWrite(mark)
+	}
+
+	lat, class := recordWorkload(r, start, hopCount, status, class)
+	outcome = class
+	recordTrace(r, start, lat, status)
+
+	if status != http.StatusOK {
+		http.Error(w, "fault injected", status)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if chaos != nil && chaos.DribbleMs > 0 {
+		dribble(w, []byte("OK\n"), time.Duration(chaos.DribbleMs)*time.Millisecond)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+// recordWorkload records a workload request that ended with status (0 when
+// no response was sent) in the HTTP meter, under class or, when class is
+// empty, the class meter.ClassifyRequest gives it. It returns the latency
+// and the class recorded.
+func recordWorkload(r *http.Request, start time.Time, hopCount, status int, class string) (float64, string) {
+	elapsed := time.Since(start)
+	if class == "" {
+		class = meter.ClassifyRequest(status, r.Context().Err(), elapsed, hops.ExpectedTimeout(r))
+	}
+	lat := meter.Ms(elapsed)
+	httpMeter.RecordRequest(lat, hopCount, !meter.Failed(class), r.URL.Path, status)
+	if status != 0 {
+		httpMeter.CountStatus(status)
+	}
+	httpMeter.CountErrorClass(class)
+	annotateSpan(r, status, class)
+	if m := listenerMeter(r); m != nil {
+		m.Record(lat, hopCount, !meter.Failed(class))
+	}
+	recordVirtualHost(r, lat, hopCount, !meter.Failed(class))
+	recordClientZone(r, lat, hopCount, !meter.Failed(class))
+	return lat, class
+}
+
+// StatsHandler serves the stats snapshot as JSON, or as text tables or an
+// HTML page for people; see exporters.Serve.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	exporters.Serve(w, r, CollectStats(r))
+}
+
+// metricsHandler serves the full Stats snapshot in the Prometheus text
+// exposition format, for scraping the pod directly.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", exporters.PrometheusContentType)
+	exporters.Prometheus(w, CollectStats(r))
+}
+
+// CollectStats builds the full Stats snapshot. The request is used for
+// header-based hop and mesh detection of the caller.
+func CollectStats(r *http.Request) meter.Stats {
+	snap := httpMeter.Snapshot()
+	uptime := time.Since(measurementStart()).Seconds()
+	rate := snap.RequestRate(uptime)
+
+	// Detect proxy and service mesh hops from current request headers
+	hop := hops.Detect(r)
+
+	// Snapshot chaos experiment state
+	chaos := chaosState()
+
+	stats := meter.Stats{
+		// Request metrics
+		Requests:          snap.Requests,
+		Errors:            snap.Errors,
+		RequestsPerSecond: rate.Last10s,
+		SuccessRate:       snap.SuccessRate(),
+		ErrorClasses:      snap.ErrorClasses(),
+		Upstream:          upstreamStats(),
+		Listeners:         listenerStats(),
+		Hosts:             hostsByHeader.stats(),
+		SNI:               hostsBySNI.stats(),
+		IPFamilies:        ipFamilyStats(),
+		Interfaces:        interfaceStats(),
+		Phases:            phaseStats(),
+		Topology:          topologyStats(),
+		Tracing:           tracingStats(),
+
+		// Service health
+		UptimeSeconds: int64(uptime),
+
+		// gRPC, WebSocket, UDP and TCP metrics
+		GRPC:      grpcStats(),
+		WebSocket: websocketStats(),
+		UDP:       udpStats(),
+		TCP:       tcpStats(),
+
+		// Active probes
+		Probes: probeStats(),
+
+		// Network/Proxy metrics
+		CurrentHopCount:       hop.Total(), // For backwards compatibility
+		ProxyHopCount:         hop.ProxyHops,
+		ServiceMeshHops:       hop.MeshHops,
+		TotalHopCount:         hop.Total(),
+		AvgProxyHops:          snap.AvgHops(),
+		ProxyDetected:         hop.Total() > 0,
+		IstioSidecar:          hop.IstioDetected,
+		WaypointProxyDetected: hop.Waypoint,
+		ServiceMeshMode:       hop.MeshMode,
+		RequestsViaProxy:      snap.ViaProxy,
+		DebugHeaders:          hops.DebugHeaders(r),
+
+		// Chaos injection
+		ChaosActive:   chaos.Active,
+		ChaosInjected: chaos.Injected,
+		HeaderFaults:  faultsInjected.Load(),
+		HeaderAborts:  faultAborts.Load(),
+
+		// Response status codes
+		StatusCodes: snap.StatusCodes(),
+
+		// Static labels
+		Labels: meter.Labels(),
+
+		// Latency sampling policy
+		LatencySampling: meter.CurrentSampling().String(),
+		LatencyWindow:   snap.Window,
+
+		Draining: draining.Load(),
+
+		RequestBody: requestBodyStats(),
+		Response:    responseSizeStats(uptime),
+		Connections: connectionStats(),
+		TLS:         tlsStats(),
+		Protocols:   snap.ProtocolCounts(),
+		UserAgents:  userAgents.Top(topReported),
+		TopClients:  topClients.Top(topReported),
+		RequestRate: rate,
+
+		AmbientEnrolled:   hops.AmbientEnrolled(),
+		WaypointTraversed: snap.MeshPaths[hops.PathWaypoint],
+		ZtunnelOnly:       snap.MeshPaths[hops.PathZtunnel],
+
+		CrossClusterHops:     hops.CrossClusterHops(r, localCluster()),
+		RequestsCrossCluster: crossClusterRequests.Load(),
+
+		Startup: startupStats(),
+
+		PanicsTotal:    panicsTotal.Load(),
+		StatusEmulated: statusEmulated.Load(),
+
+		RouteLimits: routeLimitStats(),
+	}
+	stats.SetSystem()
+	stats.SetRuntime()
+	stats.IstioVersion, stats.EnvoyVersion = hops.ProxyVersions()
+	stats.Envoy = envoyStats()
+	stats.GoroutineLeakSuspected, stats.GoroutineLeakSites = leakStatus()
+	stats.CPUStealPercent, stats.NoisyNeighborSuspected = stealStatus()
+	stats.CPUStealPercent = meter.Round(stats.CPUStealPercent)
+	stats.Node.CPUStealPercent = stats.CPUStealPercent
+	stats.Collectors, stats.CollectorErrors = meter.RunCollectors(r.Context())
+
+	// Calculate latency statistics
+	if len(snap.Latencies) > 0 {
+		stats.SetLatency(meter.Summarize(snap.Latencies))
+	}
+	stats.SetDerived()
+	return stats
+}
+
+func debugHeadersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	headers := make(map[string][]string)
+	for name, values := range r.Header {
+		headers[name] = values
+	}
+
+	proxyHops := hops.ProxyHops(r)
+	meshHops := hops.ServiceMeshHops(r)
+	totalHops := proxyHops + meshHops
+
+	response := map[string]interface{}{
+		"headers":         headers,
+		"proxy_hop_count": proxyHops,
+		"mesh_hop_count":  meshHops,
+		"total_hop_count": totalHops,
+		"hop_count":       totalHops, // Deprecated: use split counters
+		"remote_addr":     r.RemoteAddr,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// inheritEnv passes the listening sockets and the saved state to a re-executed
+// PodMeter as name=fd pairs, e.g. `http=3,grpc=4,state=5`.
+const inheritEnv = "PODMETER_INHERIT_FDS"
+
+var (
+	// inheritedFDs are the descriptors passed in by the process we replaced,
+	// by name. Run takes them before opening any listener.
+	inheritedFDs map[string]uintptr
+
+	// restartRequests carries the reason for a restart to Run
+	restartRequests = make(chan string, 1)
+)
+
+// takeInherited parses and clears PODMETER_INHERIT_FDS, so that a later
+// restart or any child process does not see stale descriptors.
+func takeInherited() (map[string]uintptr, error) {
+	spec, ok := os.LookupEnv(inheritEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(inheritEnv)
+	fds := make(map[string]uintptr)
+	for _, pair := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		fd, err := strconv.ParseUint(value, 10, 32)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s: invalid entry %q", inheritEnv, pair)
+		}
+		fds[name] = uintptr(fd)
+	}
+	return fds, nil
+}
+
+// inheritedFile returns the inherited descriptor called name, or nil. Each
+// descriptor is handed out once.
+func inheritedFile(name string) *os.File {
+	fd, ok := inheritedFDs[name]
+	if !ok {
+		return nil
+	}
+	delete(inheritedFDs, name)
+	return os.NewFile(fd, name)
+}
+
+// closeInherited closes descriptors nothing claimed, such as the socket of a
+// listener that is no longer configured.
+func closeInherited() {
+	for name := range inheritedFDs {
+		inheritedFile(name).Close()
+	}
+}
+
+// listen returns the inherited TCP listener called name if there is one, and
+// otherwise listens on addr.
+func listen(name, addr string) (net.Listener, error) {
+	if f := inheritedFile(name); f != nil {
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenPacket is listen for UDP.
+func listenPacket(name, addr string) (net.PacketConn, error) {
+	if f := inheritedFile(name); f != nil {
+		defer f.Close()
+		return net.FilePacketConn(f)
+	}
+	return net.ListenPacket("udp", addr)
+}
+
+// restoreHandoff applies the state written by the process we replaced.
+func restoreHandoff(f *os.File) error {
+	defer f.Close()
+	var cp checkpoint
+	if err := json.NewDecoder(f).Decode(&cp); err != nil {
+		return fmt.Errorf("handoff state: %w", err)
+	}
+	if err := applyCheckpoint(cp); err != nil {
+		return fmt.Errorf("handoff state: %w", err)
+	}
+	infof("Restarted in place: resumed counters and windows (handoff took %s)", time.Since(cp.SavedAt).Round(time.Millisecond))
+	return nil
+}
+
+// requestRestart asks Run to restart. It reports false if a restart is
+// already pending.
+func requestRestart(reason string) bool {
+	select {
+	case restartRequests <- reason:
+		return true
+	default:
+		return false
+	}
+}
+
+// restartHandler serves POST /admin/restart. The restart happens after the
+// response is sent.
+func restartHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusConflict)
+		return
+	}
+	if !requestRestart("/admin/restart") {
+		http.Error(w, "restart already pending", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]bool{"restarting": true})
+}
+
+// handoff is a restart that has passed its checks: the executable to run
+// and duplicates of the listening sockets to pass to it.
+type handoff struct {
+	exe string
+	fds map[string]int
+}
+
+// prepareRestart checks that the binary can be re-executed and duplicates
+// the listening sockets. Nothing is stopped yet, so on error the process
+// simply carries on.
+func prepareRestart(sockets map[string]syscall.Conn) (*handoff, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("%s is not executable", exe)
+	}
+
+	h := &handoff{exe: exe, fds: make(map[string]int, len(sockets)+1)}
+	for name, sc := range sockets {
+		fd, err := dupFD(sc)
+		if err != nil {
+			h.close()
+			return nil, fmt.Errorf("%s socket: %w", name, err)
+		}
+		h.fds[name] = fd
+	}
+	return h, nil
+}
+
+// dupFD duplicates the descriptor behind sc. Unlike the descriptors Go
+// opens, the duplicate is not close-on-exec, so it survives syscall.Exec.
+func dupFD(sc syscall.Conn) (int, error) {
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	var dupErr error
+	if err := raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	}); err != nil {
+		return -1, err
+	}
+	return fd, dupErr
+}
+
+func (h *handoff) close() {
+	for _, fd := range h.fds {
+		syscall.Close(fd)
+	}
+}
+
+// exec stops serving and replaces the process image with a fresh copy of
+// the binary, which picks up the passed sockets and state. The sockets stay
+// open throughout, so new connections wait in the kernel backlog rather than
+// being refused. It only returns if the exec fails, by which time the
+// servers are stopped.
+func (h *handoff) exec(servers []*http.Server, closers []io.Closer) error {
+	start := time.Now()
+	shutdownServers(servers)
+	stopTracing()
+	for _, c := range closers {
+		c.Close()
+	}
+	if err := db.Close(); err != nil {
+		warnf("Closing storage before restart: %v", err)
+	}
+
+	state, err := handoffState()
+	if err != nil {
+		return err
+	}
+	h.fds["state"] = state
+
+	var pairs []string
+	for name, fd := range h.fds {
+		pairs = append(pairs, name+"="+strconv.Itoa(fd))
+	}
+	env := []string{inheritEnv + "=" + strings.Join(pairs, ",")}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, inheritEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	infof("Restarting in place: exec %s (stopped serving in %s)", h.exe, time.Since(start).Round(time.Millisecond))
+	err = syscall.Exec(h.exe, os.Args, env)
+	return fmt.Errorf("exec %s: %w", h.exe, err)
+}
+
+// handoffState writes a checkpoint to an unlinked temporary file and returns
+// a descriptor for it that survives exec.
+func handoffState() (int, error) {
+	f, err := os.CreateTemp("", "podmeter-handoff-*")
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(takeCheckpoint()); err != nil {
+		return -1, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return -1, err
+	}
+	return dupFD(f)
+}
+
+// isClosed reports whether err comes from using a listener that was closed,
+// which is how the echo loops learn that a restart or shutdown stopped them.
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
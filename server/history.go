@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/history"
+)
+
+// historyStore holds per-interval snapshots, or nil when history is disabled.
+var historyStore *history.Store
+
+// ParseHistoryResolutions parses a comma-separated list of downsampled
+// history resolutions, each `interval=retention` with Go durations, e.g.
+// `1m=168h,10m=720h`. A retention of 0 keeps rows forever.
+func ParseHistoryResolutions(spec string) ([]history.Resolution, error) {
+	var out []history.Resolution
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		every, retention, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want interval=retention", s)
+		}
+		var res history.Resolution
+		var err error
+		if res.Every, err = time.ParseDuration(every); err != nil || res.Every <= 0 {
+			return nil, fmt.Errorf("%q: interval must be a positive duration", s)
+		}
+		if res.Retention, err = time.ParseDuration(retention); err != nil || res.Retention < 0 {
+			return nil, fmt.Errorf("%q: retention must be a duration", s)
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+// startHistory opens the snapshot store on db, with its downsampled
+// resolutions, and records a snapshot every interval.
+func startHistory(interval, retention time.Duration, resolutions []history.Resolution) error {
+	store, err := history.Open(db, retention, resolutions...)
+	if err != nil {
+		return err
+	}
+	historyStore = store
+	infof("Recording history every %s (%d snapshots retained, tables %s)", interval, store.Len(), strings.Join(store.Tables(), ", "))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for t := range ticker.C {
+			// Snapshots are not taken on behalf of a caller, so hop
+			// detection sees an empty request
+			r, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "/stats", nil)
+			if err := store.Record(t, CollectStats(r)); err != nil {
+				errorf("History snapshot failed: %v", err)
+				continue
+			}
+			debugf("Recorded history snapshot (%d retained)", store.Len())
+		}
+	}()
+	return nil
+}
+
+// historyQueryHandler runs a SQL query over the recorded snapshots. The query
+// is read from the q parameter or, for POST, the request body.
+func historyQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if historyStore == nil {
+		http.Error(w, "history is disabled (set PODMETER_HISTORY_INTERVAL)", http.StatusNotFound)
+		return
+	}
+
+	sql := r.URL.Query().Get("q")
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sql = string(body)
+	}
+	if strings.TrimSpace(sql) == "" {
+		http.Error(w, "missing query: pass ?q=SELECT ... or POST the SQL", http.StatusBadRequest)
+		return
+	}
+
+	res, err := historyStore.Query(sql)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// historyParquetHandler exports the recorded snapshots, or with ?table= a
+// downsampled resolution of them, as a Parquet file.
+func historyParquetHandler(w http.ResponseWriter, r *http.Request) {
+	if historyStore == nil {
+		http.Error(w, "history is disabled (set PODMETER_HISTORY_INTERVAL)", http.StatusNotFound)
+		return
+	}
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		table = history.Table
+	}
+	if !slices.Contains(historyStore.Tables(), table) {
+		http.Error(w, fmt.Sprintf("unknown table %s (tables: %s)", table, strings.Join(historyStore.Tables(), ", ")), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", history.ParquetContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="podmeter-history-%s.parquet"`, table))
+	if err := historyStore.WriteParquet(w, table); err != nil {
+		errorf("Parquet export failed: %v", err)
+	}
+}
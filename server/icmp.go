@@ -0,0 +1,259 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+	// icmpWindow is how many recent RTT samples are kept per target.
+	icmpWindow = 100
+)
+
+// pingTarget holds the live state of one ICMP probe loop.
+type pingTarget struct {
+	mu    sync.Mutex
+	stats meter.PingTargetStats
+	rtts  []float64
+}
+
+var (
+	pingTargetsMu sync.RWMutex
+	pingTargets   []*pingTarget
+)
+
+// startICMPProbes launches one probe loop per target.
+func startICMPProbes(targets []string, interval time.Duration) {
+	for i, t := range targets {
+		pt := &pingTarget{stats: meter.PingTargetStats{Target: t}}
+		pingTargetsMu.Lock()
+		pingTargets = append(pingTargets, pt)
+		pingTargetsMu.Unlock()
+		go pt.run(uint16(os.Getpid()+i), interval)
+	}
+}
+
+// pingNetwork splits a target into the network to resolve it in and the
+// host. An ip4: or ip6: prefix picks the family; without one, the first
+// address the host resolves to decides it.
+func pingNetwork(target string) (network, host string) {
+	for _, n := range []string{"ip4", "ip6"} {
+		if host, ok := strings.CutPrefix(target, n+":"); ok {
+			return n, host
+		}
+	}
+	if ipAddr, err := net.ResolveIPAddr("ip", target); err == nil && ipAddr.IP.To4() == nil {
+		return "ip6", target
+	}
+	return "ip4", target
+}
+
+// openICMPConn opens a raw ICMP or ICMPv6 socket for network when
+// CAP_NET_RAW is available and falls back to an unprivileged ping socket
+// (SOCK_DGRAM/IPPROTO_ICMP or IPPROTO_ICMPV6, which needs
+// net.ipv4.ping_group_range to include the process group, for both
+// families) otherwise.
+func openICMPConn(network string) (net.PacketConn, string, error) {
+	rawNet, rawAddr, family, proto := "ip4:icmp", "0.0.0.0", syscall.AF_INET, syscall.IPPROTO_ICMP
+	if network == "ip6" {
+		rawNet, rawAddr, family, proto = "ip6:ipv6-icmp", "::", syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	if conn, err := net.ListenPacket(rawNet, rawAddr); err == nil {
+		return conn, "raw", nil
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, "unavailable", fmt.Errorf("no raw socket permission and unprivileged ping is disabled: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, "unavailable", err
+	}
+	return conn, "unprivileged", nil
+}
+
+// run sends one echo request per interval and waits for the matching reply.
+func (pt *pingTarget) run(id uint16, interval time.Duration) {
+	network, host := pingNetwork(pt.stats.Target)
+	conn, mode, err := openICMPConn(network)
+	pt.mu.Lock()
+	pt.stats.Mode = mode
+	pt.stats.Family = map[string]string{"ip4": "ipv4", "ip6": "ipv6"}[network]
+	pt.mu.Unlock()
+	if err != nil {
+		warnf("ICMP probe %s disabled: %v", pt.stats.Target, err)
+		pt.setError(err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timeout := min(interval, 2*time.Second)
+
+	for seq := uint16(0); ; seq++ {
+		pt.probeOnce(conn, mode, network, host, id, seq, timeout)
+		<-ticker.C
+	}
+}
+
+// probeOnce resolves the target, sends a single echo request and records the
+// outcome. Resolution happens every time so DNS changes are followed.
+func (pt *pingTarget) probeOnce(conn net.PacketConn, mode, network, host string, id, seq uint16, timeout time.Duration) {
+	ipAddr, err := net.ResolveIPAddr(network, host)
+	if err != nil {
+		pt.setError(err)
+		return
+	}
+
+	var dst net.Addr = ipAddr
+	if mode == "unprivileged" {
+		// Ping sockets are datagram sockets and take a UDP-style address
+		dst = &net.UDPAddr{IP: ipAddr.IP}
+	}
+
+	request, reply := byte(icmpEchoRequest), byte(icmpEchoReply)
+	if network == "ip6" {
+		request, reply = icmpv6EchoRequest, icmpv6EchoReply
+	}
+	msg := make([]byte, 16)
+	msg[0] = request
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint64(msg[8:], uint64(time.Now().UnixNano()))
+	if network == "ip4" {
+		// The kernel fills in ICMPv6 checksums, which cover the IPv6 header
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+
+	start := time.Now()
+	pt.mu.Lock()
+	pt.stats.Address = ipAddr.String()
+	pt.stats.Interface = outboundInterface(ipAddr.String())
+	pt.stats.Sent++
+	pt.mu.Unlock()
+
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		pt.setError(err)
+		return
+	}
+
+	conn.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			pt.setError(fmt.Errorf("timeout waiting for echo reply seq %d", seq))
+			return
+		}
+		if n < 8 || buf[0] != reply || binary.BigEndian.Uint16(buf[6:]) != seq {
+			continue
+		}
+		// Raw sockets see every ICMP reply on the host, so match id and source.
+		// Ping sockets get the id rewritten by the kernel and are already filtered.
+		if mode == "raw" {
+			src, ok := from.(*net.IPAddr)
+			if binary.BigEndian.Uint16(buf[4:]) != id || !ok || !src.IP.Equal(ipAddr.IP) {
+				continue
+			}
+		}
+		pt.recordRTT(meter.Ms(time.Since(start)))
+		return
+	}
+}
+
+// icmpChecksum computes the RFC 1071 Internet checksum.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func (pt *pingTarget) setError(err error) {
+	pt.mu.Lock()
+	pt.stats.LastError = err.Error()
+	pt.mu.Unlock()
+}
+
+func (pt *pingTarget) recordRTT(rtt float64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.stats.Received++
+	pt.stats.LastError = ""
+	pt.rtts = append(pt.rtts, rtt)
+	if len(pt.rtts) > icmpWindow {
+		pt.rtts = pt.rtts[1:]
+	}
+}
+
+// probeStats snapshots all active probe results.
+func probeStats() meter.ProbeStats {
+	pingTargetsMu.RLock()
+	targets := append([]*pingTarget(nil), pingTargets...)
+	pingTargetsMu.RUnlock()
+
+	var out meter.ProbeStats
+	for _, pt := range targets {
+		pt.mu.Lock()
+		s := pt.stats
+		rtts := append([]float64(nil), pt.rtts...)
+		pt.mu.Unlock()
+
+		if s.Sent > 0 {
+			s.LossPercent = meter.Round(float64(s.Sent-s.Received) / float64(s.Sent) * 100)
+		}
+		if len(rtts) > 0 {
+			lat := meter.Summarize(rtts)
+			s.AvgRTT = lat.Avg
+			s.P50RTT = lat.P50
+			s.P95RTT = lat.P95
+			s.P99RTT = lat.P99
+			s.MaxRTT = lat.Max
+		}
+		out.ICMP = append(out.ICMP, s)
+	}
+	out.MTLS = mtlsProbeStats()
+	out.OutboundInterception = interceptionStats()
+	out.Synthetic = syntheticStats()
+
+	// Probe results are collected from many pods; name where each ran
+	node, zone := podTopology.Node, podTopology.Zone
+	for i := range out.ICMP {
+		out.ICMP[i].Node, out.ICMP[i].Zone = node, zone
+	}
+	for i := range out.MTLS {
+		out.MTLS[i].Node, out.MTLS[i].Zone = node, zone
+	}
+	if oi := out.OutboundInterception; oi != nil {
+		for i := range oi.Probes {
+			oi.Probes[i].Node, oi.Probes[i].Zone = node, zone
+		}
+	}
+	for i := range out.Synthetic {
+		out.Synthetic[i].Node, out.Synthetic[i].Zone = node, zone
+	}
+	return out
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Kinds of outbound interception targets.
+const (
+	InterceptionEcho  = "echo"   // A service, by name
+	InterceptionPodIP = "pod_ip" // A pod, by IP, bypassing services
+)
+
+// Outcomes of one interception probe, as reported in
+// InterceptionProbeStats.Result.
+const (
+	interceptionYes         = "intercepted"
+	interceptionNo          = "not_intercepted"
+	interceptionUnknown     = "inconclusive"
+	interceptionUnreachable = "unreachable"
+)
+
+// InterceptionTarget is an endpoint the outbound interception probes send
+// requests to. It should echo the request back as PodMeter's
+// /debug/headers does; other targets only give response signals.
+type InterceptionTarget struct {
+	Kind string // InterceptionEcho or InterceptionPodIP
+	URL  string
+}
+
+// ParseInterceptionTarget parses the target of a kind of interception
+// probe: a URL, or host:port for /debug/headers on it. A pod_ip target
+// must name an IP address.
+func ParseInterceptionTarget(kind, s string) (InterceptionTarget, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return InterceptionTarget{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return InterceptionTarget{}, fmt.Errorf("%s: want an http(s) URL or host:port", s)
+	}
+	if _, err := netip.ParseAddr(strings.Trim(u.Hostname(), "[]")); kind == InterceptionPodIP && err != nil {
+		return InterceptionTarget{}, fmt.Errorf("%s: want a pod IP, not a name", u.Host)
+	}
+	if u.Path == "" {
+		u.Path = "/debug/headers"
+	}
+	return InterceptionTarget{Kind: kind, URL: u.String()}, nil
+}
+
+// interceptionTarget holds the live state of one interception probe loop.
+type interceptionTarget struct {
+	mu    sync.Mutex
+	stats meter.InterceptionProbeStats
+}
+
+var (
+	interceptionTargetsMu sync.RWMutex
+	interceptionTargets   []*interceptionTarget
+
+	// interceptionClient opens a new connection for every probe, so its
+	// source port can be compared with what the target saw, and ignores
+	// HTTP_PROXY, which would intercept it itself
+	interceptionClient = &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// interceptionSent are the headers a probe is sent with; anything else
+	// the target received was added on the way
+	interceptionSent = []string{"Accept", "Accept-Encoding", "Connection", "User-Agent"}
+)
+
+// startInterceptionProbes launches one probe loop per target.
+func startInterceptionProbes(targets []InterceptionTarget, interval time.Duration) {
+	for _, t := range targets {
+		it := &interceptionTarget{stats: meter.InterceptionProbeStats{Kind: t.Kind, Target: t.URL}}
+		interceptionTargetsMu.Lock()
+		interceptionTargets = append(interceptionTargets, it)
+		interceptionTargetsMu.Unlock()
+		go it.run(t.URL, interval)
+	}
+}
+
+// run probes target once per interval.
+func (it *interceptionTarget) run(target string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timeout := min(interval, 5*time.Second)
+	for {
+		s := probeInterception(target, timeout)
+		it.record(s)
+		<-ticker.C
+	}
+}
+
+// interceptionEcho is the part of a /debug/headers response the probe uses.
+type interceptionEcho struct {
+	Headers    map[string][]string `json:"headers"`
+	RemoteAddr string              `json:"remote_addr"`
+}
+
+// probeInterception sends a request to target on a new connection and
+// works out whether this pod's sidecar captured it on the way out. The
+// strongest signals come from the target's echo of the request:
+//
+//   - The target saw the connection arrive from the source port we opened
+//     it on, so nothing terminated it in between: not intercepted
+//   - The request arrived with an X-Forwarded-Client-Cert, so a proxy
+//     originated mTLS for it, or with Istio's X-Envoy-Peer-Metadata-Id
+//     naming this pod, which our sidecar adds: intercepted
+//
+// A target that does not echo leaves only the response: Envoy's timing
+// header, with a sidecar in this pod, is taken as interception, as the mTLS
+// probes do.
+func probeInterception(target string, timeout time.Duration) meter.InterceptionProbeStats {
+	var s meter.InterceptionProbeStats
+	var connectStart time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			s.ConnectMs = meter.Ms(time.Since(connectStart))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.LocalAddr = info.Conn.LocalAddr().String()
+			s.Interface = interfaceOf(info.Conn.LocalAddr())
+		},
+	}
+	ctx, cancel := context.WithTimeout(httptrace.WithClientTrace(context.Background(), trace), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		s.Result, s.LastError = interceptionUnreachable, err.Error()
+		return s
+	}
+	req.Header.Set("User-Agent", "podmeter-interception-probe/"+meter.Build().Version)
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := interceptionClient.Do(req)
+	if err != nil {
+		s.Result, s.LastError = interceptionUnreachable, err.Error()
+		return s
+	}
+	defer resp.Body.Close()
+	var echo interceptionEcho
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&echo)
+	s.LatencyMs = meter.Ms(time.Since(start))
+	s.Status = resp.StatusCode
+
+	if v := resp.Header.Get("Server"); strings.Contains(strings.ToLower(v), "envoy") {
+		s.ResponseSignals = append(s.ResponseSignals, "server: "+v)
+	}
+	for _, name := range []string{"X-Envoy-Upstream-Service-Time", "X-Envoy-Decorator-Operation", "X-Envoy-Overloaded"} {
+		if resp.Header.Get(name) != "" {
+			s.ResponseSignals = append(s.ResponseSignals, strings.ToLower(name))
+		}
+	}
+
+	echoed := decodeErr == nil && echo.Headers != nil
+	if echoed {
+		for name := range echo.Headers {
+			if !slices.Contains(interceptionSent, http.CanonicalHeaderKey(name)) {
+				s.AddedHeaders = append(s.AddedHeaders, strings.ToLower(name))
+			}
+		}
+		slices.Sort(s.AddedHeaders)
+		s.SeenFrom = echo.RemoteAddr
+		_, seenPort, _ := net.SplitHostPort(echo.RemoteAddr)
+		_, localPort, _ := net.SplitHostPort(s.LocalAddr)
+		s.PortPreserved = seenPort != "" && seenPort == localPort
+	}
+
+	header := http.Header(echo.Headers)
+	switch {
+	case echoed && header.Get("X-Forwarded-Client-Cert") != "":
+		s.Result, s.Evidence = interceptionYes, "the request arrived with x-forwarded-client-cert: a proxy originated mTLS for it"
+	case echoed && peerMetadataNamesUs(header.Get("X-Envoy-Peer-Metadata-Id"), s.LocalAddr):
+		s.Result, s.Evidence = interceptionYes, "the request arrived with x-envoy-peer-metadata-id naming this pod: its sidecar forwarded it"
+	case s.PortPreserved:
+		s.Result, s.Evidence = interceptionNo, "the target saw the connection come from our own source port: nothing terminated it on the way"
+	case echoed:
+		s.Result, s.Evidence = interceptionUnknown, "the connection was proxied, but nothing tells this pod's sidecar from the target's"
+	case hops.SidecarPresent() && resp.Header.Get("X-Envoy-Upstream-Service-Time") != "":
+		s.Result, s.Evidence = interceptionYes, "an Envoy timing header on the response, with a sidecar in this pod; the target does not echo requests"
+	default:
+		s.Result, s.Evidence = interceptionUnknown, "the target does not echo requests as /debug/headers does"
+	}
+	return s
+}
+
+// peerMetadataNamesUs reports whether an Istio peer metadata ID,
+// sidecar~<ip>~<pod>.<namespace>~..., names this pod by its name or by the
+// address the probe left from.
+func peerMetadataNamesUs(id, localAddr string) bool {
+	parts := strings.Split(id, "~")
+	if len(parts) < 3 {
+		return false
+	}
+	ip, _, _ := net.SplitHostPort(localAddr)
+	pod, _, _ := strings.Cut(parts[2], ".")
+	return ip != "" && parts[1] == ip || pod != "" && pod == meter.Resource()["k8s.pod.name"]
+}
+
+func (it *interceptionTarget) record(s meter.InterceptionProbeStats) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	prev := it.stats
+	s.Kind, s.Target = prev.Kind, prev.Target
+	s.Probes, s.Intercepted, s.NotIntercepted, s.Inconclusive = prev.Probes+1, prev.Intercepted, prev.NotIntercepted, prev.Inconclusive
+	switch s.Result {
+	case interceptionYes:
+		s.Intercepted++
+	case interceptionNo:
+		s.NotIntercepted++
+	default:
+		s.Inconclusive++
+	}
+	s.LastProbe = time.Now().UTC()
+	it.stats = s
+}
+
+// interceptionStats snapshots every interception probe, with the verdict
+// across them, or nil when none is configured.
+func interceptionStats() *meter.OutboundInterceptionStats {
+	interceptionTargetsMu.RLock()
+	defer interceptionTargetsMu.RUnlock()
+	if len(interceptionTargets) == 0 {
+		return nil
+	}
+	out := &meter.OutboundInterceptionStats{SidecarPresent: hops.SidecarPresent()}
+	yes, no := 0, 0
+	for _, it := range interceptionTargets {
+		it.mu.Lock()
+		s := it.stats
+		it.mu.Unlock()
+		out.Probes = append(out.Probes, s)
+		switch s.Result {
+		case interceptionYes:
+			yes++
+		case interceptionNo:
+			no++
+		}
+	}
+	switch {
+	case yes > 0 && no > 0:
+		out.Result = "partial"
+	case yes > 0:
+		out.Result = "intercepted"
+	case no > 0:
+		out.Result = "bypassed"
+	default:
+		out.Result = interceptionUnknown
+	}
+	return out
+}
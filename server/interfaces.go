@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// multusNetworkStatus is the annotation Multus sets on a pod with every
+	// network it attached, the cluster network included
+	multusNetworkStatus = "k8s.v1.cni.cncf.io/network-status"
+	// interfaceRefresh is how long the address-to-interface map is trusted
+	interfaceRefresh = 10 * time.Second
+)
+
+var (
+	// annotationsFile is a downward API file with the pod's annotations,
+	// one key="value" per line
+	annotationsFile string
+
+	ifaceMu       sync.Mutex
+	ifaceByAddr   map[netip.Addr]string
+	ifaceLoopback string
+	ifaceMapped   time.Time
+	// ifaceRequests counts workload requests by the interface they
+	// arrived on
+	ifaceRequests = make(map[string]int64)
+)
+
+// multusNetwork is one entry of the network-status annotation.
+type multusNetwork struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface"`
+	IPs       []string `json:"ips"`
+	MAC       string   `json:"mac"`
+	Default   bool     `json:"default"`
+}
+
+// mapInterfaces refreshes ifaceByAddr when it is stale. The caller holds
+// ifaceMu.
+func mapInterfaces(now time.Time) {
+	if now.Sub(ifaceMapped) < interfaceRefresh {
+		return
+	}
+	ifaceMapped = now
+	ifaceByAddr = make(map[netip.Addr]string)
+	ifaces, _ := net.Interfaces()
+	for _, ifc := range ifaces {
+		if ifc.Flags&net.FlagLoopback != 0 {
+			ifaceLoopback = ifc.Name
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				if addr, ok := netip.AddrFromSlice(ipnet.IP); ok {
+					ifaceByAddr[addr.Unmap()] = ifc.Name
+				}
+			}
+		}
+	}
+}
+
+// interfaceOf returns the name of the interface that owns the local
+// address addr, or "" if none does. Loopback addresses without an address
+// of their own, such as the 127.0.0.6 Istio sidecars connect from, belong
+// to the loopback interface.
+func interfaceOf(addr net.Addr) string {
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = a.AddrPort().Addr()
+	case *net.IPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	}
+	ip = ip.Unmap().WithZone("")
+	if !ip.IsValid() {
+		return ""
+	}
+
+	ifaceMu.Lock()
+	defer ifaceMu.Unlock()
+	mapInterfaces(time.Now())
+	if name, ok := ifaceByAddr[ip]; ok {
+		return name
+	}
+	if ip.IsLoopback() {
+		return ifaceLoopback
+	}
+	return ""
+}
+
+// outboundInterface returns the interface the kernel routes traffic to host
+// through. Connecting a UDP socket picks the route without sending anything.
+func outboundInterface(host string) string {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "9"))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return interfaceOf(conn.LocalAddr())
+}
+
+// countInterface counts a workload request under the interface it arrived
+// on.
+func countInterface(r *http.Request) {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		return
+	}
+	if name := interfaceOf(local); name != "" {
+		ifaceMu.Lock()
+		ifaceRequests[name]++
+		ifaceMu.Unlock()
+	}
+}
+
+func resetInterfaces() {
+	ifaceMu.Lock()
+	clear(ifaceRequests)
+	ifaceMu.Unlock()
+}
+
+// readAnnotations parses a downward API annotations or labels file, or
+// returns nil if there is none.
+func readAnnotations(path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	out := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		key, quoted, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if value, err := strconv.Unquote(quoted); err == nil {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// multusNetworks returns the networks Multus attached, by interface name,
+// from the pod's annotations.
+func multusNetworks() map[string]multusNetwork {
+	status := readAnnotations(annotationsFile)[multusNetworkStatus]
+	if status == "" {
+		return nil
+	}
+	var networks []multusNetwork
+	if err := json.Unmarshal([]byte(status), &networks); err != nil {
+		return nil
+	}
+	out := make(map[string]multusNetwork, len(networks))
+	for _, n := range networks {
+		out[n.Interface] = n
+	}
+	return out
+}
+
+// interfaceStats lists every interface in the pod's network namespace, with
+// the Multus network attached to it and the workload requests it received.
+func interfaceStats() []meter.InterfaceStats {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	networks := multusNetworks()
+
+	ifaceMu.Lock()
+	defer ifaceMu.Unlock()
+	out := make([]meter.InterfaceStats, 0, len(ifaces))
+	for _, ifc := range ifaces {
+		s := meter.InterfaceStats{
+			Name:      ifc.Name,
+			Index:     ifc.Index,
+			MAC:       ifc.HardwareAddr.String(),
+			MTU:       ifc.MTU,
+			Up:        ifc.Flags&net.FlagUp != 0,
+			Addresses: []string{},
+			Requests:  ifaceRequests[ifc.Name],
+		}
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			s.Addresses = append(s.Addresses, a.String())
+		}
+		if n, ok := networks[ifc.Name]; ok {
+			s.Network, s.Default = n.Name, n.Default
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var (
+	// Workload requests by the IP family of the connection they arrived on
+	requestsIPv4 atomic.Int64
+	requestsIPv6 atomic.Int64
+	// Workload requests by the IP family of the client, as resolveClient
+	// finds it behind proxies
+	clientRequestsIPv4 atomic.Int64
+	clientRequestsIPv6 atomic.Int64
+)
+
+// parseForwardedAddr parses an address as forwarding headers carry it: with
+// or without a port and, for IPv6, brackets, e.g. 10.0.0.1, 10.0.0.1:3456,
+// 2001:db8::1 or [2001:db8::1]:3456. IPv4-mapped IPv6 addresses are
+// returned as IPv4.
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// countIPFamily counts a workload request by the family of its connection
+// and of client, its address as resolveClient found it. A dual-stack
+// listener sees IPv4 peers as IPv4-mapped IPv6 addresses, which count as
+// IPv4.
+func countIPFamily(r *http.Request, client string) {
+	if addr := clientAddr(r); addr.Is4() {
+		requestsIPv4.Add(1)
+	} else if addr.Is6() {
+		requestsIPv6.Add(1)
+	}
+	if addr, ok := parseForwardedAddr(client); ok && addr.Is4() {
+		clientRequestsIPv4.Add(1)
+	} else if ok && addr.Is6() {
+		clientRequestsIPv6.Add(1)
+	}
+}
+
+// podAddresses returns the pod's IPv4 and IPv6 addresses and where they came
+// from: POD_IPS, set from the downward API's status.podIPs, or else the
+// global unicast addresses of the network interfaces.
+func podAddresses() (v4, v6 []string, source string) {
+	var addrs []netip.Addr
+	if ips := os.Getenv("POD_IPS"); ips != "" {
+		source = "POD_IPS"
+		for _, s := range strings.Split(ips, ",") {
+			if addr, err := netip.ParseAddr(strings.TrimSpace(s)); err == nil {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+	} else {
+		source = "interfaces"
+		ifAddrs, _ := net.InterfaceAddrs()
+		for _, a := range ifAddrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				if addr, ok := netip.AddrFromSlice(ipnet.IP); ok {
+					addrs = append(addrs, addr.Unmap())
+				}
+			}
+		}
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	for _, addr := range slices.Compact(addrs) {
+		if addr.Is4() {
+			v4 = append(v4, addr.String())
+		} else {
+			v6 = append(v6, addr.String())
+		}
+	}
+	return v4, v6, source
+}
+
+// ipFamilyStats reports the pod's addresses and the families its inbound
+// workload traffic uses.
+func ipFamilyStats() meter.IPFamilyStats {
+	v4, v6, source := podAddresses()
+	return meter.IPFamilyStats{
+		IPv4Addresses:      v4,
+		IPv6Addresses:      v6,
+		AddressSource:      source,
+		DualStack:          len(v4) > 0 && len(v6) > 0,
+		RequestsIPv4:       requestsIPv4.Load(),
+		RequestsIPv6:       requestsIPv6.Load(),
+		ClientRequestsIPv4: clientRequestsIPv4.Load(),
+		ClientRequestsIPv6: clientRequestsIPv6.Load(),
+	}
+}
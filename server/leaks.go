@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// leakWindow is how many goroutine samples the detector compares
+	leakWindow = 30
+	// leakMinSamples is how many samples are needed before judging
+	leakMinSamples = 6
+	// leakMinGrowth is the smallest net growth over the window that counts
+	leakMinGrowth = 10
+	// leakTopSites bounds how many creation sites are reported
+	leakTopSites = 5
+)
+
+// goroutineSample is the goroutine count per creation site at one moment.
+type goroutineSample struct {
+	total int
+	sites map[string]int
+}
+
+var (
+	leakMu      sync.Mutex
+	leakSamples []goroutineSample
+)
+
+// startLeakDetector samples goroutines every interval.
+func startLeakDetector(interval time.Duration) {
+	go func() {
+		for {
+			sample := sampleGoroutines()
+			leakMu.Lock()
+			leakSamples = append(leakSamples, sample)
+			if len(leakSamples) > leakWindow {
+				leakSamples = leakSamples[1:]
+			}
+			leakMu.Unlock()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// sampleGoroutines groups every goroutine by the site that created it.
+func sampleGoroutines() goroutineSample {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	s := goroutineSample{sites: make(map[string]int)}
+	for _, block := range bytes.Split(buf, []byte("\n\n")) {
+		if len(bytes.TrimSpace(block)) == 0 {
+			continue
+		}
+		s.total++
+		s.sites[creationSite(string(block))]++
+	}
+	return s
+}
+
+// creationSite returns "func (file:line)" from a goroutine's "created by"
+// trailer, or "main" for goroutines the runtime started itself.
+func creationSite(block string) string {
+	lines := strings.Split(block, "\n")
+	for i, line := range lines {
+		fn, ok := strings.CutPrefix(line, "created by ")
+		if !ok {
+			continue
+		}
+		fn, _, _ = strings.Cut(fn, " in goroutine ")
+		if i+1 < len(lines) {
+			loc := strings.TrimSpace(lines[i+1])
+			loc, _, _ = strings.Cut(loc, " +0x")
+			return fn + " (" + loc + ")"
+		}
+		return fn
+	}
+	return "main"
+}
+
+// leakStatus reports whether the goroutine count grew monotonically by at
+// least leakMinGrowth across the window, and the sites that grew most. It
+// reports nothing while the leak_detection flag is off.
+func leakStatus() (bool, []meter.LeakSite) {
+	if !meter.FlagEnabled(flagLeakDetection) {
+		return false, nil
+	}
+	leakMu.Lock()
+	defer leakMu.Unlock()
+	if len(leakSamples) < leakMinSamples {
+		return false, nil
+	}
+	for i := 1; i < len(leakSamples); i++ {
+		if leakSamples[i].total < leakSamples[i-1].total {
+			return false, nil
+		}
+	}
+	first, last := leakSamples[0], leakSamples[len(leakSamples)-1]
+	if last.total-first.total < leakMinGrowth {
+		return false, nil
+	}
+
+	var sites []meter.LeakSite
+	for site, n := range last.sites {
+		if growth := n - first.sites[site]; growth > 0 {
+			sites = append(sites, meter.LeakSite{Site: site, Count: n, Growth: growth})
+		}
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Growth != sites[j].Growth {
+			return sites[i].Growth > sites[j].Growth
+		}
+		return sites[i].Site < sites[j].Site
+	})
+	if len(sites) > leakTopSites {
+		sites = sites[:leakTopSites]
+	}
+	return true, sites
+}
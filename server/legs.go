@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	defaultLegRequests = 50
+	maxLegRequests     = 1000
+	legTimeout         = 5 * time.Second
+)
+
+// Legs of a path comparison, from most to least direct.
+const (
+	legPodIP     = "pod_ip"     // Straight to pod IPs: no service VIP, and the mesh passes it through
+	legClusterIP = "cluster_ip" // The service VIP, translated by kube-proxy (or eBPF)
+	legMesh      = "mesh"       // The service hostname, routed by the mesh at L7
+)
+
+// LegRequest is the body of POST /admin/legs.
+type LegRequest struct {
+	Service  string   `json:"service"`            // host:port of the service, e.g. api.shop.svc.cluster.local:8080
+	Path     string   `json:"path,omitempty"`     // Request path; default /
+	Headless string   `json:"headless,omitempty"` // Headless service whose DNS returns the pod IPs
+	PodIPs   []string `json:"pod_ips,omitempty"`  // Pod IPs, instead of or in addition to Headless
+	Requests int      `json:"requests,omitempty"` // Per leg; default 50
+}
+
+// LegResult is the latency of one leg.
+type LegResult struct {
+	Leg       string   `json:"leg"`
+	Addresses []string `json:"addresses"`
+	Requests  int      `json:"requests"`
+	Errors    int      `json:"errors"`
+	AvgMs     float64  `json:"avg_ms"`
+	P50Ms     float64  `json:"p50_ms"`
+	P95Ms     float64  `json:"p95_ms"`
+	P99Ms     float64  `json:"p99_ms"`
+	LastError string   `json:"last_error,omitempty"`
+
+	latencies []float64
+	next      int // Round-robin position in Addresses
+}
+
+// LegComparison is the response of POST /admin/legs. The deltas compare
+// median latencies; each is left out when either leg could not be measured.
+type LegComparison struct {
+	Service string      `json:"service"`
+	RanAt   time.Time   `json:"ran_at"`
+	Legs    []LegResult `json:"legs"`
+
+	// kube-proxy: the service VIP against pod IPs
+	ClusterIPOverheadMs *float64 `json:"cluster_ip_vs_pod_ip_p50_ms,omitempty"`
+	// The mesh's L7 routing: the hostname against the service VIP
+	MeshOverheadMs *float64 `json:"mesh_vs_cluster_ip_p50_ms,omitempty"`
+	// Everything between the hostname and the pods
+	TotalOverheadMs *float64 `json:"mesh_vs_pod_ip_p50_ms,omitempty"`
+}
+
+// legsHandler serves POST /admin/legs: it sends the same request to a
+// service through each leg in turn and reports how much each layer adds.
+func legsHandler(w http.ResponseWriter, r *http.Request) {
+	var req LegRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	host, port, err := net.SplitHostPort(req.Service)
+	if err != nil {
+		http.Error(w, "service must be host:port", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		req.Path = "/"
+	}
+	if req.Requests == 0 {
+		req.Requests = defaultLegRequests
+	}
+	if req.Requests < 0 || req.Requests > maxLegRequests {
+		http.Error(w, fmt.Sprintf("requests must be between 1 and %d", maxLegRequests), http.StatusBadRequest)
+		return
+	}
+
+	legs, err := resolveLegs(r.Context(), host, port, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	cmp := LegComparison{Service: req.Service, RanAt: time.Now().UTC()}
+	cmp.Legs = measureLegs(r.Context(), legs, req.Path, req.Requests)
+	cmp.setDeltas()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmp)
+}
+
+// resolveLegs finds the addresses of each leg. A service name that resolves
+// to several addresses is itself headless, so it has no ClusterIP leg.
+func resolveLegs(ctx context.Context, host, port string, req LegRequest) ([]*LegResult, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	podIPs := append([]string(nil), req.PodIPs...)
+	if req.Headless != "" {
+		ips, err := net.DefaultResolver.LookupHost(ctx, req.Headless)
+		if err != nil {
+			return nil, err
+		}
+		podIPs = append(podIPs, ips...)
+	}
+
+	var legs []*LegResult
+	if len(addrs) > 1 {
+		podIPs = append(podIPs, addrs...)
+	} else if len(addrs) == 1 {
+		legs = append(legs, &LegResult{Leg: legClusterIP, Addresses: []string{net.JoinHostPort(addrs[0], port)}})
+	}
+	if len(podIPs) > 0 {
+		for i, ip := range podIPs {
+			podIPs[i] = net.JoinHostPort(ip, port)
+		}
+		legs = append([]*LegResult{{Leg: legPodIP, Addresses: podIPs}}, legs...)
+	}
+	legs = append(legs, &LegResult{Leg: legMesh, Addresses: []string{net.JoinHostPort(host, port)}})
+	return legs, nil
+}
+
+// measureLegs sends requests round-robin across the legs, so that a change
+// in the target's load affects every leg alike. Each leg keeps its own
+// connections alive, so the comparison is of steady-state requests.
+func measureLegs(ctx context.Context, legs []*LegResult, path string, requests int) []LegResult {
+	clients := make([]*http.Client, len(legs))
+	for i := range legs {
+		clients[i] = &http.Client{Timeout: legTimeout, Transport: &http.Transport{}}
+		defer clients[i].CloseIdleConnections()
+	}
+
+	for range requests {
+		for i, leg := range legs {
+			if ctx.Err() != nil {
+				break
+			}
+			leg.measure(ctx, clients[i], path)
+		}
+	}
+
+	out := make([]LegResult, len(legs))
+	for i, leg := range legs {
+		if len(leg.latencies) > 0 {
+			s := meter.Summarize(leg.latencies)
+			leg.AvgMs, leg.P50Ms, leg.P95Ms, leg.P99Ms = s.Avg, s.P50, s.P95, s.P99
+		}
+		out[i] = *leg
+	}
+	return out
+}
+
+// measure sends one request over the leg. IP legs keep the IP as the Host
+// header: a sidecar routes by Host, and would otherwise send the request
+// through the service like the mesh leg.
+func (leg *LegResult) measure(ctx context.Context, client *http.Client, path string) {
+	addr := leg.Addresses[leg.next%len(leg.Addresses)]
+	leg.next++
+	leg.Requests++
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		leg.fail(err)
+		return
+	}
+	req.Header.Set("User-Agent", "podmeter-legs/"+meter.Build().Version)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		leg.fail(err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		leg.fail(fmt.Errorf("%s: %s", addr, resp.Status))
+		return
+	}
+	leg.latencies = append(leg.latencies, meter.Ms(time.Since(start)))
+}
+
+func (leg *LegResult) fail(err error) {
+	leg.Errors++
+	leg.LastError = err.Error()
+}
+
+// setDeltas fills the overheads from the legs that were measured.
+func (c *LegComparison) setDeltas() {
+	p50 := make(map[string]float64)
+	for _, leg := range c.Legs {
+		if len(leg.latencies) > 0 {
+			p50[leg.Leg] = leg.P50Ms
+		}
+	}
+	delta := func(a, b string) *float64 {
+		va, okA := p50[a]
+		vb, okB := p50[b]
+		if !okA || !okB {
+			return nil
+		}
+		d := meter.Round(va - vb)
+		return &d
+	}
+	c.ClusterIPOverheadMs = delta(legClusterIP, legPodIP)
+	c.MeshOverheadMs = delta(legMesh, legClusterIP)
+	c.TotalOverheadMs = delta(legMesh, legPodIP)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Listener is an extra named port serving the workload, alongside the HTTP,
+// HTTPS and gRPC listeners.
+type Listener struct {
+	Name     string // As the Service port is named, e.g. http-web or grpc-api
+	Protocol string // http, https or grpc
+	Addr     string
+}
+
+// listenerName matches a Kubernetes port name: a lowercase DNS label of at
+// most 15 characters.
+var listenerName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,13}[a-z0-9])?$`)
+
+// builtinListeners are the names of the fixed listeners, which report under
+// the same names in /stats and so cannot be reused.
+var builtinListeners = map[string]bool{"http": true, "https": true, "grpc": true, "udp": true, "tcp": true, "state": true}
+
+// ParseListeners parses a comma-separated list of extra listeners. Each
+// entry is `name=[protocol://]addr`, where protocol is http (the default),
+// https or grpc, e.g. `http-web=:8081,https-web=https://:8444,grpc-api=grpc://:9091`.
+func ParseListeners(spec string) ([]Listener, error) {
+	var out []Listener
+	seen := map[string]bool{}
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want name=[protocol://]addr", s)
+		}
+		if !listenerName.MatchString(name) {
+			return nil, fmt.Errorf("%q: name must be a lowercase DNS label of at most 15 characters", s)
+		}
+		if builtinListeners[name] || seen[name] {
+			return nil, fmt.Errorf("%q: name %s is already taken", s, name)
+		}
+		seen[name] = true
+
+		l := Listener{Name: name, Protocol: "http", Addr: addr}
+		if proto, rest, ok := strings.Cut(addr, "://"); ok {
+			l.Protocol, l.Addr = proto, rest
+		}
+		if l.Protocol != "http" && l.Protocol != "https" && l.Protocol != "grpc" {
+			return nil, fmt.Errorf("%q: protocol must be http, https or grpc", s)
+		}
+		if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+			return nil, fmt.Errorf("%q: %v", s, err)
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// listenerKey carries the *workloadListener a request arrived on through
+// its context.
+type listenerKey struct{}
+
+// workloadListener is a listener and the workload requests it served.
+type workloadListener struct {
+	Listener
+	meter *meter.Meter
+}
+
+var (
+	listenersMu sync.RWMutex
+	listeners   []*workloadListener
+)
+
+// meterListener registers l and has srv tag every request it serves with
+// it, so that the workload is recorded per listener as well.
+func meterListener(srv *http.Server, l Listener) {
+	wl := &workloadListener{Listener: l, meter: meter.New(0)}
+	listenersMu.Lock()
+	listeners = append(listeners, wl)
+	listenersMu.Unlock()
+	srv.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenerKey{}, wl)
+	}
+}
+
+// listenerMeter returns the meter of the listener r arrived on, or nil when
+// it was served by a mux of the caller's own.
+func listenerMeter(r *http.Request) *meter.Meter {
+	if wl, ok := r.Context().Value(listenerKey{}).(*workloadListener); ok {
+		return wl.meter
+	}
+	return nil
+}
+
+func resetListeners() {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, wl := range listeners {
+		wl.meter.Reset()
+	}
+}
+
+// listenerStats snapshots the workload served by every listener.
+func listenerStats() map[string]meter.ListenerStats {
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	if len(listeners) == 0 {
+		return nil
+	}
+
+	out := make(map[string]meter.ListenerStats, len(listeners))
+	for _, wl := range listeners {
+		snap := wl.meter.Snapshot()
+		ls := meter.ListenerStats{
+			Protocol:         wl.Protocol,
+			Address:          wl.Addr,
+			Requests:         snap.Requests,
+			Errors:           snap.Errors,
+			RequestsViaProxy: snap.ViaProxy,
+		}
+		if len(snap.Latencies) > 0 {
+			lat := meter.Summarize(snap.Latencies)
+			ls.AvgLatency = lat.Avg
+			ls.P50Latency = lat.P50
+			ls.P95Latency = lat.P95
+			ls.P99Latency = lat.P99
+			ls.MaxLatency = lat.Max
+		}
+		out[wl.Name] = ls
+	}
+	return out
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// logLevel is the minimum level of server log lines, set by Run and
+// /admin/loglevel. The zero value is INFO.
+var logLevel slog.LevelVar
+
+// logf writes a log line if level is enabled.
+func logf(level slog.Level, format string, args ...any) {
+	if level >= logLevel.Level() {
+		log.Printf(format, args...)
+	}
+}
+
+func debugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(slog.LevelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(slog.LevelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
+
+// levelName is the lower-case name of a level, as accepted by
+// PODMETER_LOG_LEVEL and /admin/loglevel.
+func levelName(l slog.Level) string {
+	return strings.ToLower(l.String())
+}
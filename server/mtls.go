@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Outcomes of one plaintext probe, as reported in MTLSProbeStats.Result.
+const (
+	mtlsStrict      = "strict"      // The connection was closed before any plaintext response
+	mtlsPermissive  = "permissive"  // Plaintext HTTP got a response
+	mtlsIntercepted = "intercepted" // Our own sidecar upgraded the probe, so nothing was tested
+	mtlsUnreachable = "unreachable" // The port could not be reached at all
+)
+
+// mtlsTarget holds the live state of one mTLS probe loop.
+type mtlsTarget struct {
+	mu    sync.Mutex
+	stats meter.MTLSProbeStats
+}
+
+var (
+	mtlsTargetsMu sync.RWMutex
+	mtlsTargets   []*mtlsTarget
+)
+
+// startMTLSProbes launches one probe loop per host:port target.
+func startMTLSProbes(targets []string, interval time.Duration) {
+	for _, t := range targets {
+		mt := &mtlsTarget{stats: meter.MTLSProbeStats{Target: t}}
+		mtlsTargetsMu.Lock()
+		mtlsTargets = append(mtlsTargets, mt)
+		mtlsTargetsMu.Unlock()
+		go mt.run(interval)
+	}
+}
+
+// run probes the target once per interval.
+func (mt *mtlsTarget) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timeout := min(interval, 5*time.Second)
+	for {
+		result, err := probePlaintext(mt.stats.Target, timeout)
+		host, _, _ := net.SplitHostPort(mt.stats.Target)
+		mt.record(result, err, outboundInterface(host))
+		<-ticker.C
+	}
+}
+
+// probePlaintext sends a plaintext HTTP request to target and classifies
+// what happened. A STRICT PeerAuthentication makes the server-side proxy
+// close a connection whose first bytes are not a TLS handshake, so a
+// connection that is accepted and then closed without a response is taken
+// as proof that plaintext is refused.
+//
+// When this pod has a sidecar of its own, the probe is normally captured and
+// upgraded to mTLS on the way out, which says nothing about the target. Such
+// probes are recognised by our sidecar's timing header on the response and
+// reported as intercepted; run the probe from a pod outside the mesh, or
+// exclude the target port from outbound capture, to get a verdict.
+func probePlaintext(target string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return mtlsUnreachable, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+	if err != nil {
+		return mtlsUnreachable, err
+	}
+	req.Header.Set("User-Agent", "podmeter-mtls-probe")
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		if isConnRefused(err) {
+			return mtlsStrict, nil
+		}
+		return mtlsUnreachable, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		if isConnRefused(err) {
+			return mtlsStrict, nil
+		}
+		return mtlsUnreachable, fmt.Errorf("no response and no close: %w", err)
+	}
+	resp.Body.Close()
+	if hops.SidecarPresent() && resp.Header.Get("X-Envoy-Upstream-Service-Time") != "" {
+		return mtlsIntercepted, nil
+	}
+	return mtlsPermissive, nil
+}
+
+// isConnRefused reports whether err is the peer closing or resetting the
+// connection, which is how a proxy that requires TLS turns plaintext away.
+func isConnRefused(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func (mt *mtlsTarget) record(result string, err error, iface string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	s := &mt.stats
+	s.Probes++
+	s.Interface = iface
+	s.Result = result
+	s.LastProbe = time.Now().UTC()
+	s.LastError = ""
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	switch result {
+	case mtlsStrict:
+		s.PlaintextRejected++
+	case mtlsPermissive:
+		s.PlaintextAccepted++
+	default:
+		s.Inconclusive++
+	}
+	s.StrictVerified = result == mtlsStrict
+}
+
+// mtlsProbeStats snapshots every mTLS probe.
+func mtlsProbeStats() []meter.MTLSProbeStats {
+	mtlsTargetsMu.RLock()
+	defer mtlsTargetsMu.RUnlock()
+	var out []meter.MTLSProbeStats
+	for _, mt := range mtlsTargets {
+		mt.mu.Lock()
+		out = append(out, mt.stats)
+		mt.mu.Unlock()
+	}
+	return out
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var (
+	// Workload request phases, in ms. The first three come from the
+	// connection, so they are only measured for HTTP/1: HTTP/2 multiplexes
+	// requests on a connection.
+	phaseFirstByte = meter.NewWindow(0) // Accept to the first byte, on new connections
+	phaseHeaders   = meter.NewWindow(0) // First byte to the handler starting
+	phaseBodyRead  = meter.NewWindow(0)
+	phaseWork      = meter.NewWindow(0)
+	phaseWrite     = meter.NewWindow(0) // Handler writing to the response flushed
+)
+
+// timedConn is an accepted HTTP connection that notes when the first byte
+// of each request arrives on it, and when the handler serving it started
+// writing, for the phases around the handler.
+type timedConn struct {
+	net.Conn
+	accepted time.Time
+
+	mu sync.Mutex
+	// waiting is set between requests, so the next byte read starts one
+	waiting    bool
+	firstByte  time.Time
+	requests   int
+	writeStart time.Time
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if c.waiting {
+			c.firstByte, c.waiting = time.Now(), false
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// timedListener accepts timedConns.
+type timedListener struct {
+	net.Listener
+}
+
+func (l timedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: c, accepted: time.Now(), waiting: true}, nil
+}
+
+// timePhases has srv time the phases of the requests it serves from ln,
+// and returns the listener to serve instead.
+func timePhases(srv *http.Server, ln net.Listener) net.Listener {
+	srv.ConnContext = withConn
+	return timedListener{ln}
+}
+
+// connKey carries the connection a request arrived on through its context.
+type connKey struct{}
+
+// withConn is an http.Server ConnContext hook that makes the connection
+// available to the handlers of its requests.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// timedConnOf returns c, or the connection under it for TLS, as a
+// timedConn, or nil if it is not one.
+func timedConnOf(c net.Conn) *timedConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	t, _ := c.(*timedConn)
+	return t
+}
+
+// requestConn returns the timedConn an HTTP/1 request arrived on, or nil.
+func requestConn(r *http.Request) *timedConn {
+	if r.ProtoMajor != 1 {
+		return nil
+	}
+	c, _ := r.Context().Value(connKey{}).(net.Conn)
+	if c == nil {
+		return nil
+	}
+	return timedConnOf(c)
+}
+
+// recordArrival records the phases before the handler started at start:
+// waiting for the first byte on a new connection, and receiving and parsing
+// the headers. It returns the headers phase, or 0 when it is unknown.
+func (c *timedConn) recordArrival(start time.Time) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if c.firstByte.IsZero() {
+		return 0
+	}
+	if c.requests == 1 {
+		phaseFirstByte.Add(meter.Ms(c.firstByte.Sub(c.accepted)))
+	}
+	headers := meter.Ms(start.Sub(c.firstByte))
+	phaseHeaders.Add(headers)
+	return headers
+}
+
+// startWrite notes that the handler began writing its response at t.
+func (c *timedConn) startWrite(t time.Time) {
+	c.mu.Lock()
+	c.writeStart = t
+	c.mu.Unlock()
+}
+
+// responded records the write phase of the request just served, now that
+// its response has been flushed, and waits for the next one.
+func (c *timedConn) responded(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.writeStart.IsZero() {
+		phaseWrite.Add(meter.Ms(now.Sub(c.writeStart)))
+	}
+	c.writeStart = time.Time{}
+	c.firstByte = time.Time{}
+	c.waiting = true
+}
+
+func summarizePhase(w *meter.Window) meter.PhaseSummary {
+	values := w.Values()
+	if len(values) == 0 {
+		return meter.PhaseSummary{}
+	}
+	lat := meter.Summarize(values)
+	return meter.PhaseSummary{
+		Samples: len(values),
+		Avg:     lat.Avg,
+		P50:     lat.P50,
+		P95:     lat.P95,
+		P99:     lat.P99,
+		Max:     lat.Max,
+	}
+}
+
+// phaseStats summarizes every phase of the workload requests.
+func phaseStats() meter.PhaseStats {
+	return meter.PhaseStats{
+		FirstByte: summarizePhase(phaseFirstByte),
+		Headers:   summarizePhase(phaseHeaders),
+		BodyRead:  summarizePhase(phaseBodyRead),
+		Work:      summarizePhase(phaseWork),
+		Write:     summarizePhase(phaseWrite),
+	}
+}
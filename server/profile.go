@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Caps on how long a single capture may run. Execution traces grow by
+// megabytes per second under load, so they get a tighter one.
+const (
+	maxProfileDuration = 5 * time.Minute
+	maxTraceDuration   = time.Minute
+)
+
+// profileDuration returns the ?seconds= of a profiling request, def when
+// omitted, or an error when it is not a whole number of seconds up to limit.
+func profileDuration(r *http.Request, def, limit time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get("seconds")
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || time.Duration(n)*time.Second > limit {
+		return 0, fmt.Errorf("seconds must be a whole number from 1 to %d", int(limit.Seconds()))
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// waitProfile sleeps for d, or until the client goes away; it reports
+// whether the whole duration passed.
+func waitProfile(r *http.Request, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// attachProfile sets the headers of a downloaded profile named
+// <kind>-<timestamp>.<ext>.
+func attachProfile(w http.ResponseWriter, kind, ext string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, kind, time.Now().UTC().Format("20060102T150405Z"), ext))
+}
+
+// captureCPUProfile profiles the process for ?seconds= (30 by default) and
+// returns the gzipped pprof profile. It answers the request itself, and
+// returns false, when the duration is invalid, another CPU profile is
+// running or the client went away.
+func captureCPUProfile(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	d, err := profileDuration(r, 30*time.Second, maxProfileDuration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		http.Error(w, "a CPU profile is already running", http.StatusConflict)
+		return nil, false
+	}
+	infof("Profile: capturing a %s CPU profile", d)
+	completed := waitProfile(r, d)
+	pprof.StopCPUProfile()
+	return buf.Bytes(), completed
+}
+
+// cpuProfileHandler serves GET /admin/profile/cpu?seconds=30: it profiles
+// the running process for that long and returns the profile for
+// `go tool pprof`. Only one CPU profile can run at a time.
+func cpuProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := captureCPUProfile(w, r)
+	if !ok {
+		return
+	}
+	attachProfile(w, "cpu", "pprof")
+	w.Write(profile)
+}
+
+// executionTraceHandler serves GET /admin/profile/trace?seconds=5: a runtime
+// execution trace of that long (5 seconds by default) for `go tool trace`,
+// streamed as it is recorded. Only one trace can run at a time.
+func executionTraceHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := profileDuration(r, 5*time.Second, maxTraceDuration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if trace.IsEnabled() {
+		http.Error(w, "an execution trace is already running", http.StatusConflict)
+		return
+	}
+	attachProfile(w, "trace", "out")
+	if err := trace.Start(w); err != nil {
+		// Lost a race with another trace; the headers are not sent yet
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "an execution trace is already running", http.StatusConflict)
+		return
+	}
+	infof("Profile: capturing a %s execution trace", d)
+	waitProfile(r, d)
+	trace.Stop()
+}
+
+// ContentionRates are the runtime's block and mutex profiling rates. Both
+// are off by default, because sampling every event costs on the paths being
+// measured.
+type ContentionRates struct {
+	BlockRate     int `json:"block_rate"`     // Sample one blocking event per this many ns blocked; 1 records all, 0 is off
+	MutexFraction int `json:"mutex_fraction"` // Sample one in this many mutex contention events; 0 is off
+}
+
+var (
+	contentionMu sync.Mutex
+	blockRate    int // The runtime has no getter for it
+)
+
+// setContentionRates applies rates to the runtime.
+func setContentionRates(rates ContentionRates) {
+	contentionMu.Lock()
+	defer contentionMu.Unlock()
+	runtime.SetBlockProfileRate(rates.BlockRate)
+	runtime.SetMutexProfileFraction(rates.MutexFraction)
+	blockRate = rates.BlockRate
+}
+
+func currentContentionRates() ContentionRates {
+	contentionMu.Lock()
+	defer contentionMu.Unlock()
+	return ContentionRates{BlockRate: blockRate, MutexFraction: runtime.SetMutexProfileFraction(-1)}
+}
+
+// contentionRatesHandler serves GET and PUT /admin/profile/rates. PUT takes
+// block_rate and mutex_fraction as query parameters or a JSON body; omitted
+// rates are left alone.
+func contentionRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		rates := currentContentionRates()
+		query := r.URL.Query()
+		if query.Has("block_rate") || query.Has("mutex_fraction") {
+			for name, dst := range map[string]*int{"block_rate": &rates.BlockRate, "mutex_fraction": &rates.MutexFraction} {
+				if v := query.Get(name); query.Has(name) {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						http.Error(w, name+" must be an integer", http.StatusBadRequest)
+						return
+					}
+					*dst = n
+				}
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if rates.BlockRate < 0 || rates.MutexFraction < 0 {
+			http.Error(w, "block_rate and mutex_fraction must not be negative", http.StatusBadRequest)
+			return
+		}
+		setContentionRates(rates)
+		infof("Profile: block rate %d, mutex fraction %d", rates.BlockRate, rates.MutexFraction)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentContentionRates())
+}
+
+// contentionProfileHandler serves GET /admin/profile/block and
+// /admin/profile/mutex: where goroutines waited, on channels and locks or on
+// contended mutexes, since profiling was enabled. ?debug=1 returns text.
+// The profiles are empty until PUT /admin/profile/rates turns sampling on.
+func contentionProfileHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("kind")
+	profile := pprof.Lookup(name)
+	if profile == nil || (name != "block" && name != "mutex") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("debug") == "1" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		profile.WriteTo(w, 1)
+		return
+	}
+	attachProfile(w, name, "pprof")
+	profile.WriteTo(w, 0)
+}
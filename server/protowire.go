@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Minimal protobuf wire-format helpers. PodMeter only needs a handful of
+// small messages, so encoding them by hand keeps the binary dependency-free.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = fmt.Errorf("protobuf: truncated message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendStringField appends a string field, omitting it when empty (proto3 default).
+func appendStringField(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendBytesField appends a length-delimited field (bytes or embedded message).
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendIntField appends an int32/int64/enum field, omitting zero values.
+func appendIntField(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, uint64(v))
+}
+
+// appendBoolField appends a bool field, omitting false.
+func appendBoolField(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, 1)
+}
+
+// appendDoubleField appends a double field, omitting zero.
+func appendDoubleField(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireFixed64)
+	return appendDoubleBits(b, v)
+}
+
+// appendDoubleBits appends the little-endian IEEE 754 encoding of v.
+func appendDoubleBits(b []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// protoField is a single decoded field. For varint fields Varint is set; for
+// length-delimited fields Bytes is set. Fixed-width fields are skipped.
+type protoField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// parseProto walks a serialized message and calls fn for every field.
+func parseProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{Num: int(tag >> 3), Type: int(tag & 7)}
+
+		switch f.Type {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			f.Varint = v
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			f.Varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtoTruncated
+			}
+			f.Bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			f.Varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type")
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
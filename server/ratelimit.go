@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// RouteLimit caps requests to every path under Prefix: RPS requests per
+// second on average, in bursts of up to one second's worth, and MaxInFlight
+// at once. Zero leaves either unlimited.
+type RouteLimit struct {
+	Prefix      string
+	RPS         float64
+	MaxInFlight int
+}
+
+// routeLimiter enforces one RouteLimit.
+type routeLimiter struct {
+	RouteLimit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	inFlight            atomic.Int64
+	allowed             atomic.Int64
+	rejectedRate        atomic.Int64
+	rejectedConcurrency atomic.Int64
+
+	// Retries are requests a mesh proxy was retrying, with an
+	// x-envoy-attempt-count above 1
+	retries         atomic.Int64
+	retriesRejected atomic.Int64
+	maxAttempt      atomic.Int64
+
+	// pending holds the last unanswered rejection of each client, until a
+	// retry from it arrives or it is given up as abandoned
+	pendingMu           sync.Mutex
+	pending             map[string]rejection
+	rejectionsRetried   int64
+	rejectionsAbandoned int64
+	retriesEarly        int64 // Retries that came before Retry-After passed
+	retryDelayTotal     time.Duration
+}
+
+// rejection is a 429 sent to a client and the Retry-After it carried.
+type rejection struct {
+	at         time.Time
+	retryAfter time.Duration
+}
+
+const (
+	// maxPendingRejections bounds the clients whose rejections are kept
+	// per limit; rejections beyond it are not followed up
+	maxPendingRejections = 1024
+	// abandonAfter is how long past its Retry-After a rejection waits for
+	// a retry before it counts as abandoned
+	abandonAfter = 30 * time.Second
+)
+
+// routeLimiters are the configured limits, longest prefix first.
+var routeLimiters []*routeLimiter
+
+// ParseRouteLimits parses comma-separated `PREFIX=RPS[:MAX_IN_FLIGHT]`
+// entries, e.g. `/stats/history.parquet=0.2:1,/debug/=5`. An RPS of 0 caps
+// only concurrency.
+func ParseRouteLimits(spec string) ([]RouteLimit, error) {
+	var out []RouteLimit
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		prefix, limits, ok := strings.Cut(s, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%q: want /prefix=rps[:max_in_flight]", s)
+		}
+		if seen[prefix] {
+			return nil, fmt.Errorf("%s: limited twice", prefix)
+		}
+		seen[prefix] = true
+		l := RouteLimit{Prefix: prefix}
+		rps, inFlight, hasInFlight := strings.Cut(limits, ":")
+		var err error
+		if l.RPS, err = strconv.ParseFloat(rps, 64); err != nil || l.RPS < 0 || math.IsInf(l.RPS, 0) {
+			return nil, fmt.Errorf("%s: invalid rate %q", prefix, rps)
+		}
+		if hasInFlight {
+			if l.MaxInFlight, err = strconv.Atoi(inFlight); err != nil || l.MaxInFlight < 0 {
+				return nil, fmt.Errorf("%s: invalid max in flight %q", prefix, inFlight)
+			}
+		}
+		if l.RPS == 0 && l.MaxInFlight == 0 {
+			return nil, fmt.Errorf("%s: limits nothing", prefix)
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// setRouteLimits installs limits, ordered so the longest matching prefix
+// wins.
+func setRouteLimits(limits []RouteLimit) {
+	routeLimiters = nil
+	for _, l := range limits {
+		routeLimiters = append(routeLimiters, &routeLimiter{
+			RouteLimit: l,
+			tokens:     burst(l.RPS),
+			last:       time.Now(),
+			pending:    make(map[string]rejection),
+		})
+	}
+	sort.SliceStable(routeLimiters, func(i, j int) bool {
+		return len(routeLimiters[i].Prefix) > len(routeLimiters[j].Prefix)
+	})
+}
+
+// burst is the bucket size for rps: one second's worth, and at least one
+// request.
+func burst(rps float64) float64 {
+	return max(1, math.Ceil(rps))
+}
+
+// takeToken refills the bucket for the time since the last request and
+// takes a token if one is left.
+func (l *routeLimiter) takeToken() bool {
+	if l.RPS == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(burst(l.RPS), l.tokens+now.Sub(l.last).Seconds()*l.RPS)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// retryAfter is the delay advertised to a rejected client: the time until
+// the next token for a rate limit, or a second for a concurrency limit.
+func (l *routeLimiter) retryAfter(rate bool) time.Duration {
+	if rate {
+		return time.Duration(math.Ceil(1/l.RPS)) * time.Second
+	}
+	return time.Second
+}
+
+// reject answers r with a 429 and a Retry-After, and remembers the rejection
+// so a retry can be matched to it.
+func (l *routeLimiter) reject(w http.ResponseWriter, client string, rate bool, msg string) {
+	retryAfter := l.retryAfter(rate)
+	now := time.Now()
+	l.pendingMu.Lock()
+	if len(l.pending) >= maxPendingRejections {
+		l.expireRejections(now)
+	}
+	if _, ok := l.pending[client]; ok || len(l.pending) < maxPendingRejections {
+		l.pending[client] = rejection{at: now, retryAfter: retryAfter}
+	}
+	l.pendingMu.Unlock()
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// noteRetry records a retry from client, matching it to the client's last
+// rejection if there is one.
+func (l *routeLimiter) noteRetry(client string, attempt int64) {
+	l.retries.Add(1)
+	for {
+		seen := l.maxAttempt.Load()
+		if attempt <= seen || l.maxAttempt.CompareAndSwap(seen, attempt) {
+			break
+		}
+	}
+
+	now := time.Now()
+	l.pendingMu.Lock()
+	defer l.pendingMu.Unlock()
+	rej, ok := l.pending[client]
+	if !ok {
+		return
+	}
+	delete(l.pending, client)
+	l.rejectionsRetried++
+	delay := now.Sub(rej.at)
+	l.retryDelayTotal += delay
+	if delay < rej.retryAfter {
+		l.retriesEarly++
+	}
+}
+
+// expireRejections counts rejections that went unretried for too long as
+// abandoned. The caller holds l.pendingMu.
+func (l *routeLimiter) expireRejections(now time.Time) {
+	for client, rej := range l.pending {
+		if now.Sub(rej.at) > rej.retryAfter+abandonAfter {
+			delete(l.pending, client)
+			l.rejectionsAbandoned++
+		}
+	}
+}
+
+// limitRoutes applies the route limits in front of h. Requests over a limit
+// are answered with 429 and a Retry-After, and retries that follow are
+// matched to the rejections they answer.
+func limitRoutes(h http.Handler) http.Handler {
+	if len(routeLimiters) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l *routeLimiter
+		for _, candidate := range routeLimiters {
+			if strings.HasPrefix(r.URL.Path, candidate.Prefix) {
+				l = candidate
+				break
+			}
+		}
+		if l == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		client := resolveClient(r)
+		attempt, _ := strconv.ParseInt(r.Header.Get("X-Envoy-Attempt-Count"), 10, 64)
+		retry := attempt > 1
+		if retry {
+			l.noteRetry(client, attempt)
+		}
+
+		if n := l.inFlight.Add(1); l.MaxInFlight > 0 && n > int64(l.MaxInFlight) {
+			l.inFlight.Add(-1)
+			l.rejectedConcurrency.Add(1)
+			if retry {
+				l.retriesRejected.Add(1)
+			}
+			l.reject(w, client, false, fmt.Sprintf("too many concurrent requests to %s (at most %d)", l.Prefix, l.MaxInFlight))
+			return
+		}
+		defer l.inFlight.Add(-1)
+		if !l.takeToken() {
+			l.rejectedRate.Add(1)
+			if retry {
+				l.retriesRejected.Add(1)
+			}
+			l.reject(w, client, true, fmt.Sprintf("rate limit for %s exceeded (%g per second)", l.Prefix, l.RPS))
+			return
+		}
+		l.allowed.Add(1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// routeLimitStats reports each limit, what it let through, and how clients
+// reacted to its rejections.
+func routeLimitStats() []meter.RouteLimitStats {
+	var out []meter.RouteLimitStats
+	now := time.Now()
+	for _, l := range routeLimiters {
+		ls := meter.RouteLimitStats{
+			Prefix:              l.Prefix,
+			RPS:                 l.RPS,
+			MaxInFlight:         l.MaxInFlight,
+			InFlight:            l.inFlight.Load(),
+			Allowed:             l.allowed.Load(),
+			RejectedRate:        l.rejectedRate.Load(),
+			RejectedConcurrency: l.rejectedConcurrency.Load(),
+			Retries:             l.retries.Load(),
+			RetriesRejected:     l.retriesRejected.Load(),
+			MaxAttempt:          l.maxAttempt.Load(),
+		}
+		ls.RetriesAllowed = ls.Retries - ls.RetriesRejected
+		if ls.Retries > 0 {
+			ls.RetrySuccessPercent = meter.Round(float64(ls.RetriesAllowed) / float64(ls.Retries) * 100)
+		}
+
+		l.pendingMu.Lock()
+		l.expireRejections(now)
+		ls.RejectionsPending = int64(len(l.pending))
+		ls.RejectionsRetried = l.rejectionsRetried
+		ls.RejectionsAbandoned = l.rejectionsAbandoned
+		ls.RetriesEarly = l.retriesEarly
+		ls.RetriesHonoringRetryAfter = l.rejectionsRetried - l.retriesEarly
+		if l.rejectionsRetried > 0 {
+			ls.AvgRetryDelay = meter.Ms(l.retryDelayTotal / time.Duration(l.rejectionsRetried))
+		}
+		l.pendingMu.Unlock()
+		out = append(out, ls)
+	}
+	return out
+}
+
+// resetRouteLimits zeroes the counters of every limit, for /admin/reset.
+func resetRouteLimits() {
+	for _, l := range routeLimiters {
+		l.allowed.Store(0)
+		l.rejectedRate.Store(0)
+		l.rejectedConcurrency.Store(0)
+		l.retries.Store(0)
+		l.retriesRejected.Store(0)
+		l.maxAttempt.Store(0)
+		l.pendingMu.Lock()
+		clear(l.pending)
+		l.rejectionsRetried, l.rejectionsAbandoned, l.retriesEarly, l.retryDelayTotal = 0, 0, 0, 0
+		l.pendingMu.Unlock()
+	}
+}
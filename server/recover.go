@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// panicsTotal counts handler panics recovered by recoverPanics.
+var panicsTotal atomic.Int64
+
+// panicWriter records whether a response has started, which decides what a
+// panic can still send.
+type panicWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (pw *panicWriter) WriteHeader(code int) {
+	pw.started = true
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *panicWriter) Write(p []byte) (int, error) {
+	pw.started = true
+	return pw.ResponseWriter.Write(p)
+}
+
+// Flush forwards to the underlying writer so streaming handlers keep working.
+func (pw *panicWriter) Flush() {
+	pw.started = true
+	http.NewResponseController(pw.ResponseWriter).Flush()
+}
+
+// Hijack forwards to the underlying writer so WebSocket upgrades keep
+// working. A hijacked connection is the handler's: a later panic only aborts.
+func (pw *panicWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	pw.started = true
+	return http.NewResponseController(pw.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (pw *panicWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// recoverPanics turns a panic in h into a 500, counts it in panics_total and
+// logs its stack with the request, so that one bad request is measured
+// instead of ending in net/http's bare connection close. If the response had
+// already started, the connection is aborted so the client does not take the
+// partial response for a whole one. http.ErrAbortHandler passes through: it
+// is how handlers abort on purpose.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			panicsTotal.Add(1)
+			errorf("Panic serving %s %s from %s (request id %q, user agent %q): %v\n%s",
+				r.Method, r.URL.RequestURI(), r.RemoteAddr, r.Header.Get("X-Request-Id"), r.UserAgent(), p, debug.Stack())
+			if pw.started {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(pw, r)
+	})
+}
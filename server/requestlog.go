@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+)
+
+// RequestLogPolicy selects the workload requests logged in full: one in
+// every Every requests, and every request whose Header matches. A zero
+// policy logs nothing.
+type RequestLogPolicy struct {
+	Every  int    // Sample one in Every requests; 0 samples none
+	Header string // Log requests carrying this header; empty matches none
+	Value  string // ...with this value, if set
+}
+
+var (
+	requestLogMu     sync.RWMutex
+	requestLogPolicy RequestLogPolicy
+	requestLogSeen   atomic.Int64 // Workload requests considered, for 1-in-N
+)
+
+// ParseRequestLogSampling parses the sampling part of a request log policy:
+// "off" (or empty), "all" or "1/N", as for latency sampling.
+func ParseRequestLogSampling(spec string) (int, error) {
+	switch spec = strings.TrimSpace(spec); spec {
+	case "", "off":
+		return 0, nil
+	case "all":
+		return 1, nil
+	}
+	rest, ok := strings.CutPrefix(spec, "1/")
+	if !ok {
+		return 0, fmt.Errorf("sampling %q: want off, all or 1/N", spec)
+	}
+	n, err := strconv.Atoi(rest)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("sampling %q: N must be a positive integer", spec)
+	}
+	return n, nil
+}
+
+// ParseRequestLogMatch parses the header predicate of a request log policy:
+// "Name" matches requests carrying the header, "Name=value" requests where
+// it has that value. Empty matches none.
+func ParseRequestLogMatch(spec string) (header, value string, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return "", "", nil
+	}
+	header, value, _ = strings.Cut(spec, "=")
+	header = strings.TrimSpace(header)
+	if header == "" || strings.ContainsAny(header, " \t:") {
+		return "", "", fmt.Errorf("match %q: want Header or Header=value", spec)
+	}
+	return textproto.CanonicalMIMEHeaderKey(header), strings.TrimSpace(value), nil
+}
+
+// sampling returns the sampling part in the form ParseRequestLogSampling
+// accepts.
+func (p RequestLogPolicy) sampling() string {
+	switch p.Every {
+	case 0:
+		return "off"
+	case 1:
+		return "all"
+	}
+	return "1/" + strconv.Itoa(p.Every)
+}
+
+// match returns the header predicate in the form ParseRequestLogMatch
+// accepts.
+func (p RequestLogPolicy) match() string {
+	if p.Value != "" {
+		return p.Header + "=" + p.Value
+	}
+	return p.Header
+}
+
+func setRequestLogPolicy(p RequestLogPolicy) {
+	requestLogMu.Lock()
+	requestLogPolicy = p
+	requestLogMu.Unlock()
+}
+
+func currentRequestLogPolicy() RequestLogPolicy {
+	requestLogMu.RLock()
+	defer requestLogMu.RUnlock()
+	return requestLogPolicy
+}
+
+// shouldLogRequest decides whether r is logged in full. Every request
+// counts towards the 1-in-N sample, matched or not.
+func shouldLogRequest(r *http.Request) bool {
+	p := currentRequestLogPolicy()
+	if p.Every == 0 && p.Header == "" {
+		return false
+	}
+	sampled := p.Every > 0 && requestLogSeen.Add(1)%int64(p.Every) == 0
+	if p.Header != "" {
+		if values, ok := r.Header[p.Header]; ok && (p.Value == "" || slices.Contains(values, p.Value)) {
+			return true
+		}
+	}
+	return sampled
+}
+
+// requestTimings breaks the latency of one workload request into its parts.
+type requestTimings struct {
+	// From the request's first byte to the handler starting, over HTTP/1;
+	// not part of the total
+	HeadersMs float64 `json:"headers_ms,omitempty"`
+	BodyMs    float64 `json:"body_read_ms"`
+	ChaosMs   float64 `json:"chaos_delay_ms"`
+	FaultMs   float64 `json:"fault_delay_ms"`
+	WorkMs    float64 `json:"work_ms"` // In reverse-proxy mode, proxying the request and response
+	// Until the upstream's response headers, in reverse-proxy mode
+	UpstreamMs float64 `json:"upstream_ms,omitempty"`
+	TotalMs    float64 `json:"total_ms"`
+}
+
+// requestLogEntry is one full request log line.
+type requestLogEntry struct {
+	Time          time.Time           `json:"time"`
+	Method        string              `json:"method"`
+	URI           string              `json:"uri"`
+	Proto         string              `json:"proto"`
+	Host          string              `json:"host"`
+	RemoteAddr    string              `json:"remote_addr"`
+	TLS           bool                `json:"tls"`
+	ContentLength int64               `json:"content_length"`
+	Status        int                 `json:"status"`
+	BytesSent     int64               `json:"bytes_sent"`
+	Reset         bool                `json:"reset,omitempty"`
+	Timings       requestTimings      `json:"timings"`
+	Hops          requestLogHops      `json:"hops"`
+	Headers       map[string][]string `json:"headers"`
+}
+
+type requestLogHops struct {
+	Proxy        int    `json:"proxy"`
+	Mesh         int    `json:"mesh"`
+	Total        int    `json:"total"`
+	MeshMode     string `json:"mesh_mode"`
+	MeshPath     string `json:"mesh_path"`
+	Waypoint     bool   `json:"waypoint"`
+	Istio        bool   `json:"istio"`
+	CrossCluster int    `json:"cross_cluster"`
+}
+
+// newRequestLogEntry describes r in full, with credentials redacted as for
+// /debug/trace. t.TotalMs is the request's latency.
+func newRequestLogEntry(r *http.Request, start time.Time, status int, bytesSent int64, reset bool, t requestTimings) requestLogEntry {
+	headers := r.Header.Clone()
+	for _, name := range traceRedact {
+		if _, ok := headers[name]; ok {
+			headers[name] = []string{"[redacted]"}
+		}
+	}
+	hop := hops.Detect(r)
+	return requestLogEntry{
+		Time:          start.UTC(),
+		Method:        r.Method,
+		URI:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		Host:          r.Host,
+		RemoteAddr:    r.RemoteAddr,
+		TLS:           r.TLS != nil,
+		ContentLength: r.ContentLength,
+		Status:        status,
+		BytesSent:     bytesSent,
+		Reset:         reset,
+		Timings:       t,
+		Hops: requestLogHops{
+			Proxy:        hop.ProxyHops,
+			Mesh:         hop.MeshHops,
+			Total:        hop.Total(),
+			MeshMode:     hop.MeshMode,
+			MeshPath:     hop.MeshPath,
+			Waypoint:     hop.Waypoint,
+			Istio:        hop.IstioDetected,
+			CrossCluster: hops.CrossClusterHops(r, localCluster()),
+		},
+		Headers: headers,
+	}
+}
+
+// writeRequestLog logs entry as one `request-log {...}` JSON line, whatever
+// the log level: it was asked for by the policy.
+func writeRequestLog(entry requestLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		errorf("Request log: %v", err)
+		return
+	}
+	log.Printf("request-log %s", data)
+}
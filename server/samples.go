@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Page sizes of GET /stats/samples.
+const (
+	defaultSamplesLimit = 1000
+	maxSamplesLimit     = 10000
+)
+
+// samplesResponse is the body of GET /stats/samples.
+type samplesResponse struct {
+	Total      int            `json:"total"` // Samples matching since, across all pages
+	Offset     int            `json:"offset"`
+	Limit      int            `json:"limit"`
+	NextOffset int            `json:"next_offset,omitempty"` // Absent on the last page
+	Samples    []meter.Sample `json:"samples"`
+}
+
+// parseSince parses ?since= as an RFC 3339 time or a duration ago.
+func parseSince(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("since must be an RFC 3339 time or a positive duration such as 5m")
+}
+
+// samplesHandler serves GET /stats/samples?limit=&offset=&since=: the raw
+// latency samples of the workload's window, oldest first, for running
+// statistics /stats does not. The window is the one the percentiles are
+// computed from, so its size and sampling follow the retention settings.
+// Pages are positions in the window at the time of the request; samples
+// recorded or evicted between requests shift them, so page with since=
+// set to the last timestamp seen to follow a busy window.
+func samplesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := parseSince(query.Get("since"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, offset := defaultSamplesLimit, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxSamplesLimit {
+			http.Error(w, fmt.Sprintf("limit must be a whole number from 1 to %d", maxSamplesLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	samples := httpMeter.Samples(since)
+	resp := samplesResponse{Total: len(samples), Offset: offset, Limit: limit, Samples: []meter.Sample{}}
+	if offset < len(samples) {
+		end := min(offset+limit, len(samples))
+		resp.Samples = samples[offset:end]
+		for i := range resp.Samples {
+			resp.Samples[i].Time = resp.Samples[i].Time.UTC()
+		}
+		if end < len(samples) {
+			resp.NextOffset = end
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,410 @@
+// Package server is the PodMeter service: the simulated HTTP workload and
+// /stats endpoint, plus the optional gRPC, UDP, TCP and ICMP subsystems that
+// report into the same snapshot.
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/exporters"
+	"github.com/nyan-lin-tun/PodMeter/history"
+	"github.com/nyan-lin-tun/PodMeter/storage"
+)
+
+// db is where stateful features (history, captures) persist, opened by Run.
+var db storage.Store
+
+// Config selects which listeners and probes Run starts. Empty addresses and
+// an empty target list leave the corresponding subsystem disabled.
+type Config struct {
+	HTTPAddr      string        // Workload, /stats and admin endpoints
+	GRPCAddr      string        // h2c gRPC echo, health and reflection
+	UDPAddr       string        // UDP echo with loss/jitter metering
+	TCPAddr       string        // Raw TCP echo
+	TLSAddr       string        // HTTPS listener serving the same endpoints as HTTPAddr
+	TLSCertFile   string        // PEM certificate for TLSAddr; empty generates a self-signed one
+	TLSKeyFile    string        // PEM private key for TLSCertFile
+	TLSMinVersion uint16        // Oldest TLS version accepted on TLSAddr; 0 means TLS 1.2
+	Listeners     []Listener    // Extra named ports serving the workload
+	PingTargets   []string      // Hosts to probe with ICMP echo
+	PingInterval  time.Duration // Delay between probes to each ping target
+
+	MTLSProbeTargets  []string      // host:port service ports to probe with plaintext HTTP
+	MTLSProbeInterval time.Duration // Delay between probes to each mTLS target
+
+	InterceptionTargets  []InterceptionTarget // A service and a pod IP to check this pod's sidecar captures requests to
+	InterceptionInterval time.Duration        // Delay between probes to each interception target
+
+	Synthetics []SyntheticCheck // Scheduled synthetic transactions against other services
+
+	AnnotationsFile string // Downward API file with the pod's annotations, for Multus network status
+
+	Zone        string // Availability zone of the pod; empty reads it from LabelsFile, then the API server
+	Region      string // Region of the pod, likewise
+	LabelsFile  string // Downward API file with the pod's labels, for its topology labels
+	TopologyAPI bool   // Read the zone and region from the node's labels when nothing else gives them
+
+	ReachabilityTargets []ReachabilityTarget // Matrix POST /admin/reachability tests by default
+
+	RequestLog RequestLogPolicy // Workload requests to log in full; changeable with /admin/reload
+
+	Upstream *url.URL // Application to proxy workload requests to; nil serves the simulated workload
+
+	SlowRequests       int           // Slowest workload requests kept in full for /debug/slow; 0 disables the capture
+	SlowRequestsMaxAge time.Duration // How long a captured request holds its place; 0 keeps it until a slower one arrives
+
+	RouteLimits []RouteLimit // Rate and concurrency caps per path prefix
+
+	StartupDelay  time.Duration // Simulated initialization before /startupz and /readyz pass
+	StartupJitter time.Duration // Random extra initialization, up to this much
+	StartupFail   bool          // End initialization in failure, so /startupz never passes
+
+	CheckpointPath     string        // File counters and windows persist to across restarts
+	CheckpointInterval time.Duration // Delay between checkpoints
+
+	StorageBackend string // storage.BackendMemory (default) or storage.BackendKV
+	StoragePath    string // File for the kv backend
+
+	HistoryInterval  time.Duration // Delay between history snapshots; 0 disables history
+	HistoryRetention time.Duration // How long snapshots are kept; 0 keeps them forever
+	// Downsampled copies of the history, finest first
+	HistoryResolutions []history.Resolution
+
+	DebugToken string // Bearer token for dump endpoints; empty disables them
+
+	AdminToken string         // Bearer token for the /admin API; empty disables it
+	AdminAllow []netip.Prefix // Client networks allowed to use the /admin API; empty allows any
+	AdminDeny  []netip.Prefix // Client networks refused the /admin API, even if allowed
+	AuditLog   string         // File admin calls are appended to as JSON lines; empty keeps them in memory only
+
+	// Client networks allowed (empty allows any) and refused /debug/* and
+	// /stats, /stats/*
+	DebugAllow []netip.Prefix
+	DebugDeny  []netip.Prefix
+	StatsAllow []netip.Prefix
+	StatsDeny  []netip.Prefix
+
+	LogLevel slog.Level // Minimum level of server log lines
+
+	DrainDelay   time.Duration // How long to keep serving after readiness flips on SIGTERM or /admin/drain
+	DrainTimeout time.Duration // How long shutdown waits for in-flight requests
+
+	MaxRequestBody int64 // Largest request body the workload accepts, in bytes; 0 uses DefaultMaxRequestBody
+
+	IdleTimeout      time.Duration // How long an idle keep-alive connection is kept before it is closed; 0 keeps it until the client closes it
+	DisableKeepAlive bool          // Close every HTTP/1 connection after one request
+
+	LeakCheckInterval time.Duration // Delay between goroutine leak samples; 0 disables detection
+
+	StealCheckInterval time.Duration // Delay between CPU steal samples; 0 disables them
+	StealThreshold     float64       // Steal percentage that, sustained, flags a noisy neighbor
+
+	ContentionRates ContentionRates // Block and mutex profiling rates; changeable with /admin/profile/rates
+
+	Tracing TracingConfig // OpenTelemetry spans for workload and /stats requests
+}
+
+// NewMux returns a ServeMux with every PodMeter HTTP endpoint registered,
+// for callers that want to serve PodMeter on a listener of their own.
+func NewMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", traced(WorkloadHandler))
+	mux.HandleFunc("/stats", traced(StatsHandler))
+	mux.HandleFunc("GET /stats/delta", deltaHandler)
+	mux.HandleFunc("GET /stats/compare", compareHandler)
+	mux.HandleFunc("GET /stats/samples", samplesHandler)
+	mux.HandleFunc("GET /stats/digest", digestHandler)
+	mux.HandleFunc("GET /metrics", requireFlag(exporters.FlagPrometheus, metricsHandler))
+	mux.HandleFunc("GET /readyz", readyHandler)
+	mux.HandleFunc("GET /startupz", startupHandler)
+	mux.HandleFunc("/status/{code}", statusHandler)
+	mux.HandleFunc("GET /chain", requireFlag(flagChain, traced(chainHandler)))
+	mux.HandleFunc("/debug/headers", debugHeadersHandler)
+	mux.HandleFunc("GET /debug/trace/{id}", traceHandler)
+	mux.HandleFunc("GET /debug/slow", slowHandler)
+	mux.HandleFunc("GET /debug/bundle", requireDebugToken(bundleHandler))
+	mux.HandleFunc("GET /debug/goroutines", requireDebugToken(goroutinesHandler))
+	mux.HandleFunc("GET /debug/heap", requireDebugToken(heapHandler))
+	mux.HandleFunc("GET /debug/tls", requireDebugToken(tlsInspectHandler))
+	mux.HandleFunc("/ws/echo", wsEchoHandler)
+	mux.Handle("/admin/", requireAdmin(adminMux()))
+	mux.HandleFunc("GET /stats/history.parquet", requireFlag(flagParquetExport, historyParquetHandler))
+	return mux
+}
+
+// Run starts the optional listeners and probes in cfg, then serves the HTTP
+// endpoints on cfg.HTTPAddr until that listener fails or the process is
+// signalled. On SIGTERM it drains: readiness fails for cfg.DrainDelay while
+// traffic is still served, then in-flight requests get up to
+// cfg.DrainTimeout to finish, and Run returns nil.
+func Run(cfg Config) error {
+	runConfig = cfg
+	debugToken = cfg.DebugToken
+	adminToken = cfg.AdminToken
+	setAccessGroups(cfg)
+	reachTargets = cfg.ReachabilityTargets
+	annotationsFile = cfg.AnnotationsFile
+	detectTopology(cfg)
+	setRequestLogPolicy(cfg.RequestLog)
+	setSlowCapture(cfg.SlowRequests, cfg.SlowRequestsMaxAge)
+	if cfg.Upstream != nil {
+		setUpstream(cfg.Upstream)
+		infof("Reverse-proxy mode: metering requests to %s", cfg.Upstream.Redacted())
+	}
+	setRouteLimits(cfg.RouteLimits)
+	logLevel.Set(cfg.LogLevel)
+	setContentionRates(cfg.ContentionRates)
+	startTracing(cfg.Tracing)
+	defer stopTracing()
+	drainDelay = cfg.DrainDelay
+	drainTimeout = cfg.DrainTimeout
+	idleTimeout, keepAlive = cfg.IdleTimeout, !cfg.DisableKeepAlive
+	if cfg.MaxRequestBody > 0 {
+		maxRequestBody = cfg.MaxRequestBody
+	}
+	dumpOutput = log.Writer()
+	log.SetOutput(io.MultiWriter(log.Writer(), recentLogs))
+	if cfg.AuditLog != "" {
+		if err := openAuditLog(cfg.AuditLog); err != nil {
+			return err
+		}
+		defer auditFile.Close()
+	}
+
+	fds, err := takeInherited()
+	if err != nil {
+		return err
+	}
+	inheritedFDs = fds
+	defer closeInherited()
+
+	// Restore before any listener can record into the meters. After an
+	// in-place restart the state comes from the process we replaced, which
+	// is newer than the checkpoint file.
+	handedOff := false
+	if f := inheritedFile("state"); f != nil {
+		if err := restoreHandoff(f); err != nil {
+			return err
+		}
+		handedOff = true
+	} else if cfg.CheckpointPath != "" {
+		if err := restoreCheckpoint(cfg.CheckpointPath); err != nil {
+			return fmt.Errorf("restore checkpoint: %w", err)
+		}
+	}
+	// A process restarted in place belongs to a pod that has long started
+	if !handedOff && (cfg.StartupDelay > 0 || cfg.StartupJitter > 0 || cfg.StartupFail) {
+		startInitialization(cfg.StartupDelay, cfg.StartupJitter, cfg.StartupFail)
+	} else {
+		finishInitialization()
+	}
+	if cfg.CheckpointPath != "" {
+		go checkpointLoop(cfg.CheckpointPath, cfg.CheckpointInterval)
+	}
+	store, err := storage.Open(cfg.StorageBackend, cfg.StoragePath)
+	if err != nil {
+		return fmt.Errorf("open storage: %w", err)
+	}
+	db = store
+	if cfg.HistoryInterval > 0 {
+		if err := startHistory(cfg.HistoryInterval, cfg.HistoryRetention, cfg.HistoryResolutions); err != nil {
+			return fmt.Errorf("open history: %w", err)
+		}
+	}
+	if cfg.LeakCheckInterval > 0 {
+		startLeakDetector(cfg.LeakCheckInterval)
+	}
+	if cfg.StealCheckInterval > 0 {
+		startStealMonitor(cfg.StealCheckInterval, cfg.StealThreshold)
+	}
+
+	// Every listener is opened here, inherited or new, so an in-place
+	// restart can pass them all on
+	serveErr := make(chan error, 3+len(cfg.Listeners)) // HTTP, HTTPS, gRPC and the extra listeners
+	sockets := make(map[string]syscall.Conn)
+	var closers []io.Closer
+	httpLn, err := listen("http", cfg.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("HTTP listener: %w", err)
+	}
+	sockets["http"] = httpLn.(syscall.Conn)
+	// HTTP/2 with prior knowledge is accepted alongside HTTP/1, so a sidecar
+	// configured to upgrade app-bound traffic can
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	httpServer := &http.Server{Addr: cfg.HTTPAddr, Handler: recoverPanics(restrictClients(limitRoutes(NewMux()))), ConnState: trackConnState, Protocols: &protocols}
+	applyKeepAlive(httpServer)
+	meterListener(httpServer, Listener{Name: "http", Protocol: "http", Addr: cfg.HTTPAddr})
+	servers := []*http.Server{httpServer}
+	if cfg.GRPCAddr != "" {
+		ln, err := listen("grpc", cfg.GRPCAddr)
+		if err != nil {
+			return fmt.Errorf("gRPC listener: %w", err)
+		}
+		sockets["grpc"] = ln.(syscall.Conn)
+		grpcServer := newGRPCServer(cfg.GRPCAddr)
+		meterListener(grpcServer, Listener{Name: "grpc", Protocol: "grpc", Addr: cfg.GRPCAddr})
+		servers = append(servers, grpcServer)
+		go startGRPCServer(grpcServer, ln, serveErr)
+	}
+	if cfg.TLSAddr != "" {
+		tlsConfig, err := newTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSMinVersion)
+		if err != nil {
+			return fmt.Errorf("TLS certificate: %w", err)
+		}
+		ln, err := listen("https", cfg.TLSAddr)
+		if err != nil {
+			return fmt.Errorf("HTTPS listener: %w", err)
+		}
+		sockets["https"] = ln.(syscall.Conn)
+		tlsServer := &http.Server{Addr: cfg.TLSAddr, Handler: recoverPanics(restrictClients(limitRoutes(NewMux()))), ConnState: trackConnState, TLSConfig: tlsConfig}
+		applyKeepAlive(tlsServer)
+		meterListener(tlsServer, Listener{Name: "https", Protocol: "https", Addr: cfg.TLSAddr})
+		servers = append(servers, tlsServer)
+		tlsEnabled.Store(true)
+		go func() {
+			infof("HTTPS listener running on %s", ln.Addr())
+			if err := tlsServer.ServeTLS(timePhases(tlsServer, ln), "", ""); err != http.ErrServerClosed {
+				serveErr <- err
+			}
+		}()
+	}
+	for _, l := range cfg.Listeners {
+		ln, err := listen(l.Name, l.Addr)
+		if err != nil {
+			return fmt.Errorf("%s listener: %w", l.Name, err)
+		}
+		sockets[l.Name] = ln.(syscall.Conn)
+		var srv *http.Server
+		switch l.Protocol {
+		case "grpc":
+			srv = newGRPCServer(l.Addr)
+		case "https":
+			tlsConfig, err := newTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSMinVersion)
+			if err != nil {
+				return fmt.Errorf("TLS certificate: %w", err)
+			}
+			srv = &http.Server{Addr: l.Addr, Handler: recoverPanics(restrictClients(limitRoutes(NewMux()))), ConnState: trackConnState, TLSConfig: tlsConfig}
+			tlsEnabled.Store(true)
+		default:
+			srv = &http.Server{Addr: l.Addr, Handler: recoverPanics(restrictClients(limitRoutes(NewMux()))), ConnState: trackConnState, Protocols: &protocols}
+		}
+		if l.Protocol != "grpc" {
+			applyKeepAlive(srv)
+		}
+		meterListener(srv, l)
+		servers = append(servers, srv)
+		go func() {
+			infof("%s listener (%s) running on %s", l.Name, l.Protocol, ln.Addr())
+			var err error
+			if l.Protocol == "https" {
+				err = srv.ServeTLS(timePhases(srv, ln), "", "")
+			} else if l.Protocol == "grpc" {
+				err = srv.Serve(ln)
+			} else {
+				err = srv.Serve(timePhases(srv, ln))
+			}
+			if err != http.ErrServerClosed {
+				serveErr <- err
+			}
+		}()
+	}
+	if cfg.UDPAddr != "" {
+		conn, err := listenPacket("udp", cfg.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("UDP listener: %w", err)
+		}
+		sockets["udp"] = conn.(syscall.Conn)
+		closers = append(closers, conn)
+		go startUDPEchoServer(conn)
+	}
+	if cfg.TCPAddr != "" {
+		ln, err := listen("tcp", cfg.TCPAddr)
+		if err != nil {
+			return fmt.Errorf("TCP listener: %w", err)
+		}
+		sockets["tcp"] = ln.(syscall.Conn)
+		closers = append(closers, ln)
+		go startTCPEchoServer(ln)
+	}
+	closeInherited()
+	if len(cfg.PingTargets) > 0 {
+		startICMPProbes(cfg.PingTargets, cfg.PingInterval)
+	}
+	if len(cfg.MTLSProbeTargets) > 0 {
+		startMTLSProbes(cfg.MTLSProbeTargets, cfg.MTLSProbeInterval)
+	}
+	if len(cfg.InterceptionTargets) > 0 {
+		startInterceptionProbes(cfg.InterceptionTargets, cfg.InterceptionInterval)
+	}
+	if len(cfg.Synthetics) > 0 {
+		startSynthetics(cfg.Synthetics)
+	}
+
+	// SIGTERM drains before shutting down; SIGINT skips the drain delay. A
+	// second signal kills the process. SIGHUP restarts in place. SIGQUIT
+	// writes a diagnostic dump to the log and keeps serving, instead of Go's
+	// default of dumping goroutines and exiting.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	go func() {
+		infof("App running on %s", httpLn.Addr())
+		if err := httpServer.Serve(timePhases(httpServer, httpLn)); err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	for {
+		var reason string
+		select {
+		case err := <-serveErr:
+			return err
+		case reason = <-restartRequests:
+		case sig := <-sigs:
+			if sig == syscall.SIGQUIT {
+				id, size := writeDiagnosticDump("SIGQUIT")
+				infof("Diagnostic dump %s written (%d bytes)", id, size)
+				continue
+			}
+			if sig == syscall.SIGHUP {
+				reason = sig.String()
+				break
+			}
+			signal.Stop(sigs)
+			delay := drainDelay
+			if sig == syscall.SIGINT {
+				delay = 0
+			}
+			shutdown(sig.String(), delay, servers...)
+			if cfg.CheckpointPath != "" {
+				if err := saveCheckpoint(cfg.CheckpointPath); err != nil {
+					errorf("Final checkpoint failed: %v", err)
+				}
+			}
+			return db.Close()
+		}
+
+		if draining.Load() {
+			warnf("Restart (%s) ignored: draining", reason)
+			continue
+		}
+		infof("Restart requested (%s)", reason)
+		h, err := prepareRestart(sockets)
+		if err != nil {
+			errorf("Restart aborted, still serving: %v", err)
+			continue
+		}
+		return h.exec(servers, closers)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// slowRequest is a captured workload request, as the request log would
+// show it, with the trace it belongs to.
+type slowRequest struct {
+	requestLogEntry
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+}
+
+var (
+	slowMu      sync.Mutex
+	slowLimit   int           // Requests kept; 0 disables the capture
+	slowMaxAge  time.Duration // Captured requests older than this give way to newer, faster ones
+	slowEntries []slowRequest // Slowest first
+)
+
+func setSlowCapture(limit int, maxAge time.Duration) {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	slowLimit, slowMaxAge = limit, maxAge
+	if len(slowEntries) > limit {
+		slowEntries = slowEntries[:limit]
+	}
+}
+
+// expireSlow drops captured requests older than slowMaxAge. The caller
+// holds slowMu.
+func expireSlow(now time.Time) {
+	if slowMaxAge <= 0 {
+		return
+	}
+	kept := slowEntries[:0]
+	for _, e := range slowEntries {
+		if now.Sub(e.Time) <= slowMaxAge {
+			kept = append(kept, e)
+		}
+	}
+	slowEntries = kept
+}
+
+// isSlowCandidate reports whether a request that took latencyMs would make
+// the capture, so only those pay for building a full entry.
+func isSlowCandidate(latencyMs float64) bool {
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	if slowLimit == 0 {
+		return false
+	}
+	expireSlow(time.Now())
+	return len(slowEntries) < slowLimit || latencyMs > slowEntries[len(slowEntries)-1].Timings.TotalMs
+}
+
+// captureSlow adds entry, describing r, to the capture if it is still
+// among the slowest.
+func captureSlow(r *http.Request, entry requestLogEntry) {
+	traceID, spanID := traceIDs(r)
+	rec := slowRequest{requestLogEntry: entry, TraceID: traceID, SpanID: spanID}
+
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	i := sort.Search(len(slowEntries), func(i int) bool {
+		return slowEntries[i].Timings.TotalMs < rec.Timings.TotalMs
+	})
+	if i >= slowLimit {
+		return // Overtaken by slower requests since isSlowCandidate
+	}
+	slowEntries = append(slowEntries, slowRequest{})
+	copy(slowEntries[i+1:], slowEntries[i:])
+	slowEntries[i] = rec
+	if len(slowEntries) > slowLimit {
+		slowEntries = slowEntries[:slowLimit]
+	}
+}
+
+func resetSlow() {
+	slowMu.Lock()
+	slowEntries = nil
+	slowMu.Unlock()
+}
+
+// slowHandler serves GET /debug/slow: the slowest workload requests of the
+// last PODMETER_SLOW_REQUESTS_MAX_AGE in full (headers, hop analysis,
+// timing breakdown and trace IDs), slowest first, at most ?limit= of them.
+func slowHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	slowMu.Lock()
+	expireSlow(time.Now())
+	reqs := append([]slowRequest{}, slowEntries...)
+	capacity, maxAge := slowLimit, slowMaxAge
+	slowMu.Unlock()
+	if limit > 0 && len(reqs) > limit {
+		reqs = reqs[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"capacity":        capacity,
+		"max_age_seconds": maxAge.Seconds(),
+		"requests":        reqs,
+	})
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// Simulated initialization states, reported by /startupz and in Stats.
+const (
+	startupInitializing = "initializing" // /startupz and /readyz fail
+	startupStarted      = "started"      // Initialization finished
+	startupFailed       = "failed"       // Initialization never finishes; /startupz fails until restarted
+)
+
+var (
+	// processStart approximates when the container started, for
+	// time-to-started and time-to-ready
+	processStart = time.Now()
+
+	startupMu    sync.Mutex
+	startupState = startupStarted
+	startupGen   int       // Counts initializations, so a superseded one does not finish
+	startupBegan time.Time // When the current initialization began
+	startupEnds  time.Time // When it finishes, while initializing
+	startedAt    time.Time // When it last finished
+	firstReadyAt time.Time // First /readyz answered 200
+
+	startupProbes       atomic.Int64
+	startupProbesFailed atomic.Int64
+)
+
+// startInitialization enters the initializing state for delay plus a random
+// part of jitter, so pods on different nodes finish at different times.
+// When fail is set, it ends in the failed state instead of started.
+func startInitialization(delay, jitter time.Duration, fail bool) {
+	if jitter > 0 {
+		delay += rand.N(jitter)
+	}
+	now := time.Now()
+	startupMu.Lock()
+	startupGen++
+	gen := startupGen
+	startupState = startupInitializing
+	startupBegan = now
+	startupEnds = now.Add(delay)
+	startupMu.Unlock()
+	setAllGRPCHealth(healthNotServing)
+	infof("Initializing: simulated startup takes %s", delay.Round(time.Millisecond))
+
+	time.AfterFunc(delay, func() {
+		startupMu.Lock()
+		defer startupMu.Unlock()
+		if gen != startupGen {
+			return // Superseded by a later /admin/startup
+		}
+		if fail {
+			startupState = startupFailed
+			warnf("Initialization failed (simulated): /startupz will fail until the container restarts")
+			return
+		}
+		startupState = startupStarted
+		startedAt = time.Now()
+		if !draining.Load() {
+			setAllGRPCHealth(healthServing)
+		}
+		infof("Initialization finished after %s", startedAt.Sub(startupBegan).Round(time.Millisecond))
+	})
+}
+
+// finishInitialization marks the process started without a simulated delay.
+func finishInitialization() {
+	startupMu.Lock()
+	startupState = startupStarted
+	startedAt = time.Now()
+	startupMu.Unlock()
+}
+
+// started reports whether simulated initialization has finished.
+func started() bool {
+	startupMu.Lock()
+	defer startupMu.Unlock()
+	return startupState == startupStarted
+}
+
+// markReady records the first time readiness was reported, which is close
+// to when the kubelet first saw the pod ready.
+func markReady() {
+	startupMu.Lock()
+	if firstReadyAt.IsZero() {
+		firstReadyAt = time.Now()
+	}
+	startupMu.Unlock()
+}
+
+// startupStats snapshots the simulated initialization.
+func startupStats() meter.StartupStats {
+	startupMu.Lock()
+	defer startupMu.Unlock()
+	s := meter.StartupStats{
+		State:        startupState,
+		Probes:       startupProbes.Load(),
+		ProbesFailed: startupProbesFailed.Load(),
+		ProcessStart: processStart.UTC(),
+	}
+	if !startedAt.IsZero() {
+		s.TimeToStarted = meter.Ms(startedAt.Sub(processStart))
+	}
+	if !firstReadyAt.IsZero() {
+		s.TimeToReady = meter.Ms(firstReadyAt.Sub(processStart))
+	}
+	if startupState == startupInitializing {
+		s.RemainingSeconds = meter.Round(max(time.Until(startupEnds), 0).Seconds())
+	}
+	return s
+}
+
+// startupHandler serves /startupz for Kubernetes startup probes: 503 while
+// initializing, 500 once initialization failed, then 200 for good.
+func startupHandler(w http.ResponseWriter, r *http.Request) {
+	startupProbes.Add(1)
+	startupMu.Lock()
+	state, ends := startupState, startupEnds
+	startupMu.Unlock()
+
+	switch state {
+	case startupInitializing:
+		startupProbesFailed.Add(1)
+		http.Error(w, fmt.Sprintf("initializing (%s left)", max(time.Until(ends), 0).Round(time.Second)), http.StatusServiceUnavailable)
+	case startupFailed:
+		startupProbesFailed.Add(1)
+		http.Error(w, "initialization failed", http.StatusInternalServerError)
+	default:
+		w.Write([]byte("started\n"))
+	}
+}
+
+// restartupHandler serves POST /admin/startup: it runs the simulated
+// initialization again, with the delay_seconds, jitter_seconds and fail of
+// the JSON body, to rehearse how probes react to a pod that stops being
+// started.
+func restartupHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		DelaySeconds  float64 `json:"delay_seconds"`
+		JitterSeconds float64 `json:"jitter_seconds"`
+		Fail          bool    `json:"fail"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.DelaySeconds < 0 || body.JitterSeconds < 0 || body.DelaySeconds+body.JitterSeconds > 3600 {
+		http.Error(w, "delay_seconds and jitter_seconds must be non-negative and add up to at most 3600", http.StatusBadRequest)
+		return
+	}
+	startInitialization(time.Duration(body.DelaySeconds*float64(time.Second)),
+		time.Duration(body.JitterSeconds*float64(time.Second)), body.Fail)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(startupStats())
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// statusEmulated counts responses served by /status/{code}.
+var statusEmulated atomic.Int64
+
+// statusHandler serves /status/{code}: it answers any method with the given
+// status, after ?delay= (a Go duration, at most 60s) and with ?body= as the
+// body, or the status text. Redirects point at /. Unlike /, it does no work
+// and is not recorded in the workload meter, so that emulated errors aimed at
+// alert rules and outlier detection leave the latency statistics alone.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	code, err := strconv.Atoi(r.PathValue("code"))
+	if err != nil || code < 200 || code > 599 {
+		http.Error(w, "status code must be between 200 and 599", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	var delay time.Duration
+	if v := query.Get("delay"); v != "" {
+		delay, err = time.ParseDuration(v)
+		if err != nil || delay < 0 || delay > maxFaultDelay {
+			http.Error(w, fmt.Sprintf("invalid delay %q (must be a duration up to %s)", v, maxFaultDelay), http.StatusBadRequest)
+			return
+		}
+	}
+	if code := readRequestBody(w, r); code != 0 {
+		return
+	}
+
+	statusEmulated.Add(1)
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	body := query.Get("body")
+	if !query.Has("body") {
+		body = fmt.Sprintf("%d %s\n", code, http.StatusText(code))
+	}
+	if code >= 300 && code < 400 {
+		w.Header().Set("Location", "/")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if code != http.StatusNoContent && code != http.StatusNotModified {
+		w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/sysinfo"
+)
+
+const (
+	// stealWindow is how many steal samples the detector compares
+	stealWindow = 6
+	// stealMinSamples is how many samples are needed before judging
+	stealMinSamples = 3
+)
+
+var (
+	stealMu        sync.Mutex
+	stealSamples   []float64 // Steal percentage of each interval, oldest first
+	stealThreshold float64
+	stealSuspected bool
+)
+
+// startStealMonitor samples the node's CPU steal time every interval. Steal
+// is time the hypervisor ran another guest while this VM had work to do; it
+// is node-wide, and nothing inside the pod can reduce it.
+func startStealMonitor(interval time.Duration, threshold float64) {
+	stealThreshold = threshold
+	go func() {
+		prev, ok := sysinfo.ReadCPUTimes()
+		if !ok {
+			return
+		}
+		for {
+			time.Sleep(interval)
+			cur, ok := sysinfo.ReadCPUTimes()
+			if !ok {
+				return
+			}
+			total := cur.Total() - prev.Total()
+			if total == 0 || cur.Total() < prev.Total() {
+				prev = cur
+				continue
+			}
+			recordSteal(float64(cur.Steal-prev.Steal) / float64(total) * 100)
+			prev = cur
+		}
+	}()
+}
+
+// recordSteal adds a sample and logs when sustained steal starts and ends.
+func recordSteal(percent float64) {
+	stealMu.Lock()
+	defer stealMu.Unlock()
+	stealSamples = append(stealSamples, percent)
+	if len(stealSamples) > stealWindow {
+		stealSamples = stealSamples[1:]
+	}
+
+	sustained := len(stealSamples) >= stealMinSamples
+	for _, p := range stealSamples {
+		if p < stealThreshold {
+			sustained = false
+			break
+		}
+	}
+	if sustained != stealSuspected {
+		if sustained {
+			warnf("CPU steal above %g%% for the last %d samples (now %.1f%%): a noisy neighbor or an oversubscribed node", stealThreshold, len(stealSamples), percent)
+		} else {
+			infof("CPU steal back below %g%% (now %.1f%%)", stealThreshold, percent)
+		}
+	}
+	stealSuspected = sustained
+}
+
+// stealStatus returns the steal percentage of the last interval and whether
+// it has stayed above the threshold for the whole window.
+func stealStatus() (percent float64, sustained bool) {
+	stealMu.Lock()
+	defer stealMu.Unlock()
+	if len(stealSamples) == 0 {
+		return 0, false
+	}
+	return stealSamples[len(stealSamples)-1], stealSuspected
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	defaultSyntheticTimeout = 10 * time.Second
+	// maxSyntheticBody bounds how much of a response body assertions see
+	maxSyntheticBody = 1 << 20
+)
+
+// SyntheticCheck is one scheduled synthetic transaction, as configured in
+// the PODMETER_SYNTHETICS file.
+type SyntheticCheck struct {
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"` // "@every 30s", "@hourly" or five cron fields
+	URL      string            `json:"url"`      // http(s)://host/path, or grpc(s)://host:port/service for a gRPC health check
+	Method   string            `json:"method,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"` // Default 10s
+	Expect   SyntheticExpect   `json:"expect"`
+
+	schedule   schedule
+	target     *url.URL
+	timeout    time.Duration
+	maxLatency time.Duration
+	bodyRegex  *regexp.Regexp
+}
+
+// SyntheticExpect is what a run must see to pass. Every assertion given
+// must hold.
+type SyntheticExpect struct {
+	// HTTP statuses, or gRPC status codes for grpc:// targets. Empty accepts
+	// any 2xx, or OK for gRPC.
+	Status       []int  `json:"status,omitempty"`
+	MaxLatency   string `json:"max_latency,omitempty"`
+	BodyContains string `json:"body_contains,omitempty"`
+	BodyRegex    string `json:"body_regex,omitempty"`
+}
+
+// LoadSyntheticChecks reads a JSON array of checks from path, e.g.
+//
+//	[{"name": "checkout", "schedule": "@every 30s",
+//	  "url": "http://checkout.shop:8080/healthz",
+//	  "expect": {"status": [200], "max_latency": "250ms", "body_contains": "ok"}}]
+func LoadSyntheticChecks(path string) ([]SyntheticCheck, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var checks []SyntheticCheck
+	if err := dec.Decode(&checks); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i := range checks {
+		c := &checks[i]
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("%s: check %d: %w", path, i, err)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("%s: duplicate check name %q", path, c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return checks, nil
+}
+
+// validate checks the configuration and parses its schedule, URL and
+// durations.
+func (c *SyntheticCheck) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	var err error
+	if c.schedule, err = parseSchedule(c.Schedule); err != nil {
+		return fmt.Errorf("%s: %w", c.Name, err)
+	}
+	if c.schedule.next(time.Now()).IsZero() {
+		return fmt.Errorf("%s: schedule %q never fires", c.Name, c.Schedule)
+	}
+	if c.target, err = url.Parse(c.URL); err != nil {
+		return fmt.Errorf("%s: %w", c.Name, err)
+	}
+	switch c.target.Scheme {
+	case "http", "https":
+	case "grpc", "grpcs":
+		if c.target.Port() == "" {
+			return fmt.Errorf("%s: %s: missing port", c.Name, c.URL)
+		}
+		if c.Method != "" || c.Body != "" || c.Expect.BodyContains != "" || c.Expect.BodyRegex != "" {
+			return fmt.Errorf("%s: method, body and body assertions do not apply to gRPC health checks", c.Name)
+		}
+	default:
+		return fmt.Errorf("%s: %s: scheme must be http, https, grpc or grpcs", c.Name, c.URL)
+	}
+	if c.target.Host == "" {
+		return fmt.Errorf("%s: %s: missing host", c.Name, c.URL)
+	}
+
+	c.timeout = defaultSyntheticTimeout
+	if c.Timeout != "" {
+		if c.timeout, err = time.ParseDuration(c.Timeout); err != nil || c.timeout <= 0 {
+			return fmt.Errorf("%s: timeout %q: want a positive duration", c.Name, c.Timeout)
+		}
+	}
+	if v := c.Expect.MaxLatency; v != "" {
+		if c.maxLatency, err = time.ParseDuration(v); err != nil || c.maxLatency <= 0 {
+			return fmt.Errorf("%s: max_latency %q: want a positive duration", c.Name, v)
+		}
+	}
+	if v := c.Expect.BodyRegex; v != "" {
+		if c.bodyRegex, err = regexp.Compile(v); err != nil {
+			return fmt.Errorf("%s: body_regex: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// syntheticCheck holds the live state of one scheduled check.
+type syntheticCheck struct {
+	cfg       SyntheticCheck
+	latencies *meter.Window
+
+	mu    sync.Mutex
+	stats meter.SyntheticStats
+}
+
+var (
+	syntheticMu     sync.RWMutex
+	syntheticChecks []*syntheticCheck
+
+	// syntheticClient runs HTTP checks; each run has its own timeout
+	syntheticClient = &http.Client{}
+	// syntheticGRPCClients speak HTTP/2 in the clear (grpc://) or over TLS
+	// (grpcs://), as gRPC requires
+	syntheticGRPCClients = map[string]*http.Client{
+		"grpc":  {Transport: &http.Transport{Protocols: http2Only(true)}},
+		"grpcs": {Transport: &http.Transport{Protocols: http2Only(false)}},
+	}
+)
+
+func http2Only(cleartext bool) *http.Protocols {
+	p := new(http.Protocols)
+	if cleartext {
+		p.SetUnencryptedHTTP2(true)
+	} else {
+		p.SetHTTP2(true)
+	}
+	return p
+}
+
+// startSynthetics launches one scheduling loop per check.
+func startSynthetics(checks []SyntheticCheck) {
+	for _, c := range checks {
+		sc := &syntheticCheck{
+			cfg:       c,
+			latencies: meter.NewWindow(0),
+			stats: meter.SyntheticStats{
+				Name:     c.Name,
+				Target:   c.target.Redacted(),
+				Schedule: c.Schedule,
+			},
+		}
+		syntheticMu.Lock()
+		syntheticChecks = append(syntheticChecks, sc)
+		syntheticMu.Unlock()
+		go sc.run()
+	}
+	infof("Synthetic transactions: %d checks scheduled", len(checks))
+}
+
+// run waits for each scheduled time and runs the check. @every checks run
+// once straight away; a run that overruns its next slot skips it.
+func (sc *syntheticCheck) run() {
+	next := time.Now()
+	if _, every := sc.cfg.schedule.(everySchedule); !every {
+		next = sc.cfg.schedule.next(next)
+	}
+	for !next.IsZero() {
+		sc.mu.Lock()
+		sc.stats.NextRun = next.UTC()
+		sc.mu.Unlock()
+		time.Sleep(time.Until(next))
+
+		status, latency, err := sc.execute()
+		sc.record(status, latency, err, outboundInterface(sc.cfg.target.Hostname()))
+		next = sc.cfg.schedule.next(next)
+		if now := time.Now(); !next.IsZero() && next.Before(now) { // Overran its slot
+			next = sc.cfg.schedule.next(now)
+		}
+	}
+	warnf("Synthetic check %q: schedule %q never fires again", sc.cfg.Name, sc.cfg.Schedule)
+}
+
+// execute runs the transaction once and returns the status it got, how long
+// it took and, when an assertion failed, why.
+func (sc *syntheticCheck) execute() (status int, latency time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sc.cfg.timeout)
+	defer cancel()
+
+	start := time.Now()
+	var body []byte
+	if strings.HasPrefix(sc.cfg.target.Scheme, "grpc") {
+		status, err = sc.grpcHealthCheck(ctx)
+	} else {
+		status, body, err = sc.httpRequest(ctx)
+	}
+	latency = time.Since(start)
+	if err != nil {
+		return status, latency, err
+	}
+	return status, latency, sc.assert(status, latency, body)
+}
+
+func (sc *syntheticCheck) httpRequest(ctx context.Context) (int, []byte, error) {
+	method := sc.cfg.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, sc.cfg.URL, strings.NewReader(sc.cfg.Body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("User-Agent", "podmeter-synthetic")
+	for k, v := range sc.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	resp, err := syntheticClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSyntheticBody))
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("reading body: %w", err)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// grpcHealthCheck calls grpc.health.v1.Health/Check for the service named
+// by the URL path (empty for the server as a whole) and returns the gRPC
+// status code. An OK call must also report SERVING.
+func (sc *syntheticCheck) grpcHealthCheck(ctx context.Context) (int, error) {
+	service := strings.Trim(sc.cfg.target.Path, "/")
+	msg := appendStringField(nil, 1, service)
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	scheme := "http"
+	if sc.cfg.target.Scheme == "grpcs" {
+		scheme = "https"
+	}
+	endpoint := scheme + "://" + sc.cfg.target.Host + "/grpc.health.v1.Health/Check"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(frame))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("User-Agent", "podmeter-synthetic")
+	for k, v := range sc.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := syntheticGRPCClients[sc.cfg.target.Scheme].Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	reply, readErr := readGRPCMessage(resp.Body)
+	io.Copy(io.Discard, resp.Body) // Trailers arrive after the body
+
+	// A call that fails outright sends its status in the headers alone
+	code := resp.Trailer.Get("Grpc-Status")
+	if code == "" {
+		code = resp.Header.Get("Grpc-Status")
+	}
+	status, err := strconv.Atoi(code)
+	if err != nil {
+		return 0, fmt.Errorf("no grpc-status in response")
+	}
+	if status != grpcOK {
+		return status, nil // Left to the status assertion
+	}
+	if readErr != nil {
+		return status, fmt.Errorf("reading response: %w", readErr)
+	}
+	serving := healthUnknown
+	if err := parseProto(reply, func(f protoField) error {
+		if f.Num == 1 && f.Type == wireVarint {
+			serving = int(f.Varint)
+		}
+		return nil
+	}); err != nil {
+		return status, err
+	}
+	if serving != healthServing {
+		return status, fmt.Errorf("service %q is not serving (status %d)", service, serving)
+	}
+	return status, nil
+}
+
+// assert checks a completed run against the expectations, returning the
+// first that failed.
+func (sc *syntheticCheck) assert(status int, latency time.Duration, body []byte) error {
+	exp := sc.cfg.Expect
+	switch {
+	case len(exp.Status) > 0:
+		if !slices.Contains(exp.Status, status) {
+			return fmt.Errorf("status %d, want one of %v", status, exp.Status)
+		}
+	case strings.HasPrefix(sc.cfg.target.Scheme, "grpc"):
+		if status != grpcOK {
+			return fmt.Errorf("gRPC status %d, want 0 (OK)", status)
+		}
+	case status < 200 || status > 299:
+		return fmt.Errorf("status %d, want 2xx", status)
+	}
+	if sc.cfg.maxLatency > 0 && latency > sc.cfg.maxLatency {
+		return fmt.Errorf("took %s, want at most %s", latency.Round(time.Millisecond), sc.cfg.maxLatency)
+	}
+	if exp.BodyContains != "" && !bytes.Contains(body, []byte(exp.BodyContains)) {
+		return fmt.Errorf("body does not contain %q", exp.BodyContains)
+	}
+	if sc.cfg.bodyRegex != nil && !sc.cfg.bodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %q", exp.BodyRegex)
+	}
+	return nil
+}
+
+// record updates the check's stats with one run and logs when it starts
+// failing and when it recovers.
+func (sc *syntheticCheck) record(status int, latency time.Duration, err error, iface string) {
+	ms := meter.Ms(latency)
+	sc.latencies.Add(ms)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	s := &sc.stats
+	wasFailing := s.Runs > 0 && !s.Success
+	s.Runs++
+	s.LastRun = time.Now().UTC()
+	s.LastStatus = status
+	s.LastLatency = ms
+	s.Interface = iface
+	s.Success = err == nil
+	s.LastError = ""
+	if err != nil {
+		s.Failures++
+		s.ConsecutiveFailures++
+		s.LastError = err.Error()
+		if !wasFailing {
+			warnf("Synthetic check %q failing: %s", s.Name, s.LastError)
+		}
+		return
+	}
+	if wasFailing {
+		infof("Synthetic check %q recovered after %d failed runs", s.Name, s.ConsecutiveFailures)
+	}
+	s.ConsecutiveFailures = 0
+}
+
+// syntheticStats snapshots every synthetic check.
+func syntheticStats() []meter.SyntheticStats {
+	syntheticMu.RLock()
+	defer syntheticMu.RUnlock()
+	var out []meter.SyntheticStats
+	for _, sc := range syntheticChecks {
+		sc.mu.Lock()
+		s := sc.stats
+		sc.mu.Unlock()
+		if lat := sc.latencies.Values(); len(lat) > 0 {
+			sum := meter.Summarize(lat)
+			s.AvgLatency, s.P50Latency, s.P95Latency, s.P99Latency, s.MaxLatency = sum.Avg, sum.P50, sum.P95, sum.P99, sum.Max
+		}
+		out = append(out, s)
+	}
+	return out
+}
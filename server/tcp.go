@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// tcpIdleTimeout closes echo connections that stay silent this long.
+const tcpIdleTimeout = 5 * time.Minute
+
+var (
+	tcpDurations   = meter.NewWindow(0) // ms, one per closed connection
+	tcpThroughputs = meter.NewWindow(0) // bytes/sec echoed, one per closed connection
+	tcpEnabled     atomic.Bool
+	tcpConnections atomic.Int64
+	tcpActive      atomic.Int64
+	tcpBytesIn     atomic.Int64
+	tcpBytesOut    atomic.Int64
+)
+
+// startTCPEchoServer accepts plain TCP connections and echoes every byte,
+// so L4-only paths can be tested without HTTP semantics in the way. It
+// returns once ln is closed.
+func startTCPEchoServer(ln net.Listener) {
+	tcpEnabled.Store(true)
+	infof("TCP echo listener running on %s", ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if isClosed(err) {
+			return
+		}
+		if err != nil {
+			errorf("TCP accept error: %v", err)
+			continue
+		}
+		go handleTCPEcho(conn)
+	}
+}
+
+// handleTCPEcho echoes one connection until the peer closes it, then records
+// its lifetime and throughput.
+func handleTCPEcho(conn net.Conn) {
+	start := time.Now()
+	tcpConnections.Add(1)
+	tcpActive.Add(1)
+	defer tcpActive.Add(-1)
+	defer conn.Close()
+
+	var echoed int64
+	buf := make([]byte, 32*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			tcpBytesIn.Add(int64(n))
+			w, werr := conn.Write(buf[:n])
+			tcpBytesOut.Add(int64(w))
+			echoed += int64(w)
+			if werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = float64(echoed) / elapsed.Seconds()
+	}
+
+	tcpDurations.Add(meter.Ms(elapsed))
+	tcpThroughputs.Add(throughput)
+}
+
+// tcpStats snapshots the TCP echo counters and per-connection windows.
+func tcpStats() meter.TCPStats {
+	durations := tcpDurations.Values()
+	throughputs := tcpThroughputs.Values()
+
+	stats := meter.TCPStats{
+		Enabled:           tcpEnabled.Load(),
+		ConnectionsTotal:  tcpConnections.Load(),
+		ActiveConnections: tcpActive.Load(),
+		BytesReceived:     tcpBytesIn.Load(),
+		BytesSent:         tcpBytesOut.Load(),
+	}
+	if len(durations) > 0 && len(throughputs) > 0 {
+		d := meter.Summarize(durations)
+		stats.AvgDuration = d.Avg
+		stats.P50Duration = d.P50
+		stats.P99Duration = d.P99
+		stats.MaxDuration = d.Max
+		t := meter.Summarize(throughputs)
+		stats.AvgThroughput = t.Avg
+		stats.MaxThroughput = t.Max
+	}
+	return stats
+}
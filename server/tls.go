@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"maps"
+	"math/big"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var (
+	tlsEnabled        atomic.Bool
+	tlsHandshakes     atomic.Int64
+	tlsResumed        atomic.Int64
+	tlsHandshakeTimes = meter.NewWindow(0) // ms, one per completed handshake
+
+	// What completed handshakes negotiated, by version, cipher suite and
+	// ALPN protocol
+	tlsNegotiatedMu sync.Mutex
+	tlsVersions     = make(map[string]int64)
+	tlsCiphers      = make(map[string]int64)
+	tlsALPN         = make(map[string]int64)
+)
+
+// ParseTLSVersion parses a minimum TLS version: 1.0, 1.1, 1.2 or 1.3.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+}
+
+// newTLSConfig loads the serving certificate, or generates a self-signed one
+// when no files are given, and meters every handshake. minVersion 0 keeps
+// Go's default of TLS 1.2.
+func newTLSConfig(certFile, keyFile string, minVersion uint16) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+		MinVersion:   minVersion,
+	}
+	// Automatic ticket keys are per config, so without a shared key no
+	// per-connection copy could resume another's session
+	var ticketKey [32]byte
+	if _, err := rand.Read(ticketKey[:]); err != nil {
+		return nil, err
+	}
+	base.SetSessionTicketKeys([][32]byte{ticketKey})
+
+	// The handshake is timed from the ClientHello, which is when
+	// GetConfigForClient runs, to VerifyConnection, which runs once the
+	// client's last flight has arrived. A per-connection copy of the config
+	// carries the start time between the two.
+	metered := base.Clone()
+	metered.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		start := time.Now()
+		c := base.Clone()
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			recordTLSHandshake(time.Since(start), cs)
+			return nil
+		}
+		return c, nil
+	}
+	return metered, nil
+}
+
+// recordTLSHandshake adds one completed handshake.
+func recordTLSHandshake(d time.Duration, cs tls.ConnectionState) {
+	tlsHandshakes.Add(1)
+	if cs.DidResume {
+		tlsResumed.Add(1)
+	}
+	tlsHandshakeTimes.Add(meter.Ms(d))
+
+	alpn := cs.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	tlsNegotiatedMu.Lock()
+	tlsVersions[tls.VersionName(cs.Version)]++
+	tlsCiphers[tls.CipherSuiteName(cs.CipherSuite)]++
+	tlsALPN[alpn]++
+	tlsNegotiatedMu.Unlock()
+}
+
+// resetTLSNegotiated forgets the negotiated parameters, for /admin/reset.
+func resetTLSNegotiated() {
+	tlsNegotiatedMu.Lock()
+	clear(tlsVersions)
+	clear(tlsCiphers)
+	clear(tlsALPN)
+	tlsNegotiatedMu.Unlock()
+}
+
+// selfSignedCert returns a throwaway certificate for the pod's hostname, for
+// when PODMETER_TLS_ADDR is set without PODMETER_TLS_CERT.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname, "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// tlsStats snapshots the TLS handshake counters and duration window.
+func tlsStats() meter.TLSStats {
+	stats := meter.TLSStats{
+		Enabled:    tlsEnabled.Load(),
+		Handshakes: tlsHandshakes.Load(),
+		Resumed:    tlsResumed.Load(),
+	}
+	if stats.Handshakes > 0 {
+		stats.ResumptionPercent = meter.Round(float64(stats.Resumed) / float64(stats.Handshakes) * 100)
+	}
+	tlsNegotiatedMu.Lock()
+	if len(tlsVersions) > 0 {
+		stats.Versions = maps.Clone(tlsVersions)
+		stats.CipherSuites = maps.Clone(tlsCiphers)
+		stats.ALPN = maps.Clone(tlsALPN)
+	}
+	tlsNegotiatedMu.Unlock()
+	if times := tlsHandshakeTimes.Values(); len(times) > 0 {
+		h := meter.Summarize(times)
+		stats.AvgHandshake = h.Avg
+		stats.P50Handshake = h.P50
+		stats.P95Handshake = h.P95
+		stats.P99Handshake = h.P99
+		stats.MaxHandshake = h.Max
+	}
+	return stats
+}
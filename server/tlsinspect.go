@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// tlsInspectTimeout bounds the connection and the handshake of a
+	// /debug/tls inspection, unless ?timeout= says otherwise
+	tlsInspectTimeout = 5 * time.Second
+	// tlsInspectMaxTimeout is the longest ?timeout= accepted, so a caller
+	// cannot hold a connection open for long
+	tlsInspectMaxTimeout = 30 * time.Second
+	// tlsExpiryWarning is how close to expiry a certificate is flagged
+	tlsExpiryWarning = 30 * 24 * time.Hour
+)
+
+// TLSInspection is the result of /debug/tls: a TLS handshake to a target
+// from inside the pod, with what the target presented and what was agreed.
+type TLSInspection struct {
+	Target     string `json:"target"`
+	ServerName string `json:"server_name"`
+	Address    string `json:"address,omitempty"`   // The address connected to
+	Interface  string `json:"interface,omitempty"` // The interface the connection left through
+	// The stage that failed, dns, connect or handshake, and why
+	Stage string `json:"failed_stage,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	ConnectMs   float64 `json:"connect_ms"`
+	HandshakeMs float64 `json:"handshake_ms"`
+	Version     string  `json:"version,omitempty"`
+	CipherSuite string  `json:"cipher_suite,omitempty"`
+	ALPN        string  `json:"alpn,omitempty"`
+	OCSPStapled bool    `json:"ocsp_stapled"`
+	SCTs        int     `json:"signed_certificate_timestamps"`
+
+	// Verified is set when the chain leads to a root the pod trusts and the
+	// leaf is valid for ServerName; VerifyError says why it is not
+	Verified        bool   `json:"verified"`
+	VerifyError     string `json:"verify_error,omitempty"`
+	HostnameMatches bool   `json:"hostname_matches"`
+	// The soonest expiry in the presented chain
+	ExpiresAt     time.Time `json:"expires_at,omitzero"`
+	ExpiresInDays float64   `json:"expires_in_days"`
+	ExpiringSoon  bool      `json:"expiring_soon"` // Within 30 days, or already expired
+
+	Chain []TLSCertificate `json:"chain"`
+}
+
+// TLSCertificate is one certificate the target presented, leaf first.
+type TLSCertificate struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	SerialNumber       string    `json:"serial_number"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	ExpiresInDays      float64   `json:"expires_in_days"`
+	DNSNames           []string  `json:"dns_names,omitempty"`
+	IPAddresses        []string  `json:"ip_addresses,omitempty"`
+	URIs               []string  `json:"uris,omitempty"` // SPIFFE IDs of mesh workloads
+	EmailAddresses     []string  `json:"email_addresses,omitempty"`
+	IsCA               bool      `json:"is_ca"`
+	KeyAlgorithm       string    `json:"key_algorithm"`
+	KeyBits            int       `json:"key_bits,omitempty"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	SHA256             string    `json:"sha256_fingerprint"`
+}
+
+// tlsInspectHandler serves /debug/tls?target=host:port, with optional sni=
+// (default the host), alpn= (comma-separated protocols to offer) and
+// timeout= (at most 30s). It answers 200 when the handshake completed,
+// whether or not the chain verified, and 502 when it did not, with the
+// inspection as JSON either way, including any chain the target presented
+// before the handshake failed.
+func tlsInspectHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target := q.Get("target")
+	if target == "" {
+		http.Error(w, "target=host:port is required", http.StatusBadRequest)
+		return
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host, port = target, "443"
+	}
+	if host == "" {
+		http.Error(w, "target "+target+": missing host", http.StatusBadRequest)
+		return
+	}
+	timeout := tlsInspectTimeout
+	if v := q.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > tlsInspectMaxTimeout {
+			http.Error(w, "invalid timeout "+v+": want a duration up to "+tlsInspectMaxTimeout.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	serverName := q.Get("sni")
+	if serverName == "" {
+		serverName = host
+	}
+	var alpn []string
+	if v := q.Get("alpn"); v != "" {
+		alpn = strings.Split(v, ",")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	res := inspectTLS(ctx, net.JoinHostPort(host, port), serverName, alpn)
+	w.Header().Set("Content-Type", "application/json")
+	if res.Stage != "" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(res)
+}
+
+// inspectTLS connects to addr and shakes hands as serverName. Verification
+// is done after the handshake, against the system roots, so the chain of a
+// target that would fail it is still reported.
+func inspectTLS(ctx context.Context, addr, serverName string, alpn []string) *TLSInspection {
+	res := &TLSInspection{Target: addr, ServerName: serverName, Chain: []TLSCertificate{}}
+	start := time.Now()
+	raw, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	res.ConnectMs = meter.Ms(time.Since(start))
+	if err != nil {
+		res.Stage, res.Error = "connect", err.Error()
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			res.Stage = "dns"
+		}
+		return res
+	}
+	defer raw.Close()
+	res.Address = raw.RemoteAddr().String()
+	res.Interface = interfaceOf(raw.LocalAddr())
+
+	conn := tls.Client(raw, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		InsecureSkipVerify: true, // Verified below, to report failing chains too
+	})
+	start = time.Now()
+	err = conn.HandshakeContext(ctx)
+	res.HandshakeMs = meter.Ms(time.Since(start))
+	cs := conn.ConnectionState()
+	if err != nil && len(cs.PeerCertificates) == 0 {
+		res.Stage, res.Error = "handshake", err.Error()
+		return res
+	}
+	if err != nil || !cs.HandshakeComplete {
+		// The target asked for a client certificate, or gave up late, but
+		// its chain arrived, so it is still reported
+		res.Stage = "handshake"
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+	if cs.HandshakeComplete {
+		res.Version = tls.VersionName(cs.Version)
+		res.CipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+		res.ALPN = cs.NegotiatedProtocol
+	}
+	res.OCSPStapled = len(cs.OCSPResponse) > 0
+	res.SCTs = len(cs.SignedCertificateTimestamps)
+
+	now := time.Now()
+	for _, cert := range cs.PeerCertificates {
+		c := describeCertificate(cert, now)
+		res.Chain = append(res.Chain, c)
+		if res.ExpiresAt.IsZero() || cert.NotAfter.Before(res.ExpiresAt) {
+			res.ExpiresAt, res.ExpiresInDays = cert.NotAfter, c.ExpiresInDays
+		}
+	}
+	res.ExpiringSoon = res.ExpiresAt.Sub(now) < tlsExpiryWarning
+
+	leaf := cs.PeerCertificates[0]
+	res.HostnameMatches = leaf.VerifyHostname(serverName) == nil
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates, CurrentTime: now})
+	res.Verified = err == nil
+	if err != nil {
+		res.VerifyError = err.Error()
+	}
+	return res
+}
+
+// describeCertificate summarizes cert as of now.
+func describeCertificate(cert *x509.Certificate, now time.Time) TLSCertificate {
+	sum := sha256.Sum256(cert.Raw)
+	c := TLSCertificate{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       fmt.Sprintf("%X", cert.SerialNumber),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		ExpiresInDays:      meter.Round(cert.NotAfter.Sub(now).Hours() / 24),
+		DNSNames:           cert.DNSNames,
+		EmailAddresses:     cert.EmailAddresses,
+		IsCA:               cert.IsCA,
+		KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		SHA256:             hex.EncodeToString(sum[:]),
+	}
+	for _, ip := range cert.IPAddresses {
+		c.IPAddresses = append(c.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		c.URIs = append(c.URIs, u.String())
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		c.KeyBits = key.N.BitLen()
+	case *ecdsa.PublicKey:
+		c.KeyBits = key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		c.KeyBits = 256
+	}
+	return c
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/loadgen"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+	"github.com/nyan-lin-tun/PodMeter/sysinfo"
+)
+
+// The well-known labels Kubernetes puts on nodes, and, with the
+// PodTopologyLabelsAdmission plugin, copies onto their pods.
+const (
+	zoneLabel   = "topology.kubernetes.io/zone"
+	regionLabel = "topology.kubernetes.io/region"
+)
+
+var (
+	// podTopology is where the pod runs, set by Run
+	podTopology meter.TopologyStats
+
+	// clientZones records workload requests by the zone their client named
+	clientZones         = &hostMeters{meters: make(map[string]*meter.Meter)}
+	sameZoneRequests    atomic.Int64
+	crossZoneRequests   atomic.Int64
+	unknownZoneRequests atomic.Int64
+)
+
+// detectTopology finds the zone and region the pod runs in and adds them,
+// with its node, to the resource attributes every snapshot carries. They
+// come from OTEL_RESOURCE_ATTRIBUTES, cfg.Zone and cfg.Region, the pod's
+// topology labels, or, with cfg.TopologyAPI, its node's labels, in that
+// order.
+func detectTopology(cfg Config) {
+	res := meter.Resource()
+	node := res["k8s.node.name"]
+	zone, region, source := cfg.Zone, cfg.Region, "env"
+	if zone == "" {
+		labels := readAnnotations(cfg.LabelsFile)
+		zone, source = labels[zoneLabel], "labels"
+		if region == "" {
+			region = labels[regionLabel]
+		}
+	}
+	if zone == "" && cfg.TopologyAPI && node != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		labels, err := sysinfo.NodeLabels(ctx, node)
+		cancel()
+		if err != nil {
+			warnf("Topology: reading the labels of node %s: %v", node, err)
+		} else {
+			zone, source = labels[zoneLabel], "api"
+			if region == "" {
+				region = labels[regionLabel]
+			}
+		}
+	}
+	if z := res["cloud.availability_zone"]; z != "" {
+		zone, source = z, "resource"
+	}
+	if r := res["cloud.region"]; r != "" {
+		region = r
+	}
+	if zone == "" {
+		source = ""
+	}
+	meter.SetTopology(node, zone, region)
+	podTopology = meter.TopologyStats{Node: node, Zone: zone, Region: region, Source: source}
+	if zone != "" {
+		infof("Topology: node %q, zone %q, region %q (from %s)", node, zone, region, source)
+	}
+}
+
+// recordClientZone records a workload request under the zone its client
+// named, and whether it crossed zones to get here.
+func recordClientZone(r *http.Request, latencyMs float64, hopCount int, ok bool) {
+	zone := r.Header.Get(loadgen.ZoneHeader)
+	switch {
+	case zone == "" || podTopology.Zone == "":
+		unknownZoneRequests.Add(1)
+	case zone == podTopology.Zone:
+		sameZoneRequests.Add(1)
+	default:
+		crossZoneRequests.Add(1)
+	}
+	if zone == "" {
+		zone = noHost
+	}
+	clientZones.get(zone).Record(latencyMs, hopCount, ok)
+}
+
+func resetClientZones() {
+	clientZones.reset()
+	sameZoneRequests.Store(0)
+	crossZoneRequests.Store(0)
+	unknownZoneRequests.Store(0)
+}
+
+// topologyStats reports where the pod runs and where its clients are.
+func topologyStats() meter.TopologyStats {
+	t := podTopology
+	t.SameZoneRequests = sameZoneRequests.Load()
+	t.CrossZoneRequests = crossZoneRequests.Load()
+	t.UnknownZoneRequests = unknownZoneRequests.Load()
+	t.ClientZones = clientZones.stats()
+	return t
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+)
+
+// maxTraceRecords bounds how many recent traced requests are kept for
+// /debug/trace/{id}. Older requests are overwritten first.
+const maxTraceRecords = 1000
+
+// traceRecord is what the pod observed for one request carrying a trace ID.
+type traceRecord struct {
+	TraceID    string              `json:"trace_id"`
+	SpanID     string              `json:"span_id,omitempty"`
+	Time       time.Time           `json:"time"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Status     int                 `json:"status"`
+	LatencyMs  float64             `json:"latency_ms"`
+	ProxyHops  int                 `json:"proxy_hop_count"`
+	MeshHops   int                 `json:"mesh_hop_count"`
+	TotalHops  int                 `json:"total_hop_count"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+}
+
+var (
+	tracesMu    sync.Mutex
+	traces      = make([]traceRecord, 0, maxTraceRecords)
+	traceNext   int // Ring position of the next overwrite once traces is full
+	traceRedact = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+)
+
+// traceIDs extracts the trace and span IDs from W3C traceparent
+// (version-traceid-spanid-flags), B3 single (`b3: traceid-spanid-...`) or
+// B3 multi (X-B3-TraceId/X-B3-SpanId) headers, in that order.
+func traceIDs(r *http.Request) (traceID, spanID string) {
+	if tp := r.Header.Get("Traceparent"); tp != "" {
+		if parts := strings.Split(tp, "-"); len(parts) >= 4 {
+			return parts[1], parts[2]
+		}
+	}
+	if b3 := r.Header.Get("B3"); b3 != "" && b3 != "0" && b3 != "1" && b3 != "d" {
+		if parts := strings.Split(b3, "-"); len(parts) >= 2 {
+			return parts[0], parts[1]
+		}
+	}
+	return r.Header.Get("X-B3-TraceId"), r.Header.Get("X-B3-SpanId")
+}
+
+// normalizeTraceID makes 64-bit B3 IDs match their zero-padded 128-bit form,
+// as tracing UIs show either.
+func normalizeTraceID(id string) string {
+	return strings.TrimLeft(strings.ToLower(id), "0")
+}
+
+// recordTrace indexes r under its trace ID if it carries one.
+func recordTrace(r *http.Request, start time.Time, latencyMs float64, status int) {
+	traceID, spanID := traceIDs(r)
+	if normalizeTraceID(traceID) == "" {
+		return
+	}
+
+	headers := r.Header.Clone()
+	for _, name := range traceRedact {
+		if _, ok := headers[name]; ok {
+			headers[name] = []string{"[redacted]"}
+		}
+	}
+	proxyHops := hops.ProxyHops(r)
+	meshHops := hops.ServiceMeshHops(r)
+
+	rec := traceRecord{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		Time:       start,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+		LatencyMs:  latencyMs,
+		ProxyHops:  proxyHops,
+		MeshHops:   meshHops,
+		TotalHops:  proxyHops + meshHops,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    headers,
+	}
+
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	if len(traces) < maxTraceRecords {
+		traces = append(traces, rec)
+		return
+	}
+	traces[traceNext] = rec
+	traceNext = (traceNext + 1) % maxTraceRecords
+}
+
+// tracedRequests returns the recorded requests for a trace, oldest first.
+func tracedRequests(traceID string) []traceRecord {
+	want := normalizeTraceID(traceID)
+
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	var out []traceRecord
+	for i := range traces {
+		rec := traces[(traceNext+i)%len(traces)]
+		if normalizeTraceID(rec.TraceID) == want {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// traceHandler serves GET /debug/trace/{id}: every recent request the pod
+// served for that trace, for cross-checking spans seen in a tracing UI.
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if normalizeTraceID(id) == "" {
+		http.Error(w, "trace id required", http.StatusBadRequest)
+		return
+	}
+	reqs := tracedRequests(id)
+	if len(reqs) == 0 {
+		http.Error(w, "no recent requests recorded for trace "+id, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"trace_id": id,
+		"requests": reqs,
+	})
+}
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// spanQueueSize bounds the spans waiting for export; more are dropped
+	spanQueueSize = 4096
+	// spanBatchSize is the most spans sent in one export request
+	spanBatchSize = 512
+	// spanExportInterval is the longest a span waits for its batch to fill
+	spanExportInterval = 5 * time.Second
+)
+
+// TracingConfig is where and how much of the served requests to export as
+// OpenTelemetry spans.
+type TracingConfig struct {
+	Endpoint    string      // OTLP/HTTP traces URL, such as http://otel-collector:4318/v1/traces; empty disables tracing
+	Headers     http.Header // Sent with every export, such as an API key
+	SampleRatio float64     // Of requests that start a trace, 0 to 1; callers' sampling decisions are kept
+}
+
+// span is a server span for one request.
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte // Zero for a root span
+	traceState string
+	sampled    bool
+	remote     bool // The parent came from the caller's headers
+
+	name       string
+	start, end time.Time
+	attrs      []spanAttr
+	failed     bool
+	// annotated is set once the handler recorded the outcome itself
+	annotated bool
+}
+
+// spanAttr is a span attribute: a string, int64, float64 or bool.
+type spanAttr struct {
+	key   string
+	value any
+}
+
+func (s *span) set(key string, value any) {
+	s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+var (
+	tracing      TracingConfig
+	spanQueue    chan *span
+	tracingStop  chan struct{}
+	tracingDone  chan struct{}
+	stopOnce     sync.Once
+	spanExporter = &http.Client{Timeout: 10 * time.Second}
+
+	spansSampled  atomic.Int64
+	spansExported atomic.Int64
+	spansDropped  atomic.Int64
+	spansFailed   atomic.Int64
+
+	traceExportMu  sync.Mutex
+	traceExportErr string
+)
+
+// ParseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS: comma-separated
+// key=value pairs, with percent-encoded values.
+func ParseOTLPHeaders(s string) (http.Header, error) {
+	h := make(http.Header)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q: want key=value", pair)
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", key, err)
+		}
+		h.Add(key, value)
+	}
+	return h, nil
+}
+
+// startTracing starts exporting spans as cfg says, if it names an endpoint.
+func startTracing(cfg TracingConfig) {
+	if cfg.Endpoint == "" {
+		return
+	}
+	tracing = cfg
+	spanQueue = make(chan *span, spanQueueSize)
+	tracingStop, tracingDone = make(chan struct{}), make(chan struct{})
+	go exportSpans()
+	infof("Tracing: sampling %g of new traces, and the traces callers sampled, for %s", cfg.SampleRatio, cfg.Endpoint)
+}
+
+// stopTracing exports the spans still queued. Only the first call does.
+func stopTracing() {
+	if spanQueue == nil {
+		return
+	}
+	stopOnce.Do(func() {
+		close(tracingStop)
+		select {
+		case <-tracingDone:
+		case <-time.After(spanExportInterval):
+			warnf("Tracing: gave up exporting the last spans")
+		}
+	})
+}
+
+// spanKey carries the span of a request through its context.
+type spanKey struct{}
+
+// traced wraps h in a server span that continues the caller's trace, from
+// W3C traceparent or B3 headers, when tracing is enabled. Requests h makes
+// on to other services carry the span with injectTrace.
+func traced(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if spanQueue == nil {
+			h(w, r)
+			return
+		}
+		s := startSpan(r)
+		rc := &responseCounter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			p := recover()
+			status := rc.status
+			if p != nil && p != http.ErrAbortHandler {
+				status = http.StatusInternalServerError
+			}
+			if !s.annotated {
+				class := meter.ClassifyRequest(status, r.Context().Err(), time.Since(s.start), hops.ExpectedTimeout(r))
+				s.set("http.response.status_code", int64(status))
+				if class != "" {
+					s.set("podmeter.error_class", class)
+				}
+				s.failed = meter.Failed(class)
+			}
+			if p != nil {
+				s.failed = true
+			}
+			s.end = time.Now()
+			if s.sampled {
+				spansSampled.Add(1)
+				select {
+				case spanQueue <- s:
+				default:
+					spansDropped.Add(1)
+				}
+			}
+			if p != nil {
+				panic(p)
+			}
+		}()
+		h(rc, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+	}
+}
+
+// startSpan starts the server span of r, as a child of the caller's span
+// if it sent one.
+func startSpan(r *http.Request) *span {
+	s := &span{start: time.Now(), name: r.Method + " " + routeOf(r)}
+	sampled, decided := parentSpan(r, s)
+	if s.traceID == [16]byte{} {
+		binary.BigEndian.PutUint64(s.traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.traceID[8:], rand.Uint64())
+	}
+	binary.BigEndian.PutUint64(s.spanID[:], rand.Uint64()|1)
+	if !decided {
+		// As OpenTelemetry's TraceIdRatioBased sampler, so every service
+		// sampling at a ratio keeps the same traces
+		sampled = binary.BigEndian.Uint64(s.traceID[8:])>>1 < uint64(tracing.SampleRatio*(1<<63))
+	}
+	s.sampled = sampled
+
+	s.set("http.request.method", r.Method)
+	s.set("http.route", routeOf(r))
+	s.set("url.path", r.URL.Path)
+	s.set("url.scheme", schemeOf(r))
+	s.set("server.address", r.Host)
+	s.set("client.address", clientAddr(r).String())
+	s.set("network.protocol.version", strings.TrimPrefix(strings.TrimSuffix(r.Proto, ".0"), "HTTP/"))
+	if ua := r.UserAgent(); ua != "" {
+		s.set("user_agent.original", ua)
+	}
+	s.set("podmeter.hops.proxy", int64(hops.ProxyHops(r)))
+	s.set("podmeter.hops.mesh", int64(hops.ServiceMeshHops(r)))
+	s.set("podmeter.mesh_path", hops.MeshPath(r, hops.SidecarPresent(), hops.AmbientEnrolled()))
+	return s
+}
+
+// routeOf is the pattern r was routed by, or its path.
+func routeOf(r *http.Request) string {
+	if _, route, ok := strings.Cut(r.Pattern, " "); ok {
+		return route
+	}
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.URL.Path
+}
+
+func schemeOf(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// parentSpan sets the trace and parent of s from r's traceparent, b3 or
+// X-B3-* headers, in that order, and returns whether the caller sampled
+// the trace, and whether it decided at all.
+func parentSpan(r *http.Request, s *span) (sampled, decided bool) {
+	if parts := strings.Split(r.Header.Get("Traceparent"), "-"); len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" {
+		flags, err := strconv.ParseUint(parts[3], 16, 8)
+		if err == nil && decodeID(s.traceID[:], parts[1]) && decodeID(s.parentID[:], parts[2]) {
+			s.remote = true
+			s.traceState = r.Header.Get("Tracestate")
+			return flags&1 == 1, true
+		}
+		s.traceID, s.parentID = [16]byte{}, [8]byte{}
+	}
+	if b3 := r.Header.Get("B3"); b3 != "" {
+		parts := strings.Split(b3, "-")
+		if len(parts) == 1 {
+			// Only a sampling decision
+			return b3sampled(parts[0])
+		}
+		if decodeID(s.traceID[:], parts[0]) && decodeID(s.parentID[:], parts[1]) {
+			s.remote = true
+			if len(parts) > 2 {
+				return b3sampled(parts[2])
+			}
+			return false, false
+		}
+		s.traceID, s.parentID = [16]byte{}, [8]byte{}
+	}
+	if r.Header.Get("X-B3-Flags") == "1" {
+		sampled, decided = true, true
+	} else {
+		sampled, decided = b3sampled(r.Header.Get("X-B3-Sampled"))
+	}
+	if decodeID(s.traceID[:], r.Header.Get("X-B3-TraceId")) && decodeID(s.parentID[:], r.Header.Get("X-B3-SpanId")) {
+		s.remote = true
+	} else {
+		s.traceID, s.parentID = [16]byte{}, [8]byte{}
+	}
+	return sampled, decided
+}
+
+// b3sampled reads a B3 sampling state: 1 or true samples, 0 or false does
+// not, d (debug) samples, and anything else leaves it to us.
+func b3sampled(v string) (sampled, decided bool) {
+	switch v {
+	case "1", "true", "d":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// decodeID decodes the hex ID s into dst, right-aligned so 64-bit B3 trace
+// IDs become their zero-padded 128-bit form, and reports whether it is a
+// valid, non-zero ID.
+func decodeID(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) && !(len(dst) == 16 && len(s) == 16) {
+		return false
+	}
+	n, err := hex.Decode(dst[len(dst)-len(s)/2:], []byte(s))
+	if err != nil || n != len(s)/2 {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// annotateSpan records the outcome of a workload request on its span.
+func annotateSpan(r *http.Request, status int, class string) {
+	s, ok := r.Context().Value(spanKey{}).(*span)
+	if !ok {
+		return
+	}
+	s.annotated = true
+	if status != 0 {
+		s.set("http.response.status_code", int64(status))
+	}
+	if class != "" {
+		s.set("podmeter.error_class", class)
+	}
+	s.failed = meter.Failed(class)
+}
+
+// injectTrace sets the trace headers of an outgoing request made for the
+// request ctx belongs to, so the next service continues this trace under
+// its span. B3 headers the caller used are rewritten too.
+func injectTrace(ctx context.Context, h http.Header) {
+	s, ok := ctx.Value(spanKey{}).(*span)
+	if !ok {
+		return
+	}
+	traceID, spanID := hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])
+	flags, sampled := "00", "0"
+	if s.sampled {
+		flags, sampled = "01", "1"
+	}
+	h.Set("Traceparent", "00-"+traceID+"-"+spanID+"-"+flags)
+	if s.traceState != "" {
+		h.Set("Tracestate", s.traceState)
+	}
+	if h.Get("B3") != "" {
+		h.Set("B3", traceID+"-"+spanID+"-"+sampled)
+	}
+	if h.Get("X-B3-TraceId") != "" {
+		h.Set("X-B3-TraceId", traceID)
+		h.Set("X-B3-SpanId", spanID)
+		h.Set("X-B3-ParentSpanId", hex.EncodeToString(s.parentID[:]))
+		h.Set("X-B3-Sampled", sampled)
+	}
+}
+
+// exportSpans sends queued spans to the collector in batches, until
+// stopTracing, and then the spans still queued. The queue is never closed,
+// as handlers outliving the shutdown may still end spans.
+func exportSpans() {
+	defer close(tracingDone)
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, spanBatchSize)
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-tracingStop:
+			for len(spanQueue) > 0 && len(batch) < spanBatchSize {
+				batch = append(batch, <-spanQueue)
+			}
+			exportBatch(batch)
+			return
+		}
+		exportBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// exportBatch sends spans in one OTLP/HTTP protobuf request.
+func exportBatch(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	err := postSpans(encodeSpans(spans))
+	traceExportMu.Lock()
+	defer traceExportMu.Unlock()
+	if err != nil {
+		spansFailed.Add(int64(len(spans)))
+		if err.Error() != traceExportErr {
+			warnf("Tracing: exporting %d spans: %v", len(spans), err)
+		}
+		traceExportErr = err.Error()
+		return
+	}
+	spansExported.Add(int64(len(spans)))
+	traceExportErr = ""
+}
+
+func postSpans(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, tracing.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range tracing.Headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := spanExporter.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// encodeSpans encodes spans as an OTLP ExportTraceServiceRequest, under
+// the pod's resource attributes.
+func encodeSpans(spans []*span) []byte {
+	var resource []byte
+	attrs := meter.Resource()
+	for _, key := range slices.Sorted(maps.Keys(attrs)) {
+		resource = appendBytesField(resource, 1, encodeKeyValue(key, attrs[key]))
+	}
+	var scope []byte
+	scope = appendStringField(scope, 1, "github.com/nyan-lin-tun/PodMeter")
+	scope = appendStringField(scope, 2, meter.Build().Version)
+
+	var scopeSpans []byte
+	scopeSpans = appendBytesField(scopeSpans, 1, scope)
+	for _, s := range spans {
+		scopeSpans = appendBytesField(scopeSpans, 2, encodeSpan(s))
+	}
+	var resourceSpans []byte
+	resourceSpans = appendBytesField(resourceSpans, 1, resource)
+	resourceSpans = appendBytesField(resourceSpans, 2, scopeSpans)
+	return appendBytesField(nil, 1, resourceSpans)
+}
+
+// OTLP span fields, kinds and status codes
+const (
+	spanKindServer  = 2
+	statusCodeError = 2
+	// Span flags saying whether the parent is remote
+	spanFlagHasIsRemote = 0x100
+	spanFlagIsRemote    = 0x200
+)
+
+func encodeSpan(s *span) []byte {
+	var b []byte
+	b = appendBytesField(b, 1, s.traceID[:])
+	b = appendBytesField(b, 2, s.spanID[:])
+	b = appendStringField(b, 3, s.traceState)
+	if s.parentID != [8]byte{} {
+		b = appendBytesField(b, 4, s.parentID[:])
+	}
+	b = appendStringField(b, 5, s.name)
+	b = appendIntField(b, 6, spanKindServer)
+	b = appendTag(b, 7, wireFixed64)
+	b = binary.LittleEndian.AppendUint64(b, uint64(s.start.UnixNano()))
+	b = appendTag(b, 8, wireFixed64)
+	b = binary.LittleEndian.AppendUint64(b, uint64(s.end.UnixNano()))
+	for _, a := range s.attrs {
+		b = appendBytesField(b, 9, encodeKeyValue(a.key, a.value))
+	}
+	if s.failed {
+		b = appendBytesField(b, 15, appendIntField(nil, 3, statusCodeError))
+	}
+	flags := uint32(spanFlagHasIsRemote)
+	if s.remote {
+		flags |= spanFlagIsRemote
+	}
+	if s.sampled {
+		flags |= 1
+	}
+	b = appendTag(b, 16, wireFixed32)
+	return binary.LittleEndian.AppendUint32(b, flags)
+}
+
+// encodeKeyValue encodes an OTLP KeyValue. AnyValue is a oneof, so zero
+// values are encoded too.
+func encodeKeyValue(key string, value any) []byte {
+	var v []byte
+	switch value := value.(type) {
+	case string:
+		v = appendTag(v, 1, wireBytes)
+		v = appendVarint(v, uint64(len(value)))
+		v = append(v, value...)
+	case bool:
+		v = appendTag(v, 2, wireVarint)
+		if value {
+			v = appendVarint(v, 1)
+		} else {
+			v = appendVarint(v, 0)
+		}
+	case int64:
+		v = appendTag(v, 3, wireVarint)
+		v = appendVarint(v, uint64(value))
+	case float64:
+		v = appendTag(v, 4, wireFixed64)
+		v = appendDoubleBits(v, value)
+	}
+	b := appendStringField(nil, 1, key)
+	return appendBytesField(b, 2, v)
+}
+
+// tracingStats reports the spans exported, or nil when tracing is off.
+func tracingStats() *meter.TracingStats {
+	if spanQueue == nil {
+		return nil
+	}
+	traceExportMu.Lock()
+	lastErr := traceExportErr
+	traceExportMu.Unlock()
+	return &meter.TracingStats{
+		Endpoint:    tracing.Endpoint,
+		SampleRatio: tracing.SampleRatio,
+		Sampled:     spansSampled.Load(),
+		Exported:    spansExported.Load(),
+		Dropped:     spansDropped.Load(),
+		Failed:      spansFailed.Load(),
+		LastError:   lastErr,
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/loadgen"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// udpPeerTTL forgets peers that have gone quiet, bounding the peer map.
+	udpPeerTTL = time.Minute
+	// udpMaxPeers caps how many distinct senders are tracked at once.
+	udpMaxPeers = 1024
+)
+
+// udpPeer tracks sequence and jitter state for one sender.
+type udpPeer struct {
+	firstSeq    uint64
+	maxSeq      uint64
+	received    int64
+	outOfOrder  int64
+	lastTransit float64 // ms
+	jitter      float64 // ms, RFC 3550 interarrival jitter
+	lastSeen    time.Time
+}
+
+var (
+	udpEnabled           atomic.Bool
+	udpReceived          atomic.Int64
+	udpEchoed            atomic.Int64
+	udpProbes            atomic.Int64
+	udpPeersMu           sync.Mutex
+	udpPeers             = make(map[string]*udpPeer)
+	udpRetiredLost       int64 // Loss from peers that have been forgotten
+	udpRetiredOutOfOrder int64
+	udpRetiredExpected   int64
+)
+
+// startUDPEchoServer echoes every datagram back to its sender and meters
+// loss and jitter for PodMeter probe datagrams. It returns once conn is
+// closed.
+func startUDPEchoServer(conn net.PacketConn) {
+	udpEnabled.Store(true)
+	infof("UDP echo listener running on %s", conn.LocalAddr())
+
+	buf := make([]byte, 65535)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if isClosed(err) {
+			return
+		}
+		if err != nil {
+			errorf("UDP read error: %v", err)
+			continue
+		}
+		arrival := time.Now()
+		udpReceived.Add(1)
+
+		if seq, sent, ok := loadgen.ParseUDPProbe(buf[:n]); ok {
+			recordUDPProbe(peer.String(), seq, sent, arrival)
+		}
+
+		if _, err := conn.WriteTo(buf[:n], peer); err == nil {
+			udpEchoed.Add(1)
+		}
+	}
+}
+
+// recordUDPProbe updates per-peer loss and jitter state for one probe.
+func recordUDPProbe(peer string, seq uint64, sentNanos int64, arrival time.Time) {
+	udpProbes.Add(1)
+	transit := float64(arrival.UnixNano()-sentNanos) / 1e6
+
+	udpPeersMu.Lock()
+	defer udpPeersMu.Unlock()
+
+	p, ok := udpPeers[peer]
+	if !ok {
+		expireUDPPeersLocked(arrival)
+		if len(udpPeers) >= udpMaxPeers {
+			return
+		}
+		p = &udpPeer{firstSeq: seq, maxSeq: seq, lastTransit: transit}
+		udpPeers[peer] = p
+	}
+
+	p.received++
+	p.lastSeen = arrival
+	if seq < p.firstSeq {
+		p.firstSeq = seq
+	}
+	if seq > p.maxSeq {
+		p.maxSeq = seq
+	} else if ok {
+		p.outOfOrder++
+	}
+
+	// RFC 3550: the clock offset between sender and receiver cancels out in
+	// the difference of consecutive transit times.
+	d := math.Abs(transit - p.lastTransit)
+	p.jitter += (d - p.jitter) / 16
+	p.lastTransit = transit
+}
+
+// expireUDPPeersLocked drops idle peers, folding their totals into the
+// retired counters so aggregate loss is not lost with them.
+func expireUDPPeersLocked(now time.Time) {
+	for addr, p := range udpPeers {
+		if now.Sub(p.lastSeen) > udpPeerTTL {
+			expected := int64(p.maxSeq-p.firstSeq) + 1
+			udpRetiredExpected += expected
+			udpRetiredLost += max(expected-p.received, 0)
+			udpRetiredOutOfOrder += p.outOfOrder
+			delete(udpPeers, addr)
+		}
+	}
+}
+
+// udpStats snapshots the UDP echo metrics.
+func udpStats() meter.UDPStats {
+	stats := meter.UDPStats{
+		Enabled:           udpEnabled.Load(),
+		DatagramsReceived: udpReceived.Load(),
+		DatagramsEchoed:   udpEchoed.Load(),
+		ProbeDatagrams:    udpProbes.Load(),
+	}
+
+	udpPeersMu.Lock()
+	defer udpPeersMu.Unlock()
+	expireUDPPeersLocked(time.Now())
+
+	expected := udpRetiredExpected
+	stats.Lost = udpRetiredLost
+	stats.OutOfOrder = udpRetiredOutOfOrder
+	jitterSum := 0.0
+	for _, p := range udpPeers {
+		e := int64(p.maxSeq-p.firstSeq) + 1
+		expected += e
+		stats.Lost += max(e-p.received, 0)
+		stats.OutOfOrder += p.outOfOrder
+		jitterSum += p.jitter
+	}
+	stats.ActivePeers = len(udpPeers)
+	if expected > 0 {
+		stats.LossPercent = meter.Round(float64(stats.Lost) / float64(expected) * 100)
+	}
+	if len(udpPeers) > 0 {
+		stats.JitterMs = meter.Round(jitterSum / float64(len(udpPeers)))
+	}
+	return stats
+}
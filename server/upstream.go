@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/hops"
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+var (
+	// upstream is the application PodMeter fronts in reverse-proxy mode, or
+	// nil when it serves the simulated workload
+	upstream    *httputil.ReverseProxy
+	upstreamURL *url.URL
+
+	// upstreamMeter records the upstream's own latency, up to its response
+	// headers; the HTTP meter keeps recording the total
+	upstreamMeter       = meter.New(0)
+	upstreamOverheads   = meter.NewWindow(0) // ms, total minus upstream latency per request
+	upstreamUnreachable atomic.Int64
+	upstreamRetries     atomic.Int64
+)
+
+// upstreamTimingKey carries an *upstreamTiming through the request context
+// to the transport.
+type upstreamTimingKey struct{}
+
+// upstreamTiming is what the transport learned about one proxied request.
+type upstreamTiming struct {
+	latency   time.Duration // Until the response headers
+	responded bool
+}
+
+// timedTransport measures how long the upstream takes to answer.
+type timedTransport struct {
+	base http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	injectTrace(req.Context(), req.Header)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if timing, ok := req.Context().Value(upstreamTimingKey{}).(*upstreamTiming); ok {
+		timing.latency = time.Since(start)
+		timing.responded = err == nil
+	}
+	return resp, err
+}
+
+// setUpstream switches the workload to proxying to target, a URL such as
+// http://127.0.0.1:9000. Requests keep their Host header and gain the
+// client's address in X-Forwarded-For, as behind any proxy.
+func setUpstream(target *url.URL) {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = timedTransport{base: http.DefaultTransport}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() == nil {
+			warnf("Upstream: %s %s: %v", r.Method, r.URL.Path, err)
+		}
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}
+	upstream, upstreamURL = proxy, target
+}
+
+// proxyUpstream passes r to the upstream and writes its response to w, or a
+// 502 when the upstream cannot be reached. It returns the status sent and
+// the upstream's latency in ms.
+func proxyUpstream(w *responseCounter, r *http.Request) (status int, upstreamMs float64) {
+	if n, _ := strconv.Atoi(r.Header.Get("X-Envoy-Attempt-Count")); n > 1 {
+		upstreamRetries.Add(1)
+	}
+	timing := &upstreamTiming{}
+	upstream.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamTimingKey{}, timing)))
+
+	upstreamMs = meter.Ms(timing.latency)
+	if !timing.responded {
+		if r.Context().Err() == nil { // Not just a client that went away
+			upstreamUnreachable.Add(1)
+		}
+		return w.status, upstreamMs
+	}
+	upstreamMeter.Record(upstreamMs, hops.TotalHops(r), w.status < 500)
+	return w.status, upstreamMs
+}
+
+// upstreamStats reports the upstream's latency and what proxying added to
+// it, or nil when not in reverse-proxy mode.
+func upstreamStats() *meter.UpstreamStats {
+	if upstream == nil {
+		return nil
+	}
+	snap := upstreamMeter.Snapshot()
+	s := &meter.UpstreamStats{
+		URL:         upstreamURL.Redacted(),
+		Requests:    snap.Requests,
+		Errors:      snap.Errors,
+		Unreachable: upstreamUnreachable.Load(),
+		Retries:     upstreamRetries.Load(),
+	}
+	if len(snap.Latencies) > 0 {
+		lat := meter.Summarize(snap.Latencies)
+		s.AvgLatency, s.P50Latency, s.P95Latency, s.P99Latency, s.MaxLatency = lat.Avg, lat.P50, lat.P95, lat.P99, lat.Max
+	}
+	if overheads := upstreamOverheads.Values(); len(overheads) > 0 {
+		o := meter.Summarize(overheads)
+		s.AvgOverhead, s.P50Overhead, s.P95Overhead, s.P99Overhead = o.Avg, o.P50, o.P95, o.P99
+	}
+	return s
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+const (
+	// maxHosts bounds how many distinct hosts, and server names, are
+	// tracked; requests for any further ones count under otherHost
+	maxHosts  = 64
+	otherHost = "(other)"
+	// noHost stands for a request without a Host header or a TLS
+	// connection without SNI
+	noHost = "(none)"
+)
+
+// hostMeters records the workload per host name, bounded to maxHosts.
+type hostMeters struct {
+	mu     sync.RWMutex
+	meters map[string]*meter.Meter
+}
+
+var (
+	// hostsByHeader records workload requests by Host header
+	hostsByHeader = &hostMeters{meters: make(map[string]*meter.Meter)}
+	// hostsBySNI records workload requests over TLS by the server name
+	// the client sent in its ClientHello
+	hostsBySNI = &hostMeters{meters: make(map[string]*meter.Meter)}
+)
+
+// get returns the meter for host, creating it on first use.
+func (h *hostMeters) get(host string) *meter.Meter {
+	h.mu.RLock()
+	m, ok := h.meters[host]
+	h.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m, ok := h.meters[host]; ok {
+		return m
+	}
+	if len(h.meters) >= maxHosts {
+		host = otherHost
+		if m, ok := h.meters[host]; ok {
+			return m
+		}
+	}
+	m = meter.New(0)
+	h.meters[host] = m
+	return m
+}
+
+func (h *hostMeters) reset() {
+	h.mu.Lock()
+	clear(h.meters)
+	h.mu.Unlock()
+}
+
+// stats snapshots every tracked host.
+func (h *hostMeters) stats() map[string]meter.HostStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.meters) == 0 {
+		return nil
+	}
+
+	out := make(map[string]meter.HostStats, len(h.meters))
+	for host, m := range h.meters {
+		snap := m.Snapshot()
+		hs := meter.HostStats{
+			Requests:         snap.Requests,
+			Errors:           snap.Errors,
+			RequestsViaProxy: snap.ViaProxy,
+		}
+		if len(snap.Latencies) > 0 {
+			lat := meter.Summarize(snap.Latencies)
+			hs.AvgLatency = lat.Avg
+			hs.P50Latency = lat.P50
+			hs.P95Latency = lat.P95
+			hs.P99Latency = lat.P99
+			hs.MaxLatency = lat.Max
+		}
+		out[host] = hs
+	}
+	return out
+}
+
+// normalizeHost lowercases a Host header and drops its port, so that
+// shop.example.com and Shop.Example.com:80 count as one host.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if host == "" {
+		return noHost
+	}
+	return host
+}
+
+// recordVirtualHost records a workload request under its Host header and,
+// over TLS, its server name.
+func recordVirtualHost(r *http.Request, latencyMs float64, hopCount int, ok bool) {
+	hostsByHeader.get(normalizeHost(r.Host)).Record(latencyMs, hopCount, ok)
+	if r.TLS != nil {
+		sni := strings.ToLower(r.TLS.ServerName)
+		if sni == "" {
+			sni = noHost
+		}
+		hostsBySNI.get(sni).Record(latencyMs, hopCount, ok)
+	}
+}
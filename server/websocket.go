@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nyan-lin-tun/PodMeter/meter"
+)
+
+// websocketGUID is the fixed GUID from RFC 6455 used to derive Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	// wsMaxMessageSize caps a reassembled message to keep memory bounded.
+	wsMaxMessageSize = 1 << 20
+	// wsPingInterval is how often the server pings to measure round-trip time.
+	wsPingInterval = 5 * time.Second
+	// wsIdleTimeout closes connections that send nothing, not even pongs.
+	wsIdleTimeout = 3 * wsPingInterval
+)
+
+var (
+	wsUpgradeLatencies = meter.NewWindow(0)
+	wsRTTs             = meter.NewWindow(0)
+	wsConnections      atomic.Int64
+	wsActive           atomic.Int64
+	wsUpgradeFailures  atomic.Int64
+	wsMessagesIn       atomic.Int64
+	wsMessagesOut      atomic.Int64
+	wsBytesIn          atomic.Int64
+	wsBytesOut         atomic.Int64
+)
+
+// wsConn is a server-side WebSocket connection. Writes are serialized because
+// the echo loop and the pinger share the connection.
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// headerHasToken reports whether a comma-separated header contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsEchoHandler serves /ws/echo: it upgrades the connection, echoes every
+// text/binary message, and pings periodically to meter round-trip time
+// through whatever proxies sit in the path.
+func wsEchoHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		wsUpgradeFailures.Add(1)
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		wsUpgradeFailures.Add(1)
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		wsUpgradeFailures.Add(1)
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		wsUpgradeFailures.Add(1)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		wsUpgradeFailures.Add(1)
+		return
+	}
+
+	wsUpgradeLatencies.Add(meter.Ms(time.Since(start)))
+	wsConnections.Add(1)
+	wsActive.Add(1)
+	defer wsActive.Add(-1)
+
+	ws := &wsConn{conn: conn, br: brw.Reader}
+	done := make(chan struct{})
+	defer close(done)
+	go ws.pingLoop(done)
+
+	ws.echoLoop()
+}
+
+// echoLoop reads messages until the peer closes or errors, echoing data
+// messages and handling control frames.
+func (ws *wsConn) echoLoop() {
+	var (
+		message []byte
+		msgOp   byte
+	)
+
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case wsOpPing:
+			ws.writeFrame(wsOpPong, payload)
+		case wsOpPong:
+			// Our pings carry the send time; anything else is an unsolicited pong
+			if len(payload) == 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				wsRTTs.Add(meter.Ms(time.Since(sent)))
+			}
+		case wsOpClose:
+			// Echo the status code back, completing the closing handshake
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			ws.writeFrame(wsOpClose, payload)
+			return
+		case wsOpText, wsOpBinary, wsOpContinuation:
+			if op != wsOpContinuation {
+				message, msgOp = message[:0], op
+			} else if msgOp == 0 {
+				ws.closeWith(1002, "unexpected continuation frame")
+				return
+			}
+			if len(message)+len(payload) > wsMaxMessageSize {
+				ws.closeWith(1009, "message too big")
+				return
+			}
+			message = append(message, payload...)
+			if !fin {
+				continue
+			}
+
+			wsMessagesIn.Add(1)
+			wsBytesIn.Add(int64(len(message)))
+			if err := ws.writeFrame(msgOp, message); err != nil {
+				return
+			}
+			wsMessagesOut.Add(1)
+			wsBytesOut.Add(int64(len(message)))
+			msgOp = 0
+		default:
+			ws.closeWith(1002, "unknown opcode")
+			return
+		}
+	}
+}
+
+// pingLoop sends a timestamped ping every wsPingInterval until done closes.
+func (ws *wsConn) pingLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	var payload [8]byte
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+			if err := ws.writeFrame(wsOpPing, payload[:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads a single client frame and unmasks its payload.
+func (ws *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(ws.br, hdr[:]); err != nil {
+		return
+	}
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Clients must mask every frame (RFC 6455 section 5.1)
+	if !masked {
+		ws.closeWith(1002, "client frames must be masked")
+		return fin, op, nil, fmt.Errorf("unmasked client frame")
+	}
+	if length > wsMaxMessageSize {
+		ws.closeWith(1009, "frame too big")
+		return fin, op, nil, fmt.Errorf("frame of %d bytes too big", length)
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes a single unmasked, unfragmented server frame.
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// closeWith sends a close frame with the given status code and reason.
+func (ws *wsConn) closeWith(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	ws.writeFrame(wsOpClose, append(payload, reason...))
+}
+
+// websocketStats snapshots the WebSocket counters and latency windows.
+func websocketStats() meter.WebSocketStats {
+	upgrades := wsUpgradeLatencies.Values()
+	rtts := wsRTTs.Values()
+
+	stats := meter.WebSocketStats{
+		ConnectionsTotal:  wsConnections.Load(),
+		ActiveConnections: wsActive.Load(),
+		UpgradeFailures:   wsUpgradeFailures.Load(),
+		MessagesReceived:  wsMessagesIn.Load(),
+		MessagesSent:      wsMessagesOut.Load(),
+		BytesReceived:     wsBytesIn.Load(),
+		BytesSent:         wsBytesOut.Load(),
+	}
+	if len(upgrades) > 0 {
+		lat := meter.Summarize(upgrades)
+		stats.AvgUpgradeLatency = lat.Avg
+		stats.P99UpgradeLatency = lat.P99
+	}
+	if len(rtts) > 0 {
+		lat := meter.Summarize(rtts)
+		stats.AvgRTT = lat.Avg
+		stats.P50RTT = lat.P50
+		stats.P95RTT = lat.P95
+		stats.P99RTT = lat.P99
+		stats.MaxRTT = lat.Max
+	}
+	return stats
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Record operations in the KV log.
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// compactMinBytes is how much dead data the log must hold before it is
+// rewritten.
+const compactMinBytes = 1 << 20
+
+// KV is an embedded Store persisted to an append-only log, in the style of
+// Bitcask: every write appends a checksummed record and the live data is
+// indexed in memory. The log is rewritten once more than half of it is
+// superseded. It suits the modest amounts of state PodMeter keeps, not
+// data sets larger than memory.
+//
+// Each record is:
+//
+//	op (1) | len(bucket) uvarint | len(key) uvarint | len(value) uvarint |
+//	bucket | key | value | crc32 of everything before it (4, big endian)
+type KV struct {
+	*Memory
+	path string
+	file *os.File
+
+	size int64 // Bytes in the log
+	live int64 // Bytes of records still reflected in the index
+}
+
+// OpenKV opens or creates the KV log at path and replays it. A truncated or
+// corrupt tail, as left by a crash mid-write, is discarded.
+func OpenKV(path string) (*KV, error) {
+	kv := &KV{Memory: NewMemory(), path: path}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := kv.replay(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	kv.file = f
+	kv.size = valid
+	return kv, nil
+}
+
+// replay applies every intact record and returns the offset after the last
+// one.
+func (kv *KV) replay(r *bufio.Reader) (int64, error) {
+	var offset int64
+	for {
+		op, bucket, key, value, n, err := readRecord(r)
+		if err == io.EOF || errors.Is(err, errCorrupt) {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += n
+		kv.apply(op, bucket, key, value, n)
+	}
+}
+
+// apply updates the index and live-byte accounting for one record. The
+// caller holds kv.mu or has exclusive access.
+func (kv *KV) apply(op byte, bucket, key string, value []byte, n int64) {
+	if old, ok := kv.buckets[bucket][key]; ok {
+		kv.live -= recordSize(bucket, key, old)
+	}
+	switch op {
+	case opPut:
+		kv.put(bucket, key, value)
+		kv.live += n
+	case opDelete:
+		kv.delete(bucket, key)
+	}
+}
+
+func (kv *KV) Put(bucket, key string, value []byte) error {
+	return kv.write(opPut, bucket, key, value)
+}
+
+func (kv *KV) Delete(bucket, key string) error {
+	kv.mu.RLock()
+	_, ok := kv.buckets[bucket][key]
+	kv.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return kv.write(opDelete, bucket, key, nil)
+}
+
+func (kv *KV) write(op byte, bucket, key string, value []byte) error {
+	rec := encodeRecord(op, bucket, key, value)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := kv.file.Write(rec); err != nil {
+		return err
+	}
+	kv.size += int64(len(rec))
+	kv.apply(op, bucket, key, value, int64(len(rec)))
+
+	if dead := kv.size - kv.live; dead > compactMinBytes && dead > kv.live {
+		return kv.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked rewrites the log with only the live records and swaps it in
+// atomically. The caller holds kv.mu.
+func (kv *KV) compactLocked() error {
+	tmp := kv.path + ".compact"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	buckets := make([]string, 0, len(kv.buckets))
+	for b := range kv.buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+	var size int64
+	for _, b := range buckets {
+		for k, v := range kv.buckets[b] {
+			rec := encodeRecord(opPut, b, k, v)
+			w.Write(rec)
+			size += int64(len(rec))
+		}
+	}
+	// The new log must be on disk before it replaces the old one: a crash
+	// could otherwise leave it empty or cut short, and replay would drop
+	// every live record as a corrupt tail
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, kv.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	kv.file.Close()
+	kv.file = f
+	kv.size, kv.live = size, size
+	return syncDir(filepath.Dir(kv.path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close closes the log file.
+func (kv *KV) Close() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.file == nil {
+		return nil
+	}
+	err := kv.file.Close()
+	kv.file = nil
+	return err
+}
+
+// errCorrupt marks a record that fails its checksum or is cut short.
+var errCorrupt = errors.New("corrupt record")
+
+func encodeRecord(op byte, bucket, key string, value []byte) []byte {
+	buf := make([]byte, 0, recordSize(bucket, key, value))
+	buf = append(buf, op)
+	buf = binary.AppendUvarint(buf, uint64(len(bucket)))
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	buf = append(buf, bucket...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// recordSize is the encoded length of a put record.
+func recordSize(bucket, key string, value []byte) int64 {
+	var tmp [binary.MaxVarintLen64]byte
+	n := 1 + len(bucket) + len(key) + len(value) + 4
+	n += binary.PutUvarint(tmp[:], uint64(len(bucket)))
+	n += binary.PutUvarint(tmp[:], uint64(len(key)))
+	n += binary.PutUvarint(tmp[:], uint64(len(value)))
+	return int64(n)
+}
+
+// readRecord decodes the next record and its encoded length. It returns
+// io.EOF at a clean end of log and errCorrupt for a damaged tail.
+func readRecord(r *bufio.Reader) (op byte, bucket, key string, value []byte, n int64, err error) {
+	op, err = r.ReadByte()
+	if err != nil {
+		return 0, "", "", nil, 0, err
+	}
+	if op != opPut && op != opDelete {
+		return 0, "", "", nil, 0, errCorrupt
+	}
+
+	var lens [3]uint64
+	hdr := []byte{op}
+	for i := range lens {
+		if lens[i], err = binary.ReadUvarint(r); err != nil || lens[i] > 1<<30 {
+			return 0, "", "", nil, 0, errCorrupt
+		}
+		hdr = binary.AppendUvarint(hdr, lens[i])
+	}
+
+	body := make([]byte, lens[0]+lens[1]+lens[2]+4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, "", "", nil, 0, errCorrupt
+	}
+	data, sum := body[:len(body)-4], binary.BigEndian.Uint32(body[len(body)-4:])
+	crc := crc32.Update(crc32.ChecksumIEEE(hdr), crc32.IEEETable, data)
+	if crc != sum {
+		return 0, "", "", nil, 0, errCorrupt
+	}
+
+	bucket = string(data[:lens[0]])
+	key = string(data[lens[0] : lens[0]+lens[1]])
+	value = data[lens[0]+lens[1]:]
+	return op, bucket, key, value, int64(len(hdr) + len(body)), nil
+}
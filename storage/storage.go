@@ -0,0 +1,131 @@
+// Package storage is PodMeter's persistence layer: a small bucketed
+// key-value interface with an in-memory backend and an embedded, file-backed
+// one, so features that keep state (history, captures, alerts) do not depend
+// on how it is stored.
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store is a bucketed key-value store. Keys within a bucket are scanned in
+// byte order, so zero-padded timestamps make good time-series keys.
+// Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value stored under key, and whether it exists.
+	Get(bucket, key string) ([]byte, bool, error)
+	// Put stores value under key, replacing any previous value.
+	Put(bucket, key string, value []byte) error
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// Scan calls fn for each key with the given prefix in order, until fn
+	// returns false.
+	Scan(bucket, prefix string, fn func(key string, value []byte) bool) error
+	// Close releases the store's resources.
+	Close() error
+}
+
+// Backends accepted by Open.
+const (
+	BackendMemory = "memory"
+	BackendKV     = "kv"
+)
+
+// Open returns a Store for the named backend: "memory" keeps everything in
+// the process, "kv" persists to the append-only log at path.
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case "", BackendMemory:
+		return NewMemory(), nil
+	case BackendKV:
+		if path == "" {
+			return nil, fmt.Errorf("storage backend %q needs a path", backend)
+		}
+		return OpenKV(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (want %s or %s)", backend, BackendMemory, BackendKV)
+	}
+}
+
+// Memory is a Store that lives only as long as the process.
+type Memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemory returns an empty in-memory Store.
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *Memory) Get(bucket, key string) ([]byte, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.buckets[bucket][key]
+	return append([]byte(nil), v...), ok, nil
+}
+
+func (m *Memory) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	m.put(bucket, key, value)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	m.delete(bucket, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Memory) Scan(bucket, prefix string, fn func(key string, value []byte) bool) error {
+	// Copy under the lock so fn may call back into the store
+	m.mu.RLock()
+	b := m.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	values := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		values[k] = b[k]
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn(k, append([]byte(nil), values[k]...)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// put and delete update the maps; the caller holds m.mu.
+func (m *Memory) put(bucket, key string, value []byte) {
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+}
+
+func (m *Memory) delete(bucket, key string) {
+	if b, ok := m.buckets[bucket]; ok {
+		delete(b, key)
+		if len(b) == 0 {
+			delete(m.buckets, bucket)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package sysinfo
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Cgroup files as a container sees them: its cgroup namespace puts its own
+// cgroup at the root of the mount.
+const (
+	cgroupV2MemoryMax = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryMax = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+	cgroupV2CPUMax    = "/sys/fs/cgroup/cpu.max"
+	cgroupV1CPUQuota  = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriod = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+
+	cgroupV2MemoryCurrent = "/sys/fs/cgroup/memory.current"
+	cgroupV2MemoryStat    = "/sys/fs/cgroup/memory.stat"
+	cgroupV2CPUStat       = "/sys/fs/cgroup/cpu.stat"
+	cgroupV1MemoryUsage   = "/sys/fs/cgroup/memory/memory.usage_in_bytes"
+	cgroupV1MemoryStat    = "/sys/fs/cgroup/memory/memory.stat"
+	cgroupV1CPUStat       = "/sys/fs/cgroup/cpu/cpu.stat"
+	cgroupV1CPUUsage      = "/sys/fs/cgroup/cpuacct/cpuacct.usage"
+)
+
+// CgroupUsage is the container's resource usage as its cgroup accounts it,
+// which is what limits, throttling and OOM kills act on.
+type CgroupUsage struct {
+	Version         int    // 1 or 2; 0 when no cgroup files were found
+	MemoryBytes     int64  // Including page cache
+	WorkingSetBytes int64  // Memory minus inactive page cache, as the kubelet computes it
+	CPUNanos        uint64 // CPU time used since the cgroup was created
+	Periods         uint64 // CFS enforcement periods with a quota in force
+	Throttled       uint64 // Periods in which the quota ran out
+	ThrottledNanos  uint64 // Time spent throttled
+}
+
+// ContainerUsage reads the container's cgroup usage from cgroup v2, or v1 on
+// older nodes.
+func ContainerUsage() CgroupUsage {
+	var u CgroupUsage
+	if v, ok := readCgroupValue(cgroupV2MemoryCurrent); ok {
+		u.Version = 2
+		u.MemoryBytes, _ = strconv.ParseInt(v, 10, 64)
+		u.WorkingSetBytes = workingSet(u.MemoryBytes, readCgroupStat(cgroupV2MemoryStat)["inactive_file"])
+		cpu := readCgroupStat(cgroupV2CPUStat)
+		u.CPUNanos = cpu["usage_usec"] * 1000
+		u.Periods, u.Throttled, u.ThrottledNanos = cpu["nr_periods"], cpu["nr_throttled"], cpu["throttled_usec"]*1000
+		return u
+	}
+	if v, ok := readCgroupValue(cgroupV1MemoryUsage); ok {
+		u.Version = 1
+		u.MemoryBytes, _ = strconv.ParseInt(v, 10, 64)
+		u.WorkingSetBytes = workingSet(u.MemoryBytes, readCgroupStat(cgroupV1MemoryStat)["total_inactive_file"])
+		v, _ := readCgroupValue(cgroupV1CPUUsage)
+		u.CPUNanos, _ = strconv.ParseUint(v, 10, 64)
+		cpu := readCgroupStat(cgroupV1CPUStat)
+		u.Periods, u.Throttled, u.ThrottledNanos = cpu["nr_periods"], cpu["nr_throttled"], cpu["throttled_time"]
+	}
+	return u
+}
+
+func workingSet(usage int64, inactiveFile uint64) int64 {
+	return max(usage-int64(inactiveFile), 0)
+}
+
+// readCgroupStat reads a flat "key value" cgroup file such as cpu.stat.
+func readCgroupStat(file string) map[string]uint64 {
+	out := make(map[string]uint64)
+	v, ok := readCgroupValue(file)
+	if !ok {
+		return out
+	}
+	for _, line := range strings.Split(v, "\n") {
+		if key, val, ok := strings.Cut(line, " "); ok {
+			out[key], _ = strconv.ParseUint(val, 10, 64)
+		}
+	}
+	return out
+}
+
+// MemoryLimitBytes returns the container's memory limit from cgroup v2, or
+// cgroup v1 on older nodes, or 0 when there is none. A v1 limit above the
+// node's memory is how v1 reports "unlimited", so it counts as none.
+func MemoryLimitBytes() int64 {
+	if v, ok := readCgroupValue(cgroupV2MemoryMax); ok {
+		if v == "max" {
+			return 0
+		}
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	if v, ok := readCgroupValue(cgroupV1MemoryMax); ok {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		if total := TotalMemoryMB() * 1024 * 1024; total > 0 && float64(n) >= total {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// CPUQuota returns the container's CPU limit in cores (quota over period)
+// from cgroup v2, or cgroup v1 on older nodes, or 0 when there is none.
+func CPUQuota() float64 {
+	if v, ok := readCgroupValue(cgroupV2CPUMax); ok {
+		// "$MAX $PERIOD", where $MAX is "max" without a limit
+		quota, period, _ := strings.Cut(v, " ")
+		return cpuCores(quota, period)
+	}
+	quota, ok := readCgroupValue(cgroupV1CPUQuota)
+	if !ok {
+		return 0
+	}
+	period, _ := readCgroupValue(cgroupV1CPUPeriod)
+	return cpuCores(quota, period) // A quota of -1 is unlimited
+}
+
+// cpuCores divides a CFS quota by its period, or returns 0 when either is
+// not a positive number.
+func cpuCores(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// readCgroupValue returns the trimmed content of a cgroup interface file.
+func readCgroupValue(file string) (string, bool) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
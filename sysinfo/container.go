@@ -0,0 +1,75 @@
+package sysinfo
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// containerIDPattern matches the 64-hex container ID that container runtimes
+// put in cgroup paths and mount sources, e.g.
+// `/kubepods/burstable/pod<uid>/<id>`, `cri-containerd-<id>.scope` or
+// `/var/lib/docker/containers/<id>/hostname`.
+var containerIDPattern = regexp.MustCompile(`(?:^|[/:-])([0-9a-f]{64})(?:\.scope)?(?:/|$)`)
+
+// serviceAccountNamespace is where Kubernetes mounts the pod's namespace.
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// ContainerID returns the ID of the container this process runs in, or "" if
+// it does not run in one. It reads /proc/self/cgroup, which carries the ID
+// under cgroup v1, and falls back to /proc/self/mountinfo, where the runtime's
+// bind mounts of /etc/hostname and friends carry it under cgroup v2 (with
+// containerd, those belong to the pod sandbox, so its ID is reported).
+func ContainerID() string {
+	if id := scanContainerID("/proc/self/cgroup", func(line string) string {
+		// hierarchy-ID:controllers:path
+		if _, path, ok := strings.Cut(line, ":"); ok {
+			_, path, _ = strings.Cut(path, ":")
+			return path
+		}
+		return ""
+	}); id != "" {
+		return id
+	}
+	return scanContainerID("/proc/self/mountinfo", func(line string) string {
+		// mount-ID parent-ID major:minor root mount-point ...
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return ""
+		}
+		switch fields[4] {
+		case "/etc/hostname", "/etc/hosts", "/etc/resolv.conf":
+			return fields[3]
+		}
+		return ""
+	})
+}
+
+// scanContainerID returns the first container ID found in the part of a line
+// of file that field selects.
+func scanContainerID(file string, field func(line string) string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := containerIDPattern.FindStringSubmatch(field(scanner.Text())); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// Namespace returns the Kubernetes namespace from the service account mount,
+// or "" outside a pod or when automountServiceAccountToken is off.
+func Namespace() string {
+	b, err := os.ReadFile(serviceAccountNamespace)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
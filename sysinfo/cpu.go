@@ -0,0 +1,94 @@
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// notableCPUFlags are the /proc/cpuinfo flags (x86) and features (arm64)
+// that commonly explain performance differences between node pools: vector
+// extensions, crypto acceleration and TSC behaviour.
+var notableCPUFlags = []string{
+	"sse4_2", "avx", "avx2", "avx512f", "avx512_vnni", "amx_tile", "aes", "sha_ni", "vaes",
+	"constant_tsc", "nonstop_tsc", "tsc_known_freq", "hypervisor",
+	"asimd", "sve", "sve2", "sha2", "atomics",
+}
+
+// CPUInfo is the node's CPU model as /proc/cpuinfo and cpufreq describe it.
+type CPUInfo struct {
+	Vendor     string
+	Model      string
+	BaseMHz    float64 // Rated frequency; 0 when not exposed
+	MaxMHz     float64 // Highest frequency the driver allows, e.g. with turbo
+	CurrentMHz float64 // Average across CPUs right now
+	Flags      []string
+}
+
+// ReadCPUInfo reads the CPU model, notable flags and frequencies. Inside VMs
+// cpufreq is usually absent, leaving the base and max frequency 0 and the
+// current one as the hypervisor reports it.
+func ReadCPUInfo() CPUInfo {
+	var info CPUInfo
+	var mhzSum float64
+	var mhzCount int
+	var flags, implementer, part string
+
+	if f, err := os.Open("/proc/cpuinfo"); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024) // Flag lines are long
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), ":")
+			if !ok {
+				continue
+			}
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			switch key {
+			case "vendor_id":
+				info.Vendor = value
+			case "model name":
+				info.Model = value
+			case "cpu MHz":
+				if mhz, err := strconv.ParseFloat(value, 64); err == nil {
+					mhzSum += mhz
+					mhzCount++
+				}
+			case "flags", "Features":
+				flags = value
+			case "CPU implementer":
+				implementer = value
+			case "CPU part":
+				part = value
+			}
+		}
+		f.Close()
+	}
+	if info.Model == "" && implementer != "" {
+		// arm64 has no model name; the implementer and part identify the core
+		info.Model = fmt.Sprintf("implementer %s part %s", implementer, part)
+	}
+	for _, flag := range strings.Fields(flags) {
+		if slices.Contains(notableCPUFlags, flag) {
+			info.Flags = append(info.Flags, flag)
+		}
+	}
+
+	const cpufreq = "/sys/devices/system/cpu/cpu0/cpufreq"
+	info.BaseMHz = float64(readInt(filepath.Join(cpufreq, "base_frequency"))) / 1000
+	info.MaxMHz = float64(readInt(filepath.Join(cpufreq, "cpuinfo_max_freq"))) / 1000
+	if cur, _ := filepath.Glob("/sys/devices/system/cpu/cpu[0-9]*/cpufreq/scaling_cur_freq"); len(cur) > 0 {
+		mhzSum, mhzCount = 0, 0
+		for _, file := range cur {
+			mhzSum += float64(readInt(file)) / 1000
+			mhzCount++
+		}
+	}
+	if mhzCount > 0 {
+		info.CurrentMHz = round(mhzSum / float64(mhzCount))
+	}
+	return info
+}
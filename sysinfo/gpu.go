@@ -0,0 +1,153 @@
+package sysinfo
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GPU is an accelerator visible to this container. Fields the source could
+// not provide are zero.
+type GPU struct {
+	Index              int
+	Vendor             string // nvidia or amd
+	Model              string
+	UUID               string
+	BusID              string
+	MemoryTotalMB      float64
+	MemoryUsedMB       float64
+	UtilizationPercent float64
+	TemperatureC       float64
+	Source             string // nvidia-smi, procfs or sysfs
+}
+
+// nvidiaSMITimeout bounds a query, which can hang on a wedged driver.
+const nvidiaSMITimeout = 2 * time.Second
+
+// GPUs returns the GPUs this container can see. NVIDIA GPUs are queried
+// through nvidia-smi, and so NVML, when the NVIDIA container toolkit mounted
+// it; otherwise they are listed from /proc/driver/nvidia without usage. AMD
+// GPUs are read from the amdgpu driver's sysfs files. Only GPUs the device
+// plugin allocated to the pod are visible.
+func GPUs() (gpus []GPU, driverVersion string) {
+	if g, v, ok := nvidiaSMI(); ok {
+		gpus, driverVersion = g, v
+	} else {
+		gpus, driverVersion = nvidiaProcfs()
+	}
+	return append(gpus, amdGPUs(len(gpus))...), driverVersion
+}
+
+// nvidiaSMI queries every NVIDIA GPU through nvidia-smi.
+func nvidiaSMI() ([]GPU, string, bool) {
+	path, err := exec.LookPath("nvidia-smi")
+	if err != nil {
+		return nil, "", false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nvidiaSMITimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path,
+		"--query-gpu=index,name,uuid,pci.bus_id,memory.total,memory.used,utilization.gpu,temperature.gpu,driver_version",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, "", false
+	}
+
+	var gpus []GPU
+	var driver string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Split(line, ",")
+		if len(f) < 9 {
+			continue
+		}
+		for i := range f {
+			f[i] = strings.TrimSpace(f[i])
+		}
+		num := func(s string) float64 {
+			v, _ := strconv.ParseFloat(s, 64) // "[N/A]" where unsupported
+			return v
+		}
+		index, _ := strconv.Atoi(f[0])
+		gpus = append(gpus, GPU{
+			Index: index, Vendor: "nvidia", Model: f[1], UUID: f[2], BusID: f[3],
+			MemoryTotalMB: num(f[4]), MemoryUsedMB: num(f[5]), UtilizationPercent: num(f[6]), TemperatureC: num(f[7]),
+			Source: "nvidia-smi",
+		})
+		driver = f[8]
+	}
+	return gpus, driver, len(gpus) > 0
+}
+
+// nvidiaProcfs lists NVIDIA GPUs from the driver's procfs entries, which
+// give the model and UUID but no usage.
+func nvidiaProcfs() ([]GPU, string) {
+	dirs, _ := filepath.Glob("/proc/driver/nvidia/gpus/*")
+	var gpus []GPU
+	for i, dir := range dirs {
+		g := GPU{Index: i, Vendor: "nvidia", BusID: filepath.Base(dir), Source: "procfs"}
+		if f, err := os.Open(filepath.Join(dir, "information")); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				key, value, _ := strings.Cut(scanner.Text(), ":")
+				switch strings.TrimSpace(key) {
+				case "Model":
+					g.Model = strings.TrimSpace(value)
+				case "GPU UUID":
+					g.UUID = strings.TrimSpace(value)
+				}
+			}
+			f.Close()
+		}
+		gpus = append(gpus, g)
+	}
+
+	var driver string
+	if b, err := os.ReadFile("/proc/driver/nvidia/version"); err == nil {
+		// "NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.104.05  Sat Aug ..."
+		fields := strings.Fields(strings.SplitN(string(b), "\n", 2)[0])
+		for i, f := range fields {
+			if f == "Module" && i+1 < len(fields) {
+				driver = fields[i+1]
+			}
+		}
+	}
+	return gpus, driver
+}
+
+// amdGPUs lists AMD GPUs from /sys/class/drm, numbering them from first.
+func amdGPUs(first int) []GPU {
+	cards, _ := filepath.Glob("/sys/class/drm/card[0-9]*")
+	var gpus []GPU
+	for _, card := range cards {
+		if strings.Contains(filepath.Base(card), "-") {
+			continue // Connectors such as card0-DP-1
+		}
+		dev := filepath.Join(card, "device")
+		if vendor, _ := os.ReadFile(filepath.Join(dev, "vendor")); strings.TrimSpace(string(vendor)) != "0x1002" {
+			continue
+		}
+		g := GPU{Index: first + len(gpus), Vendor: "amd", Source: "sysfs"}
+		if b, err := os.ReadFile(filepath.Join(dev, "product_name")); err == nil {
+			g.Model = strings.TrimSpace(string(b))
+		}
+		if b, err := os.ReadFile(filepath.Join(dev, "unique_id")); err == nil {
+			g.UUID = strings.TrimSpace(string(b))
+		}
+		if link, err := os.Readlink(dev); err == nil {
+			g.BusID = filepath.Base(link)
+		}
+		g.MemoryTotalMB = round(float64(readInt(filepath.Join(dev, "mem_info_vram_total"))) / 1024 / 1024)
+		g.MemoryUsedMB = round(float64(readInt(filepath.Join(dev, "mem_info_vram_used"))) / 1024 / 1024)
+		g.UtilizationPercent = float64(readInt(filepath.Join(dev, "gpu_busy_percent")))
+		if temps, _ := filepath.Glob(filepath.Join(dev, "hwmon", "hwmon*", "temp1_input")); len(temps) > 0 {
+			g.TemperatureC = float64(readInt(temps[0])) / 1000
+		}
+		gpus = append(gpus, g)
+	}
+	return gpus
+}
@@ -0,0 +1,95 @@
+package sysinfo
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	hugepagesDir = "/sys/kernel/mm/hugepages"
+	thpDir       = "/sys/kernel/mm/transparent_hugepage"
+)
+
+// HugepagePool is the node's pool of explicit hugepages of one size.
+type HugepagePool struct {
+	SizeKB   int
+	Total    int
+	Free     int
+	Reserved int // Promised to mappings but not yet faulted in
+	Surplus  int // Allocated beyond Total through overcommit
+}
+
+// Hugepages describes the node's hugepage configuration: the explicit pools
+// that DPDK and databases reserve, and the transparent hugepage policy.
+type Hugepages struct {
+	DefaultSizeKB int
+	Pools         []HugepagePool // By size, smallest first
+	AnonymousKB   int            // Anonymous memory currently backed by transparent hugepages
+	THPEnabled    string         // always, madvise or never
+	THPDefrag     string
+}
+
+// ReadHugepages reads the hugepage pools from sysfs, falling back to
+// /proc/meminfo for the default size, and the transparent hugepage modes.
+func ReadHugepages() Hugepages {
+	h := Hugepages{
+		DefaultSizeKB: int(meminfoValue("Hugepagesize:")),
+		AnonymousKB:   int(meminfoValue("AnonHugePages:")),
+		THPEnabled:    selectedMode(filepath.Join(thpDir, "enabled")),
+		THPDefrag:     selectedMode(filepath.Join(thpDir, "defrag")),
+	}
+
+	dirs, _ := filepath.Glob(filepath.Join(hugepagesDir, "hugepages-*kB"))
+	for _, dir := range dirs {
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dir), "hugepages-"), "kB"))
+		if err != nil {
+			continue
+		}
+		h.Pools = append(h.Pools, HugepagePool{
+			SizeKB:   size,
+			Total:    readInt(filepath.Join(dir, "nr_hugepages")),
+			Free:     readInt(filepath.Join(dir, "free_hugepages")),
+			Reserved: readInt(filepath.Join(dir, "resv_hugepages")),
+			Surplus:  readInt(filepath.Join(dir, "surplus_hugepages")),
+		})
+	}
+	if len(h.Pools) == 0 && h.DefaultSizeKB > 0 {
+		h.Pools = []HugepagePool{{
+			SizeKB:   h.DefaultSizeKB,
+			Total:    int(meminfoValue("HugePages_Total:")),
+			Free:     int(meminfoValue("HugePages_Free:")),
+			Reserved: int(meminfoValue("HugePages_Rsvd:")),
+			Surplus:  int(meminfoValue("HugePages_Surp:")),
+		}}
+	}
+	sort.Slice(h.Pools, func(i, j int) bool { return h.Pools[i].SizeKB < h.Pools[j].SizeKB })
+	return h
+}
+
+// selectedMode returns the bracketed choice of a sysfs mode file such as
+// "always [madvise] never", or "" when the file is missing.
+func selectedMode(file string) string {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	s := string(b)
+	start, end := strings.IndexByte(s, '['), strings.IndexByte(s, ']')
+	if start < 0 || end < start {
+		return strings.TrimSpace(s)
+	}
+	return s[start+1 : end]
+}
+
+// readInt returns the integer in a sysfs file, or 0.
+func readInt(file string) int {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return n
+}
@@ -0,0 +1,76 @@
+package sysinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The service account credentials Kubernetes mounts into the pod.
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// ErrNotInCluster is returned by NodeLabels outside a Kubernetes pod, or in
+// one without a service account token.
+var ErrNotInCluster = errors.New("not running in a Kubernetes pod with a service account")
+
+// NodeLabels reads the labels of a node from the API server, with the pod's
+// service account, which needs `get` on `nodes`. Labels such as
+// topology.kubernetes.io/zone are not available through the downward API.
+func NodeLabels(ctx context.Context, node string) (map[string]string, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	token, err := os.ReadFile(serviceAccountToken)
+	if host == "" || port == "" || err != nil {
+		return nil, ErrNotInCluster
+	}
+	pem, err := os.ReadFile(serviceAccountCA)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", serviceAccountCA)
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+
+	u := "https://" + net.JoinHostPort(host, port) + "/api/v1/nodes/" + url.PathEscape(node)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET node %s: %s: %s", node, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var obj struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj.Metadata.Labels, nil
+}
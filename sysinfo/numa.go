@@ -0,0 +1,135 @@
+package sysinfo
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const numaDir = "/sys/devices/system/node"
+
+// NUMANode is one NUMA node: its CPUs and local memory.
+type NUMANode struct {
+	ID         int
+	CPUs       []int
+	MemTotalKB int64
+	MemFreeKB  int64
+	Distances  []int // Relative access cost to each node, by node order; 10 is local
+}
+
+// NUMANodes reads the node's NUMA topology from sysfs. Kernels built
+// without NUMA, and most containers on single-socket VMs, expose one node or
+// none.
+func NUMANodes() []NUMANode {
+	dirs, _ := filepath.Glob(filepath.Join(numaDir, "node[0-9]*"))
+	var nodes []NUMANode
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		n := NUMANode{ID: id}
+		if b, err := os.ReadFile(filepath.Join(dir, "cpulist")); err == nil {
+			n.CPUs = ParseCPUList(strings.TrimSpace(string(b)))
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "distance")); err == nil {
+			for _, f := range strings.Fields(string(b)) {
+				d, _ := strconv.Atoi(f)
+				n.Distances = append(n.Distances, d)
+			}
+		}
+		n.MemTotalKB, n.MemFreeKB = numaMeminfo(filepath.Join(dir, "meminfo"))
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// numaMeminfo reads MemTotal and MemFree from a node's meminfo, whose lines
+// look like "Node 0 MemTotal:  5471992 kB".
+func numaMeminfo(file string) (total, free int64) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		v, _ := strconv.ParseInt(fields[3], 10, 64)
+		switch fields[2] {
+		case "MemTotal:":
+			total = v
+		case "MemFree:":
+			free = v
+		}
+	}
+	return total, free
+}
+
+// AllowedCPUs returns the CPUs this process may run on, from the
+// Cpus_allowed_list of /proc/self/status: the cpuset the container runtime
+// pinned it to, or every online CPU.
+func AllowedCPUs() []int {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "Cpus_allowed_list:"); ok {
+			return ParseCPUList(strings.TrimSpace(v))
+		}
+	}
+	return nil
+}
+
+// ParseCPUList parses a kernel CPU list such as "0-3,8,10-11".
+func ParseCPUList(s string) []int {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			continue
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil {
+				continue
+			}
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus
+}
+
+// FormatCPUList formats CPUs, sorted, as a kernel CPU list.
+func FormatCPUList(cpus []int) string {
+	var sb strings.Builder
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(cpus[i]))
+		if j > i {
+			sb.WriteByte('-')
+			sb.WriteString(strconv.Itoa(cpus[j]))
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
@@ -0,0 +1,138 @@
+// Package sysinfo reads host-level facts (hostname, kernel, memory, disk)
+// for the system section of PodMeter's stats.
+package sysinfo
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Host returns the hostname and `uname -a` output, or "unknown" for either
+// that cannot be determined.
+func Host() (hostname, kernelVersion string) {
+	// Get hostname
+	hostname, _ = os.Hostname()
+	if hostname == "" {
+		hostname = "unknown"
+	}
+
+	// Get kernel version from uname -a
+	if output, err := exec.Command("uname", "-a").Output(); err == nil {
+		kernelVersion = strings.TrimSpace(string(output))
+	}
+
+	if kernelVersion == "" {
+		kernelVersion = "unknown"
+	}
+
+	return
+}
+
+// TotalMemoryMB reads total system memory from /proc/meminfo (Linux)
+func TotalMemoryMB() float64 {
+	return meminfoMB("MemTotal:")
+}
+
+// AvailableMemoryMB reads available system memory from /proc/meminfo (Linux)
+func AvailableMemoryMB() float64 {
+	return meminfoMB("MemAvailable:")
+}
+
+// meminfoMB returns the /proc/meminfo value for key converted to MB, or 0.
+func meminfoMB(key string) float64 {
+	return round(meminfoValue(key) / 1024) // Convert KB to MB
+}
+
+// meminfoValue returns the /proc/meminfo value for key as written: kB for
+// sizes, a count for the HugePages_ lines. It returns 0 when absent.
+func meminfoValue(key string) float64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, key) {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				v, err := strconv.ParseFloat(fields[1], 64)
+				if err == nil {
+					return v
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// DiskStats gets filesystem statistics for the root partition
+func DiskStats() (totalGB, availableGB, usagePercent float64) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs("/", &stat)
+	if err != nil {
+		return 0, 0, 0
+	}
+
+	// Calculate total and available space
+	totalBytes := stat.Blocks * uint64(stat.Bsize)
+	availBytes := stat.Bavail * uint64(stat.Bsize)
+
+	totalGB = round(float64(totalBytes) / 1024 / 1024 / 1024)
+	availableGB = round(float64(availBytes) / 1024 / 1024 / 1024)
+
+	if totalGB > 0 {
+		usagePercent = round((float64(totalBytes-availBytes) / float64(totalBytes)) * 100)
+	}
+
+	return
+}
+
+// round keeps two decimals, matching meter.Round without importing the stats engine.
+func round(val float64) float64 {
+	return math.Round(val*100) / 100
+}
+
+// CPUTimes are the node's cumulative CPU times across all CPUs, in clock
+// ticks, from the aggregate line of /proc/stat.
+type CPUTimes struct {
+	User, Nice, System, Idle, IOWait, IRQ, SoftIRQ, Steal uint64
+}
+
+// Total is the sum of the times. Guest time is already counted in User.
+func (t CPUTimes) Total() uint64 {
+	return t.User + t.Nice + t.System + t.Idle + t.IOWait + t.IRQ + t.SoftIRQ + t.Steal
+}
+
+// ReadCPUTimes reads the node's CPU times from /proc/stat (Linux). Kernels
+// without steal accounting report it as 0.
+func ReadCPUTimes() (CPUTimes, bool) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return CPUTimes{}, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var v [8]uint64
+		for i := range v {
+			if i+1 < len(fields) {
+				v[i], _ = strconv.ParseUint(fields[i+1], 10, 64)
+			}
+		}
+		return CPUTimes{User: v[0], Nice: v[1], System: v[2], Idle: v[3], IOWait: v[4], IRQ: v[5], SoftIRQ: v[6], Steal: v[7]}, true
+	}
+	return CPUTimes{}, false
+}
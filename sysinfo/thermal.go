@@ -0,0 +1,148 @@
+package sysinfo
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	thermalZoneDir = "/sys/class/thermal"
+	hwmonDir       = "/sys/class/hwmon"
+	cpuSysfsDir    = "/sys/devices/system/cpu"
+)
+
+// TemperatureSensor is one temperature reading, in degrees Celsius.
+type TemperatureSensor struct {
+	Source    string // thermal_zone or hwmon
+	Chip      string // Zone type (x86_pkg_temp, cpu-thermal) or hwmon driver (coretemp, k10temp, nvme)
+	Label     string // Sensor within the chip, e.g. "Package id 0" or "Core 3"; may be empty
+	TempC     float64
+	HighC     float64 // Where the hardware or kernel starts throttling; 0 when not exposed
+	CriticalC float64 // Where it shuts down; 0 when not exposed
+}
+
+// Thermal is the node's temperature sensors and how often its CPUs were
+// throttled for heat.
+type Thermal struct {
+	Sensors []TemperatureSensor
+	// Times a core or package went over its thermal limit and was clocked
+	// down since boot; Intel CPUs only
+	CoreThrottleEvents    uint64
+	PackageThrottleEvents uint64
+}
+
+// ReadThermal reads the kernel's thermal zones and hwmon sensors from sysfs,
+// and Intel's thermal throttle counters. Containers see them only when
+// sysfs is not masked, which is typical on bare metal and edge nodes and
+// rare on cloud VMs.
+func ReadThermal() Thermal {
+	t := Thermal{Sensors: append(thermalZones(thermalZoneDir), hwmonSensors(hwmonDir)...)}
+	t.CoreThrottleEvents, t.PackageThrottleEvents = throttleEvents(cpuSysfsDir)
+	return t
+}
+
+// thermalZones reads /sys/class/thermal/thermal_zone*, taking the lowest
+// passive trip point, where the kernel starts throttling, as the high mark.
+func thermalZones(dir string) []TemperatureSensor {
+	zones, _ := filepath.Glob(filepath.Join(dir, "thermal_zone*"))
+	var sensors []TemperatureSensor
+	for _, zone := range zones {
+		temp, ok := readMillidegrees(filepath.Join(zone, "temp"))
+		if !ok {
+			continue // Disabled zones fail to read
+		}
+		s := TemperatureSensor{Source: "thermal_zone", Chip: readString(filepath.Join(zone, "type")), Label: filepath.Base(zone), TempC: temp}
+		trips, _ := filepath.Glob(filepath.Join(zone, "trip_point_*_type"))
+		for _, trip := range trips {
+			limit, ok := readMillidegrees(strings.TrimSuffix(trip, "_type") + "_temp")
+			if !ok || limit <= 0 {
+				continue
+			}
+			switch readString(trip) {
+			case "passive":
+				if s.HighC == 0 || limit < s.HighC {
+					s.HighC = limit
+				}
+			case "critical":
+				s.CriticalC = limit
+			}
+		}
+		sensors = append(sensors, s)
+	}
+	return sensors
+}
+
+// hwmonSensors reads the temp*_input files of every /sys/class/hwmon chip.
+func hwmonSensors(dir string) []TemperatureSensor {
+	chips, _ := filepath.Glob(filepath.Join(dir, "hwmon*"))
+	var sensors []TemperatureSensor
+	for _, chip := range chips {
+		name := readString(filepath.Join(chip, "name"))
+		inputs, _ := filepath.Glob(filepath.Join(chip, "temp*_input"))
+		sort.Slice(inputs, func(i, j int) bool { return sensorIndex(inputs[i]) < sensorIndex(inputs[j]) })
+		for _, input := range inputs {
+			temp, ok := readMillidegrees(input)
+			if !ok {
+				continue
+			}
+			prefix := strings.TrimSuffix(input, "_input")
+			high, _ := readMillidegrees(prefix + "_max")
+			critical, _ := readMillidegrees(prefix + "_crit")
+			sensors = append(sensors, TemperatureSensor{
+				Source:    "hwmon",
+				Chip:      name,
+				Label:     readString(prefix + "_label"),
+				TempC:     temp,
+				HighC:     high,
+				CriticalC: critical,
+			})
+		}
+	}
+	return sensors
+}
+
+// sensorIndex returns N of a .../tempN_input path, so temp10 sorts after
+// temp2.
+func sensorIndex(path string) int {
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "temp"), "_input"))
+	return n
+}
+
+// throttleEvents sums the per-CPU core throttle counters, and the package
+// counters once per physical package, since every CPU of a package repeats
+// them.
+func throttleEvents(dir string) (core, pkg uint64) {
+	cpus, _ := filepath.Glob(filepath.Join(dir, "cpu[0-9]*"))
+	packages := make(map[string]bool)
+	for _, cpu := range cpus {
+		core += uint64(readInt(filepath.Join(cpu, "thermal_throttle", "core_throttle_count")))
+		id := readString(filepath.Join(cpu, "topology", "physical_package_id"))
+		if !packages[id] {
+			packages[id] = true
+			pkg += uint64(readInt(filepath.Join(cpu, "thermal_throttle", "package_throttle_count")))
+		}
+	}
+	return core, pkg
+}
+
+// readMillidegrees reads a sysfs temperature, which is in thousandths of a
+// degree Celsius.
+func readMillidegrees(file string) (float64, bool) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return float64(n) / 1000, true
+}
+
+func readString(file string) string {
+	b, _ := os.ReadFile(file)
+	return strings.TrimSpace(string(b))
+}